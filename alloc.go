@@ -0,0 +1,24 @@
+package main
+
+import "fmt"
+
+// Memory strategies (-alloc). Programs are compiled with the constants ARENA_ALLOC & RC_ALLOC which the standard
+// library uses to select an allocator. See: install/lib/mem.clara
+const (
+	gcAlloc    = "gc"
+	arenaAlloc = "arena"
+	rcAlloc    = "rc" // See: rc.go
+)
+
+func checkAllocStrategy(alloc string) error {
+	switch alloc {
+	case "", gcAlloc, arenaAlloc, rcAlloc:
+		return nil
+	default:
+		return fmt.Errorf("Unknown allocation strategy: '%v'. Available strategies: %v, %v, %v", alloc, gcAlloc, arenaAlloc, rcAlloc)
+	}
+}
+
+func allocConstants(alloc string) string {
+	return fmt.Sprintf("const ARENA_ALLOC = %v\nconst RC_ALLOC = %v\n", alloc == arenaAlloc, alloc == rcAlloc)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// Position independent so the runtime may also be linked into shared libraries
+var cFlags = []string{"-fPIC", "-pthread"}
+
+// Compiles the C runtime (See: install/init) into a static archive which is linked into every program. Archives are
+// named by a hash of their sources, including any headers alongside them, so are only rebuilt when the runtime changes.
+// Any C file added to the runtime is included.
+func buildRuntime(cLibPaths []string) (string, error) {
+	if len(cLibPaths) == 0 {
+		return "", nil
+	}
+
+	// Hash sources & headers
+	srcs := append([]string(nil), cLibPaths...)
+	for _, path := range cLibPaths {
+		srcs = append(srcs, glob(filepath.Join(filepath.Dir(path), "*.h"))...)
+	}
+	sort.Strings(srcs)
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\n", cFlags)
+	for j, path := range srcs {
+		if j > 0 && srcs[j-1] == path {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%v %v\n", filepath.Base(path), len(b))
+		h.Write(b)
+	}
+	archive := filepath.Join(os.TempDir(), fmt.Sprintf("libclara-%x.a", h.Sum(nil)[:8]))
+	if _, err := os.Stat(archive); err == nil {
+		return archive, nil
+	}
+
+	// Build in a private directory & rename into place so concurrent compiles never see a partial archive
+	dir, err := ioutil.TempDir("", "libclara")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	var objs []string
+	for j, path := range cLibPaths {
+		obj := filepath.Join(dir, fmt.Sprintf("%v.%v.o", j, filepath.Base(path)))
+		if err := runTool("gcc", append(append([]string{"-c"}, cFlags...), "-o", obj, path)...); err != nil {
+			return "", err
+		}
+		objs = append(objs, obj)
+	}
+	tmp := filepath.Join(dir, "libclara.a")
+	if err := runTool("ar", append([]string{"rcs", tmp}, objs...)...); err != nil {
+		return "", err
+	}
+	return archive, os.Rename(tmp, archive)
+}
+
+func runTool(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Runtime build failure: %v\n%v\n", err, string(output)))
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -106,6 +107,27 @@ func (so labelOp) Print() string  {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+// Label addressed relative to the instruction pointer so code is position independent
+type ripOp string
+
+func (ro ripOp) Print() string  {
+	return fmt.Sprintf("%v(%%rip)", string(ro))
+}
+
+// Instruction pointer relative form of a symbol or label
+func rip(op operand) ripOp {
+	switch op := op.(type) {
+	case symOp:
+		return ripOp(op.Print()[1:]) // Trim '$'
+	case ripOp:
+		return op
+	default:
+		return ripOp(op.Print())
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
 type litOp string
 
 func (lo litOp) Print() string  {
@@ -245,6 +267,7 @@ const (
 	movq = inst(iota + 1)
 	movb
 	movsbq
+	movzbq
 	movabs
 	popq
 	pushq
@@ -269,11 +292,17 @@ const (
 
 	// Arithmetic
 	addq
+	incq
 	subq
 	imulq
 	idivq
 	cqo
 
+	// Atomics
+	xchgq
+	lockXaddq
+	lockCmpxchgq
+
 	// Looping instructions
 	jmp
 	jne
@@ -291,6 +320,7 @@ var instNames = map[inst]string{
 	movq:   "movq",
 	movb:   "movb",
 	movsbq: "movsbq",
+	movzbq: "movzbq",
 	movabs: "movabs",
 	popq:   "popq",
 	pushq:  "pushq",
@@ -309,10 +339,12 @@ var instNames = map[inst]string{
 	setle:  "setle",
 	sete:   "sete",
 	addq:   "addq",
+	incq:   "incq",
 	subq:   "subq",
 	imulq:  "imulq",
 	idivq:  "idivq",
 	cqo:    "cqo",
+	xchgq:  "xchgq",
 	jmp:    "jmp",
 	jne:    "jne",
 	jae:    "jae",
@@ -321,6 +353,9 @@ var instNames = map[inst]string{
 	enter:  "enter",
 	ret:    "ret",
 	call:   "call",
+
+	lockXaddq:    "lock xaddq",
+	lockCmpxchgq: "lock cmpxchgq",
 }
 
 type asmWriter interface {
@@ -332,7 +367,10 @@ type asmWriter interface {
 	label(s string)
 	newLabel(s string) string
 	raw(s string) // Remove me!
+	comment(s string)
+	loc(file string, line, col int) // Source position of the following instructions (for debuggers)
 	addr(op operand)
+	relAddr(op operand)
 	fnStart(name string)
 	fnEnd()
 	ins(i inst, ops ...operand)
@@ -346,12 +384,19 @@ type asmWriter interface {
 type gasWriter struct {
 	w              *bufio.Writer
 	debug          bool
+	syntax         syntax
 	sIndex, lIndex int
-	literals       map[string]string
+	literals       map[string]string // Label of each literal, keyed by content
+	quoted         []string          // Literals in the order first seen
+	files          map[string]int    // Number of each source file referenced by .loc
 }
 
-func NewGasWriter(io io.Writer, debug bool) *gasWriter {
-	return &gasWriter { w : bufio.NewWriter(io), debug: debug, literals: make(map[string]string) }
+func NewGasWriter(io io.Writer, debug bool, syntax syntax) *gasWriter {
+	gw := &gasWriter { w : bufio.NewWriter(io), debug: debug, syntax: syntax, literals: make(map[string]string), files: make(map[string]int) }
+	if d := syntax.directive(); d != "" {
+		gw.tab(d)
+	}
+	return gw
 }
 
 func (gw *gasWriter) write(asm string, a...interface{}) {
@@ -368,11 +413,19 @@ func (gw *gasWriter) addr(op operand) {
 		gw.tab(".8byte", op.Print()[1:]) // Trim '$'
 	case fnOp, labelOp:
 		gw.tab(".8byte", op.Print())
+	case ripOp:
+		gw.tab(".8byte", string(op.(ripOp)))
 	case litOp:
 		panic("Cannot output the address of literal")
 	}
 }
 
+// Outputs the address of op relative to this word. Unlike absolute addresses these require no relocation when placed
+// in code.
+func (gw *gasWriter) relAddr(op operand) {
+	gw.tab(".8byte", string(rip(op))+" - .")
+}
+
 func (gw *gasWriter) tab(s ... string) {
 	gw.write(fmt.Sprintf("   " + strings.Join(s, "   ") + "\n"))
 }
@@ -397,35 +450,40 @@ func (gw *gasWriter) fnStart(name string) {
 	gw.raw(fmt.Sprintf("%v:", name))
 }
 
+// Interns a (quoted) string literal. Literals with identical content share a single label regardless of how they were
+// escaped in the source.
 func (gw *gasWriter) stringLit(s string) operand {
 	const suffix = "+8" // Ensure the address points _after_ the header
-	if label, ok := gw.literals[s]; ok {
-		return litOp(label + suffix)
+	raw, err := strconv.Unquote(s)
+	if err != nil {
+		panic(err)
+	}
+	if label, ok := gw.literals[raw]; ok {
+		return ripOp(label + suffix)
 	}
 
 	// Create new label
 	label := fmt.Sprintf(".LC%v", gw.sIndex)
 	gw.sIndex++
-	gw.literals[s] = label
-	return litOp(label + suffix)
+	gw.literals[raw] = label
+	gw.quoted = append(gw.quoted, s)
+	return ripOp(label + suffix)
 }
 
+// Writes literals to the read-only data section. Strings are immutable & their GC header is marked read-only so the
+// collector never writes to them.
 func (gw *gasWriter) flush() {
-	gw.tab(".data")
-	for s, label := range gw.literals {
-
-		raw, err := strconv.Unquote(s)
-		if err != nil {
-			panic(err)
-		}
+	gw.tab(".section", ".rodata")
+	for _, s := range gw.quoted {
 
+		raw, _ := strconv.Unquote(s)
 		gw.tab(".align", "8")
-		gw.label(label)
+		gw.label(gw.literals[raw])
 		gw.taggedInt(readOnlyGcHeader(4)) // gc.go defines fixed IDs
 		gw.taggedInt(len(raw))
 		gw.write("   .ascii \"%v\\0\"\n", s[1:len(s)-1])
 	}
-	gw.literals = make(map[string]string) // Clear values
+	gw.literals, gw.quoted = make(map[string]string), nil // Clear values
 }
 
 func (gw *gasWriter) newLabel(s string) string {
@@ -442,12 +500,27 @@ func (gw *gasWriter) raw(s string) {
 	gw.write(fmt.Sprintf("%v\n", s))
 }
 
-func (gw *gasWriter) ins(i inst, ops ...operand) {
-	s := make([]string, len(ops))
-	for i := 0; i < len(s); i++ {
-		s[i] = ops[i].Print()
+func (gw *gasWriter) comment(s string) {
+	gw.write("   # %v\n", s) // NOTE: Comment character for x86 in either syntax
+}
+
+// Source positions are assembled into a DWARF line table (.debug_line) which maps instructions to Clara source lines
+func (gw *gasWriter) loc(file string, line, col int) {
+	n, ok := gw.files[file]
+	if !ok {
+		n = len(gw.files) + 1
+		gw.files[file] = n
+		path, err := filepath.Abs(file)
+		if err != nil {
+			path = file
+		}
+		gw.write("   .file   %v %v\n", n, strconv.Quote(path))
 	}
-	gw.write("   %-8s%-50s\n", instNames[i], strings.Join(s, ", "))
+	gw.write("   .loc   %v %v %v\n", n, line, col)
+}
+
+func (gw *gasWriter) ins(i inst, ops ...operand) {
+	gw.write("   %v\n", gw.syntax.print(i, ops))
 }
 
 func (gw *gasWriter) roSymbol(name string, f func(w asmWriter)) operand {
@@ -22,6 +22,7 @@ type Node struct {
 	sym    *Symbol
 	typ    *Type   // Set after typeCheck()..
 	symtab *SymTab // Enclosing scope
+	end    *lex.Token // Last token of an expression folded into this literal
 }
 
 func (n *Node) Add(stmt *Node) *Node {
@@ -36,7 +37,7 @@ func (n *Node) hasType() bool {
 // n should be type checked before call!
 func (n *Node) isAddressable() bool {
 	switch n.op {
-	case opArray: return true
+	case opArray: return n.left.typ.Is(Array)
 	case opFuncCall: return n.typ.Is(Struct) || n.typ.Is(Array)
 	case opIdentifier: return true
 	case opDot: return true
@@ -370,6 +371,7 @@ const (
 	opSub
 	opMul
 	opDiv
+	opMod
 	opEq
 	opNot
 	opNeg
@@ -408,6 +410,7 @@ const (
 	opRange
 	opFor
 	opArrayLit
+	opConstDcl
 )
 
 var nodeTypes = map[int]string{
@@ -424,6 +427,7 @@ var nodeTypes = map[int]string{
 	opSub:         "Binary Op [Min]",
 	opMul:         "Binary Op [Mul]",
 	opDiv:         "Binary Op [Div]",
+	opMod:         "Binary Op [Mod]",
 	opBNot:        "Bitwise Op [~]",
 	opBAnd:        "Bitwise Op [&]",
 	opBOr:         "Bitwise Op [|]",
@@ -461,11 +465,12 @@ var nodeTypes = map[int]string{
 	opFor:       "For",
 	opRange:     "Range",
 	opArrayLit:  "Array Literal",
+	opConstDcl:  "Const Decl",
 }
 
 func printTree(n *Node, f func(*Node) bool, out io.Writer) {
 	fmt.Fprintln(out, "\nAbstract Syntax Tree:")
-	printTreeImpl(n, f, "    ", true, out)
+	printTreeImpl(n, f, "    ", true, console.NewPrinter(out))
 	fmt.Fprintln(out)
 }
 
@@ -486,11 +491,12 @@ func printTreeImpl(n *Node, f func(*Node) bool, prefix string, isTail bool, out
     }
 
     // Print node
-	fmt.Fprintf(out, "%v%v%v%v%v%v%v ", console.Yellow, prefix, row, console.Disable, console.NodeTypeColour, val, console.Disable)
+	p := console.NewPrinter(out)
+	fmt.Fprintf(out, "%v%v ", p.Sprint(console.Yellow, prefix+row), p.Sprint(console.NodeTypeColour, val))
 	if n.sym != nil {
-		fmt.Fprintf(out, ": %v%v%v(%v%v - %v%v)", console.Red, nodeTypes[n.op], console.Disable, console.Green, n.sym.Name, n.sym.Type, console.Disable)
+		fmt.Fprintf(out, ": %v(%v)", p.Sprint(console.Red, nodeTypes[n.op]), p.Sprint(console.Green, fmt.Sprintf("%v - %v", n.sym.Name, n.sym.Type)))
 	} else {
-		fmt.Fprintf(out,": %v%v%v", console.Red, nodeTypes[n.op], console.Disable)
+		fmt.Fprintf(out,": %v", p.Sprint(console.Red, nodeTypes[n.op]))
 	}
 	fmt.Fprintln(out, "")
 
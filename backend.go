@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/g-dx/clarac/lex"
+)
+
+// Generates code for a target. The front end lowers & optimises the whole program then hands the IR to a backend
+// which writes a file for the linker. Backends must not modify the front end's data beyond the IR itself.
+type backend interface {
+	ext() string  // Extension of the generated file, including the '.'
+	native() bool // Generated file is linked with the runtime by gcc
+	lower(prog *irProgram, out io.Writer) error
+}
+
+const defaultBackend = "x64"
+
+func newBackend(o options) (backend, error) {
+	if o.shared() && o.backend != "" && o.backend != "x64" {
+		return nil, fmt.Errorf("Build mode '%v' requires the x64 backend", o.buildMode)
+	}
+	switch o.backend {
+	case "", "x64":
+		syntax := o.syntax
+		if syntax == nil {
+			syntax = syntaxes[defaultSyntax]
+		}
+		return &x64Backend{syntax: syntax, debug: o.showAsm, omitFp: o.omitFramePointer, lines: o.debugInfo}, nil
+	case "c":
+		return &cBackend{}, nil
+	case "vm":
+		return &vmBackend{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown backend: '%v'. Available backends: x64, c, vm", o.backend)
+	}
+}
+
+// Optimised IR of a whole program
+type irProgram struct {
+	fns []*irFunc
+	gt  *GcTypes
+
+	// Asm names of runtime functions called directly by generated code
+	entrypoint  string
+	threadEntry string
+	ioob        string
+	divz        string
+	nullp       string
+
+	// Functions callable from C (if building a shared library)
+	exports []*export
+
+	// Profiling (if enabled)
+	counters   []blockCounter
+	profileOut string
+}
+
+// Quoted source location of a call or runtime check
+func trapLocation(pos *lex.Token) string {
+	if pos == nil {
+		return strconv.Quote("<unknown>")
+	}
+	return strconv.Quote(fmt.Sprintf("%v:%v", pos.File, pos.Line))
+}
+
+// Function & source location of a call or runtime check, from which panics print a backtrace. Backends output one
+// read-only callSite (See: runtime.clara) before the GC map of each call & pass one to the function handling a failed
+// check.
+type callSite struct {
+	fn, loc string // Quoted
+}
+
+func siteOf(f *irFunc, pos *lex.Token) callSite {
+	return callSite{strconv.Quote(demangle(f.name)), trapLocation(pos)}
+}
+
+func lowerProgram(symtab *SymTab, tree []*Node, exports []*export, pl *pipeline) (*irProgram, error) {
+
+	// Runtime functions declared in Clara code
+	ioob := symtab.MustResolve("indexOutOfBounds")
+	divz := symtab.MustResolve("divideByZero")
+	nullp := symtab.MustResolve("nullDereference")
+	alloc := symtab.MustResolve("claralloc")
+	entrypoint := symtab.MustResolve("entrypoint")
+	threadEntry := symtab.MustResolve("threadEntry")
+	asserts := &assertions{assert: symtab.MustResolve("assert"), failed: symtab.MustResolve("assertionFailed"), elide: pl.elideAsserts}
+
+	gt := &GcTypes{}
+	gt.AddBuiltins(symtab)
+
+	// Ensure we only generate code for "our" functions
+	var fns []*irFunc
+	for _, n := range tree {
+		if n.isFuncDcl() && !n.sym.Type.AsFunction().Is(External) {
+			fns = append(fns, lowerToIR(n, gt, alloc, asserts))
+		}
+	}
+
+	// Only compile functions which may be called. Inlining may leave further functions unused.
+	prog := &irProgram{
+		gt:          gt,
+		entrypoint:  entrypoint.Type.AsFunction().AsmName(entrypoint.Name),
+		threadEntry: threadEntry.Type.AsFunction().AsmName(threadEntry.Name),
+		ioob:        ioob.Type.AsFunction().AsmName(ioob.Name),
+		divz:        divz.Type.AsFunction().AsmName(divz.Name),
+		nullp:       nullp.Type.AsFunction().AsmName(nullp.Name),
+		exports:     exports,
+	}
+	roots := []string{prog.entrypoint, prog.threadEntry, prog.ioob, prog.divz, prog.nullp}
+	for _, e := range exports {
+		wrapper := symtab.MustResolve(e.wrapper)
+		e.asmName = wrapper.Type.AsFunction().AsmName(wrapper.Name)
+		roots = append(roots, e.asmName)
+	}
+	if pl.countRefs {
+		pl.rc = &refCounting{alloc: alloc, retain: symtab.MustResolve("rcRetain"), release: symtab.MustResolve("rcRelease")}
+		roots = append(roots, pl.rc.retain.Type.AsFunction().AsmName(pl.rc.retain.Name),
+			pl.rc.release.Type.AsFunction().AsmName(pl.rc.release.Name))
+	}
+	fns = reachableFuncs(fns, roots...)
+	if err := pl.run(fns, gt); err != nil {
+		return nil, err
+	}
+	prog.fns = reachableFuncs(fns, roots...)
+	prog.counters, prog.profileOut = pl.counters, pl.profileOut
+	return prog, nil
+}
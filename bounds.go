@@ -0,0 +1,114 @@
+package main
+
+// Removes bounds checks which are provably redundant: an index already checked against the same array in a dominating
+// block or one guarded by a comparison against the array's length where the index is known to be non-negative (i.e.
+// loop induction variables counting up from zero).
+func (f *irFunc) eliminateBoundsChecks() {
+
+	f.dominators()
+	defs := make(map[*irTemp]*irInstr)
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.dst != nil {
+				defs[i.dst] = i
+			}
+		}
+	}
+
+	type access struct{ arr, idx *irTemp }
+	checked := make(map[access]bool)
+	var visit func(b *irBlock)
+	visit = func(b *irBlock) {
+		var added []access
+		for _, i := range b.instrs {
+			if i.op != irIndex && i.op != irSetIndex {
+				continue
+			}
+			a := access{i.args[0], i.args[1]}
+			if checked[a] || (isNonNegative(a.idx, defs, make(map[*irTemp]bool)) && isBelowLength(b, a.arr, a.idx, defs)) {
+				i.unchecked = true
+			}
+			if !checked[a] {
+				checked[a] = true
+				added = append(added, a)
+			}
+		}
+		for _, child := range b.doms {
+			visit(child)
+		}
+		for _, a := range added {
+			delete(checked, a)
+		}
+	}
+	visit(f.blocks[0])
+}
+
+// Reports if a dominating branch is only taken when idx < arr.length
+func isBelowLength(b *irBlock, arr *irTemp, idx *irTemp, defs map[*irTemp]*irInstr) bool {
+	for ; ; b = b.idom {
+		if len(b.preds) == 1 {
+			br := b.preds[0].last()
+			if br.op == irBr && br.succs[0] == b && br.succs[1] != b {
+				if cond := defs[br.args[0]]; cond != nil {
+					switch {
+					case cond.op == irLt && cond.args[0] == idx && isLength(cond.args[1], arr, defs):
+						return true
+					case cond.op == irGt && cond.args[1] == idx && isLength(cond.args[0], arr, defs):
+						return true
+					}
+				}
+			}
+		}
+		if b.idom == b {
+			return false // Entry
+		}
+	}
+}
+
+func isLength(t *irTemp, arr *irTemp, defs map[*irTemp]*irInstr) bool {
+	i := defs[t]
+	return i != nil && i.op == irLoad && i.args[0] == arr && i.val == 0 && arr.typ.IsAny(Array, String, Bytes)
+}
+
+// Limits constants to ensure overflowing an incremented value requires an impractical number (>2^46) of iterations
+const maxInductionConst = 1 << 16
+
+// Reports if a temp is a small non-negative constant or only ever incremented by them
+func isNonNegative(t *irTemp, defs map[*irTemp]*irInstr, visiting map[*irTemp]bool) bool {
+	if visiting[t] {
+		return true // Cycle through a phi: holds if every other input holds
+	}
+	i := defs[t]
+	if i == nil {
+		return false
+	}
+	switch i.op {
+	case irConst:
+		return i.val >= 0 && i.val <= maxInductionConst
+	case irCopy:
+		return isNonNegative(i.args[0], defs, visiting)
+	case irAdd:
+		// One operand must be constant so values only grow linearly
+		x, c := i.args[0], defs[i.args[1]]
+		if c == nil || c.op != irConst {
+			x, c = i.args[1], defs[i.args[0]]
+		}
+		if c == nil || c.op != irConst {
+			return false
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		return isNonNegative(c.dst, defs, visiting) && isNonNegative(x, defs, visiting)
+	case irPhi:
+		visiting[t] = true
+		defer delete(visiting, t)
+		for _, arg := range i.args {
+			if !isNonNegative(arg, defs, visiting) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,865 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/g-dx/clarac/lex"
+)
+
+/*
+
+ Bytecode backend:
+ -----------------
+ Lowers IR to a compact stack based bytecode run by the VM (See: vm.go) rather than native code. Values & memory are
+ laid out exactly as in the C backend so the runtime & GC are shared:
+ - Temps are VM locals except pointers live across a call, which are kept in the frame so the GC can find them (See:
+   shadowFrame).
+ - Frames live in VM memory & those of functions which make calls or contain runtime checks are linked into a shadow
+   stack. The VM links & unlinks frames on call & return. Calls to Clara functions record the caller's GC map in the frame record.
+ - Literals, function descriptors, GC maps & type information are laid out in a data segment loaded at a fixed address.
+   Function descriptors hold the index of the function.
+ - External functions are implemented by the VM & looked up by name when a program is loaded.
+
+ File format (integers are varints):
+
+   "CLBC" version entrypoint threadEntry typeInfo profile
+   len(data) data...
+   len(externs) (len(name) name)...
+   len(fns) (len(name) name params temps slots linked len(code) (op operands...)...)...
+
+*/
+
+const (
+	bcMagic    = "CLBC"
+	bcVersion  = 2
+	bcDataBase = 0x10000 // Address of data segment
+)
+
+type bcOp byte
+
+const (
+	bcConst    = bcOp(iota + 1) // push a
+	bcLocal                     // push locals[a]
+	bcSetLocal                  // locals[a] = pop
+	bcSlot                      // push slot a of frame
+	bcSetSlot                   // slot a of frame = pop
+	bcFrame                     // push address of frame record
+	bcDup                       // push top of stack
+	bcPop                       // discard top of stack
+	bcTag                       // push tag(pop)
+	bcUntag                     // push untag(pop)
+	bcAdd                       // y = pop, x = pop, push x + y
+	bcSub                       // ...
+	bcMul
+	bcDiv
+	bcMod
+	bcAnd
+	bcOr
+	bcXor
+	bcShl
+	bcShr
+	bcNeg // push -pop
+	bcNot // push ^pop
+	bcEq  // y = pop, x = pop, push x == y
+	bcLt
+	bcLte
+	bcGt
+	bcGte
+	bcLtu   // Unsigned x < y
+	bcLoad  // push word at pop + a
+	bcStore // v = pop, word at pop + a = v
+	bcLoadB // push unsigned byte at pop + a
+	bcCall  // Call fns[a] with b arguments from the stack, recording GC map c
+	bcCallI // Call function value below a arguments, recording GC map b
+	bcCallX // Call externs[a] with b arguments from the stack
+	bcRet   // Return pop
+	bcJmp   // goto a
+	bcJnz   // if pop != 0 goto a
+)
+
+var bcOpNames = map[bcOp]string{
+	bcConst:    "const",
+	bcLocal:    "local",
+	bcSetLocal: "setlocal",
+	bcSlot:     "slot",
+	bcSetSlot:  "setslot",
+	bcFrame:    "frame",
+	bcDup:      "dup",
+	bcPop:      "pop",
+	bcTag:      "tag",
+	bcUntag:    "untag",
+	bcAdd:      "add",
+	bcSub:      "sub",
+	bcMul:      "mul",
+	bcDiv:      "div",
+	bcMod:      "mod",
+	bcAnd:      "and",
+	bcOr:       "or",
+	bcXor:      "xor",
+	bcShl:      "shl",
+	bcShr:      "shr",
+	bcNeg:      "neg",
+	bcNot:      "not",
+	bcEq:       "eq",
+	bcLt:       "lt",
+	bcLte:      "lte",
+	bcGt:       "gt",
+	bcGte:      "gte",
+	bcLtu:      "ltu",
+	bcLoad:     "load",
+	bcStore:    "store",
+	bcLoadB:    "loadb",
+	bcCall:     "call",
+	bcCallI:    "calli",
+	bcCallX:    "callx",
+	bcRet:      "ret",
+	bcJmp:      "jmp",
+	bcJnz:      "jnz",
+}
+
+// Operands of each op. Ops not listed have none.
+var bcOperands = map[bcOp]int{
+	bcConst:    1,
+	bcLocal:    1,
+	bcSetLocal: 1,
+	bcSlot:     1,
+	bcSetSlot:  1,
+	bcLoad:     1,
+	bcStore:    1,
+	bcLoadB:    1,
+	bcCall:     3,
+	bcCallI:    2,
+	bcCallX:    2,
+	bcJmp:      1,
+	bcJnz:      1,
+}
+
+type bcInstr struct {
+	op      bcOp
+	a, b, c int
+}
+
+func (i bcInstr) String() string {
+	s := bcOpNames[i.op]
+	for j, v := range []int{i.a, i.b, i.c}[:bcOperands[i.op]] {
+		if j == 0 {
+			s += " "
+		} else {
+			s += ", "
+		}
+		s += strconv.Itoa(v)
+	}
+	return s
+}
+
+type bcFunc struct {
+	name   string // Asm name
+	params int
+	temps  int       // Locals, including parameters
+	slots  int       // Slots in frame
+	linked bool      // Frame is part of the shadow stack
+	code   []bcInstr // Jumps target an index in code
+}
+
+type bcProgram struct {
+	data        []byte // Loaded at bcDataBase
+	fns         []*bcFunc
+	externs     []string
+	entrypoint  int // Index of function
+	threadEntry int // Index of function run by threads
+	typeInfo    int // Address of type info table
+	profile     int // Address of profile table
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type vmBackend struct{}
+
+func (be *vmBackend) ext() string  { return ".cbc" }
+func (be *vmBackend) native() bool { return false }
+
+func (be *vmBackend) lower(prog *irProgram, out io.Writer) error {
+
+	bw := &bcWriter{prog: &bcProgram{}, fns: make(map[string]int), literals: make(map[string]int),
+		descs: make(map[string]int), sites: make(map[callSite]int), externs: make(map[string]int)}
+	for i, f := range prog.fns {
+		bw.fns[f.name] = i
+		bw.prog.fns = append(bw.prog.fns, &bcFunc{name: f.name, params: len(f.params), temps: len(f.temps)})
+	}
+	bw.noRoots = bw.gcMap(nil, 0)
+	bw.ioob, bw.divz, bw.nullp = bw.fns[prog.ioob], bw.fns[prog.divz], bw.fns[prog.nullp]
+	bw.genProfileTable(prog.counters, prog.profileOut)
+	for i, f := range prog.fns {
+		bw.genFunc(bw.prog.fns[i], f)
+	}
+	bw.genTypeInfoTable(prog.gt)
+	bw.prog.entrypoint = bw.fns[prog.entrypoint]
+	bw.prog.threadEntry = bw.fns[prog.threadEntry]
+
+	w := bufio.NewWriter(out)
+	bw.prog.encode(w)
+	return w.Flush()
+}
+
+type bcWriter struct {
+	prog       *bcProgram
+	fns        map[string]int   // Index of each function, keyed by asm name
+	literals   map[string]int   // Address of each string literal, keyed by content
+	descs      map[string]int   // Address of each function descriptor, keyed by asm name
+	sites      map[callSite]int // Address of each call site
+	externs    map[string]int   // Index of each external function, keyed by name
+	counters   int              // Address of profile counters
+	noRoots    int              // GC map of calls which never return
+	ioob, divz int              // Index of trap functions
+	nullp      int
+}
+
+// Function being compiled
+type bcFuncWriter struct {
+	*shadowFrame
+	f      *irFunc
+	w      *bcWriter
+	code   []bcInstr
+	blocks []int // Index in code of each block
+	jumps  []int // Index in code of each jump to a block
+}
+
+func (bw *bcWriter) genFunc(bf *bcFunc, f *irFunc) {
+
+	fn := &bcFuncWriter{shadowFrame: layoutShadowFrame(f), f: f, w: bw, blocks: make([]int, len(f.blocks))}
+	bf.slots, bf.linked = fn.size, fn.linked
+
+	// Entry. The VM clears the frame so pointers are never scanned before they are assigned.
+	for _, p := range f.params {
+		if s, ok := fn.slots[p]; ok {
+			fn.emit(bcLocal, p.id)
+			fn.emit(bcSetSlot, s)
+		}
+	}
+	for _, i := range fn.allocs {
+		fn.emit(bcConst, (readOnlyGcHeader(i.val)<<1)|1) // Headers are tagged
+		fn.emit(bcSetSlot, fn.objects[i]+1)
+	}
+	for j, b := range f.blocks {
+		var next *irBlock
+		if j+1 < len(f.blocks) {
+			next = f.blocks[j+1]
+		}
+		fn.blocks[b.id] = len(fn.code)
+		for _, i := range b.instrs {
+			fn.genInstr(i, next)
+		}
+	}
+
+	// Resolve jumps to blocks
+	for _, j := range fn.jumps {
+		fn.code[j].a = fn.blocks[fn.code[j].a]
+	}
+	bf.code = fn.code
+}
+
+func (fn *bcFuncWriter) emit(op bcOp, operands ...int) {
+	i := bcInstr{op: op}
+	switch len(operands) {
+	case 3:
+		i.c = operands[2]
+		fallthrough
+	case 2:
+		i.b = operands[1]
+		fallthrough
+	case 1:
+		i.a = operands[0]
+	}
+	fn.code = append(fn.code, i)
+}
+
+// Jumps to a block, which is resolved once all blocks are placed
+func (fn *bcFuncWriter) jump(op bcOp, b *irBlock) {
+	fn.jumps = append(fn.jumps, len(fn.code))
+	fn.emit(op, b.id)
+}
+
+// Pushes value of temp
+func (fn *bcFuncWriter) load(t *irTemp) {
+	if s, ok := fn.slots[t]; ok {
+		fn.emit(bcSlot, s)
+	} else {
+		fn.emit(bcLocal, t.id)
+	}
+}
+
+// Pops value into temp
+func (fn *bcFuncWriter) store(t *irTemp) {
+	if s, ok := fn.slots[t]; ok {
+		fn.emit(bcSetSlot, s)
+	} else {
+		fn.emit(bcSetLocal, t.id)
+	}
+}
+
+// Pushes value of temp, stripping any tag
+func (fn *bcFuncWriter) val(t *irTemp) {
+	fn.load(t)
+	if t.typ.IsAny(Integer, Byte) {
+		fn.emit(bcUntag)
+	}
+}
+
+// Pops (untagged) value into temp, adding any tag
+func (fn *bcFuncWriter) set(t *irTemp) {
+	if t.typ.IsAny(Integer, Byte) {
+		fn.emit(bcTag)
+	}
+	fn.store(t)
+}
+
+// Calls a runtime function which never returns unless the condition on the stack is true. Pushes n arguments first.
+func (fn *bcFuncWriter) trap(callee int, n int, args func()) {
+	skip := len(fn.code)
+	fn.emit(bcJnz, 0)
+	if args != nil {
+		args()
+	}
+	fn.emit(bcCall, callee, n, fn.w.noRoots)
+	fn.emit(bcPop)
+	fn.code[skip].a = len(fn.code)
+}
+
+func (fn *bcFuncWriter) nullCheck(i *irInstr) {
+	if i.isNullChecked() {
+		fn.load(i.args[0])
+		fn.trap(fn.w.nullp, 1, func() { fn.emit(bcConst, fn.site(i.pos)) })
+	}
+}
+
+var bcOps = map[irOp]bcOp{
+	irAdd: bcAdd,
+	irSub: bcSub,
+	irMul: bcMul,
+	irDiv: bcDiv,
+	irMod: bcMod,
+	irAnd: bcAnd,
+	irOr:  bcOr,
+	irXor: bcXor,
+	irShl: bcShl,
+	irShr: bcShr,
+	irEq:  bcEq,
+	irLt:  bcLt,
+	irLte: bcLte,
+	irGt:  bcGt,
+	irGte: bcGte,
+}
+
+func (fn *bcFuncWriter) genInstr(i *irInstr, next *irBlock) {
+
+	switch i.op {
+
+	case irConst:
+		v := i.val
+		if i.dst.typ.IsAny(Integer, Byte) {
+			v = (v << tagLenFor(i.dst.typ.Kind)) | tagFor(i.dst.typ.Kind)
+		}
+		fn.emit(bcConst, v)
+		fn.store(i.dst)
+
+	case irString:
+		fn.emit(bcConst, fn.w.stringLit(i.str))
+		fn.store(i.dst)
+
+	case irFnAddr:
+		if i.sym.Type.AsFunction().Is(External) {
+			fn.emit(bcConst, 0) // NOTE: As per x64 backend
+		} else {
+			fn.emit(bcConst, fn.w.descriptor(i.sym.Type.AsFunction().AsmName(i.sym.Name)))
+		}
+		fn.store(i.dst)
+
+	case irCopy:
+		fn.load(i.args[0])
+		fn.store(i.dst)
+
+	case irAdd, irSub, irMul, irAnd, irOr, irXor, irShl, irShr:
+		fn.val(i.args[0])
+		fn.val(i.args[1])
+		fn.emit(bcOps[i.op])
+		fn.set(i.dst)
+
+	case irDiv, irMod:
+		fn.val(i.args[1])
+		fn.trap(fn.w.divz, 1, func() { fn.emit(bcConst, fn.site(i.pos)) })
+		fn.val(i.args[0])
+		fn.val(i.args[1])
+		fn.emit(bcOps[i.op])
+		fn.set(i.dst)
+
+	case irNeg:
+		fn.val(i.args[0])
+		fn.emit(bcNeg)
+		fn.set(i.dst)
+
+	case irNot:
+		fn.load(i.args[0])
+		fn.emit(bcNot)
+		fn.emit(bcConst, 1)
+		fn.emit(bcAnd)
+		fn.store(i.dst)
+
+	case irBNot:
+		fn.load(i.args[0])
+		fn.emit(bcNot)
+		fn.emit(bcConst, tagFor(i.dst.typ.Kind)) // Keep tag
+		fn.emit(bcOr)
+		fn.store(i.dst)
+
+	case irEq, irLt, irLte, irGt, irGte:
+		fn.val(i.args[0])
+		fn.val(i.args[1])
+		fn.emit(bcOps[i.op])
+		fn.store(i.dst)
+
+	case irLoad:
+		fn.nullCheck(i)
+		fn.load(i.args[0])
+		fn.emit(bcLoad, i.val)
+		fn.store(i.dst)
+
+	case irStore:
+		fn.nullCheck(i)
+		fn.load(i.args[0])
+		fn.load(i.args[1])
+		fn.emit(bcStore, i.val)
+
+	case irIndex, irSetIndex:
+		a, idx := i.args[0], i.args[1]
+		if !i.unchecked {
+			fn.val(idx)
+			fn.load(a)
+			fn.emit(bcLoad, 0)
+			fn.emit(bcUntag)
+			fn.emit(bcLtu)
+			fn.trap(fn.w.ioob, 3, func() {
+				fn.load(idx)
+				fn.load(a)
+				fn.emit(bcLoad, 0) // Tagged length
+				fn.emit(bcConst, fn.site(i.pos))
+			})
+		}
+		fn.load(a)
+		fn.val(idx)
+		switch {
+		case a.typ.IsAny(String, Bytes):
+			fn.emit(bcAdd)
+			fn.emit(bcLoadB, 8) // Single (unsigned) byte after length
+			fn.set(i.dst)
+		default:
+			fn.emit(bcConst, 3)
+			fn.emit(bcShl)
+			fn.emit(bcAdd)
+			if i.op == irSetIndex {
+				fn.load(i.args[2])
+				fn.emit(bcStore, 8)
+			} else {
+				fn.emit(bcLoad, 8)
+				fn.store(i.dst)
+			}
+		}
+
+	case irCall:
+		fn.genCall(i)
+
+	case irStackAlloc:
+		fn.emit(bcFrame)
+		fn.emit(bcConst, -ptrSize*fn.objects[i])
+		fn.emit(bcAdd)
+		fn.store(i.dst)
+
+	case irCount:
+		fn.emit(bcConst, fn.w.counters+i.val*3*ptrSize+2*ptrSize) // Count follows function name & block
+		fn.emit(bcDup)
+		fn.emit(bcLoad, 0)
+		fn.emit(bcConst, 1)
+		fn.emit(bcAdd)
+		fn.emit(bcStore, 0)
+
+	case irRet:
+		if len(i.args) > 0 {
+			fn.load(i.args[0])
+		} else {
+			fn.emit(bcConst, 0)
+		}
+		fn.emit(bcRet)
+
+	case irJmp:
+		if i.succs[0] != next {
+			fn.jump(bcJmp, i.succs[0])
+		}
+
+	case irBr:
+		then, els := i.succs[0], i.succs[1]
+		fn.load(i.args[0])
+		fn.jump(bcJnz, then)
+		if els != next {
+			fn.jump(bcJmp, els)
+		}
+
+	default:
+		panic(fmt.Sprintf("Can't generate code for IR op: %v", irOpNames[i.op]))
+	}
+
+}
+
+func (fn *bcFuncWriter) genCall(i *irInstr) {
+
+	// Determine how function is referenced
+	args := i.args
+	if i.sym == nil {
+		fn.load(args[0])
+		args = args[1:]
+	}
+
+	// Create "raw" values for any external functions which require them
+	raw := i.fn.Is(External) && i.fn.RawValues
+	for _, arg := range args {
+		switch {
+		case raw && arg.typ.IsAny(String, Array, Bytes):
+			fn.load(arg)
+			fn.emit(bcConst, 8) // Point past length
+			fn.emit(bcAdd)
+		case raw && arg.typ.IsAny(Integer, Byte):
+			fn.val(arg)
+		default:
+			fn.load(arg)
+		}
+	}
+
+	// NOTE: Functions called through values may take fewer parameters than the arguments forwarded by invokeDynamic().
+	// The VM drops any extra arguments.
+	switch {
+	case i.sym == nil:
+		fn.emit(bcCallI, len(args), fn.w.gcMap(fn.roots[i], fn.site(i.pos)))
+	case i.fn.Is(External):
+		fn.emit(bcCallX, fn.w.extern(i.sym.Name), len(args))
+	default:
+		callee := fn.w.fns[i.fn.AsmName(i.sym.Name)]
+		n := fn.w.prog.fns[callee].params
+		for j := len(args); j < n; j++ {
+			fn.emit(bcConst, 0) // Unused by callee. See: invokeDynamic()
+		}
+		fn.emit(bcCall, callee, n, fn.w.gcMap(fn.roots[i], fn.site(i.pos)))
+	}
+	switch {
+	case i.dst == nil:
+		fn.emit(bcPop)
+	case raw && i.fn.ret.IsAny(Integer, Byte):
+		fn.set(i.dst)
+	default:
+		fn.store(i.dst)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Appends words to the data segment, returning their address
+func (bw *bcWriter) words(vals ...int) int {
+	addr := bcDataBase + len(bw.prog.data)
+	var buf [ptrSize]byte
+	for _, v := range vals {
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+		bw.prog.data = append(bw.prog.data, buf[:]...)
+	}
+	return addr
+}
+
+// Appends a NUL terminated string to the data segment, returning its address. Data remains word aligned.
+func (bw *bcWriter) cString(s string) int {
+	addr := bcDataBase + len(bw.prog.data)
+	bw.prog.data = append(bw.prog.data, s...)
+	bw.prog.data = append(bw.prog.data, make([]byte, ptrSize-len(s)%ptrSize)...)
+	return addr
+}
+
+// Interns a (quoted) string literal, returning its value
+func (bw *bcWriter) stringLit(s string) int {
+	raw, err := strconv.Unquote(s)
+	if err != nil {
+		panic(err)
+	}
+	return bw.literal(raw)
+}
+
+func (bw *bcWriter) literal(raw string) int {
+	if v, ok := bw.literals[raw]; ok {
+		return v
+	}
+	v := bw.words((readOnlyGcHeader(4)<<1)|1, (len(raw)<<1)|1) + ptrSize
+	bw.cString(raw)
+	bw.literals[raw] = v
+	return v
+}
+
+// Read-only descriptor of a function value, returning its value
+func (bw *bcWriter) descriptor(asmName string) int {
+	if v, ok := bw.descs[asmName]; ok {
+		return v
+	}
+	v := bw.words((readOnlyGcHeader(5)<<1)|1, bw.fns[asmName]) + ptrSize
+	bw.descs[asmName] = v
+	return v
+}
+
+// GC map of a call, preceded by its address relative to the map's own address & its site (See: runtime.c)
+func (bw *bcWriter) gcMap(slots []int, site int) int {
+	return bw.words(append([]int{2 * ptrSize, site}, taggedInts(slots)...)...)
+}
+
+// Read-only call site (See: callSite in runtime.clara), returning its value
+func (bw *bcWriter) site(s callSite) int {
+	if v, ok := bw.sites[s]; ok {
+		return v
+	}
+	v := bw.words((2<<1)|1, bw.stringLit(s.fn), bw.stringLit(s.loc)) + ptrSize
+	bw.sites[s] = v
+	return v
+}
+
+func (fn *bcFuncWriter) site(pos *lex.Token) int { return fn.w.site(siteOf(fn.f, pos)) }
+
+func (bw *bcWriter) extern(name string) int {
+	if i, ok := bw.externs[name]; ok {
+		return i
+	}
+	bw.externs[name] = len(bw.prog.externs)
+	bw.prog.externs = append(bw.prog.externs, name)
+	return bw.externs[name]
+}
+
+func (bw *bcWriter) genTypeInfoTable(gt *GcTypes) {
+
+	var roots []int
+	for _, r := range gt.roots() {
+		roots = append(roots, bw.words(taggedInts(r.offsets)...))
+	}
+
+	// NOTE: The IDs used here must match the enum definition in gc.clara!
+	var infos []int
+	for i, t := range gt.types {
+		vals := []int{(2 << 1) | 1} // "Read-only" GC header
+		switch t.Kind {
+		case Struct, Enum:
+			vals = append(vals, 1, bw.literal(t.String()), roots[i])
+		case String:
+			vals = append(vals, 3)
+		case Array:
+			elemIsPointer := 0
+			if t.AsArray().Elem.IsPointer() {
+				elemIsPointer = 1
+			}
+			vals = append(vals, 5, bw.literal(t.String()), elemIsPointer)
+		case Function:
+			vals = append(vals, 7)
+		case Bytes:
+			vals = append(vals, 9)
+		}
+		infos = append(infos, bw.words(vals...)+ptrSize)
+	}
+	bw.prog.typeInfo = bw.words(append([]int{(2 << 1) | 1, (len(infos) << 1) | 1}, infos...)...) + ptrSize
+}
+
+// Counters read by writeProfile() (See: vm.go) on exit, laid out as in runtime.c. The table is empty when the program
+// is not instrumented.
+func (bw *bcWriter) genProfileTable(counters []blockCounter, path string) {
+	names := make(map[string]int)
+	var vals []int
+	for _, c := range counters {
+		if _, ok := names[c.fn]; !ok {
+			names[c.fn] = bw.cString(c.fn)
+		}
+		vals = append(vals, names[c.fn], c.block, 0)
+	}
+	if len(vals) > 0 {
+		bw.counters = bw.words(vals...)
+	}
+	bw.prog.profile = bw.words(len(counters), bw.cString(path), bw.counters)
+}
+
+func taggedInts(is []int) []int {
+	vals := []int{(len(is) << 1) | 1}
+	for _, i := range is {
+		vals = append(vals, (i<<1)|1)
+	}
+	return vals
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (p *bcProgram) encode(w *bufio.Writer) {
+	e := &bcEncoder{w: w}
+	w.WriteString(bcMagic)
+	e.uint(bcVersion)
+	e.uint(p.entrypoint)
+	e.uint(p.threadEntry)
+	e.int(p.typeInfo)
+	e.int(p.profile)
+	e.bytes(p.data)
+	e.uint(len(p.externs))
+	for _, name := range p.externs {
+		e.bytes([]byte(name))
+	}
+	e.uint(len(p.fns))
+	for _, f := range p.fns {
+		e.bytes([]byte(f.name))
+		e.uint(f.params)
+		e.uint(f.temps)
+		e.uint(f.slots)
+		linked := 0
+		if f.linked {
+			linked = 1
+		}
+		e.uint(linked)
+		e.uint(len(f.code))
+		for _, i := range f.code {
+			w.WriteByte(byte(i.op))
+			for _, v := range []int{i.a, i.b, i.c}[:bcOperands[i.op]] {
+				e.int(v)
+			}
+		}
+	}
+}
+
+type bcEncoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *bcEncoder) uint(v int) {
+	e.w.Write(e.buf[:binary.PutUvarint(e.buf[:], uint64(v))])
+}
+
+func (e *bcEncoder) int(v int) {
+	e.w.Write(e.buf[:binary.PutVarint(e.buf[:], int64(v))])
+}
+
+func (e *bcEncoder) bytes(b []byte) {
+	e.uint(len(b))
+	e.w.Write(b)
+}
+
+// Reads a program, checking every instruction refers to a valid function, extern, local, slot or jump target
+func readBytecode(r io.Reader) (*bcProgram, error) {
+	d := &bcDecoder{r: bufio.NewReader(r)}
+	if string(d.bytes(len(bcMagic))) != bcMagic {
+		return nil, errors.New("Not a Clara bytecode file")
+	}
+	if v := d.uint(); d.err == nil && v != bcVersion {
+		return nil, fmt.Errorf("Unsupported bytecode version: %v", v)
+	}
+	p := &bcProgram{entrypoint: d.uint(), threadEntry: d.uint(), typeInfo: d.int(), profile: d.int()}
+	p.data = d.bytes(d.uint())
+	for n := d.uint(); d.err == nil && n > 0; n-- {
+		p.externs = append(p.externs, string(d.bytes(d.uint())))
+	}
+	for n := d.uint(); d.err == nil && n > 0; n-- {
+		f := &bcFunc{name: string(d.bytes(d.uint())), params: d.uint(), temps: d.uint(), slots: d.uint(), linked: d.uint() == 1}
+		for n := d.uint(); d.err == nil && n > 0; n-- {
+			i := bcInstr{op: bcOp(d.byte())}
+			if _, ok := bcOpNames[i.op]; !ok && d.err == nil {
+				return nil, fmt.Errorf("Corrupt bytecode: %v: unknown op: %v", f.name, i.op)
+			}
+			operands := []*int{&i.a, &i.b, &i.c}
+			for j := 0; j < bcOperands[i.op]; j++ {
+				*operands[j] = d.int()
+			}
+			f.code = append(f.code, i)
+		}
+		p.fns = append(p.fns, f)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("Corrupt bytecode: %v", d.err)
+	}
+	return p, p.validate()
+}
+
+func (p *bcProgram) validate() error {
+	if p.entrypoint >= len(p.fns) || p.threadEntry >= len(p.fns) {
+		return errors.New("Corrupt bytecode: invalid entrypoint")
+	}
+	for _, f := range p.fns {
+		if f.params > f.temps {
+			return fmt.Errorf("Corrupt bytecode: %v: more parameters than locals", f.name)
+		}
+		if len(f.code) == 0 || f.code[len(f.code)-1].op != bcRet && f.code[len(f.code)-1].op != bcJmp {
+			return fmt.Errorf("Corrupt bytecode: %v: code does not end with return or jump", f.name)
+		}
+		for j, i := range f.code {
+			var ok bool
+			switch i.op {
+			case bcLocal, bcSetLocal:
+				ok = i.a >= 0 && i.a < f.temps
+			case bcSlot, bcSetSlot:
+				ok = i.a > 0 && i.a <= f.slots
+			case bcCall:
+				ok = i.a >= 0 && i.a < len(p.fns) && i.b == p.fns[i.a].params
+			case bcCallX:
+				ok = i.a >= 0 && i.a < len(p.externs) && i.b >= 0
+			case bcCallI:
+				ok = i.a >= 0
+			case bcJmp, bcJnz:
+				ok = i.a >= 0 && i.a < len(f.code)
+			default:
+				ok = true
+			}
+			if !ok {
+				return fmt.Errorf("Corrupt bytecode: %v: invalid instruction %v: %v", f.name, j, i)
+			}
+		}
+	}
+	return nil
+}
+
+type bcDecoder struct {
+	r   *bufio.Reader
+	err error // First error
+}
+
+func (d *bcDecoder) uint() int {
+	v, err := binary.ReadUvarint(d.r)
+	d.fail(err)
+	return int(v)
+}
+
+func (d *bcDecoder) int() int {
+	v, err := binary.ReadVarint(d.r)
+	d.fail(err)
+	return int(v)
+}
+
+func (d *bcDecoder) byte() byte {
+	b, err := d.r.ReadByte()
+	d.fail(err)
+	return b
+}
+
+func (d *bcDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > 1<<30 {
+		d.err = errors.New("length out of range")
+		return nil
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	d.fail(err)
+	return b
+}
+
+func (d *bcDecoder) fail(err error) {
+	if d.err == nil && err != nil {
+		d.err = err
+	}
+}
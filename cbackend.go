@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/g-dx/clarac/lex"
+)
+
+/*
+
+ C backend:
+ ----------
+ Lowers IR to C99 which gcc compiles & links with the runtime. Values are represented exactly as in the x64 backend so
+ the runtime & GC are shared:
+ - Every value is a word (V). Integers & bytes are tagged. Arithmetic is performed unsigned so overflow wraps.
+ - Temps are C locals except pointers live across a call, which are kept in the frame array so the GC can find them.
+ - Frames of functions which make calls or contain runtime checks are linked into a shadow stack mirroring the rbp
+   chain, one per thread. A frame record is { next, caller's GC map, GC map of the current call } & getFramePointer()
+   returns the innermost one. Slot s of a frame is at -8 * s from its record, as in the x64 backend.
+ - Function values point to a read-only descriptor holding the function's address, as C code has no GC header.
+
+*/
+
+type cBackend struct{}
+
+func (be *cBackend) ext() string  { return ".c" }
+func (be *cBackend) native() bool { return true }
+
+// Functions declared in Clara as external but implemented by codegen
+var cBuiltins = map[string]string{
+	"readByte":        "static V readByte(V p, V i) { return (signed char) ((char *) p)[untag(i)]; }",
+	"readInt":         "static V readInt(V p, V i) { return ((V *) p)[untag(i)]; }",
+	"writeByte":       "static V writeByte(V p, V i, V v) { ((char *) p)[untag(i)] = (char) v; return 0; }",
+	"writeInt":        "static V writeInt(V p, V i, V v) { ((V *) p)[untag(i)] = v; return 0; }",
+	"atomicLoad":      "static V atomicLoad(V a) { return __atomic_load_n((V *) a, __ATOMIC_SEQ_CST); }",
+	"atomicStore":     "static V atomicStore(V a, V v) { __atomic_store_n((V *) a, v, __ATOMIC_SEQ_CST); return 0; }",
+	"atomicAdd":       "static V atomicAdd(V a, V d) { return __atomic_add_fetch((V *) a, d - 1, __ATOMIC_SEQ_CST); }",
+	"compareAndSwap":  "static V compareAndSwap(V a, V o, V n) { return __atomic_compare_exchange_n((V *) a, &o, n, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST); }",
+	"getFramePointer": "static V getFramePointer(void) { return (V) top; }",
+	"unsafe":          "static V unsafe(V p, V off, V t) { return p + untag(off); }",
+	"toTaggedInt":     "static V toTaggedInt(V p) { return tag(p); }",
+	"toUntaggedInt":   "static V toUntaggedInt(V p) { return untag(p); }",
+	"typeInfoTable":   "static V typeInfoTable(void) { return (V) &typeInfoArray[1]; }",
+}
+
+const cPrelude = `#include <stdint.h>
+
+typedef intptr_t V;
+
+static inline V tag(V v) { return (V) (((uintptr_t) v << 1) | 1); }
+static inline V untag(V v) { return v >> 1; }
+
+// Shadow stack, one per thread. The base record has no maps & calls never trap to the GC from it.
+static V base[3];
+static __thread V *top = base;
+static const V noRoots[] = { 16, 0, 1 };
+`
+
+func (be *cBackend) lower(prog *irProgram, out io.Writer) error {
+
+	cw := &cWriter{ioob: prog.ioob, divz: prog.divz, nullp: prog.nullp, literals: make(map[string]string), names: make(map[string]string),
+		arity: make(map[string]int), descs: make(map[string]string), sites: make(map[callSite]string), externs: make(map[string]*FunctionType)}
+	for i, f := range prog.fns {
+		cw.names[f.name] = fmt.Sprintf("f%v_%v", i, cIdent(f.name))
+		cw.arity[f.name] = len(f.params)
+	}
+	for _, f := range prog.fns {
+		cw.genFunc(f)
+	}
+	cw.genTypeInfoTable(prog.gt)
+	cw.genProfileTable(prog.counters, prog.profileOut)
+	fmt.Fprintf(&cw.code, "int %v(int argc, char **argv, char **envp) { return (int) untag(%v(tag(argc), (V) argv, (V) envp)); }\n",
+		fnPrefix+"asm_entrypoint", cw.names[prog.entrypoint])
+	fmt.Fprintf(&cw.code, "void %v(V f) { V threadBase[3] = { 0 }; top = threadBase; %v(f); }\n",
+		fnPrefix+"asm_threadEntry", cw.names[prog.threadEntry])
+
+	// Declarations precede data, which precedes code
+	w := bufio.NewWriter(out)
+	w.WriteString(cPrelude)
+	var externs []string
+	for name := range cw.externs {
+		externs = append(externs, name)
+	}
+	sort.Strings(externs)
+	for _, name := range externs {
+		fmt.Fprintf(w, "V %v(%v);\n", name, cExternParams(cw.externs[name]))
+	}
+	for _, f := range prog.fns {
+		fmt.Fprintf(w, "static V %v(%v);\n", cw.names[f.name], cParams(len(f.params)))
+	}
+	w.WriteString("\n")
+	w.Write(cw.data.Bytes())
+	w.WriteString("\n")
+	var builtins []string
+	for name := range cBuiltins {
+		builtins = append(builtins, name)
+	}
+	sort.Strings(builtins)
+	for _, name := range builtins {
+		w.WriteString(cBuiltins[name] + "\n")
+	}
+	w.WriteString("\n")
+	w.Write(cw.code.Bytes())
+	return w.Flush()
+}
+
+type cWriter struct {
+	data, code bytes.Buffer
+	ioob, divz string                   // Asm names of trap functions
+	nullp      string
+	literals   map[string]string        // Name of each string literal, keyed by content
+	names      map[string]string        // C name of each function, keyed by asm name
+	arity      map[string]int           // Parameters of each function, keyed by asm name
+	descs      map[string]string        // Name of each function descriptor, keyed by asm name
+	sites      map[callSite]string      // Value of each call site
+	externs    map[string]*FunctionType // External functions called
+	maps       int
+}
+
+// Frame of a function whose pointers are found by walking the shadow stack. Temps are held outside the frame except
+// pointers live across a call.
+type shadowFrame struct {
+	slots   map[*irTemp]int    // Pointers live across calls
+	objects map[*irInstr]int   // Slot of each stack allocated struct
+	allocs  []*irInstr         // Stack allocated structs, in order
+	roots   map[*irInstr][]int // Slots of pointers live across each call
+	size    int                // Slots in frame
+	linked  bool               // Frame is part of the shadow stack
+}
+
+func layoutShadowFrame(f *irFunc) *shadowFrame {
+
+	fr := &shadowFrame{slots: make(map[*irTemp]int), objects: make(map[*irInstr]int), roots: make(map[*irInstr][]int), linked: !f.isLeaf() || f.hasTraps()}
+	_, out := f.liveness()
+
+	// Pointers live across each call
+	live := make(map[*irInstr][]*irTemp)
+	for _, b := range f.blocks {
+		set := out[b.id].copy()
+		for j := len(b.instrs) - 1; j >= 0; j-- {
+			i := b.instrs[j]
+			if i.dst != nil {
+				set.remove(i.dst)
+			}
+			if i.op == irCall {
+				for _, t := range f.temps {
+					if set.has(t) && t.typ.IsPointer() {
+						live[i] = append(live[i], t)
+						if fr.slots[t] == 0 {
+							fr.size += 1
+							fr.slots[t] = fr.size
+						}
+					}
+				}
+			}
+			for _, arg := range i.args {
+				set.add(arg)
+			}
+		}
+	}
+
+	// Stack allocated structs are laid out as heap objects. Pointer fields are always roots.
+	var objectRoots []int
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.op == irStackAlloc {
+				n := len(i.dst.typ.AsStruct().Fields)
+				fr.objects[i] = fr.size + n
+				fr.size += n + 1
+				fr.allocs = append(fr.allocs, i)
+				for j, field := range i.dst.typ.AsStruct().Fields {
+					if field.Type.IsPointer() {
+						objectRoots = append(objectRoots, fr.objects[i]-j)
+					}
+				}
+			}
+		}
+	}
+	for i, ts := range live {
+		for _, t := range ts {
+			fr.roots[i] = append(fr.roots[i], fr.slots[t])
+		}
+		fr.roots[i] = append(fr.roots[i], objectRoots...)
+	}
+	return fr
+}
+
+// Function being compiled
+type cFunc struct {
+	*shadowFrame
+	f *irFunc
+	w *cWriter
+}
+
+func (cw *cWriter) genFunc(f *irFunc) {
+
+	fn := &cFunc{shadowFrame: layoutShadowFrame(f), f: f, w: cw}
+
+	// Entry. The frame is cleared so pointers are never scanned before they are assigned.
+	w := &cw.code
+	var params []string
+	for _, p := range f.params {
+		params = append(params, "V "+cTemp(p))
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+	}
+	fmt.Fprintf(w, "// %v\nstatic V %v(%v) {\n", f.name, cw.names[f.name], strings.Join(params, ", "))
+	if fn.size > 0 || fn.linked {
+		fmt.Fprintf(w, "    V fr[%v] = { 0 };\n", fn.size+3)
+	}
+	var locals []string
+	for _, t := range f.temps[len(f.params):] {
+		if fn.slots[t] == 0 {
+			locals = append(locals, cTemp(t))
+		}
+	}
+	if len(locals) > 0 {
+		fmt.Fprintf(w, "    V %v;\n", strings.Join(locals, ", "))
+	}
+	if fn.linked {
+		fmt.Fprintf(w, "    fr[%v] = (V) top; fr[%v] = top[2]; top = &fr[%v];\n", fn.size, fn.size+1, fn.size)
+	}
+	for _, p := range f.params {
+		if fn.slots[p] != 0 {
+			fmt.Fprintf(w, "    %v = %v;\n", fn.loc(p), cTemp(p))
+		}
+	}
+	for _, i := range fn.allocs {
+		fmt.Fprintf(w, "    %v = %v;\n", fn.slot(fn.objects[i]+1), cInt((readOnlyGcHeader(i.val)<<1)|1)) // Headers are tagged
+	}
+
+	// Blocks in order, falling through where possible
+	for j, b := range f.blocks {
+		var next *irBlock
+		if j+1 < len(f.blocks) {
+			next = f.blocks[j+1]
+		}
+		fmt.Fprintf(w, "%v:\n", b)
+		for _, i := range b.instrs {
+			fn.genInstr(i, next)
+		}
+	}
+	w.WriteString("}\n\n")
+}
+
+// Frame slot, addressed as in the x64 backend
+func (fn *cFunc) slot(s int) string {
+	return fmt.Sprintf("fr[%v]", fn.size-s)
+}
+
+func (fn *cFunc) loc(t *irTemp) string {
+	if s, ok := fn.slots[t]; ok {
+		return fn.slot(s)
+	}
+	return cTemp(t)
+}
+
+// Value of temp, stripping any tag
+func (fn *cFunc) val(t *irTemp) string {
+	if t.typ.IsAny(Integer, Byte) {
+		return fmt.Sprintf("untag(%v)", fn.loc(t))
+	}
+	return fn.loc(t)
+}
+
+// Assigns an (untagged) value to temp, adding any tag
+func (fn *cFunc) set(t *irTemp, format string, a ...interface{}) {
+	v := fmt.Sprintf(format, a...)
+	if t.typ.IsAny(Integer, Byte) {
+		v = fmt.Sprintf("tag(%v)", v)
+	}
+	fn.stmt("%v = %v;", fn.loc(t), v)
+}
+
+func (fn *cFunc) stmt(format string, a ...interface{}) {
+	fmt.Fprintf(&fn.w.code, "    "+format+"\n", a...)
+}
+
+// Calls a runtime function which never returns
+func (fn *cFunc) trap(cond string, callee string, args string) {
+	if fn.linked {
+		fn.stmt("if (%v) { fr[%v] = (V) noRoots; %v(%v); }", cond, fn.size+2, callee, args)
+	} else {
+		fn.stmt("if (%v) %v(%v);", cond, callee, args)
+	}
+}
+
+func (fn *cFunc) nullCheck(i *irInstr) {
+	if i.isNullChecked() {
+		fn.trap(fmt.Sprintf("%v == 0", fn.loc(i.args[0])), fn.w.names[fn.w.nullp], fn.site(i.pos))
+	}
+}
+
+var cOps = map[irOp]string{
+	irAdd: "+",
+	irSub: "-",
+	irMul: "*",
+	irAnd: "&",
+	irOr:  "|",
+	irXor: "^",
+	irEq:  "==",
+	irLt:  "<",
+	irLte: "<=",
+	irGt:  ">",
+	irGte: ">=",
+}
+
+func (fn *cFunc) genInstr(i *irInstr, next *irBlock) {
+
+	switch i.op {
+
+	case irConst:
+		v := i.val
+		if i.dst.typ.IsAny(Integer, Byte) {
+			v = (v << tagLenFor(i.dst.typ.Kind)) | tagFor(i.dst.typ.Kind)
+		}
+		fn.stmt("%v = %v;", fn.loc(i.dst), cInt(v))
+
+	case irString:
+		fn.stmt("%v = (V) &%v.len;", fn.loc(i.dst), fn.w.stringLit(i.str))
+
+	case irFnAddr:
+		if i.sym.Type.AsFunction().Is(External) {
+			fn.stmt("%v = 0;", fn.loc(i.dst)) // NOTE: As per x64 backend
+		} else {
+			fn.stmt("%v = (V) &%v[1];", fn.loc(i.dst), fn.w.descriptor(i.sym.Type.AsFunction().AsmName(i.sym.Name)))
+		}
+
+	case irCopy:
+		fn.stmt("%v = %v;", fn.loc(i.dst), fn.loc(i.args[0]))
+
+	case irAdd, irSub, irMul, irAnd, irOr, irXor:
+		fn.set(i.dst, "(V) ((uintptr_t) %v %v (uintptr_t) %v)", fn.val(i.args[0]), cOps[i.op], fn.val(i.args[1]))
+
+	case irDiv, irMod:
+		fn.trap(fmt.Sprintf("%v == 0", fn.val(i.args[1])), fn.w.names[fn.w.divz], fn.site(i.pos))
+		op := "/"
+		if i.op == irMod {
+			op = "%"
+		}
+		fn.set(i.dst, "%v %v %v", fn.val(i.args[0]), op, fn.val(i.args[1])) // NOTE: 63-bit values cannot overflow
+
+	case irShl:
+		fn.set(i.dst, "(V) ((uintptr_t) %v << (%v & 63))", fn.val(i.args[0]), fn.val(i.args[1]))
+
+	case irShr:
+		fn.set(i.dst, "%v >> (%v & 63)", fn.val(i.args[0]), fn.val(i.args[1]))
+
+	case irNeg:
+		fn.set(i.dst, "(V) (0 - (uintptr_t) %v)", fn.val(i.args[0]))
+
+	case irNot:
+		fn.stmt("%v = ~%v & 1;", fn.loc(i.dst), fn.loc(i.args[0]))
+
+	case irBNot:
+		fn.stmt("%v = ~%v | %v;", fn.loc(i.dst), fn.loc(i.args[0]), tagFor(i.dst.typ.Kind)) // Keep tag
+
+	case irEq, irLt, irLte, irGt, irGte:
+		fn.stmt("%v = %v %v %v;", fn.loc(i.dst), fn.val(i.args[0]), cOps[i.op], fn.val(i.args[1]))
+
+	case irLoad:
+		fn.nullCheck(i)
+		fn.stmt("%v = *(V *) (%v + %v);", fn.loc(i.dst), fn.loc(i.args[0]), i.val)
+
+	case irStore:
+		fn.nullCheck(i)
+		fn.stmt("*(V *) (%v + %v) = %v;", fn.loc(i.args[0]), i.val, fn.loc(i.args[1]))
+
+	case irIndex, irSetIndex:
+		a, idx := fn.loc(i.args[0]), fn.val(i.args[1])
+		if !i.unchecked {
+			fn.trap(fmt.Sprintf("(uintptr_t) %v >= (uintptr_t) untag(*(V *) %v)", idx, a), fn.w.names[fn.w.ioob],
+				fmt.Sprintf("tag(%v), *(V *) %v, %v", idx, a, fn.site(i.pos)))
+		}
+		switch {
+		case i.args[0].typ.IsAny(String, Bytes):
+			fn.set(i.dst, "((unsigned char *) %v)[8 + %v]", a, idx) // Single (unsigned) byte after length
+		case i.op == irSetIndex:
+			fn.stmt("((V *) (%v + 8))[%v] = %v;", a, idx, fn.loc(i.args[2]))
+		default:
+			fn.stmt("%v = ((V *) (%v + 8))[%v];", fn.loc(i.dst), a, idx)
+		}
+
+	case irCall:
+		fn.genCall(i)
+
+	case irStackAlloc:
+		fn.stmt("%v = (V) &%v;", fn.loc(i.dst), fn.slot(fn.objects[i]))
+
+	case irCount:
+		fn.stmt("counters[%v].count++;", i.val)
+
+	case irRet:
+		v := "0"
+		if len(i.args) > 0 {
+			v = fn.loc(i.args[0])
+		}
+		if fn.linked {
+			fn.stmt("top = (V *) fr[%v];", fn.size)
+		}
+		fn.stmt("return %v;", v)
+
+	case irJmp:
+		if i.succs[0] != next {
+			fn.stmt("goto %v;", i.succs[0])
+		}
+
+	case irBr:
+		then, els := i.succs[0], i.succs[1]
+		switch {
+		case then == next:
+			fn.stmt("if (%v != 1) goto %v;", fn.loc(i.args[0]), els)
+		case els == next:
+			fn.stmt("if (%v == 1) goto %v;", fn.loc(i.args[0]), then)
+		default:
+			fn.stmt("if (%v == 1) goto %v; else goto %v;", fn.loc(i.args[0]), then, els)
+		}
+
+	default:
+		panic(fmt.Sprintf("Can't generate code for IR op: %v", irOpNames[i.op]))
+	}
+}
+
+func (fn *cFunc) genCall(i *irInstr) {
+
+	// Determine how function is referenced
+	args := i.args
+	var callee string
+	if i.sym == nil {
+		callee = fmt.Sprintf("((V (*)(%v)) *(V *) %v)", cParams(len(args)-1), fn.loc(args[0]))
+		args = args[1:]
+	} else if i.fn.Is(External) {
+		callee = i.sym.Name
+		if _, ok := cBuiltins[callee]; !ok {
+			fn.w.externs[callee] = i.fn
+		}
+	} else {
+		callee = fn.w.names[i.fn.AsmName(i.sym.Name)]
+	}
+
+	// NOTE: Functions called through values may take fewer parameters than the arguments forwarded by invokeDynamic().
+	// This is harmless under the C calling convention as the caller removes the arguments.
+
+	// Create "raw" values for any external functions which require them
+	raw := i.fn.Is(External) && i.fn.RawValues
+	var vals []string
+	for _, arg := range args {
+		switch {
+		case raw && arg.typ.IsAny(String, Array, Bytes):
+			vals = append(vals, fmt.Sprintf("%v + 8", fn.loc(arg))) // Point past length
+		case raw && arg.typ.IsAny(Integer, Byte):
+			vals = append(vals, fn.val(arg))
+		default:
+			vals = append(vals, fn.loc(arg))
+		}
+	}
+	if i.sym != nil && !i.fn.Is(External) {
+		for len(vals) < fn.w.arity[i.fn.AsmName(i.sym.Name)] {
+			vals = append(vals, "0") // Unused by callee. See: invokeDynamic()
+		}
+	}
+
+	// Only Clara functions record the caller's GC map
+	if !i.fn.Is(External) {
+		fn.stmt("fr[%v] = (V) %v;", fn.size+2, fn.w.gcMap(fn.roots[i], fn.site(i.pos)))
+	}
+	call := fmt.Sprintf("%v(%v)", callee, strings.Join(vals, ", "))
+	switch {
+	case i.dst == nil:
+		fn.stmt("%v;", call)
+	case raw && i.fn.ret.IsAny(Integer, Byte):
+		fn.set(i.dst, "%v", call)
+	default:
+		fn.stmt("%v = %v;", fn.loc(i.dst), call)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Interns a (quoted) string literal, returning its name
+func (cw *cWriter) stringLit(s string) string {
+	raw, err := strconv.Unquote(s)
+	if err != nil {
+		panic(err)
+	}
+	return cw.literal(raw)
+}
+
+func (cw *cWriter) literal(raw string) string {
+	if name, ok := cw.literals[raw]; ok {
+		return name
+	}
+	name := fmt.Sprintf("lc%v", len(cw.literals))
+	cw.literals[raw] = name
+	fmt.Fprintf(&cw.data, "static const struct { V header; V len; char s[%v]; } %v = { %v, %v, %v };\n",
+		len(raw)+1, name, cInt((readOnlyGcHeader(4)<<1)|1), cInt((len(raw)<<1)|1), cString(raw))
+	return name
+}
+
+// Read-only descriptor of a function value, returning its name
+func (cw *cWriter) descriptor(asmName string) string {
+	if name, ok := cw.descs[asmName]; ok {
+		return name
+	}
+	name := fmt.Sprintf("fd%v", len(cw.descs))
+	cw.descs[asmName] = name
+	fmt.Fprintf(&cw.data, "static const V %v[] = { %v, (V) &%v };\n", name, cInt((readOnlyGcHeader(5)<<1)|1), cw.names[asmName])
+	return name
+}
+
+// GC map of a call, preceded by its address relative to the map's own address & its site (See: runtime.c)
+func (cw *cWriter) gcMap(slots []int, site string) string {
+	name := fmt.Sprintf("gm%v", cw.maps)
+	cw.maps++
+	fmt.Fprintf(&cw.data, "static const V %v[] = { 16, %v, %v };\n", name, site, cTaggedInts(slots))
+	return name
+}
+
+// Read-only call site (See: callSite in runtime.clara), returning its value
+func (cw *cWriter) site(s callSite) string {
+	if v, ok := cw.sites[s]; ok {
+		return v
+	}
+	name := fmt.Sprintf("cs%v", len(cw.sites))
+	fmt.Fprintf(&cw.data, "static const V %v[] = { %v, (V) &%v.len, (V) &%v.len };\n", name, cInt((2<<1)|1),
+		cw.stringLit(s.fn), cw.stringLit(s.loc))
+	cw.sites[s] = fmt.Sprintf("(V) &%v[1]", name)
+	return cw.sites[s]
+}
+
+func (fn *cFunc) site(pos *lex.Token) string { return fn.w.site(siteOf(fn.f, pos)) }
+
+func (cw *cWriter) genTypeInfoTable(gt *GcTypes) {
+
+	var roots []string
+	for i, r := range gt.roots() {
+		name := fmt.Sprintf("tr%v", i)
+		fmt.Fprintf(&cw.data, "static const V %v[] = { %v };\n", name, cTaggedInts(r.offsets))
+		roots = append(roots, name)
+	}
+
+	// NOTE: The IDs used here must match the enum definition in gc.clara!
+	var infos []string
+	for i, t := range gt.types {
+		name := fmt.Sprintf("ti%v", i)
+		vals := []string{cInt((2 << 1) | 1)} // "Read-only" GC header
+		switch t.Kind {
+		case Struct, Enum:
+			vals = append(vals, cInt(1), cw.typeName(t), fmt.Sprintf("(V) %v", roots[i]))
+		case String:
+			vals = append(vals, cInt(3))
+		case Array:
+			elemIsPointer := "0"
+			if t.AsArray().Elem.IsPointer() {
+				elemIsPointer = "1"
+			}
+			vals = append(vals, cInt(5), cw.typeName(t), elemIsPointer)
+		case Function:
+			vals = append(vals, cInt(7))
+		case Bytes:
+			vals = append(vals, cInt(9))
+		}
+		fmt.Fprintf(&cw.data, "static const V %v[] = { %v };\n", name, strings.Join(vals, ", "))
+		infos = append(infos, fmt.Sprintf("(V) &%v[1]", name))
+	}
+	fmt.Fprintf(&cw.data, "static V typeInfoArray[] = { %v, %v, %v };\n", cInt((2<<1)|1), cInt((len(infos)<<1)|1),
+		strings.Join(infos, ", "))
+}
+
+func (cw *cWriter) typeName(t *Type) string {
+	return fmt.Sprintf("(V) &%v.len", cw.literal(t.String()))
+}
+
+// Counters read by writeProfile() (See: runtime.c) on exit. The table is empty when the program is not instrumented.
+func (cw *cWriter) genProfileTable(counters []blockCounter, path string) {
+	w := &cw.data
+	fmt.Fprintf(w, "struct counter { char *fn; V block; V count; };\n")
+	table := "0"
+	if len(counters) > 0 {
+		var cs []string
+		for _, c := range counters {
+			cs = append(cs, fmt.Sprintf("{ %v, %v, 0 }", cString(c.fn), c.block))
+		}
+		fmt.Fprintf(w, "static struct counter counters[] = { %v };\n", strings.Join(cs, ", "))
+		table = "counters"
+	}
+	fmt.Fprintf(w, "struct { V size; char *path; struct counter *counters; } %v = { %v, %v, %v };\n",
+		fnPrefix+"profile", len(counters), cString(path), table)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func cTemp(t *irTemp) string {
+	return "t" + strconv.Itoa(t.id)
+}
+
+func cExternParams(ft *FunctionType) string {
+	if ft.isVariadic {
+		return cParams(len(ft.Params)) + ", ..." // NOTE: Variadic functions always declare a named parameter
+	}
+	return cParams(len(ft.Params))
+}
+
+func cParams(n int) string {
+	if n == 0 {
+		return "void"
+	}
+	return strings.TrimSuffix(strings.Repeat("V, ", n), ", ")
+}
+
+func cTaggedInts(is []int) string {
+	vals := []string{cInt((len(is) << 1) | 1)}
+	for _, i := range is {
+		vals = append(vals, cInt((i<<1)|1))
+	}
+	return strings.Join(vals, ", ")
+}
+
+func cInt(i int) string {
+	if i == math.MinInt64 {
+		return "(-9223372036854775807 - 1)" // Not representable as a literal
+	}
+	return strconv.Itoa(i)
+}
+
+// Escapes all but printable ASCII. NOTE: '?' is escaped to avoid trigraphs.
+func cString(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for _, b := range []byte(s) {
+		if b < ' ' || b > '~' || b == '"' || b == '\\' || b == '?' {
+			fmt.Fprintf(&buf, "\\%03o", b)
+		} else {
+			buf.WriteByte(b)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// Readable C identifier for an asm name. NOTE: May not be unique so is always prefixed by the caller.
+func cIdent(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -21,15 +21,15 @@ func rewriteAnonFnAndClosures(rootNode *Node, n *Node) {
 			// ----------------------------------------------------------
 
 			// Generate closure & environment structs
-			env, envCons := generateStruct(rootNode, fmt.Sprintf("env.%X", id), freeVars...)
-			_, clCons := generateStruct(rootNode, fmt.Sprintf("cl.%X", id), n.sym, env)
+			env, envCons := generateStruct(rootNode, fmt.Sprintf("env.%d", id), freeVars...)
+			_, clCons := generateStruct(rootNode, fmt.Sprintf("cl.%d", id), n.sym, env)
 
 			// Rewrite <freevar> -> env.<freevar>
 			clRewriteFreeVars(n, env, freeVars)
 
 			// Hoist function to root & rename
 			clFn := copyNode(n)
-			clFn.token = lex.WithVal(clFn.token, fmt.Sprintf("clFn.%X", id))
+			clFn.token = lex.WithVal(clFn.token, fmt.Sprintf("clFn.%d", id))
 			clFn.sym.Name = clFn.token.Val
 			clFn.sym.IsGlobal = true
 			rootNode.Add(clFn)
@@ -66,7 +66,7 @@ func rewriteAnonFnAndClosures(rootNode *Node, n *Node) {
 
 			// Hoist function to root & rename
 			fn := copyNode(n)
-			fn.token = lex.WithVal(fn.token, fmt.Sprintf("anonFn.%X", id))
+			fn.token = lex.WithVal(fn.token, fmt.Sprintf("anonFn.%d", id))
 			fn.sym.IsGlobal = true
 			rootNode.Add(fn)
 
@@ -161,10 +161,10 @@ func (fc *freeVarChecker) IdentityFreeVars(n *Node) bool {
 	case n.Is(opIdentifier) && fc.isFree(n):
 		fc.free[n.sym] = true
 
-	case n.Is(opDot, opArray) && n.left.Is(opIdentifier):
-		if fc.isFree(n.left) {
-			fc.free[n.left.sym] = true
-		}
+	case n.Is(opDot):
+		// Right selects a field so only the left can reference a free variable
+		WalkPreOrder(n.left, fc.IdentityFreeVars)
+		fc.exitNode()
 		return false // No need to walk right!
 
 	case n.Is(opBlockFnDcl, opExprFnDcl) && n != fc.n:
@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"github.com/g-dx/clarac/lex"
 	"math"
 	"strconv"
+	"strings"
 )
 
 /*
@@ -18,107 +21,201 @@ import (
 
   https://en.wikipedia.org/wiki/X86_calling_conventions#System_V_AMD64_ABI
 
+ Clara calling convention:
+ -------------------------
+ Follows the above so external functions can be called directly & Clara functions can be called from C:
+ - Parameters passed in RDI, RSI, RDX, RCX, R8, R9. Remaining parameters are pushed RTL so the 7th is at 16(%rbp)
+   in the callee. The caller pads the stack to keep it 16-byte aligned at the call & removes the parameters after.
+ - Result returned in RAX.
+ - Callee restores RBP & R12–R15. RBX is used as scratch within Clara code so is restored by clara_asm_entrypoint
+   on return to C.
+ - Integers & bytes are passed tagged. Functions declared #[RawValues] instead receive untagged integers & pointers
+   to the data of strings, arrays & bytes and return an untagged integer.
+ - Each call to a Clara function is immediately followed by the address of the caller's GC map for the call,
+   relative to the word itself. Clara functions return past it, except #[ExtRet] functions which are called from C.
+   Each map is preceded by the address of the call's site for backtraces.
+ - Code is position independent. Globals & literals are addressed relative to RIP.
+ - RBP is the frame pointer & frames are walked by the GC & panics. With -fomit-frame-pointer functions which make no
+   calls & contain no runtime checks address their frame relative to RSP (using the red zone when small enough) & may
+   allocate RBP.
+
 */
 
 var noGc = labelOp("_noGc")
 
 var regs = []reg{rdi, rsi, rdx, rcx, r8, r9}
 
+const redZoneSize = 128 // Bytes below rsp which leaf functions may use without adjusting it
+
+// Location of a parameter passed on the stack, i.e. the 7th onwards
+func (f *function) stackParam(i int) memOp {
+	if f.omitFp {
+		return rsp.displace(f.frameSize + ptrSize + (i-len(regs))*ptrSize) // Above return address
+	}
+	return rbp.displace(2*ptrSize + (i-len(regs))*ptrSize)
+}
+
 // Current function being compiled
 type function struct {
-	attrs   attributes
-	AstName string
-	Type    *FunctionType
-	gcRoots *GcState
-	gcMaps  map[string]GcRoots
-	id      int
-	sp      int
-	reg     [][]*Type // Stack to track register types in use across calls
-}
-
-func (f *function) reset(n *Node) {
-	f.attrs = n.attrs
-	f.AstName = n.sym.Name
-	f.Type = n.sym.Type.AsFunction()
-	f.gcRoots = &GcState{}
-	f.gcMaps = make(map[string]GcRoots)
-	f.sp = 0
-	f.reg = nil
-}
-func (f *function) incSp(i int) { f.sp += i }
-func (f *function) decSp(i int) { f.sp -= i }
-func (f *function) isSpAligned() bool { return f.sp % 2 == 0 }
-
-func (f *function) AsmName() string {
-	return f.Type.AsmName(f.AstName)
-}
-
-func (f *function) NewGcMap() operand {
-	roots := f.gcRoots.Snapshot()
-	if len(roots) == 0 {
-		return noGc
-	}
-	name := fmt.Sprintf(".SM%v", f.id)
-	f.gcMaps[name] = roots
-	f.id += 1
+	*irFunc
+	labels map[*irBlock]string
+	roots  map[*irInstr][]int // Stack slots of pointers live across each call
+	consts map[*irTemp]int    // Integer temps with a known value
+	alloc  *allocation
+	gcMaps []gcMap
+	traps  []trapStub
+	sites  map[callSite]labelOp
+	order  []callSite // Of sites, as first referenced
+	id     *int
+
+	omitFp    bool // Slots are addressed relative to rsp
+	frameSize int  // Bytes subtracted from rsp on entry when the frame pointer is omitted
+
+	sources map[string][]string // Lines of each source file, loaded as required
+	lines   bool                // Emit source positions for debuggers
+}
+
+type gcMap struct {
+	name  string
+	slots []int
+	site  labelOp
+}
+
+// Out of line code which loads the call site of a failed check into reg before jumping to a trampoline
+type trapStub struct {
+	name, trampoline string
+	site             labelOp
+	reg              reg
+}
+
+func (f *function) NewTrap(trampoline string, pos *lex.Token, r reg) operand {
+	name := fmt.Sprintf(".L%v%v", trampoline, *f.id)
+	*f.id += 1
+	f.traps = append(f.traps, trapStub{name, trampoline, f.NewSite(pos), r})
 	return labelOp(name)
 }
 
-func (f *function) SpillRegisters(asm asmWriter) {
-	// Spill any in-use registers to stack
-	if len(f.reg) > 0 {
-		call := f.reg[len(f.reg)-1]
-		for i := len(call)-1; i >=0; i-- {
-			asm.ins(pushq, regs[i])
-			f.incSp(1)
-			f.gcRoots.Add(f.sp * ptrSize, call[i])
-		}
+// GC map of a call, preceded by the address of its call site. Every call has its own map so backtraces may report it.
+func (f *function) NewGcMap(i *irInstr) operand {
+	name := fmt.Sprintf(".SM%v", *f.id)
+	*f.id += 1
+	f.gcMaps = append(f.gcMaps, gcMap{name, f.roots[i], f.NewSite(i.pos)})
+	return labelOp(name)
+}
+
+func (f *function) NewSite(pos *lex.Token) labelOp {
+	s := siteOf(f.irFunc, pos)
+	if label, ok := f.sites[s]; ok {
+		return label
 	}
-	// Track new register set
-	f.reg = append(f.reg, []*Type(nil))
+	label := labelOp(fmt.Sprintf(".CS%v", *f.id))
+	*f.id += 1
+	f.sites[s] = label
+	f.order = append(f.order, s)
+	return label
 }
 
-func (f *function) RestoreRegisters(asm asmWriter) {
-	// Remove register tracking
-	f.reg = f.reg[:len(f.reg)-1]
+// Location of a temp: either a register or a stack slot
+func (f *function) loc(t *irTemp) operand {
+	if r, ok := f.alloc.regs[t]; ok {
+		return r
+	}
+	return f.slot(f.alloc.slots[t])
+}
 
-	// Restore previous register values from stack
-	if len(f.reg) > 0 {
-		call := f.reg[len(f.reg)-1]
-		for i := 0; i < len(call); i++ {
-			asm.ins(popq, regs[i])
-			f.gcRoots.Remove(f.sp * ptrSize, call[i])
-			f.decSp(1)
-		}
+// Stack slot relative to the frame pointer or, when omitted, the stack pointer
+func (f *function) slot(i int) memOp {
+	if f.omitFp {
+		return rsp.displace(f.frameSize - ptrSize*i)
 	}
+	return slot(i)
 }
 
-func (f *function) RegisterInUse(t *Type) {
-	f.reg[(len(f.reg)-1)] = append(f.reg[(len(f.reg)-1)], t)
+func slot(i int) memOp {
+	return rbp.displace(-ptrSize * i)
 }
 
-func codegen(symtab *SymTab, tree []*Node, asm asmWriter) error {
+// Temp in a register, loading into the given scratch register if required
+func (f *function) inReg(asm asmWriter, t *irTemp, scratch reg) reg {
+	if r, ok := f.alloc.regs[t]; ok {
+		return r
+	}
+	asm.ins(movq, f.loc(t), scratch)
+	return scratch
+}
 
-	// ---------------------------------------------------------------------------------------
-	// Assembly Generation Start
-	// ---------------------------------------------------------------------------------------
+// Copies between locations, going via rax if both are in memory
+func move(asm asmWriter, src operand, dst operand) {
+	switch {
+	case src == dst:
+	case mem(src) && mem(dst):
+		asm.ins(movq, src, rax)
+		asm.ins(movq, rax, dst)
+	default:
+		asm.ins(movq, src, dst)
+	}
+}
+
+// Moves values into registers "simultaneously", breaking any cycles via rax
+func parallelMove(asm asmWriter, dsts []reg, srcs []operand) {
+	type mv struct {
+		dst reg
+		src operand
+	}
+	var pending []mv
+	for j := range dsts {
+		if srcs[j] != dsts[j] {
+			pending = append(pending, mv{dsts[j], srcs[j]})
+		}
+	}
+	for len(pending) > 0 {
+		// Find a move whose destination is not needed by any other
+		j := 0
+		for ; j < len(pending); j++ {
+			blocked := false
+			for k, m := range pending {
+				if k != j && m.src == pending[j].dst {
+					blocked = true
+					break
+				}
+			}
+			if !blocked {
+				break
+			}
+		}
+		if j == len(pending) {
+			// Every destination is a source: save first destination and read it from rax instead
+			j = 0
+			asm.ins(movq, pending[0].dst, rax)
+			for k := range pending {
+				if pending[k].src == pending[0].dst {
+					pending[k].src = rax
+				}
+			}
+		}
+		asm.ins(movq, pending[j].src, pending[j].dst)
+		pending = append(pending[:j], pending[j+1:]...)
+	}
+}
 
-	// Runtime functions declared in Clara code
-	ioob := symtab.MustResolve("indexOutOfBounds")
-	alloc := symtab.MustResolve("claralloc")
-	entrypoint := symtab.MustResolve("entrypoint")
+// Textual x64 assembly for GAS, linked by gcc
+type x64Backend struct {
+	syntax syntax
+	debug  bool // Echo assembly as it is written
+	omitFp bool // Omit the frame pointer in leaf functions
+	lines  bool // Emit DWARF line information
+}
 
-	// Holds compilation state for current function
-	fn := &function{}
+func (be *x64Backend) ext() string  { return ".S" }
+func (be *x64Backend) native() bool { return true }
 
-	gt := &GcTypes{}
-	gt.AddBuiltins(symtab)
+func (be *x64Backend) lower(prog *irProgram, out io.Writer) error {
 
-	for _, n := range tree {
-		if n.isFuncDcl() {
-			fn.reset(n)
-			genFunc(asm, n, fn, gt, alloc)
-		}
+	asm := NewOptimiser(NewGasWriter(out, be.debug, be.syntax))
+	id := 0
+	sources := make(map[string][]string)
+	for _, f := range prog.fns {
+		genFunc(asm, f, &id, sources, be.omitFp && f.isLeaf() && !f.hasTraps(), be.lines)
 	}
 
 	// Raw memory access
@@ -130,7 +227,21 @@ func codegen(symtab *SymTab, tree []*Node, asm asmWriter) error {
 	asm.spacer()
 	genWrite(asm, "Int", 8)
 	asm.spacer()
-	genIoobTrampoline(asm, fnOp(ioob.Type.AsFunction().AsmName(ioob.Name)))
+
+	// Atomics
+	genAtomicLoad(asm)
+	asm.spacer()
+	genAtomicStore(asm)
+	asm.spacer()
+	genAtomicAdd(asm)
+	asm.spacer()
+	genCompareAndSwap(asm)
+	asm.spacer()
+	genIoobTrampoline(asm, fnOp(prog.ioob))
+	asm.spacer()
+	genDivzTrampoline(asm, fnOp(prog.divz))
+	asm.spacer()
+	genNullpTrampoline(asm, fnOp(prog.nullp))
 	asm.spacer()
 	genFramePointerAccess(asm)
 	asm.spacer()
@@ -140,139 +251,229 @@ func codegen(symtab *SymTab, tree []*Node, asm asmWriter) error {
 	asm.spacer()
 	genToUntaggedInt(asm)
 	asm.spacer()
-	genAsmEntrypoint(asm, fnOp(entrypoint.Type.AsFunction().AsmName(entrypoint.Name)))
+	genAsmEntrypoint(asm, fnOp(prog.entrypoint))
+	asm.spacer()
+	genThreadTrampoline(asm, fnOp(prog.threadEntry))
 	asm.spacer()
+	for _, e := range prog.exports {
+		genExportTrampoline(asm, e)
+		asm.spacer()
+	}
 	genNoGc(asm)
 	asm.spacer()
-	genTypeInfoTable(asm, gt)
+	genTypeInfoTable(asm, prog.gt)
+	asm.spacer()
+	genProfileTable(asm, prog.counters, prog.profileOut)
 	asm.spacer()
 	asm.flush() // Write final values
 	return nil
 }
 
-func genFunc(asm asmWriter, n *Node, fn *function, gt *GcTypes, alloc *Symbol) {
-
-	// Ensure we only generate code for "our" functions
-	if !fn.Type.Is(External) {
-
-		// Assign stack offsets for temporaries
-		temps := len(fn.Type.Params)
-		WalkPostOrder(n, func(n *Node) {
-			// Look for symbols which should be on the stack but have no address
-			if n.sym != nil && n.sym.IsStack && n.sym.Addr == 0 {
-				n.sym.Addr = ptrSize * (temps + 1) // Assign a stack slot for temporary
-				temps++
+// Position of the first statement (if any)
+func (f *irFunc) firstPos() *lex.Token {
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.pos != nil {
+				return i.pos
 			}
-		})
-
-		// Generate standard entry sequence
-		fn.incSp(genFnEntry(asm, fn.AsmName(), temps))
-
-		// Copy register values into stack slots
-		for i, param := range n.params {
-			addr := ptrSize * (i + 1) // Assign a stack slot for var
-			param.sym.Addr = addr
-			param.sym.IsStack = true
-			asm.ins(movq, regs[i], rbp.displace(-addr))
-			fn.gcRoots.Add(addr, param.typ)
-		}
-
-		// Generate functions
-		switch fn.Type.Kind {
-		case StructCons, EnumCons:
-			genConstructor(asm, fn, n.params, n.token.Val, gt.AssignId(fn.Type.ret), alloc)
-		case Normal, Closure:
-			switch n.op {
-			case opBlockFnDcl:
-				genStmtList(asm, n.stmts, fn)
-				if fn.Type.ret.Is(Nothing) && !n.IsReturnLastStmt() {
-					genFnExit(asm, fn.attrs.isExternalReturn())
-				}
-			case opExprFnDcl:
-				genReturnStmt(asm, n.stmts[0], fn)
+		}
+	}
+	return nil
+}
+
+// Functions which make no calls. The GC only walks frames of functions which are part of a call chain & so these
+// may omit the frame pointer.
+func (f *irFunc) isLeaf() bool {
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.op == irCall {
+				return false
 			}
-		case External:
-			panic(fmt.Sprintf("Cannot generate code for external functions"))
 		}
+	}
+	return true
+}
 
-		// Generate function GC maps
-		asm.spacer()
-		asm.tab(".data")
-		for name, roots := range fn.gcMaps {
-			var off []int
-			for _, root := range roots {
-				off = append(off, root.off/ptrSize)
+// Reports if the function may call out of bounds, division by zero or null dereference handling code. These expect a
+// frame pointer & the function's frame to be linked so backtraces include it.
+func (f *irFunc) hasTraps() bool {
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if ((i.op == irIndex || i.op == irSetIndex) && !i.unchecked) || i.op == irDiv || i.op == irMod || i.isNullChecked() {
+				return true
 			}
-			asm.gcMap(name, off)
 		}
 	}
+	return false
 }
 
-func genTypeInfoTable(asm asmWriter, gt *GcTypes) {
+func genFunc(asm asmWriter, f *irFunc, id *int, sources map[string][]string, omitFp bool, lines bool) {
 
-	asm.raw(".data")
-	var roots []labelOp // Collect root maps to output at next stage
-	tag := 0
-	var et *Type
-	for _, t := range gt.types {
-		switch t.Kind {
-		case String, Array, Bytes, Function:
-			roots = append(roots, noGc)
-			tag = 0
-		case Struct:
-
-			// Gather field offsets
-			var off []int
-			for _, f := range t.AsStruct().Fields {
-				if f.Type.IsPointer() {
-					off = append(off, f.Addr/ptrSize)
-				}
+	fn := &function{irFunc: f, labels: make(map[*irBlock]string), roots: make(map[*irInstr][]int), consts: make(map[*irTemp]int), sites: make(map[callSite]labelOp), id: id, omitFp: omitFp, sources: sources, lines: lines}
+	in, out := f.liveness()
+	preserved := calleeSaved
+	if omitFp {
+		preserved = append(append([]reg(nil), calleeSaved...), rbp)
+	}
+	fn.alloc = allocateRegisters(f, in, out, preserved)
+	for _, b := range f.blocks {
+		fn.labels[b] = asm.newLabel("bb")
+		for _, i := range b.instrs {
+			if i.op == irConst && i.dst.typ.IsAny(Integer, Byte) {
+				fn.consts[i.dst] = i.val // NOTE: Constants are only ever assigned once
 			}
+		}
+	}
 
-			// Skip if no pointers
-			if len(off) == 0 {
-				roots = append(roots, noGc)
-				continue
+	// Pointer fields of stack allocated structs are always roots. They are cleared on entry so may be scanned before
+	// the struct is created.
+	var objects []*irInstr
+	var objectRoots []int
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if s, ok := fn.alloc.objects[i]; ok {
+				objects = append(objects, i)
+				for j, field := range i.dst.typ.AsStruct().Fields {
+					if field.Type.IsPointer() {
+						objectRoots = append(objectRoots, s-j)
+					}
+				}
 			}
+		}
+	}
 
-			// Output GC map
-			roots = append(roots, asm.gcMap("struct_" + t.AsmName(), off))
-			tag = 0
-
-		case Enum:
-			// TODO: Clean this up!
-			// HACK! HACk!
-			if t != et {
-				et = nil
-				tag = 0
+	// Record pointers live across each call so the GC can find them. NOTE: Such pointers are never allocated registers.
+	for _, b := range f.blocks {
+		live := out[b.id].copy()
+		for j := len(b.instrs) - 1; j >= 0; j-- {
+			i := b.instrs[j]
+			if i.dst != nil {
+				live.remove(i.dst)
+			}
+			if i.op == irCall {
+				for _, t := range f.temps {
+					if live.has(t) && t.typ.IsPointer() {
+						fn.roots[i] = append(fn.roots[i], fn.alloc.slots[t])
+					}
+				}
+				fn.roots[i] = append(fn.roots[i], objectRoots...)
 			}
-			et = t
-			cons := t.AsEnum().Members[tag]
-			if cons.AsEnumCons().Tag != tag {
-				panic("out of order!")
+			for _, arg := range i.args {
+				live.add(arg)
 			}
+		}
+	}
+
+	// Attribute the entry sequence to the function's first statement rather than whatever preceded it
+	if lines {
+		if pos := f.firstPos(); pos != nil {
+			asm.loc(pos.File, pos.Line, pos.Pos)
+		}
+	}
+	// Generate standard entry sequence. Without a frame pointer small frames fit in the red zone below rsp
+	if omitFp {
+		if fn.alloc.size*ptrSize > redZoneSize {
+			fn.frameSize = fn.alloc.size * ptrSize
+		}
+		asm.fnStart(f.name)
+		if fn.frameSize > 0 {
+			asm.ins(subq, intOp(fn.frameSize), rsp)
+		}
+	} else {
+		genFnEntry(asm, f.name, fn.alloc.size)
+	}
+	for j, r := range fn.alloc.saved {
+		asm.ins(movq, r, fn.slot(fn.alloc.savedSlot(j)))
+	}
 
-			// Gather field offsets
-			var off []int
-			for i, tp := range cons.Params {
-				if tp.IsPointer() {
-					off = append(off, i + 1) // Skip tag!
+	// Copy parameters from registers into their locations. Spilled parameters can be copied directly but those
+	// allocated registers may overlap with the parameter registers. Parameters passed on the stack are copied once
+	// every parameter register has been read.
+	var dsts []reg
+	var srcs []operand
+	for i, param := range f.params {
+		if i >= len(regs) {
+			break
+		}
+		if r, ok := fn.alloc.regs[param]; ok {
+			dsts = append(dsts, r)
+			srcs = append(srcs, regs[i])
+		} else {
+			asm.ins(movq, regs[i], fn.loc(param))
+		}
+	}
+	parallelMove(asm, dsts, srcs)
+	for i := len(regs); i < len(f.params); i++ {
+		move(asm, fn.stackParam(i), fn.loc(f.params[i]))
+	}
+
+	// Initialise stack allocated structs with a read-only header so the GC does not attempt to mark them
+	for _, i := range objects {
+		asm.ins(movabs, intOp((readOnlyGcHeader(i.val)<<1)|1), rax) // Headers are tagged
+		asm.ins(movq, rax, fn.slot(fn.alloc.objects[i]+1))
+	}
+	for _, s := range objectRoots {
+		asm.ins(movq, _false, fn.slot(s))
+	}
+
+	// Clear any pointers which may be live before they are assigned
+	for _, t := range f.temps[len(f.params):] {
+		if in[0].has(t) && t.typ.IsPointer() {
+			asm.ins(movq, _false, fn.loc(t))
+		}
+	}
+
+	// Generate blocks in order, falling through where possible. Each statement is preceded by its source line.
+	var pos *lex.Token
+	for j, b := range f.blocks {
+		var next *irBlock
+		if j+1 < len(f.blocks) {
+			next = f.blocks[j+1]
+		}
+		asm.label(fn.labels[b])
+		for _, i := range b.instrs {
+			if i.pos != nil && (pos == nil || i.pos.Line != pos.Line || i.pos.File != pos.File) {
+				pos = i.pos
+				if line, ok := sourceLine(pos, fn.sources); ok {
+					asm.comment(fmt.Sprintf("%v:%v  %v", pos.File, pos.Line, strings.TrimSpace(line)))
+				}
+				if fn.lines {
+					asm.loc(pos.File, pos.Line, pos.Pos)
 				}
 			}
+			genInstr(asm, fn, i, next)
+		}
+	}
+	for _, t := range fn.traps {
+		asm.label(t.name)
+		asm.ins(leaq, rip(t.site), t.reg)
+		asm.ins(jmp, labelOp(t.trampoline))
+	}
 
-			// Skip if no pointers
-			if len(off) == 0 {
-				roots = append(roots, noGc)
-				tag += 1
-				continue
-			}
+	// Generate function GC maps & call sites
+	asm.spacer()
+	asm.tab(".data")
+	for _, m := range fn.gcMaps {
+		asm.addr(m.site)
+		asm.gcMap(m.name, m.slots)
+	}
+	for _, s := range fn.order {
+		asm.taggedInt(2) // "Read-only" GC header
+		asm.label(string(fn.sites[s]))
+		asm.addr(asm.stringLit(s.fn))
+		asm.addr(asm.stringLit(s.loc))
+	}
+}
 
-			// Output GC map
-			roots = append(roots, asm.gcMap(fmt.Sprintf("enum_%v_tag_%v", t.AsmName(),  tag), off))
-			tag += 1
+func genTypeInfoTable(asm asmWriter, gt *GcTypes) {
 
-		default:
-			panic(fmt.Sprintf("Unexpected type for GC: %v (%v)\n", t.AsmName(), typeKindNames[t.Kind]))
+	asm.raw(".data")
+	var roots []labelOp // Collect root maps to output at next stage
+	for _, r := range gt.roots() {
+		if len(r.offsets) == 0 {
+			roots = append(roots, noGc) // Skip if no pointers
+		} else {
+			roots = append(roots, asm.gcMap(r.name, r.offsets))
 		}
 	}
 
@@ -280,20 +481,19 @@ func genTypeInfoTable(asm asmWriter, gt *GcTypes) {
 	var infos []operand
 	for i, t := range gt.types {
 		infos = append(infos, asm.roSymbol("typeInfo_"+strconv.Itoa(i), func(w asmWriter) {
-			// TODO: Hack! Find a better way of returning a label to a string literal
-			s := []byte(w.stringLit(fmt.Sprintf("\"%v\"", t)).Print())
+			name := w.stringLit(fmt.Sprintf("\"%v\"", t))
 
 			// NOTE: The IDs used here must match the enum definition in gc.clara!
 			switch t.Kind {
 			case Struct, Enum:
 				w.taggedInt(0)
-				w.addr(labelOp(s[1:])) // TODO: Clean this up!
+				w.addr(name)
 				w.addr(roots[i])
 			case String:
 				w.taggedInt(1)
 			case Array:
 				w.taggedInt(2)
-				w.addr(labelOp(s[1:])) // TODO: Clean this up!
+				w.addr(name)
 				elemIsPointer := "0x0"
 				if t.AsArray().Elem.IsPointer() {
 					elemIsPointer = "0x1"
@@ -318,7 +518,7 @@ func genTypeInfoTable(asm asmWriter, gt *GcTypes) {
 	// typeInfoTable()
 	asm.spacer()
 	genFnEntry(asm, "typeInfoTable", 0)
-	asm.ins(movabs, typeInfoArray, rax)
+	asm.ins(leaq, rip(typeInfoArray), rax)
 	genFnExit(asm, true) // NOTE: Defined in Clara code as external function so no GC
 }
 
@@ -347,6 +547,38 @@ func genWrite(asm asmWriter, suffix string, scale int) {
 	genFnExit(asm, true) // NOTE: Defined in Clara code as external function so no GC
 }
 
+// Atomic operations on the value of an atomic (See: atomic.clara). Values are stored tagged so need no conversion. x64
+// loads are atomic & a locked instruction (xchg is implicitly locked) orders each update with all other memory accesses.
+func genAtomicLoad(asm asmWriter) {
+	genFnEntry(asm, "atomicLoad", 0) // NOTE: Lie! This function takes 1 parameter!
+	asm.ins(movq, rdi.deref(), rax)
+	genFnExit(asm, true) // NOTE: Defined in Clara code as external function so no GC
+}
+
+func genAtomicStore(asm asmWriter) {
+	genFnEntry(asm, "atomicStore", 0) // NOTE: Lie! This function takes 2 parameters!
+	asm.ins(xchgq, rsi, rdi.deref())
+	genFnExit(asm, true) // NOTE: Defined in Clara code as external function so no GC
+}
+
+func genAtomicAdd(asm asmWriter) {
+	genFnEntry(asm, "atomicAdd", 0) // NOTE: Lie! This function takes 2 parameters!
+	asm.ins(leaq, rsi.displace(-1), rax) // Strip tag from delta
+	asm.ins(movq, rax, rcx)
+	asm.ins(lockXaddq, rcx, rdi.deref())
+	asm.ins(leaq, rcx.index(rax), rax) // Old value + delta
+	genFnExit(asm, true) // NOTE: Defined in Clara code as external function so no GC
+}
+
+func genCompareAndSwap(asm asmWriter) {
+	genFnEntry(asm, "compareAndSwap", 0) // NOTE: Lie! This function takes 3 parameters!
+	asm.ins(movq, rsi, rax)
+	asm.ins(lockCmpxchgq, rdx, rdi.deref())
+	asm.ins(sete, al)
+	asm.ins(andq, _true, rax) // Clear top bits
+	genFnExit(asm, true) // NOTE: Defined in Clara code as external function so no GC
+}
+
 func genFramePointerAccess(asm asmWriter) {
 	// Requires non-standard entry & exit!
 	asm.fnStart("getFramePointer")
@@ -378,12 +610,44 @@ func genToUntaggedInt(asm asmWriter) {
 }
 
 func genAsmEntrypoint(asm asmWriter, entrypoint fnOp) {
-	genFnEntry(asm, "clara_asm_entrypoint", 0)
+	genFnEntry(asm, fnPrefix+"asm_entrypoint", 1)
+	asm.ins(movq, rbx, slot(1)) // Callee saved in C but scratch in Clara
 	tagAs(asm, Integer, rdi) // Tag argc as int
 	asm.ins(call, entrypoint)
+	asm.ins(movq, slot(1), rbx)
+	untagAs(asm, Integer, rax) // Exit status
 	genFnExit(asm, true) // NOTE: Stubbed in Clara code & called from C main() so no GC
 }
 
+// Called from C code to run a thread started by startThread() in runtime.c. The function to run is a pointer so is
+// passed as is.
+func genThreadTrampoline(asm asmWriter, entry fnOp) {
+	genFnEntry(asm, fnPrefix+"asm_threadEntry", 1)
+	asm.ins(movq, rbx, slot(1)) // Callee saved in C but scratch in Clara
+	asm.ins(call, entry)
+	asm.ins(movq, slot(1), rbx)
+	genFnExit(asm, true) // NOTE: Called from C so no GC
+}
+
+// Called from C code to invoke an exported function. See: shared.go
+func genExportTrampoline(asm asmWriter, e *export) {
+	genFnEntry(asm, e.name, 1)
+	asm.ins(movq, rbx, slot(1)) // Callee saved in C but scratch in Clara
+	for j, p := range e.params {
+		if isIntExport(p.left) {
+			tagAs(asm, Integer, regs[j])
+		} else {
+			asm.ins(andq, intOp(1), regs[j]) // Only the low byte of a C bool is defined
+		}
+	}
+	asm.ins(call, fnOp(e.asmName))
+	asm.ins(movq, slot(1), rbx)
+	if e.ret != nil && isIntExport(e.ret) {
+		untagAs(asm, Integer, rax)
+	}
+	genFnExit(asm, true)
+}
+
 func genNoGc(asm asmWriter) {
 	asm.tab(".data")
 	asm.label("_noGc")
@@ -392,19 +656,29 @@ func genNoGc(asm asmWriter) {
 }
 
 func genFnEntry(asm asmWriter, name string, temps int) int {
-	// Ensure an even number of slack slots. This means $rsp is 16 byte
-	// aligned as part of the function prologue. Wasting an extra 8-bytes
-	// of space here means less $rsp manipulation in the generated code
+	// Ensure an even number of slack slots. On entry $rsp is 8 bytes off 16 byte
+	// alignment (the return address) which pushing $rbp restores, so an even
+	// sized frame keeps it aligned at every call made by the function. Wasting
+	// an extra 8-bytes of space here means less $rsp manipulation around calls
 	if temps % 2 != 0 {
 		temps += 1
 	}
 	asm.fnStart(name)
-	asm.ins(enter, intOp(temps*8), intOp(0))
+	asm.ins(pushq, rbp)
+	asm.ins(movq, rsp, rbp)
+	if temps > 0 {
+		asm.ins(subq, intOp(temps*ptrSize), rsp)
+	}
 	return temps
 }
 
 func genFnExit(asm asmWriter, skipGc bool) {
 	asm.ins(leave)
+	genReturn(asm, skipGc)
+}
+
+// Returns to the caller. Calls from Clara code are followed by a GC map address which must be skipped.
+func genReturn(asm asmWriter, skipGc bool) {
 	if skipGc {
 		asm.ins(ret)
 	} else {
@@ -419,444 +693,341 @@ func genFnExit(asm asmWriter, skipGc bool) {
 
 func genIoobTrampoline(asm asmWriter, ioob operand) {
 
-	// rbx is index register. See: codegen.go:647
+	// rbx is index register. See: genInstr(irIndex)
 	asm.tab(".text")
 	asm.label("ioob")
 	asm.ins(andq, intOp(-16), rsp) // Destructively align stack
 	asm.ins(movq, rbx, rdi) // Load index, NOTE: Depends on current register usage!
 	tagAs(asm, Integer, rdi) // Retag index
 	asm.ins(movq, rax.deref(), rsi) // Load array length, NOTE: Depends on current register usage!
-	asm.ins(call, ioob)
+	asm.ins(call, ioob)             // NOTE: Call site already in rdx
 	// NOTE: Never returns so no need for GC word, return, etc
 }
 
-func genConstructor(asm asmWriter, f *function, params []*Node, name string, id int, alloc *Symbol) {
-
-	size := ptrSize * len(params)
-	if f.Type.Is(EnumCons) {
-		size += ptrSize // space for tag
-	}
-
-	// Malloc memory of appropriate size
-	asm.ins(movq, taggedIntOp(size), rdi)
-	asm.ins(movabs, asm.stringLit(fmt.Sprintf("\"%v\"", f.Type.Describe(name))), rsi)
-	asm.ins(movabs, taggedIntOp(id), rdx)
-	asm.ins(call, fnOp(alloc.Type.AsFunction().AsmName(alloc.Name))) // Implemented in lib/mem.clara
-	asm.addr(f.NewGcMap())
-
-	off := 0
-
-	// Set tag (if required)
-	if f.Type.Is(EnumCons) {
-		asm.ins(movq, taggedIntOp(f.Type.AsEnumCons().Tag), rax.displace(off))
-		off += ptrSize
-	}
+func genNullpTrampoline(asm asmWriter, nullp operand) {
+	asm.tab(".text")
+	asm.label("nullp")
+	asm.ins(andq, intOp(-16), rsp) // Destructively align stack
+	asm.ins(call, nullp)           // NOTE: Call site already in rdi
+	// NOTE: Never returns so no need for GC word, return, etc
+}
 
-	// Copy stack values into fields
-	for _, param := range params {
-		id := param.sym
-		// Can't move mem -> mem. Must go through a register.
-		asm.ins(movq, rbp.displace(-id.Addr), rbx)
-		asm.ins(movq, rbx, rax.displace(off))
-		off += ptrSize
+// Checks the struct of a field access is non-null
+func genNullCheck(asm asmWriter, fn *function, i *irInstr, p reg) {
+	if i.isNullChecked() {
+		asm.ins(cmpq, intOp(0), p)
+		asm.ins(je, fn.NewTrap("nullp", i.pos, rdi)) // NOTE: Expects call site in rdi
 	}
+}
 
-	// Pointer is already in rax so nothing to do...
-	genFnExit(asm, false)
+func genDivzTrampoline(asm asmWriter, divz operand) {
+	asm.tab(".text")
+	asm.label("divz")
+	asm.ins(andq, intOp(-16), rsp) // Destructively align stack
+	asm.ins(call, divz)            // NOTE: Call site already in rdi
+	// NOTE: Never returns so no need for GC word, return, etc
 }
 
-func genStmtList(asm asmWriter, stmts []*Node, fn *function) {
-	fn.gcRoots.OpenScope()
-	for _, stmt := range stmts {
+func genInstr(asm asmWriter, fn *function, i *irInstr, next *irBlock) {
 
-		switch stmt.op {
-		case opReturn:
-			genReturnStmt(asm, stmt.left, fn)
+	switch i.op {
 
-		case opIf:
-			genIfElseIfElseStmts(asm, stmt, fn)
+	case irConst:
+		v := i.val
+		if i.dst.typ.IsAny(Integer, Byte) {
+			v = (v << tagLenFor(i.dst.typ.Kind)) | tagFor(i.dst.typ.Kind)
+		}
+		// Check if we need a true 64-bit load
+		if v > math.MaxInt32 || v < math.MinInt32 {
+			asm.ins(movabs, intOp(v), rax)
+			asm.ins(movq, rax, fn.loc(i.dst))
+		} else {
+			asm.ins(movq, intOp(v), fn.loc(i.dst))
+		}
 
-		case opDas, opAs:
-			genAssignStmt(asm, stmt, fn)
+	case irString:
+		asm.ins(leaq, asm.stringLit(i.str), rax)
+		asm.ins(movq, rax, fn.loc(i.dst))
 
-		case opWhile:
-			genWhileStmt(asm, stmt, fn)
+	case irFnAddr:
+		// TODO: External functions may only be called directly. Their address would be loaded via the GOT.
+		if i.sym.Type.AsFunction().Is(External) {
+			asm.ins(movq, _false, fn.loc(i.dst))
+		} else {
+			asm.ins(leaq, rip(symOp(i.sym.Type.AsFunction().AsmName(i.sym.Name))), rax)
+			asm.ins(movq, rax, fn.loc(i.dst))
+		}
 
-		case opBlock:
-			genStmtList(asm, stmt.stmts, fn)
+	case irCopy:
+		move(asm, fn.loc(i.args[0]), fn.loc(i.dst))
 
-		default:
-			genExpr(asm, stmt, false, fn)
+	case irAdd, irSub, irMul, irAnd, irOr, irXor:
+		if x, c, ok := constOperand(i, fn.consts); i.op == irMul && ok && (c == 3 || c == 5 || c == 9) {
+			load(asm, fn, x, rax)
+			asm.ins(leaq, rax.index(rax).scale(c-1), rax) // x + x * (c-1)
+			store(asm, fn, rax, i.dst)
+			break
 		}
-	}
-	fn.gcRoots.CloseScope()
-}
+		load(asm, fn, i.args[0], rax)
+		load(asm, fn, i.args[1], rbx)
+		asm.ins(ins[i.op], rbx, rax)
+		store(asm, fn, rax, i.dst)
 
-func genWhileStmt(asm asmWriter, n *Node, fn *function) {
+		// NOTES:
+		// For imul, result is: rdx(high-64 bits):rax(low 64-bits)
 
-	// Create new labels
-	exit := asm.newLabel("while_end")
-	start := asm.newLabel("while_start")
-	asm.label(start)
+	case irDiv, irMod:
+		load(asm, fn, i.args[0], rax)
+		load(asm, fn, i.args[1], rbx)
+		if c, ok := fn.consts[i.args[1]]; !ok || c == 0 {
+			asm.ins(cmpq, intOp(0), rbx)
+			asm.ins(je, fn.NewTrap("divz", i.pos, rdi)) // NOTE: Expects call site in rdi
+		}
+		asm.ins(cqo) // Sign-extend rax into rdx
+		asm.ins(idivq, rbx)
 
-	// Generate condition
-	genExpr(asm, n.left, false, fn) // Left stores condition
+		// NOTE: idiv leaves the quotient (truncated) in rax & remainder (sign of dividend) in rdx. Untagged values
+		// are 63-bit so the most negative value divided by -1 cannot overflow.
+		if i.op == irDiv {
+			store(asm, fn, rax, i.dst)
+		} else {
+			store(asm, fn, rdx, i.dst)
+		}
 
-	asm.ins(cmpq, _true, rax)    // Pop result from stack to rax
-	asm.ins(jne, labelOp(exit))  // Jump over block if not true
-	genStmtList(asm, n.stmts, fn)        // Generate stmts block
-	asm.ins(jmp, labelOp(start)) // Jump to start of loop
-	asm.label(exit)                      // Declare exit point
-}
+	case irShl, irShr:
+		load(asm, fn, i.args[0], rax)
+		if c, ok := fn.consts[i.args[1]]; ok {
+			asm.ins(ins[i.op], intOp(c&63), rax)
+			store(asm, fn, rax, i.dst)
+			break
+		}
+		load(asm, fn, i.args[1], rcx)
+		asm.ins(ins[i.op], cl, rax)
+		store(asm, fn, rax, i.dst)
 
-func genAssignStmt(asm asmWriter, n *Node, fn *function) {
+	case irNeg:
+		load(asm, fn, i.args[0], rax)
+		asm.ins(negq, rax)
+		store(asm, fn, rax, i.dst)
 
-	// Evaluate expression & push result to stack
-	genExpr(asm, n.right, false, fn)
-	save(asm, fn, rax)
+	case irNot, irBNot:
+		asm.ins(movq, fn.loc(i.args[0]), rax)
+		asm.ins(notq, rax)
+		switch i.op {
+		case irNot:
+			asm.ins(andq, _true, rax)
+		case irBNot:
+			asm.ins(orq, intOp(tagFor(i.dst.typ.Kind)), rax) // SPECIAL CASE: Set tag again
+		}
+		asm.ins(movq, rax, fn.loc(i.dst))
 
-	// Evaluate mem location to store
-	slot := n.left
-	genExpr(asm, slot, true, fn)
+	case irEq, irLt, irLte, irGt, irGte:
+		load(asm, fn, i.args[0], rax)
+		load(asm, fn, i.args[1], rbx)
+		asm.ins(cmpq, rbx, rax)
+		asm.ins(ins[i.op], al)
+		asm.ins(andq, _true, rax) // Clear top bits
+		asm.ins(movq, rax, fn.loc(i.dst))
+
+	case irLoad:
+		p := fn.inReg(asm, i.args[0], rax)
+		genNullCheck(asm, fn, i, p)
+		if r, ok := fn.alloc.regs[i.dst]; ok {
+			asm.ins(movq, p.displace(i.val), r)
+			break
+		}
+		asm.ins(movq, p.displace(i.val), rax)
+		asm.ins(movq, rax, fn.loc(i.dst))
 
-	// Pop result
-	restore(asm, fn, rbx)
-	src := rbx
+	case irStore:
+		p := fn.inReg(asm, i.args[0], rax)
+		genNullCheck(asm, fn, i, p)
+		v := fn.inReg(asm, i.args[1], rbx)
+		asm.ins(movq, v, p.displace(i.val))
 
-	// Write slot
-	asm.ins(movq, src, rax.deref()) // [rax] = src;
+	case irIndex, irSetIndex:
+		// Load array address & index
+		asm.ins(movq, fn.loc(i.args[0]), rax)
+		load(asm, fn, i.args[1], rbx)
 
-	// If decl & assign start tracking as gc root
-	if n.op == opDas {
-		fn.gcRoots.Add(slot.sym.Addr, slot.sym.Type)
-	}
-}
+		// Bounds check
+		// https://blogs.msdn.microsoft.com/clrcodegeneration/2009/08/13/array-bounds-check-elimination-in-the-clr/
+		if !i.unchecked {
+			asm.ins(movq, rax.deref(), rcx)
+			untagAs(asm, Integer, rcx) // Strip tag from length
+			asm.ins(cmpq, rcx, rbx) // index - array.length
+			asm.ins(jae, fn.NewTrap("ioob", i.pos, rdx)) // NOTE: Expects array in rax, index in rbx & call site in rdx
+		}
 
-func genIfElseIfElseStmts(asm asmWriter, n *Node, fn *function) {
+		// Strings & bytes load a single (unsigned) byte
+		if i.args[0].typ.IsAny(String, Bytes) {
+			asm.ins(movzbq, rax.index(rbx).displace(ptrSize), rax) // rax = load[rax(*string) + rbx(index) + 8]
+			store(asm, fn, rax, i.dst)
+			break
+		}
 
-	// Generate exit label
-	exit := asm.newLabel("if_end")
+		// Displace + ptrSize to skip over length
+		elem := rax.index(rbx).scale(ptrSize).displace(ptrSize) // [rax(*array) + (rbx(index) * 8 + 8)]
+		if i.op == irSetIndex {
+			asm.ins(movq, fn.loc(i.args[2]), rcx)
+			asm.ins(movq, rcx, elem)
+		} else {
+			asm.ins(movq, elem, rax)
+			asm.ins(movq, rax, fn.loc(i.dst))
+		}
 
-	cur := n
-	for cur != nil {
-		if cur.left != nil {
-			// Generate condition
-			genExpr(asm, cur.left, false, fn) // Left stores condition
+	case irCall:
+		genFnCall(asm, fn, i)
 
-			// Create new label
-			next := asm.newLabel("else")
+	case irStackAlloc:
+		asm.ins(leaq, fn.slot(fn.alloc.objects[i]), rax)
+		asm.ins(movq, rax, fn.loc(i.dst))
 
-			asm.ins(cmpq, _true, rax)   // Compare (true) to rax
-			asm.ins(jne, labelOp(next)) // Jump over block if not equal
+	case irCount:
+		asm.ins(incq, counterOp(i.val))
 
-			genStmtList(asm, cur.stmts, fn)     // Generate if (true) stmt block
-			asm.ins(jmp, labelOp(exit)) // Exit if/elseif/else block completely
-			asm.label(next)                     // Label to jump if false
+	case irRet:
+		if len(i.args) > 0 {
+			asm.ins(movq, fn.loc(i.args[0]), rax)
+		}
+		for j, r := range fn.alloc.saved {
+			asm.ins(movq, fn.slot(fn.alloc.savedSlot(j)), r)
+		}
+		if fn.omitFp {
+			if fn.frameSize > 0 {
+				asm.ins(addq, intOp(fn.frameSize), rsp)
+			}
+			genReturn(asm, fn.attrs.isExternalReturn())
 		} else {
-			genStmtList(asm, cur.stmts, fn) // Generate block without condition (else block)
+			genFnExit(asm, fn.attrs.isExternalReturn())
 		}
-		cur = cur.right // Move down tree
-	}
-	asm.label(exit) // Declare exit point
-}
 
-func genReturnStmt(asm asmWriter, expr *Node, fn *function) {
+	case irJmp:
+		if i.succs[0] != next {
+			asm.ins(jmp, labelOp(fn.labels[i.succs[0]]))
+		}
 
-	// If return has expression evaluate it
-	if expr != nil {
-		genExpr(asm, expr, false, fn)
-	}
+	case irBr:
+		then, els := i.succs[0], i.succs[1]
+		asm.ins(cmpq, _true, fn.loc(i.args[0]))
+		switch {
+		case then == next:
+			asm.ins(jne, labelOp(fn.labels[els]))
+		case els == next:
+			asm.ins(je, labelOp(fn.labels[then]))
+		default:
+			asm.ins(je, labelOp(fn.labels[then]))
+			asm.ins(jmp, labelOp(fn.labels[els]))
+		}
 
-	// Clean stack & return
-	genFnExit(asm, fn.attrs.isExternalReturn())
+	default:
+		panic(fmt.Sprintf("Can't generate code for IR op: %v", irOpNames[i.op]))
+	}
 }
 
-func genFnCall(asm asmWriter, n *Node, f *function) {
+func genFnCall(asm asmWriter, fn *function, i *irInstr) {
 
 	// Determine how function is referenced
-	var s *Symbol
-	var fn *FunctionType
-	if n.left.sym != nil {
-		s = n.left.sym
-		fn = s.Type.AsFunction()
-	} else {
-		genExpr(asm, n.left, false, f)
-		save(asm, f, rax)
-		fn = n.left.typ.AsFunction()
-	}
-
-	f.SpillRegisters(asm)
-
-	// Generate arg code
-	for i, arg := range n.stmts {
-		// Evaluate expression, move into arg reg & record in use
-		genExpr(asm, arg, false, f)
-		asm.ins(movq, rax, regs[i])
-		f.RegisterInUse(arg.typ)
-
-		// Create "raw" values for any external functions which require them
-		if fn.Is(External) && fn.RawValues {
-			switch arg.typ.Kind {
-			case String, Array, Bytes:
-				// Modify pointer to point past length
-				asm.ins(leaq, regs[i].displace(8), regs[i])
-			case Integer:
-				// Ensure valid "C" value
-				untag(asm, arg, regs[i])
-			}
-		}
+	args := i.args
+	var callee *irTemp
+	if i.sym == nil {
+		callee, args = args[0], args[1:]
 	}
 
-	// Variadic functions must set rax to number of floating point parameters
-	if fn.isVariadic {
-		asm.ins(movq, intOp(0), rax) // No floating-point register usage yet...
+	// Load callee first as argument registers may hold it
+	if callee != nil {
+		asm.ins(movq, fn.loc(callee), r11)
 	}
 
-	// Recover fn address from stack, if required
-	if s == nil {
-		restore(asm, f, rax)
+	// Push args which don't fit in registers, keeping the stack 16-byte aligned at the call
+	raw := i.fn.Is(External) && i.fn.RawValues
+	var stackArgs []*irTemp
+	if len(args) > len(regs) {
+		args, stackArgs = args[:len(regs)], args[len(regs):]
+	}
+	stackSize := (len(stackArgs) + len(stackArgs)%2) * ptrSize
+	if len(stackArgs)%2 != 0 {
+		asm.ins(subq, intOp(ptrSize), rsp)
+	}
+	for j := len(stackArgs) - 1; j >= 0; j-- {
+		if raw {
+			asm.ins(movq, fn.loc(stackArgs[j]), rax)
+			genRawValue(asm, stackArgs[j], rax)
+			asm.ins(pushq, rax)
+		} else {
+			asm.ins(pushq, fn.loc(stackArgs[j]))
+		}
 	}
 
-	// Align stack as per ABI
-	if !f.isSpAligned() {
-		asm.ins(subq, intOp(8), rsp)
+	// Move remaining args into registers
+	var srcs []operand
+	for _, arg := range args {
+		srcs = append(srcs, fn.loc(arg))
+	}
+	parallelMove(asm, regs[:len(args)], srcs)
+	if raw {
+		for j, arg := range args {
+			genRawValue(asm, arg, regs[j])
+		}
+	}
+
+	// Variadic functions must set rax to number of floating point parameters
+	if i.fn.isVariadic {
+		asm.ins(movq, intOp(0), rax) // No floating-point register usage yet...
 	}
 
 	// Call function
-	if s == nil {
-		asm.ins(call, rax.indirect()) // anonymous func call: register indirect
-	} else if s.IsStack {
-		asm.ins(call, rbp.displace(-s.Addr).indirect()) // Parameter func call: memory indirect
+	if callee != nil {
+		asm.ins(call, r11.indirect()) // Func value call: register indirect
 	} else {
-		asm.ins(call, fnOp(fn.AsmName(s.Name))) // Named func call
+		asm.ins(call, fnOp(i.fn.AsmName(i.sym.Name))) // Named func call
 	}
 
 	// TODO: Hoist this into the language!
 	// Convert any "raw" values
-	if fn.Is(External) && fn.RawValues && fn.ret.Is(Integer) {
-		tagAs(asm, fn.ret.Kind, rax)
+	if i.fn.Is(External) && i.fn.RawValues && i.fn.ret.IsAny(Integer, Byte) {
+		tagAs(asm, i.fn.ret.Kind, rax)
 	}
 
-	// Only generate GC function addresses for Clara functions
-	if !fn.Is(External) {
-		asm.addr(f.NewGcMap())
+	// Only generate GC map addresses for Clara functions. NOTE: Relative so code requires no relocations
+	if !i.fn.Is(External) {
+		asm.relAddr(fn.NewGcMap(i))
 	}
-
-	// Correct stack pointer (if required)
-	if !f.isSpAligned() {
-		asm.ins(addq, intOp(8), rsp)
+	if stackSize > 0 {
+		asm.ins(addq, intOp(stackSize), rsp)
 	}
 
-	f.RestoreRegisters(asm)
+	if i.dst != nil {
+		asm.ins(movq, rax, fn.loc(i.dst))
+	}
 }
 
-func genExpr(asm asmWriter, expr *Node, takeAddr bool, fn *function) {
-
-	switch expr.op {
-
-	case opLit:
-		switch expr.sym.Type.Kind {
-		case String:
-			asm.ins(movabs, asm.stringLit(expr.sym.Name), rax)
-
-		case Integer:
-			// Parse
-			i, err := strconv.ParseInt(expr.sym.Name, 0, 64)
-			if err != nil {
-				panic(err) // NOTE: Should never happen as has been checked on front end
-			}
-			// Check if we need a true 64-bit load
-			ins := movq
-			if i > math.MaxInt32 || i < math.MinInt32 {
-				ins = movabs
-			}
-			asm.ins(ins, strOp(expr.sym.Name), rax) // Push onto top of stack
-			tag(asm, expr, rax)
-
-		case Boolean:
-			v := _false
-			if expr.sym.Name == "true" {
-				v = _true
-			}
-			asm.ins(movq, v, rax) // Push onto top of stack
-
-		default:
-			panic(fmt.Sprintf("Unknown type for literal: %v", expr.sym.Type.Kind))
-		}
-
-	case opOr, opAnd:
-
-		genExpr(asm, expr.left, false, fn)
-		save(asm, fn, rax)
-		genExpr(asm, expr.right, false, fn)
-		asm.ins(movq, rax, rbx)
-		restore(asm, fn, rax)
-		asm.ins(ins[expr.op], rbx, rax)
-
-	case opAdd, opSub, opMul, opDiv, opBOr, opBAnd, opBXor:
-
-		genExpr(asm, expr.left, false, fn)
-		untag(asm, expr.left, rax)
-		save(asm, fn, rax)
-		genExpr(asm, expr.right, false, fn)
-		untag(asm, expr.right, rax)
-		asm.ins(movq, rax, rbx)
-		restore(asm, fn, rax)
-		if expr.op == opDiv {
-			asm.ins(cqo) // Sign-extend rax into rdx
-		}
-		asm.ins(ins[expr.op], rbx, rax)
-		tag(asm, expr, rax)
-
-		// NOTES:
-		// For imul, result is: rdx(high-64 bits):rax(low 64-bits)
-		// For idiv, result is: rdx(remainder):rax(quotient)
-
-	case opNot, opBNot:
-
-		genExpr(asm, expr.left, false, fn)
-		asm.ins(notq, rax)
-		switch expr.op {
-		case opNot:
-			asm.ins(andq, _true, rax)
-		case opBNot:
-			asm.ins(orq, intOp(tagFor(expr.left.typ.Kind)), rax) // SPECIAL CASE: Set tag again
-		}
-
-	case opNeg:
-
-		genExpr(asm, expr.left, false, fn)
-		untag(asm, expr.left, rax)
-		asm.ins(negq, rax)
-		tag(asm, expr.left, rax)
-
-	case opGt, opGte, opLt, opLte, opEq:
-
-		genExpr(asm, expr.left, false, fn)
-		untag(asm, expr.left, rax)
-		save(asm, fn, rax)
-		genExpr(asm, expr.right, false, fn)
-		untag(asm, expr.right, rax)
-		asm.ins(movq, rax, rbx)
-		restore(asm, fn, rax)
-		asm.ins(cmpq, rbx, rax)
-		asm.ins(ins[expr.op], al)
-		asm.ins(andq, _true, rax) // Clear top bits
-
-	case opBLeft, opBRight:
-
-		genExpr(asm, expr.left, false, fn)
-		untag(asm, expr.left, rax)
-		save(asm, fn, rax)
-		genExpr(asm, expr.right, false, fn)
-		untag(asm, expr.right, rax)
-		asm.ins(movq, rax, rcx)
-		restore(asm, fn, rax)
-		asm.ins(ins[expr.op], cl, rax)
-		tag(asm, expr, rax)
-
-	case opIdentifier:
-
-		v := expr.sym
-		switch {
-		case v.IsStack: // Var operand
-			inst := movq
-			if takeAddr {
-				inst = leaq
-			}
-			asm.ins(inst, rbp.displace(-v.Addr), rax)
-
-		case v.Type.Is(Function) && v.IsGlobal: // Named function operand
-			// HACK to workaround absolute addressing!
-			// TODO: Figure out how to get a PIC relative address of an external function
-			if v.Type.AsFunction().Is(External) {
-				asm.ins(movq, _false, rax)
-			} else {
-				asm.ins(movabs, symOp(v.Type.AsFunction().AsmName(v.Name)), rax)
-			}
-
-		default: // Struct field operand
-			asm.ins(movq, intOp(v.Addr), rax)
-		}
-
-	case opTernary:
-
-		genExpr(asm, expr.left, false, fn)
-
-		elseLabel := asm.newLabel("else")
-		exitLabel := asm.newLabel("exit")
-
-		asm.ins(cmpq, _true, rax)
-		asm.ins(jne, labelOp(elseLabel))
-		genExpr(asm, expr.stmts[0], false, fn)
-		asm.ins(jmp, labelOp(exitLabel))
-		asm.label(elseLabel)
-		genExpr(asm, expr.stmts[1], false, fn)
-		asm.label(exitLabel)
-
-	case opArrayLit:
-
-		// Left has builder logic to create array & populate with elements
-		genExpr(asm, expr.left, false, fn)
-
-	case opFuncCall:
-		genFnCall(asm, expr, fn)
-
-	case opDot:
-
-		genExpr(asm, expr.left, false, fn)
-		save(asm, fn, rax)
-		genExpr(asm, expr.right, false, fn)
-
-		inst := movq
-		if takeAddr {
-			inst = leaq
-		}
-		asm.ins(movq, rax, rbx)
-		restore(asm, fn, rax)
-		asm.ins(inst, rax.index(rbx), rax)
-
-	case opArray:
-
-		// Calculate array address
-		genExpr(asm, expr.left, false, fn)
-		save(asm, fn, rax)
-
-		// Calculate index
-		genExpr(asm, expr.right, false, fn)
-		untag(asm, expr.right, rax) // Strip tag from index
-		asm.ins(movq, rax, rbx)
-
-		// Load array address (don't pop as we need it later)
-		asm.ins(movq, rsp.deref(), rax)
-
-		// Bounds check
-		// https://blogs.msdn.microsoft.com/clrcodegeneration/2009/08/13/array-bounds-check-elimination-in-the-clr/
-		asm.ins(movq, rax.deref(), rax)
-		untagAs(asm, Integer, rax) // Strip tag from length
-		asm.ins(cmpq, rax, rbx) // index - array.length
-
-		// Restore array address before jump!
-		restore(asm, fn, rax)
-		asm.ins(jae, labelOp("ioob"))
-
-		// Displace + ptrSize to skip over length
-		inst := movq
-		if takeAddr {
-			inst = leaq
-		}
-		asm.ins(inst, rax.index(rbx).scale(ptrSize).displace(ptrSize), rax) // rax = load[rax(*array) + (rbx(index) * 8 + 8)]
-
-	case opNamedType, opFuncType, opArrayType:
-		// Nothing do to - yet!
+// Create "raw" values for any external functions which require them
+func genRawValue(asm asmWriter, arg *irTemp, r reg) {
+	switch arg.typ.Kind {
+	case String, Array, Bytes:
+		// Modify pointer to point past length
+		asm.ins(leaq, r.displace(8), r)
+	case Integer, Byte:
+		// Ensure valid "C" value
+		untagAs(asm, arg.typ.Kind, r)
+	}
+}
 
-	default:
-		panic(fmt.Sprintf("Can't generate expr code for op: %v", nodeTypes[expr.op]))
+// Load temp into register, stripping any tag
+func load(asm asmWriter, fn *function, t *irTemp, r reg) {
+	asm.ins(movq, fn.loc(t), r)
+	if t.typ.IsAny(Integer, Byte) {
+		untagAs(asm, t.typ.Kind, r)
 	}
 }
 
-func tag(asm asmWriter, n *Node, r reg) {
-	tagAs(asm, n.typ.Kind, r)
+// Store register into temp, adding any tag
+func store(asm asmWriter, fn *function, r reg, t *irTemp) {
+	if t.typ.IsAny(Integer, Byte) {
+		tagAs(asm, t.typ.Kind, r)
+	}
+	asm.ins(movq, r, fn.loc(t))
 }
 
 func tagAs(asm asmWriter, t TypeKind, r reg) {
@@ -864,17 +1035,13 @@ func tagAs(asm asmWriter, t TypeKind, r reg) {
 	asm.ins(orq, intOp(tagFor(t)), r)
 }
 
-func untag(asm asmWriter, n *Node, r reg) {
-	untagAs(asm, n.typ.Kind, r)
-}
-
 func untagAs(asm asmWriter, t TypeKind, r reg) {
 	asm.ins(sarq, intOp(tagLenFor(t)), r)
 }
 
 func tagFor(tk TypeKind) int {
 	switch tk {
-	case Integer:
+	case Integer, Byte:
 		return 0b1
 	default:
 		panic(fmt.Sprintf("TypeKind (%v) does not have a tag", typeKindNames[tk]))
@@ -883,39 +1050,25 @@ func tagFor(tk TypeKind) int {
 
 func tagLenFor(tk TypeKind) int {
 	switch tk {
-	case Integer:
+	case Integer, Byte:
 		return 1
 	default:
 		panic(fmt.Sprintf("TypeKind (%v) does not have a tag", typeKindNames[tk]))
 	}
 }
 
-func save(asm asmWriter, fn *function, r reg) {
-	asm.ins(pushq, r)
-	fn.incSp(1)
-}
-
-func restore(asm asmWriter, fn *function, r reg) {
-	asm.ins(popq, r)
-	fn.decSp(1)
-}
-
-var ins = make(map[int]inst)
-func init() {
-	ins[opAdd] = addq
-	ins[opSub] = subq
-	ins[opMul] = imulq
-	ins[opDiv] = idivq
-	ins[opOr]  = orq
-	ins[opBOr] = orq
-	ins[opAnd] = andq
-	ins[opBAnd] = andq
-	ins[opBXor] = xorq
-	ins[opEq] = sete
-	ins[opGt] = setg
-	ins[opGte] = setge
-	ins[opLt] = setl
-	ins[opLte] = setle
-	ins[opBLeft] = shlq
-	ins[opBRight] = sarq
+var ins = map[irOp]inst{
+	irAdd: addq,
+	irSub: subq,
+	irMul: imulq,
+	irOr:  orq,
+	irAnd: andq,
+	irXor: xorq,
+	irEq:  sete,
+	irGt:  setg,
+	irGte: setge,
+	irLt:  setl,
+	irLte: setle,
+	irShl: shlq,
+	irShr: sarq,
 }
@@ -1,8 +1,10 @@
 package console
 
+// Styles, applied by a Printer when its output supports colour
 const (
-	Disable = "\u001B[0m"
 	Yellow = "\u001B[33m"
 	Red = "\u001B[31m"
 	Green = "\u001B[32m"
+
+	reset = "\u001B[0m"
 )
@@ -0,0 +1,90 @@
+package console
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Mode controls when output is coloured
+type Mode int
+
+const (
+	Auto   Mode = iota // Only terminals, unless NO_COLOR is set or TERM is dumb
+	Always             // Including pipes & files
+	Never
+)
+
+var modeNames = map[string]Mode{"auto": Auto, "always": Always, "never": Never}
+
+func ParseMode(s string) (Mode, error) {
+	m, ok := modeNames[s]
+	if !ok {
+		return Auto, fmt.Errorf("invalid colour mode '%v', expected: auto, always or never", s)
+	}
+	return m, nil
+}
+
+var (
+	mode      = Auto
+	terminals sync.Map // Whether each file descriptor supports colour, by fd
+)
+
+// SetMode sets the mode of all printers created afterwards
+func SetMode(m Mode) { mode = m }
+
+// Printer writes to out, styling text only when out supports colour
+type Printer struct {
+	out    io.Writer
+	colour bool
+}
+
+// NewPrinter returns a printer for out, or out itself if already a printer. Printers for nil never colour.
+func NewPrinter(out io.Writer) *Printer {
+	if p, ok := out.(*Printer); ok {
+		return p
+	}
+	return &Printer{out: out, colour: supportsColour(out)}
+}
+
+func supportsColour(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	switch {
+	case mode == Never || out == nil:
+		return false
+	case mode == Always:
+		if ok {
+			enableColour(f.Fd()) // Best effort
+		}
+		return true
+	case !ok || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb":
+		return false
+	}
+	if colour, ok := terminals.Load(f.Fd()); ok {
+		return colour.(bool)
+	}
+	colour := isTerminal(f.Fd()) && enableColour(f.Fd())
+	terminals.Store(f.Fd(), colour)
+	return colour
+}
+
+func (p *Printer) Colour() bool { return p.colour }
+
+func (p *Printer) Write(b []byte) (int, error) { return p.out.Write(b) }
+
+// Sprint formats v, wrapped in the style if colour is supported
+func (p *Printer) Sprint(style string, v interface{}) string {
+	if !p.colour {
+		return fmt.Sprint(v)
+	}
+	return style + fmt.Sprint(v) + reset
+}
+
+func (p *Printer) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(p.out, format, args...)
+}
+
+func (p *Printer) Println(args ...interface{}) {
+	fmt.Fprintln(p.out, args...)
+}
@@ -0,0 +1,15 @@
+package console
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func isTerminal(fd uintptr) bool {
+	var t syscall.Termios
+	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGETA, uintptr(unsafe.Pointer(&t)))
+	return err == 0
+}
+
+// Terminals interpret escape codes
+func enableColour(fd uintptr) bool { return true }
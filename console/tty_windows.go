@@ -0,0 +1,25 @@
+package console
+
+import "syscall"
+
+const enableVirtualTerminalProcessing = 0x4
+
+var setConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+func isTerminal(fd uintptr) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(fd), &mode) == nil
+}
+
+// Consoles only interpret escape codes once virtual terminal processing is enabled (Windows 10 onwards)
+func enableColour(fd uintptr) bool {
+	var mode uint32
+	if syscall.GetConsoleMode(syscall.Handle(fd), &mode) != nil {
+		return false
+	}
+	if mode&enableVirtualTerminalProcessing != 0 {
+		return true
+	}
+	r, _, _ := setConsoleMode.Call(fd, uintptr(mode|enableVirtualTerminalProcessing))
+	return r != 0
+}
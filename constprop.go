@@ -0,0 +1,213 @@
+package main
+
+// Folds operations over constants & propagates values through copies and phis. Branches on constant conditions
+// become jumps, removing any code which can then no longer be reached.
+func (f *irFunc) propagateConstants() {
+
+	consts := make(map[*irTemp]int)
+	subst := make(map[*irTemp]*irTemp)
+	dead := make(map[*irInstr]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, b := range f.blocks {
+			for _, i := range b.instrs {
+				if dead[i] {
+					continue
+				}
+				for j, arg := range i.args {
+					if s, ok := subst[arg]; ok {
+						i.args[j] = s
+					}
+				}
+				if _, ok := consts[i.dst]; ok && i.dst != nil {
+					continue
+				}
+				switch i.op {
+				case irConst:
+					if i.dst.typ.IsAny(Integer, Byte, Boolean) {
+						consts[i.dst] = i.val
+						changed = true
+					}
+
+				case irCopy:
+					if canPropagate(i.args[0], i.dst) {
+						subst[i.dst] = i.args[0]
+						dead[i] = true
+						changed = true
+					}
+
+				case irPhi:
+					if v, ok := uniquePhiValue(i); ok && canPropagate(v, i.dst) {
+						subst[i.dst] = v
+						dead[i] = true
+						changed = true
+					} else if v, ok := constPhiValue(i, consts); ok {
+						consts[i.dst] = v
+						changed = true
+					}
+
+				case irBr:
+					if v, ok := consts[i.args[0]]; ok {
+						taken, dropped := i.succs[0], i.succs[1]
+						if v == 0 {
+							taken, dropped = dropped, taken
+						}
+						f.removeEdge(b, dropped)
+						i.op, i.args, i.succs = irJmp, nil, []*irBlock{taken}
+						changed = true
+					}
+
+				default:
+					if v, ok := foldIrInstr(i, consts); ok {
+						i.op, i.args, i.val = irConst, nil, v
+						consts[i.dst] = v
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	// Remove propagated instructions. Constant phis are replaced after any remaining phis as they must stay grouped
+	// at the start of a block.
+	for _, b := range f.blocks {
+		var instrs, folded []*irInstr
+		for _, i := range b.instrs {
+			switch {
+			case dead[i]:
+			case i.op == irPhi && hasConst(consts, i.dst):
+				folded = append(folded, &irInstr{op: irConst, dst: i.dst, val: consts[i.dst]})
+			default:
+				instrs = append(instrs, i)
+			}
+		}
+		n := 0
+		for n < len(instrs) && instrs[n].op == irPhi {
+			n++
+		}
+		b.instrs = append(append(append([]*irInstr(nil), instrs[:n]...), folded...), instrs[n:]...)
+	}
+	f.substitute(subst)
+	f.removeUnreachable()
+	f.eliminateDeadCode()
+}
+
+func hasConst(consts map[*irTemp]int, t *irTemp) bool {
+	_, ok := consts[t]
+	return ok
+}
+
+// Values may only be propagated between temps with the same representation
+func canPropagate(from *irTemp, to *irTemp) bool {
+	switch {
+	case from.typ.IsAny(Integer, Byte) && to.typ.IsAny(Integer, Byte):
+		return true
+	default:
+		return from.typ.Kind == to.typ.Kind && from.typ.IsPointer() == to.typ.IsPointer()
+	}
+}
+
+// Phis where every argument is the same value (ignoring itself) are redundant
+func uniquePhiValue(phi *irInstr) (*irTemp, bool) {
+	var v *irTemp
+	for _, arg := range phi.args {
+		if arg == phi.dst || arg == v {
+			continue
+		}
+		if v != nil {
+			return nil, false
+		}
+		v = arg
+	}
+	return v, v != nil
+}
+
+// Phis where every argument is the same constant
+func constPhiValue(phi *irInstr, consts map[*irTemp]int) (int, bool) {
+	if !phi.dst.typ.IsAny(Integer, Byte, Boolean) {
+		return 0, false
+	}
+	v, found := 0, false
+	for _, arg := range phi.args {
+		c, ok := consts[arg]
+		if !ok || (found && c != v) {
+			return 0, false
+		}
+		v, found = c, true
+	}
+	return v, found
+}
+
+// Evaluates an instruction whose operands are all constant, following the runtime's 63-bit wrapping arithmetic
+func foldIrInstr(i *irInstr, consts map[*irTemp]int) (int, bool) {
+	if i.dst == nil || len(i.args) == 0 || !i.dst.typ.IsAny(Integer, Byte, Boolean) {
+		return 0, false
+	}
+	var args []int
+	for _, arg := range i.args {
+		v, ok := consts[arg]
+		if !ok {
+			return 0, false
+		}
+		args = append(args, v)
+	}
+
+	var v int
+	switch i.op {
+	case irAdd:
+		v = args[0] + args[1]
+	case irSub:
+		v = args[0] - args[1]
+	case irMul:
+		v = args[0] * args[1]
+	case irDiv:
+		if args[1] == 0 {
+			return 0, false // Leave to runtime
+		}
+		v = args[0] / args[1] // Truncated, as idiv
+	case irMod:
+		if args[1] == 0 {
+			return 0, false // Leave to runtime
+		}
+		v = args[0] % args[1]
+	case irAnd:
+		v = args[0] & args[1]
+	case irOr:
+		v = args[0] | args[1]
+	case irXor:
+		v = args[0] ^ args[1]
+	case irShl:
+		v = args[0] << uint(args[1]&63)
+	case irShr:
+		v = args[0] >> uint(args[1]&63)
+	case irNeg:
+		v = -args[0]
+	case irBNot:
+		v = ^args[0]
+	case irNot:
+		v = args[0] ^ 1
+	case irEq:
+		v = toBit(args[0] == args[1])
+	case irLt:
+		v = toBit(args[0] < args[1])
+	case irLte:
+		v = toBit(args[0] <= args[1])
+	case irGt:
+		v = toBit(args[0] > args[1])
+	case irGte:
+		v = toBit(args[0] >= args[1])
+	default:
+		return 0, false
+	}
+	if i.dst.typ.IsAny(Integer, Byte) {
+		v = (v << 1) >> 1 // Wrap as tagging discards the top bit
+	}
+	return v, true
+}
+
+func toBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
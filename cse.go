@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Removes recomputation of values already available in a dominating instruction. Pure operations are reused across
+// the whole dominator tree. Loads & indexes are reused within a block until memory may have been written, or across
+// the dominator tree when the function never writes memory at all.
+func (f *irFunc) eliminateCommonSubexpressions() {
+
+	f.dominators()
+	writes := false
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			writes = writes || i.writesMemory()
+		}
+	}
+
+	subst := make(map[*irTemp]*irTemp)
+	avail := make(map[string]*irTemp)
+	memory := 0 // Current version of memory
+	var visit func(b *irBlock)
+	visit = func(b *irBlock) {
+		if writes {
+			memory++ // Unknown which paths reach this block
+		}
+		var added []string
+		instrs := b.instrs[:0]
+		for _, i := range b.instrs {
+			for j, arg := range i.args {
+				if s, ok := subst[arg]; ok {
+					i.args[j] = s
+				}
+			}
+			instrs = append(instrs, i)
+			if i.writesMemory() {
+				memory++
+				continue
+			}
+			key, ok := i.cseKey(memory)
+			if !ok {
+				continue
+			}
+			if t, ok := avail[key]; ok {
+				subst[i.dst] = t
+				instrs = instrs[:len(instrs)-1]
+				continue
+			}
+			avail[key] = i.dst
+			added = append(added, key)
+		}
+		b.instrs = instrs
+		for _, child := range b.doms {
+			visit(child)
+		}
+		for _, key := range added {
+			delete(avail, key)
+		}
+	}
+	visit(f.blocks[0])
+
+	f.substitute(subst)
+	f.compact()
+}
+
+func (i *irInstr) writesMemory() bool {
+	return i.op == irStore || i.op == irSetIndex || i.op == irCall
+}
+
+// Key identifying the value an instruction computes. Only instructions which may be reused have a key.
+func (i *irInstr) cseKey(memory int) (string, bool) {
+	if i.dst == nil {
+		return "", false
+	}
+	args := i.args
+	switch i.op {
+	case irConst, irString, irFnAddr, irSub, irDiv, irMod, irShl, irShr, irNeg, irBNot, irNot,
+		irLt, irLte, irGt, irGte:
+		memory = 0
+	case irAdd, irMul, irAnd, irOr, irXor, irEq:
+		// Commutative so order operands
+		memory = 0
+		if args[0].id > args[1].id {
+			args = []*irTemp{args[1], args[0]}
+		}
+	case irLoad, irIndex:
+		// Reads memory
+	default:
+		return "", false
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%v:%v:%v:%v:%v", i.op, i.dst.typ.Kind, i.dst.typ.IsPointer(), i.val, memory)
+	if i.op == irString {
+		buf.WriteString(":" + i.str)
+	}
+	if i.op == irFnAddr {
+		fmt.Fprintf(&buf, ":%p", i.sym)
+	}
+	for _, arg := range args {
+		fmt.Fprintf(&buf, ":%d", arg.id)
+	}
+	return buf.String(), true
+}
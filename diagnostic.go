@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"github.com/g-dx/clarac/console"
+	"github.com/g-dx/clarac/lex"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Error which can be traced back to a token in the source
+type diagnostic struct {
+	code  string
+	msg   string
+	token *lex.Token
+	end   *lex.Token // Last token of the node reported (if any), marked in the source from token onwards
+}
+
+func (d *diagnostic) Error() string {
+	return d.msg
+}
+
+// Message without the location of the token, which is reported separately (See: lsp.go, sarif.go)
+func (d *diagnostic) text() string {
+	if d.token.Kind == lex.Err {
+		return d.token.Val
+	}
+	return strings.TrimPrefix(d.msg, fmt.Sprintf("%v:%d:%d: ", d.token.File, d.token.Line, d.token.Pos))
+}
+
+// Columns of source the token spans, at least one so its position can always be marked
+func tokenWidth(t *lex.Token) int {
+	width := utf8.RuneCountInString(t.Val)
+	if width == 0 || t.Kind == lex.EOF || t.Kind == lex.Err {
+		width = 1
+	}
+	return width
+}
+
+func newDiagnostic(t *lex.Token, msg string, vals ...interface{}) *diagnostic {
+	return &diagnostic{code: errorCode(msg), msg: fmt.Sprintf(msg, vals...), token: t}
+}
+
+// Error at the start of the node, marking all of the node in the source rather than only its token. Message formats
+// are those of semanticError2().
+func nodeError(msg string, n *Node, vals ...interface{}) error {
+	start, end := nodeRange(n)
+	d := semanticError2(msg, start, vals...).(*diagnostic)
+	d.end = end
+	return d
+}
+
+// First & last tokens in the source of the node & its children
+func nodeRange(n *Node) (start *lex.Token, end *lex.Token) {
+	start, end = n.token, n.token
+	WalkPreOrder(n, func(c *Node) bool {
+		if c == nil || c.token == nil || c.token.Line < 1 || c.token.File != n.token.File {
+			return true // Created by the compiler
+		}
+		t := c.token
+		if start.Line < 1 || t.Line < start.Line || (t.Line == start.Line && t.Pos < start.Pos) {
+			start = t
+		}
+		if c.end != nil {
+			t = c.end
+		}
+		if end.Line < 1 || t.Line > end.Line || (t.Line == end.Line && t.Pos+tokenWidth(t) > end.Pos+tokenWidth(end)) {
+			end = t
+		}
+		return true
+	})
+	return start, end
+}
+
+// Orders diagnostics by file, line & column, dropping duplicates reported when several passes reach the same node.
+// Errors without a position in the source come first, in the order they were reported.
+func sortDiagnostics(errs []error) []error {
+	var sorted []error
+	seen := make(map[string]bool)
+	for _, err := range errs {
+		key := err.Error()
+		if d, ok := err.(*diagnostic); ok {
+			key = d.code + " " + key
+		}
+		if !seen[key] {
+			seen[key] = true
+			sorted = append(sorted, err)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := diagnosticToken(sorted[i]), diagnosticToken(sorted[j])
+		switch {
+		case a == nil || b == nil:
+			return a == nil && b != nil
+		case a.File != b.File:
+			return a.File < b.File
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		default:
+			return a.Pos < b.Pos
+		}
+	})
+	return sorted
+}
+
+// Token the error was reported at, if it has a position in the source
+func diagnosticToken(err error) *lex.Token {
+	if d, ok := err.(*diagnostic); ok && d.token != nil && d.token.Line > 0 {
+		return d.token
+	}
+	return nil
+}
+
+// Codes suppressed on each line of the source by '//clara:ignore CODE[,CODE]...' comments. Only warnings (such as the
+// rules of clarac vet) may be suppressed as errors prevent compilation.
+func ignoredCodes(src string, path string) map[int]map[string]bool {
+	ignored := make(map[int]map[string]bool)
+	for i, line := range fmtLex(src, path) {
+		if line.comment == nil || !strings.HasPrefix(line.comment.Val, ignoreDirective) {
+			continue
+		}
+		codes := make(map[string]bool)
+		for _, code := range strings.FieldsFunc(strings.TrimPrefix(line.comment.Val, ignoreDirective), func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}) {
+			codes[code] = true
+		}
+		ignored[i+1] = codes
+	}
+	return ignored
+}
+
+const ignoreDirective = "//clara:ignore "
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func printErrors(errs []error, out io.Writer) {
+	sources := make(map[string][]string)
+	fmt.Fprintln(out, "\nErrors")
+	explainable := false
+	for _, err := range sortDiagnostics(errs) {
+		d, ok := err.(*diagnostic)
+		if !ok {
+			fmt.Fprintf(out, " - %v\n", err)
+			continue
+		}
+		if d.code != "" {
+			fmt.Fprintf(out, " - [%v] %v\n", d.code, err)
+			explainable = true
+		} else {
+			fmt.Fprintf(out, " - %v\n", err)
+		}
+		printSnippet(d.token, d.end, sources, out)
+	}
+	if explainable {
+		fmt.Fprintln(out, "\nFor more information about an error, try 'clarac explain <code>'")
+	}
+}
+
+// Prints the source line containing the token with the token itself, or everything up to end on its line, underlined,
+// e.g:
+//
+//    12 |     x := y + "a"
+//       |          ^^^^^^^
+//
+func printSnippet(t *lex.Token, end *lex.Token, sources map[string][]string, out io.Writer) {
+	if t == nil || t.Pos < 1 {
+		return // Token was created by the compiler
+	}
+	line, ok := sourceLine(t, sources)
+	if !ok {
+		return
+	}
+
+	// Find the runes underlined, widening them to cover every token up to end on the line
+	runes := []rune(line)
+	from, to := t.Pos-1, t.Pos-1+tokenWidth(t)
+	switch {
+	case end == nil || end.Line < t.Line || (end.Line == t.Line && end.Pos <= t.Pos):
+	case end.Line > t.Line:
+		if len(runes) > to {
+			to = len(runes) // Until the end of the line
+		}
+	default:
+		from, to = balanceParens(runes, from, end.Pos-1+tokenWidth(end))
+	}
+
+	// Build marker, preserving any tabs so the underline aligns with the token
+	var marker strings.Builder
+	for i := 0; i < from && i < len(runes); i++ {
+		if runes[i] == '\t' {
+			marker.WriteRune('\t')
+		} else {
+			marker.WriteRune(' ')
+		}
+	}
+	gutter := len(fmt.Sprint(t.Line))
+	p := console.NewPrinter(out)
+	fmt.Fprintf(out, "   %v %v\n", p.Sprint(console.Yellow, fmt.Sprintf("%*d |", gutter, t.Line)), line)
+	fmt.Fprintf(out, "   %v %v%v\n", p.Sprint(console.Yellow, fmt.Sprintf("%*s |", gutter, "")), marker.String(),
+		p.Sprint(console.Red, strings.Repeat("^", to-from)))
+}
+
+// Widens runes[from:to] over the parentheses surrounding it which it closes or leaves open, as these aren't tokens of
+// any node
+func balanceParens(runes []rune, from int, to int) (int, int) {
+	open, closed := 0, 0 // Unmatched parentheses within the range
+	for i := from; i < to && i < len(runes); i++ {
+		switch runes[i] {
+		case '(':
+			open++
+		case ')':
+			if open > 0 {
+				open--
+			} else {
+				closed++
+			}
+		}
+	}
+	for i := from - 1; closed > 0 && i >= 0; i-- {
+		if runes[i] == '(' {
+			closed--
+			from = i
+		} else if runes[i] != ' ' && runes[i] != '\t' {
+			break
+		}
+	}
+	for i := to; open > 0 && i < len(runes); i++ {
+		if runes[i] == ')' {
+			open--
+			to = i + 1
+		} else if runes[i] != ' ' && runes[i] != '\t' {
+			break
+		}
+	}
+	return from, to
+}
+
+// Source line containing the token, loading & caching the lines of its file as required
+func sourceLine(t *lex.Token, sources map[string][]string) (string, bool) {
+	if t.Line < 1 {
+		return "", false // Token was created by the compiler
+	}
+	lines, ok := sources[t.File]
+	if !ok {
+		b, err := ioutil.ReadFile(t.File)
+		if err == nil {
+			lines = strings.Split(string(b), "\n")
+		}
+		sources[t.File] = lines
+	}
+	if t.Line > len(lines) {
+		return "", false
+	}
+	return strings.TrimRight(lines[t.Line-1], "\r"), true
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+const didYouMeanMsg = ", did you mean '%v'?"
+
+// Appends a suggestion to the diagnostic if any candidate is a close enough match for the name
+func suggest(err error, name string, candidates []string) error {
+	d, ok := err.(*diagnostic)
+	if !ok {
+		return err
+	}
+	if match, found := closestMatch(name, candidates); found {
+		d.msg += fmt.Sprintf(didYouMeanMsg, match)
+	}
+	return d
+}
+
+func closestMatch(name string, candidates []string) (string, bool) {
+	best, bestDist := "", len(name)/3+1 // Allow roughly one edit for every three characters
+	for _, c := range candidates {
+		if c == name {
+			continue
+		}
+		d := editDistance(strings.ToLower(name), strings.ToLower(c))
+		if d < bestDist || (d == bestDist && best != "" && c < best) {
+			best, bestDist = c, d
+		}
+	}
+	return best, best != ""
+}
+
+// Levenshtein distance between two strings
+func editDistance(s, t string) int {
+	a, b := []rune(s), []rune(t)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/g-dx/clarac/lex"
+	"html"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Documentation generator (clarac doc). Each file is a module & is documented by the comment at its top (if separated
+// from the first declaration by a blank line). Declarations are documented by the comment lines directly above them,
+// skipping any attributes, or otherwise by a comment at the end of their line. Signatures are rebuilt from the parsed
+// declarations so are shown consistently however the source is laid out.
+
+func runDoc(args []string, out io.Writer, errOut io.Writer) int {
+	flags := flag.NewFlagSet("doc", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	asHtml := flags.Bool("html", false, "Write HTML instead of Markdown.")
+	outPath := flags.String("out", "", "Write a file per module to the given directory instead of printing them.")
+	flags.Usage = func() {
+		fmt.Fprintln(errOut, "usage: clarac doc [-html] [-out dir] <file or directory>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	status := 0
+	for _, path := range fmtPaths(flags.Args()) {
+		m, errs := readModule(path)
+		if len(errs) > 0 {
+			printErrors(errs, errOut)
+			status = 1
+			continue
+		}
+		var buf bytes.Buffer
+		ext := ".md"
+		if *asHtml {
+			ext = ".html"
+			m.writeHtml(&buf)
+		} else {
+			m.writeMarkdown(&buf)
+		}
+		if *outPath == "" {
+			out.Write(buf.Bytes())
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(*outPath, m.name+ext), buf.Bytes(), 0644); err != nil {
+			fmt.Fprintln(errOut, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// Documented declarations of a file
+type docModule struct {
+	name    string
+	doc     []string
+	consts  []*docDecl
+	structs []*docDecl
+	enums   []*docDecl
+	fns     []*docDecl
+}
+
+type docDecl struct {
+	name      string
+	signature string
+	doc       []string
+	members   []*docMember // Struct fields or enum cases
+}
+
+type docMember struct {
+	name string
+	typ  string // Fields only
+	doc  []string
+}
+
+func readModule(path string) (*docModule, []error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+	src := string(b)
+	root := &Node{op: opRoot, symtab: NewSymtab()}
+	if errs := lexAndParse(src, path, root, false, ioutil.Discard); len(errs) > 0 {
+		return nil, errs
+	}
+	lines := fmtLex(src, path) // Line n of the source is at n-1
+	base := filepath.Base(path)
+	m := &docModule{name: strings.TrimSuffix(base, filepath.Ext(base)), doc: moduleComment(lines)}
+	for _, n := range root.stmts {
+		d := &docDecl{name: n.token.Val, doc: docComment(lines, n.token.Line)}
+		switch n.op {
+		case opConstDcl:
+			d.signature = constSignature(lines, n.token)
+			m.consts = append(m.consts, d)
+		case opStructDcl:
+			var b strings.Builder
+			fmt.Fprintf(&b, "struct %v%v {\n", n.token.Val, docTypeParams(n.params))
+			for _, field := range n.stmts {
+				typ := docType(field.left)
+				fmt.Fprintf(&b, "    %v: %v\n", field.token.Val, typ)
+				d.members = append(d.members, &docMember{name: field.token.Val, typ: typ, doc: docComment(lines, field.token.Line)})
+			}
+			b.WriteString("}")
+			d.signature = b.String()
+			m.structs = append(m.structs, d)
+		case opEnumDcl:
+			var b strings.Builder
+			fmt.Fprintf(&b, "enum %v%v {\n", n.token.Val, docTypeParams(n.params))
+			for _, cons := range n.stmts {
+				sig := cons.token.Val + docParams(cons.params)
+				fmt.Fprintf(&b, "    %v\n", sig)
+				d.members = append(d.members, &docMember{name: sig, doc: docComment(lines, cons.token.Line)})
+			}
+			b.WriteString("}")
+			d.signature = b.String()
+			m.enums = append(m.enums, d)
+		case opBlockFnDcl, opExprFnDcl, opExternFnDcl:
+			sig := "fn " + n.token.Val
+			if n.right != nil {
+				sig += docTypeParams(n.right.params)
+			}
+			sig += docParams(n.params)
+			if n.left != nil {
+				sig += " " + docType(n.left)
+			}
+			d.signature = sig
+			m.fns = append(m.fns, d)
+		}
+	}
+	return m, nil
+}
+
+// Comment at the top of the file, unless it documents the first declaration
+func moduleComment(lines []*fmtLine) []string {
+	var doc []string
+	for _, line := range lines {
+		switch {
+		case line.blank:
+			return doc
+		case len(line.tokens) > 0 || line.comment == nil:
+			return nil
+		case !isBanner(line.comment):
+			doc = append(doc, commentText(line.comment))
+		}
+	}
+	return nil
+}
+
+// Comment lines directly above the declaration on the given line (ignoring attributes) or the comment ending it
+func docComment(lines []*fmtLine, line int) []string {
+	var doc []string
+	for i := line - 2; i >= 0; i-- {
+		l := lines[i]
+		if len(l.tokens) > 0 && l.tokens[0].Kind == lex.Hash && l.comment == nil {
+			continue // Attributes
+		}
+		if len(l.tokens) > 0 || l.comment == nil || isBanner(l.comment) {
+			break
+		}
+		doc = append([]string{commentText(l.comment)}, doc...)
+	}
+	if len(doc) == 0 && line > 0 && line <= len(lines) && lines[line-1].comment != nil {
+		doc = []string{commentText(lines[line-1].comment)}
+	}
+	return doc
+}
+
+func commentText(t *lex.Token) string {
+	s := strings.TrimPrefix(t.Val, "//")
+	return strings.TrimRight(strings.TrimPrefix(s, " "), " ")
+}
+
+// Whether the comment only separates sections, e.g. // ------
+func isBanner(t *lex.Token) bool {
+	s := strings.TrimSpace(commentText(t))
+	return s != "" && strings.Trim(s, "-=") == ""
+}
+
+// Source of the constant's line, as formatted
+func constSignature(lines []*fmtLine, t *lex.Token) string {
+	var buf bytes.Buffer
+	fmtTokens(&buf, lines[t.Line-1])
+	return buf.String()
+}
+
+func docParams(params []*Node) string {
+	var ps []string
+	for _, p := range params {
+		ps = append(ps, fmt.Sprintf("%v: %v", p.token.Val, docType(p.left)))
+	}
+	return "(" + strings.Join(ps, ", ") + ")"
+}
+
+func docTypeParams(params []*Node) string {
+	if len(params) == 0 {
+		return ""
+	}
+	var ps []string
+	for _, p := range params {
+		ps = append(ps, docType(p))
+	}
+	return "«" + strings.Join(ps, ", ") + "»"
+}
+
+// Type as written in source
+func docType(n *Node) string {
+	switch n.op {
+	case opNamedType:
+		if n.left != nil {
+			return n.token.Val + docTypeParams(n.left.params)
+		}
+		return n.token.Val
+	case opArrayType:
+		return "[]" + docType(n.left)
+	case opFuncType:
+		var ps []string
+		for _, p := range n.stmts {
+			ps = append(ps, docType(p))
+		}
+		s := "fn(" + strings.Join(ps, ", ") + ")"
+		if n.left != nil {
+			s += " " + docType(n.left)
+		}
+		return s
+	default:
+		return n.typeName()
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (m *docModule) sections() []*docSection {
+	return []*docSection{{"Constants", m.consts}, {"Structs", m.structs}, {"Enums", m.enums}, {"Functions", m.fns}}
+}
+
+type docSection struct {
+	title string
+	decls []*docDecl
+}
+
+func (m *docModule) writeMarkdown(out io.Writer) {
+	fmt.Fprintf(out, "# %v\n", m.name)
+	if len(m.doc) > 0 {
+		fmt.Fprintf(out, "\n%v\n", strings.Join(m.doc, "\n"))
+	}
+	for _, s := range m.sections() {
+		if len(s.decls) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\n## %v\n", s.title)
+		for _, d := range s.decls {
+			fmt.Fprintf(out, "\n### %v\n\n```clara\n%v\n```\n", d.name, d.signature)
+			if len(d.doc) > 0 {
+				fmt.Fprintf(out, "\n%v\n", strings.Join(d.doc, "\n"))
+			}
+			if !d.documentsMembers() {
+				continue
+			}
+			if s.title == "Structs" {
+				fmt.Fprintf(out, "\n| Field | Type | Description |\n| --- | --- | --- |\n")
+				for _, f := range d.members {
+					fmt.Fprintf(out, "| `%v` | `%v` | %v |\n", f.name, mdCell(f.typ), mdCell(strings.Join(f.doc, " ")))
+				}
+			} else {
+				fmt.Fprintf(out, "\n| Case | Description |\n| --- | --- |\n")
+				for _, c := range d.members {
+					fmt.Fprintf(out, "| `%v` | %v |\n", mdCell(c.name), mdCell(strings.Join(c.doc, " ")))
+				}
+			}
+		}
+	}
+}
+
+func (d *docDecl) documentsMembers() bool {
+	for _, m := range d.members {
+		if len(m.doc) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func mdCell(s string) string { return strings.ReplaceAll(s, "|", "\\|") }
+
+func (m *docModule) writeHtml(out io.Writer) {
+	esc := html.EscapeString
+	fmt.Fprintf(out, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%v</title>\n</head>\n<body>\n", esc(m.name))
+	fmt.Fprintf(out, "<h1>%v</h1>\n", esc(m.name))
+	writeHtmlDoc(out, m.doc)
+	for _, s := range m.sections() {
+		if len(s.decls) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "<h2>%v</h2>\n", s.title)
+		for _, d := range s.decls {
+			fmt.Fprintf(out, "<h3>%v</h3>\n<pre><code class=\"language-clara\">%v</code></pre>\n", esc(d.name), esc(d.signature))
+			writeHtmlDoc(out, d.doc)
+			if !d.documentsMembers() {
+				continue
+			}
+			if s.title == "Structs" {
+				fmt.Fprintln(out, "<table>\n<tr><th>Field</th><th>Type</th><th>Description</th></tr>")
+				for _, f := range d.members {
+					fmt.Fprintf(out, "<tr><td><code>%v</code></td><td><code>%v</code></td><td>%v</td></tr>\n", esc(f.name),
+						esc(f.typ), esc(strings.Join(f.doc, " ")))
+				}
+			} else {
+				fmt.Fprintln(out, "<table>\n<tr><th>Case</th><th>Description</th></tr>")
+				for _, c := range d.members {
+					fmt.Fprintf(out, "<tr><td><code>%v</code></td><td>%v</td></tr>\n", esc(c.name), esc(strings.Join(c.doc, " ")))
+				}
+			}
+			fmt.Fprintln(out, "</table>")
+		}
+	}
+	fmt.Fprintln(out, "</body>\n</html>")
+}
+
+// Comment lines as paragraphs, which are separated by empty lines
+func writeHtmlDoc(out io.Writer, doc []string) {
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			fmt.Fprintf(out, "<p>%v</p>\n", html.EscapeString(strings.Join(para, " ")))
+			para = nil
+		}
+	}
+	for _, line := range doc {
+		if line == "" {
+			flush()
+		} else {
+			para = append(para, line)
+		}
+	}
+	flush()
+}
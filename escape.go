@@ -0,0 +1,146 @@
+package main
+
+// Escape analysis. Structs which never outlive the creating function's frame are allocated within it rather than on
+// the heap. A value escapes if it is stored in memory, returned or passed to a function which may let it escape.
+// Summaries of which parameters escape are computed for every function so analysis can see through calls.
+type escapes map[*irFunc][]bool
+
+func analyseEscapes(fns []*irFunc) escapes {
+
+	byName := make(map[string]*irFunc)
+	esc := make(escapes)
+	for _, f := range fns {
+		byName[f.name] = f
+		esc[f] = make([]bool, len(f.params))
+	}
+
+	// Iterate to a fixed point as functions may be (mutually) recursive
+	for changed := true; changed; {
+		changed = false
+		for _, f := range fns {
+			escaping := f.escapingTemps(byName, esc)
+			for j, p := range f.params {
+				if escaping[p] && !esc[f][j] {
+					esc[f][j] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return esc
+}
+
+// Replaces each heap allocated struct which does not escape with a stack allocation. Allocations within loops are
+// ignored as each iteration would share the same stack memory.
+func (f *irFunc) allocateOnStack(fns []*irFunc, esc escapes, gt *GcTypes) {
+
+	byName := make(map[string]*irFunc)
+	for _, fn := range fns {
+		byName[fn.name] = fn
+	}
+	escaping := f.escapingTemps(byName, esc)
+	loops := f.loopBlocks()
+	for _, b := range f.blocks {
+		if loops[b] {
+			continue
+		}
+		var instrs []*irInstr
+		for _, i := range b.instrs {
+			if i.op != irCall || i.sym == nil || !i.fn.Is(StructCons) || escaping[i.dst] {
+				instrs = append(instrs, i)
+				continue
+			}
+
+			// Allocate & populate fields as the constructor would
+			instrs = append(instrs, &irInstr{op: irStackAlloc, dst: i.dst, val: gt.IdOf(i.fn.ret)})
+			for j, arg := range i.args {
+				instrs = append(instrs, &irInstr{op: irStore, args: []*irTemp{i.dst, arg}, val: j * ptrSize, unchecked: true})
+			}
+		}
+		b.instrs = instrs
+	}
+}
+
+// Set of temps whose values escape the function
+func (f *irFunc) escapingTemps(byName map[string]*irFunc, esc escapes) map[*irTemp]bool {
+
+	escaping := make(map[*irTemp]bool)
+	aliases := make(map[*irTemp][]*irTemp) // Temps which may hold the same value
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			switch i.op {
+			case irCopy, irPhi:
+				for _, arg := range i.args {
+					aliases[i.dst] = append(aliases[i.dst], arg)
+				}
+			case irStore:
+				escaping[i.args[1]] = true
+			case irSetIndex:
+				escaping[i.args[2]] = true
+			case irRet:
+				for _, arg := range i.args {
+					escaping[arg] = true
+				}
+			case irCall:
+				var callee *irFunc
+				if i.sym != nil {
+					callee = byName[i.fn.AsmName(i.sym.Name)]
+				}
+				for j, arg := range i.args {
+					switch {
+					case i.sym == nil && j == 0:
+						// Function value
+					case callee == nil:
+						escaping[arg] = true // Unknown callee
+					case esc[callee][j]:
+						escaping[arg] = true
+					}
+				}
+			case irLoad, irIndex, irEq:
+				// Only read
+			default:
+				for _, arg := range i.args {
+					escaping[arg] = true
+				}
+			}
+		}
+	}
+
+	// Anything assigned to an escaping temp also escapes
+	var work []*irTemp
+	for t := range escaping {
+		work = append(work, t)
+	}
+	for len(work) > 0 {
+		t := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, a := range aliases[t] {
+			if !escaping[a] {
+				escaping[a] = true
+				work = append(work, a)
+			}
+		}
+	}
+	return escaping
+}
+
+// Blocks which are part of a cycle
+func (f *irFunc) loopBlocks() map[*irBlock]bool {
+	loops := make(map[*irBlock]bool)
+	for _, b := range f.blocks {
+		seen := make(map[*irBlock]bool)
+		work := append([]*irBlock(nil), b.succs()...)
+		for len(work) > 0 && !loops[b] {
+			x := work[len(work)-1]
+			work = work[:len(work)-1]
+			if x == b {
+				loops[b] = true
+			}
+			if !seen[x] {
+				seen[x] = true
+				work = append(work, x.succs()...)
+			}
+		}
+	}
+	return loops
+}
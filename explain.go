@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Extended description of a diagnostic
+type explanation struct {
+	code    string
+	msg     string // Message format the code is attached to
+	summary string
+	mistake string // Example program exhibiting the error
+	fix     string // Example program with the error corrected
+}
+
+var explanations = []*explanation{
+	{
+		code:    "E0001",
+		msg:     errSyntaxMsg,
+		summary: "The parser encountered a token it did not expect at this point in the program.",
+		mistake: "fn main() {\n    x := (1 + 2\n}",
+		fix:     "fn main() {\n    x := (1 + 2)\n}",
+	},
+	{
+		code:    "E0002",
+		msg:     errRedeclaredMsg,
+		summary: "A name was declared more than once in the same scope.",
+		mistake: "fn main() {\n    x := 1\n    x := 2\n}",
+		fix:     "fn main() {\n    x := 1\n    x = 2\n}",
+	},
+	{
+		code:    "E0003",
+		msg:     errUnknownTypeMsg,
+		summary: "A type name was used which is not declared as a struct, enum or builtin type.",
+		mistake: "fn area(s: sqare) int = s.w * s.w\nstruct square {\n    w: int\n}",
+		fix:     "fn main() {}\nfn area(s: square) int = s.w * s.w\nstruct square {\n    w: int\n}",
+	},
+	{
+		code:    "E0004",
+		msg:     errUnknownVarMsg,
+		summary: "An identifier was used which is not a variable, parameter or function visible in this scope.",
+		mistake: "fn main() {\n    printn(\"Hello\")\n}",
+		fix:     "fn main() {\n    println(\"Hello\")\n}",
+	},
+	{
+		code:    "E0005",
+		msg:     errAmbiguousVarMsg,
+		summary: "An overloaded function was referenced without calling it so the compiler cannot choose between the overloads.",
+		mistake: "fn f(x: int) {}\nfn f(x: string) {}\nfn main() {\n    g := f\n}",
+		fix:     "fn f(x: int) {}\nfn h(x: string) {}\nfn main() {\n    g := f\n}",
+	},
+	{
+		code:    "E0006",
+		msg:     errStructNamingLowerMsg,
+		summary: "Struct names must start with a lowercase letter. The capitalised name is reserved for the generated constructor function.",
+		mistake: "fn main() {}\nstruct Point {\n    x: int\n}",
+		fix:     "fn main() {}\nstruct point {\n    x: int\n}",
+	},
+	{
+		code:    "E0007",
+		msg:     errConstructorOverrideMsg,
+		summary: "Every struct has a constructor function named after it with the first letter capitalised. No other function may use that name.",
+		mistake: "fn main() {}\nstruct point {\n    x: int\n}\nfn Point() point = Point(0)",
+		fix:     "fn main() {}\nstruct point {\n    x: int\n}\nfn origin() point = Point(0)",
+	},
+	{
+		code:    "E0008",
+		msg:     errNotStructMsg,
+		summary: "A field was selected from a value which is not a struct.",
+		mistake: "fn main() {\n    x := 1\n    println(x.y)\n}",
+		fix:     "fn main() {\n    x := 1\n    println(x)\n}",
+	},
+	{
+		code:    "E0009",
+		msg:     errStructHasNoFieldMsg,
+		summary: "A field was selected which is not declared in the struct.",
+		mistake: "fn main() {}\nstruct point {\n    x: int\n}\nfn getX(p: point) int = p.z",
+		fix:     "fn main() {}\nstruct point {\n    x: int\n}\nfn getX(p: point) int = p.x",
+	},
+	{
+		code:    "E0010",
+		msg:     errInvalidDotSelectionMsg,
+		summary: "The right hand side of '.' must be a field name or a function call.",
+		mistake: "fn main() {\n    \"abc\".1\n}",
+		fix:     "fn main() {\n    \"abc\".println()\n}",
+	},
+	{
+		code:    "E0011",
+		msg:     errInvalidOperatorTypeMsg,
+		summary: "The operator cannot be applied to values of this type.",
+		mistake: "fn main() {\n    x := \"ab\" - \"b\"\n}",
+		fix:     "fn main() {\n    x := \"ab\".substring(0, 1)\n}",
+	},
+	{
+		code:    "E0012",
+		msg:     errMismatchedTypesMsg,
+		summary: "A value of one type was used where a value of a different type is required.",
+		mistake: "fn main() {\n    x := 1\n    x = \"one\"\n}",
+		fix:     "fn main() {\n    x := 1\n    x = 2\n}",
+	},
+	{
+		code:    "E0013",
+		msg:     errInvalidNumberArgsMsg,
+		summary: "An enum case was matched, or unsafe() called, with a different number of arguments than it declares.",
+		mistake: "enum shape {\n    Circle(r: int)\n}\nfn main() {\n    match Circle(1) {\n        case Circle(r, d):\n            println(r)\n    }\n}",
+		fix:     "enum shape {\n    Circle(r: int)\n}\nfn main() {\n    match Circle(1) {\n        case Circle(r):\n            println(r)\n    }\n}",
+	},
+	{
+		code:    "E0014",
+		msg:     errInvalidNumberTypeArgsMsg,
+		summary: "A generic type was given a different number of type arguments than it declares.",
+		mistake: "fn main() {}\nstruct box«T» {\n    val: T\n}\nfn f(b: box«int, int») {}",
+		fix:     "fn main() {}\nstruct box«T» {\n    val: T\n}\nfn f(b: box«int») {}",
+	},
+	{
+		code:    "E0015",
+		msg:     errResolveFunctionMsg,
+		summary: "A call was made on an expression which cannot produce a function.",
+		mistake: "fn main() {\n    x := 1 + 2()\n}",
+		fix:     "fn two() int = 2\nfn main() {\n    x := 1 + two()\n}",
+	},
+	{
+		code:    "E0016",
+		msg:     errOverloadResolutionMsg,
+		summary: "Functions with this name exist but none accept the supplied argument types.",
+		mistake: "fn twice(x: int) int = x * 2\nfn twice(x: string) string = x.append(x)\nfn main() {\n    twice(true)\n}",
+		fix:     "fn twice(x: int) int = x * 2\nfn twice(x: string) string = x.append(x)\nfn main() {\n    twice(2)\n}",
+	},
+	{
+		code:    "E0017",
+		msg:     errNonIntegerIndexMsg,
+		summary: "Arrays can only be indexed by integers.",
+		mistake: "fn main() {\n    a := intArray(2)\n    a[true] = 1\n}",
+		fix:     "fn main() {\n    a := intArray(2)\n    a[0] = 1\n}",
+	},
+	{
+		code:    "E0018",
+		msg:     errUnexpectedAssignMsg,
+		summary: "Only identifiers may be declared with ':='.",
+		mistake: "fn main() {\n    1 := 2\n}",
+		fix:     "fn main() {\n    x := 2\n}",
+	},
+	{
+		code:    "E0019",
+		msg:     errNotAddressableAssignMsg,
+		summary: "The left hand side of '=' must be a variable, field or array element.",
+		mistake: "fn main() {\n    1 = 2\n}",
+		fix:     "fn main() {\n    x := 1\n    x = 2\n}",
+	},
+	{
+		code:    "E0020",
+		msg:     errNotWritableAssignMsg,
+		summary: "The field is readonly and cannot be assigned to, e.g. the 'length' of an array or string.",
+		mistake: "fn main() {\n    a := intArray(2)\n    a.length = 3\n}",
+		fix:     "fn main() {\n    a := intArray(3)\n}",
+	},
+	{
+		code:    "E0021",
+		msg:     errMissingReturnMsg,
+		summary: "A function which declares a return type does not return a value on every path.",
+		mistake: "fn main() {}\nfn sign(x: int) int {\n    if x < 0 {\n        return -1\n    }\n}",
+		fix:     "fn main() {}\nfn sign(x: int) int {\n    if x < 0 {\n        return -1\n    }\n    return 1\n}",
+	},
+	{
+		code:    "E0022",
+		msg:     errIntegerOverflowMsg,
+		summary: "An integer literal, or arithmetic on literals & constants evaluated at compile time, is too large to be represented. Integers are 63 bits wide.",
+		mistake: "fn main() {\n    x := 4611686018427387904\n}",
+		fix:     "fn main() {\n    x := 4611686018427387903\n}",
+	},
+	{
+		code:    "E0023",
+		msg:     errUnknownEnumCaseMsg,
+		summary: "A match case names a constructor which belongs to a different enum than the value being matched.",
+		mistake: "fn main() {}\nenum shape {\n    Circle(r: int)\n}\nenum colour {\n    Red(x: int)\n}\nfn f(s: shape) {\n    match s {\n        case Red(x):\n    }\n}",
+		fix:     "fn main() {}\nenum shape {\n    Circle(r: int)\n}\nenum colour {\n    Red(x: int)\n}\nfn f(s: shape) {\n    match s {\n        case Circle(r):\n    }\n}",
+	},
+	{
+		code:    "E0024",
+		msg:     errMatchNotExhaustiveMsg,
+		summary: "A match over an enum must handle every case of the enum.",
+		mistake: "fn main() {}\nenum shape {\n    Circle(r: int)\n    Square(w: int)\n}\nfn f(s: shape) {\n    match s {\n        case Circle(r):\n    }\n}",
+		fix:     "fn main() {}\nenum shape {\n    Circle(r: int)\n    Square(w: int)\n}\nfn f(s: shape) {\n    match s {\n        case Circle(r):\n        case Square(w):\n    }\n}",
+	},
+	{
+		code:    "E0025",
+		msg:     errNotAnEnumCaseMsg,
+		summary: "A match case must name an enum constructor.",
+		mistake: "fn main() {}\nenum shape {\n    Circle(r: int)\n}\nfn f(s: shape) {\n    match s {\n        case println(r):\n    }\n}",
+		fix:     "fn main() {}\nenum shape {\n    Circle(r: int)\n}\nfn f(s: shape) {\n    match s {\n        case Circle(r):\n    }\n}",
+	},
+	{
+		code:    "E0026",
+		msg:     errTooManyArgsMsg,
+		summary: "Calls to function values and enum cases may have at most 5 arguments.",
+		mistake: "fn apply(f: fn(int, int, int, int, int, int) int) int {\n    return f(1, 2, 3, 4, 5, 6)\n}",
+		fix:     "fn apply(f: fn(int, int, int, int, int) int) int {\n    return f(1, 2, 3, 4, 5)\n}",
+	},
+	{
+		code:    "E0027",
+		msg:     errTypeParameterNotKnownMsg,
+		summary: "The return type of a generic function uses a type parameter which cannot be determined from the arguments.",
+		mistake: "fn cast«T, R»(t: T) R = unsafe(t, 0, type(R))\nfn main() {\n    x := cast(1)\n}",
+		fix:     "fn cast«T, R»(t: T) R = unsafe(t, 0, type(R))\nfn main() {\n    x := cast«int, bool»(1)\n}",
+	},
+	{
+		code:    "E0028",
+		msg:     errEmptyArrayLiteralMsg,
+		summary: "Array literals must contain at least one element so their type can be determined.",
+		mistake: "fn main() {\n    x := []\n}",
+		fix:     "fn main() {\n    x := intArray(0)\n}",
+	},
+	{
+		code:    "E0029",
+		msg:     errNoTypeParametersMsg,
+		summary: "Type arguments were supplied to a type which is not generic.",
+		mistake: "fn main() {}\nstruct point {\n    x: int\n}\nfn f(p: point«int») {}",
+		fix:     "fn main() {}\nstruct point {\n    x: int\n}\nfn f(p: point) {}",
+	},
+	{
+		code:    "E0030",
+		msg:     errImpureFnMsg,
+		summary: "A function declared #[Pure] performs IO, mutates memory or calls a function which does.",
+		mistake: "fn main() {}\n#[Pure]\nfn square(x: int) int {\n    println(x)\n    return x * x\n}",
+		fix:     "fn main() {}\n#[Pure]\nfn square(x: int) int {\n    return x * x\n}",
+	},
+	{
+		code:    "E0031",
+		msg:     errDivideByZeroMsg,
+		summary: "An integer was divided by a value which is zero at compile time.",
+		mistake: "const PARTS = 0\nfn main() {\n    println(10 / PARTS)\n}",
+		fix:     "const PARTS = 2\nfn main() {\n    println(10 / PARTS)\n}",
+	},
+	{
+		code:    "E0032",
+		msg:     errNotConstantMsg,
+		summary: "The value of a constant must be computable at compile time from literals, operators & other constants.",
+		mistake: "const LEN = \"abc\".length\nfn main() {}",
+		fix:     "const LEN = 3\nfn main() {}",
+	},
+	{
+		code:    "E0033",
+		msg:     errConstantCycleMsg,
+		summary: "The value of a constant refers, directly or through other constants, to itself.",
+		mistake: "const A = B + 1\nconst B = A * 2\nfn main() {}",
+		fix:     "const A = B + 1\nconst B = 2\nfn main() {}",
+	},
+	{
+		code:    "E0034",
+		msg:     errNotExportableMsg,
+		summary: "A function declared #[Export] cannot be called from C. Exported functions must not be generic & may only take & return ints & bools.",
+		mistake: "#[Export]\nfn greeting(name: string) string = \"Hello \" + name",
+		fix:     "#[Export]\nfn square(x: int) int = x * x",
+	},
+	{
+		code:    "E0035",
+		msg:     errMainReturnMsg,
+		summary: "The value returned by main() becomes the exit status of the program so main() may only return an int or nothing.",
+		mistake: "fn main() bool = true",
+		fix:     "fn main() int = 0",
+	},
+	{
+		code:    "E0036",
+		msg:     errFormatVerbMsg,
+		summary: "The format of printf() may only use the verbs %d, %i, %u, %x, %X & %o for ints, bytes & the addresses of references, %c for ints & bytes, %s for strings, %p for references & %% for a percent sign. Flags, width & precision may precede a verb.",
+		mistake: "fn main() {\n    printf(\"%f\\n\", 1)\n}",
+		fix:     "fn main() {\n    printf(\"%d\\n\", 1)\n}",
+	},
+	{
+		code:    "E0037",
+		msg:     errFormatTypeMsg,
+		summary: "An argument of printf() does not have a type accepted by the verb it is formatted by.",
+		mistake: "fn main() {\n    printf(\"%s\\n\", 1)\n}",
+		fix:     "fn main() {\n    printf(\"%s\\n\", 1.toString())\n}",
+	},
+	{
+		code:    "E0038",
+		msg:     errFormatArgsMsg,
+		summary: "The format of printf() has a different number of verbs to the number of arguments which follow it.",
+		mistake: "fn main() {\n    printf(\"%d %d\\n\", 1)\n}",
+		fix:     "fn main() {\n    printf(\"%d %d\\n\", 1, 2)\n}",
+	},
+}
+
+var errorCodes = make(map[string]*explanation)
+
+func init() {
+	for _, e := range explanations {
+		errorCodes[e.msg] = e
+		errorCodes[e.code] = e
+	}
+}
+
+// Code of the diagnostic with the given message format (if any)
+func errorCode(msg string) string {
+	if e, ok := errorCodes[msg]; ok {
+		return e.code
+	}
+	return ""
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func runExplain(args []string, out io.Writer, errOut io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(errOut, "usage: clarac explain <code>")
+		return 2
+	}
+	if !explain(args[0], out) {
+		return 1
+	}
+	return 0
+}
+
+func explain(code string, out io.Writer) bool {
+	e, ok := errorCodes[strings.ToUpper(code)]
+	if !ok || e.code != strings.ToUpper(code) {
+		var codes []string
+		for _, e := range explanations {
+			codes = append(codes, e.code)
+		}
+		sort.Strings(codes)
+		fmt.Fprintf(out, "Unknown error code '%v'. Known codes: %v\n", code, strings.Join(codes, ", "))
+		return false
+	}
+	fmt.Fprintf(out, "%v: %v\n\n", e.code, e.summary)
+	fmt.Fprintf(out, "Erroneous code example:\n\n%v\n\n", indent(e.mistake))
+	fmt.Fprintf(out, "Corrected code example:\n\n%v\n", indent(e.fix))
+	return true
+}
+
+func indent(s string) string {
+	return "    " + strings.Replace(s, "\n", "\n    ", -1)
+}
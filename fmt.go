@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/g-dx/clarac/lex"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Formatter (clarac fmt). Source is lexed with its whitespace & comments, which the parser never sees, so output only
+// differs in layout: indentation is four spaces per block, case bodies are indented beneath their case, tokens are
+// separated by at most one space, opening braces end the line before them, `else` & `elseif` follow the closing brace
+// & runs of blank lines are collapsed to one. Comments are kept where they are & those starting a line at the first
+// column (i.e. commented out code) are not indented. Files which do not parse are left as they are.
+
+func runFmt(args []string, out io.Writer, errOut io.Writer) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	write := flags.Bool("w", false, "Write the result to each file instead of printing it.")
+	diff := flags.Bool("d", false, "Print the difference each file would have once formatted instead of the result.")
+	flags.Usage = func() {
+		fmt.Fprintln(errOut, "usage: clarac fmt [-w] [-d] <file or directory>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, path := range fmtPaths(flags.Args()) {
+		if err := fmtFile(path, *write, *diff, out); err != nil {
+			fmt.Fprintln(errOut, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// Directories are expanded to the Clara files they contain
+func fmtPaths(args []string) (paths []string) {
+	for _, arg := range args {
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			paths = append(paths, glob(filepath.Join(arg, "*.clara"))...)
+		} else {
+			paths = append(paths, arg)
+		}
+	}
+	return paths
+}
+
+func fmtFile(path string, write bool, diff bool, out io.Writer) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	formatted, errs := formatSource(string(src), path)
+	if len(errs) > 0 {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return errors.New(strings.Join(msgs, "\n"))
+	}
+	if diff {
+		d, err := diffSource(path, string(src), formatted)
+		if err != nil {
+			return err
+		}
+		out.Write(d)
+	}
+	switch {
+	case write:
+		if formatted != string(src) {
+			return ioutil.WriteFile(path, []byte(formatted), 0644)
+		}
+	case !diff:
+		io.WriteString(out, formatted)
+	}
+	return nil
+}
+
+// Unified diff of a file before & after formatting (if they differ)
+func diffSource(path string, before, after string) ([]byte, error) {
+	if before == after {
+		return nil, nil
+	}
+	dir, err := ioutil.TempDir("", "clarafmt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := ioutil.WriteFile(a, []byte(before), 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(b, []byte(after), 0644); err != nil {
+		return nil, err
+	}
+	output, err := exec.Command("diff", "-u", "--label", path+".orig", "--label", path, a, b).CombinedOutput()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		err = nil // Files differ
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Diff failure: %v\n%v\n", err, string(output)))
+	}
+	return output, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Line of source as lexed
+type fmtLine struct {
+	tokens  []*lex.Token
+	spaced  []bool // Whether each token was preceded by whitespace
+	comment *lex.Token
+	blank   bool
+}
+
+func formatSource(src string, path string) (string, []error) {
+	if errs := lexAndParse(src, path, &Node{op: opRoot, symtab: NewSymtab()}, false, ioutil.Discard); len(errs) > 0 {
+		return "", errs
+	}
+	lines := fmtJoin(fmtLex(src, path))
+
+	var outs []*fmtOut
+	var stack []*fmtBlock
+	continued := false
+	stmts := make(map[int]int) // Indent of the last statement started at each depth
+	for j, line := range lines {
+		if line.blank {
+			if j > 0 && !lines[j-1].blank {
+				outs = append(outs, &fmtOut{line: line})
+			}
+			continue
+		}
+		indent, rest := fmtIndent(line, &stack)
+		depth := len(stack)
+		switch {
+		case len(line.tokens) > 0 && line.tokens[0].Kind == lex.Dot:
+			indent = stmts[depth] + 1 // Chained call
+		case continued:
+			indent++
+		}
+		opened := fmtNest(rest, &stack, indent)
+		if len(line.tokens) > 0 {
+			if line.tokens[0].Kind != lex.Dot {
+				stmts[depth] = indent
+			}
+			continued = !opened && isContinuedBy(line.tokens[len(line.tokens)-1])
+		}
+		var code bytes.Buffer
+		if len(line.tokens) > 0 || line.comment.Pos > 1 {
+			code.WriteString(strings.Repeat("    ", indent))
+		}
+		fmtTokens(&code, line)
+		outs = append(outs, &fmtOut{line: line, code: code.String(), gap: 1})
+	}
+	fmtAlignComments(outs)
+
+	var buf bytes.Buffer
+	for _, o := range outs {
+		buf.WriteString(o.code)
+		if o.line.comment != nil {
+			if len(o.line.tokens) > 0 {
+				buf.WriteString(strings.Repeat(" ", o.gap))
+			}
+			buf.WriteString(o.line.comment.Val)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String(), nil
+}
+
+// Formatted line
+type fmtOut struct {
+	line *fmtLine
+	code string
+	gap  int // Spaces before a trailing comment
+}
+
+// Trailing comments of consecutive lines which were aligned remain so
+func fmtAlignComments(outs []*fmtOut) {
+	trailing := func(o *fmtOut) bool { return len(o.line.tokens) > 0 && o.line.comment != nil }
+	for j := 0; j < len(outs); {
+		if !trailing(outs[j]) {
+			j++
+			continue
+		}
+		k, width := j, 0
+		for k < len(outs) && trailing(outs[k]) && outs[k].line.comment.Pos == outs[j].line.comment.Pos {
+			if w := utf8.RuneCountInString(outs[k].code); w > width {
+				width = w
+			}
+			k++
+		}
+		if k-j > 1 {
+			for _, o := range outs[j:k] {
+				o.gap = width - utf8.RuneCountInString(o.code) + 1
+			}
+		}
+		j = k
+	}
+}
+
+func fmtLex(src string, path string) (lines []*fmtLine) {
+	line := &fmtLine{}
+	lexer := lex.Lex(src, path)
+	space := 0
+	for {
+		token := lexer.NextToken()
+		switch token.Kind {
+		case lex.EOF:
+			if len(line.tokens) > 0 || line.comment != nil {
+				lines = append(lines, line)
+			}
+			return lines
+		case lex.Space:
+			space = len(token.Val)
+		case lex.EOL:
+			if token.Val == "\r" {
+				continue // Followed by \n
+			}
+			line.blank = len(line.tokens) == 0 && line.comment == nil
+			lines = append(lines, line)
+			line = &fmtLine{}
+			space = 0
+		case lex.Comment:
+			line.comment = token
+		default:
+			line.tokens = append(line.tokens, token)
+			line.spaced = append(line.spaced, space > 0)
+			space = 0
+		}
+	}
+}
+
+// Moves opening braces & else clauses onto the line they follow
+func fmtJoin(lines []*fmtLine) (joined []*fmtLine) {
+	for _, line := range lines {
+		if len(line.tokens) > 0 && (line.tokens[0].Kind == lex.LBrace || line.tokens[0].Kind == lex.Else || line.tokens[0].Kind == lex.ElseIf) {
+			prev := len(joined) - 1
+			for prev >= 0 && joined[prev].blank {
+				prev--
+			}
+			if prev >= 0 && joined[prev].comment == nil && len(joined[prev].tokens) > 0 {
+				last := joined[prev].tokens[len(joined[prev].tokens)-1]
+				if line.tokens[0].Kind == lex.LBrace || last.Kind == lex.RBrace {
+					joined = joined[:prev+1]
+					joined[prev].tokens = append(joined[prev].tokens, line.tokens...)
+					joined[prev].spaced = append(joined[prev].spaced, true)
+					joined[prev].spaced = append(joined[prev].spaced, line.spaced[1:]...)
+					joined[prev].comment = line.comment
+					continue
+				}
+			}
+		}
+		joined = append(joined, line)
+	}
+
+	// Drop blank lines at the start & end
+	for len(joined) > 0 && joined[0].blank {
+		joined = joined[1:]
+	}
+	for len(joined) > 0 && joined[len(joined)-1].blank {
+		joined = joined[:len(joined)-1]
+	}
+	return joined
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Open brace, parenthesis or bracket
+type fmtBlock struct {
+	indent int  // Of the line it was opened on
+	inCase bool // Following a case of a match
+}
+
+// Indentation of a line & its tokens following any leading closers, which are indented as the line which opened them
+func fmtIndent(line *fmtLine, stack *[]*fmtBlock) (int, []*lex.Token) {
+	indent := 0
+	if n := len(*stack); n > 0 {
+		top := (*stack)[n-1]
+		indent = top.indent + 1
+		if top.inCase {
+			indent++
+		}
+	}
+	toks := line.tokens
+	if len(toks) > 0 && toks[0].Kind == lex.Case && len(*stack) > 0 {
+		top := (*stack)[len(*stack)-1]
+		top.inCase = true
+		indent = top.indent + 1
+	}
+	for len(toks) > 0 && isCloser(toks[0]) && len(*stack) > 0 {
+		indent = (*stack)[len(*stack)-1].indent
+		*stack = (*stack)[:len(*stack)-1]
+		toks = toks[1:]
+	}
+	return indent, toks
+}
+
+// Tracks the blocks opened & closed by the tokens of a line. Returns whether any remain open.
+func fmtNest(toks []*lex.Token, stack *[]*fmtBlock, indent int) bool {
+	depth := len(*stack)
+	for _, t := range toks {
+		switch {
+		case isOpener(t):
+			*stack = append(*stack, &fmtBlock{indent: indent})
+		case isCloser(t) && len(*stack) > 0:
+			*stack = (*stack)[:len(*stack)-1]
+		}
+	}
+	return len(*stack) > depth
+}
+
+func isOpener(t *lex.Token) bool {
+	return t.Kind == lex.LBrace || t.Kind == lex.LParen || t.Kind == lex.LBrack
+}
+
+func isCloser(t *lex.Token) bool {
+	return t.Kind == lex.RBrace || t.Kind == lex.RParen || t.Kind == lex.RBrack
+}
+
+// Lines ending with a binary operator continue onto the next
+func isContinuedBy(t *lex.Token) bool {
+	return isBinaryOp(t.Kind) || t.Kind == lex.Min
+}
+
+func isBinaryOp(k lex.Kind) bool {
+	switch k {
+	case lex.Plus, lex.Mul, lex.Div, lex.Mod, lex.BAnd, lex.BOr, lex.BXor, lex.BLeft, lex.BRight, lex.Gt, lex.Gte,
+		lex.Lt, lex.Lte, lex.Eq, lex.Das, lex.As, lex.And, lex.Or, lex.Question, lex.DotDot:
+		return true
+	}
+	return false
+}
+
+// Ends an operand, so a following minus is binary
+func isOperandEnd(k lex.Kind) bool {
+	switch k {
+	case lex.Identifier, lex.Integer, lex.String, lex.True, lex.False, lex.RParen, lex.RBrack, lex.RGmet:
+		return true
+	}
+	return false
+}
+
+func fmtTokens(buf *bytes.Buffer, line *fmtLine) {
+	ternaries := 0 // Unmatched ? on line
+	for j, t := range line.tokens {
+		if j > 0 {
+			prev := line.tokens[j-1]
+			unary := j > 1 && prev.Kind == lex.Min && !isOperandEnd(line.tokens[j-2].Kind) ||
+				j == 1 && prev.Kind == lex.Min
+			if fmtSpaced(prev, t, line.spaced[j], unary, ternaries > 0) {
+				buf.WriteString(" ")
+			}
+		}
+		switch {
+		case t.Kind == lex.Question:
+			ternaries++
+		case t.Kind == lex.Colon && ternaries > 0:
+			ternaries--
+		}
+		buf.WriteString(t.Val)
+	}
+}
+
+// Whether a space separates two tokens. Otherwise the source is followed.
+func fmtSpaced(prev, cur *lex.Token, spaced bool, unaryMin bool, ternary bool) bool {
+	switch {
+	case cur.Kind == lex.Comma || cur.Kind == lex.RParen || cur.Kind == lex.RBrack || cur.Kind == lex.RGmet ||
+		cur.Kind == lex.Dot || cur.Kind == lex.LGmet:
+		return false
+	case prev.Kind == lex.LParen || prev.Kind == lex.LBrack || prev.Kind == lex.LGmet || prev.Kind == lex.Dot ||
+		prev.Kind == lex.Hash || prev.Kind == lex.BNot || unaryMin:
+		return false
+	case cur.Kind == lex.Colon:
+		return ternary
+	case prev.Kind == lex.LBrace && cur.Kind == lex.RBrace:
+		return false
+	case prev.Kind == lex.Comma || prev.Kind == lex.Colon || prev.Kind == lex.LBrace || cur.Kind == lex.LBrace ||
+		cur.Kind == lex.RBrace:
+		return true
+	case cur.Kind == lex.LParen && prev.Kind == lex.Not:
+		return spaced
+	case cur.Kind == lex.LParen:
+		return !(isOperandEnd(prev.Kind) || prev.Kind == lex.Fn || prev.Kind == lex.Type || prev.Kind == lex.RBrace)
+	case cur.Kind == lex.LBrack:
+		return !isOperandEnd(prev.Kind) || (prev.Kind == lex.RParen && spaced) // Index or array return type
+	case isBinaryOp(prev.Kind) || isBinaryOp(cur.Kind) || prev.Kind == lex.Min || cur.Kind == lex.Min:
+		return true
+	case prev.Kind == lex.RParen && cur.Kind == lex.Identifier:
+		return true // Return type
+	default:
+		return spaced
+	}
+}
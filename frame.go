@@ -0,0 +1,53 @@
+package main
+
+// Frame layout. Slots are numbered from 1, each addressed at -8 * slot from the frame pointer (See: slot()), and are
+// assigned from the frame pointer down:
+//
+//   - Spilled temps. Temps whose live intervals do not overlap share a slot. This is safe for the GC as the map of each
+//     call only lists the slots of pointers live across it.
+//   - Stack allocated structs, laid out as heap objects: a header followed by fields at increasing addresses.
+//   - Callee saved registers in use.
+//
+// Parameters beyond the sixth & outgoing arguments are not part of the frame. They are pushed by the caller (See:
+// genFnCall) & removed after the call returns.
+
+func (a *allocation) layoutFrame(f *irFunc, intervals []*interval, spilled map[*irTemp]bool) {
+
+	// Intervals are ordered by start so a slot is free once the interval last assigned to it has ended
+	var ends []int
+	for _, it := range intervals {
+		if !spilled[it.t] {
+			continue
+		}
+		s := len(ends)
+		for j, end := range ends {
+			if end < it.start {
+				s = j
+				break
+			}
+		}
+		if s == len(ends) {
+			ends = append(ends, 0)
+		}
+		ends[s] = it.end
+		a.slots[it.t] = s + 1
+	}
+	a.size = len(ends)
+
+	a.objects = make(map[*irInstr]int)
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.op == irStackAlloc {
+				n := len(i.dst.typ.AsStruct().Fields)
+				a.objects[i] = a.size + n
+				a.size += n + 1
+			}
+		}
+	}
+	a.size += len(a.saved)
+}
+
+// Stack slot used to preserve a callee saved register
+func (a *allocation) savedSlot(j int) int {
+	return a.size - len(a.saved) + j + 1
+}
@@ -1,9 +1,6 @@
 package main
 
-import (
-	"bytes"
-	"fmt"
-)
+import "fmt"
 
 const (
 	readOnlyType = 0x2
@@ -15,65 +12,6 @@ func readOnlyGcHeader(id int) int {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-type GcState struct {
-	scopes []int
-	roots GcRoots
-}
-
-// ---------------------------------------------------------------------------------------------------------------------
-
-type GcRoots []GcRoot
-
-// ---------------------------------------------------------------------------------------------------------------------
-
-type GcRoot struct {
-	off int
-	typ *Type
-}
-
-// ---------------------------------------------------------------------------------------------------------------------
-
-func (gr GcRoots) String() string {
-	buf := bytes.NewBufferString("")
-	for _, root := range gr {
-		buf.WriteString(".")
-		buf.WriteString(root.typ.AsmName())
-	}
-	return buf.String()
-}
-
-func (gs *GcState) OpenScope() {
-	gs.scopes = append(gs.scopes, len(gs.roots))
-}
-
-func (gs *GcState) CloseScope() {
-	gs.roots = gs.roots[:gs.scopes[len(gs.scopes)-1]]
-}
-
-func (gs *GcState) Add(off int, t *Type) {
-	if t.IsPointer() {
-		gs.roots = append(gs.roots, GcRoot{ off: off, typ: t })
-	}
-}
-
-func (gs *GcState) Remove(off int, t *Type) {
-	if t.IsPointer() {
-		for i, root := range gs.roots {
-			if root.off == off && root.typ == t {
-				gs.roots = append(gs.roots[:i], gs.roots[i+1:]...)
-				return
-			}
-		}
-		panic(fmt.Sprintf("GC root of type (%v) at offset (%v) not found", t, off))
-	}
-}
-
-func (gs *GcState) Snapshot() GcRoots {
-	return append([]GcRoot{}, gs.roots...)
-}
-
-// ---------------------------------------------------------------------------------------------------------------------
-
 type GcTypes struct {
 	types []*Type
 }
@@ -123,4 +61,62 @@ func (gt *GcTypes) AddBuiltins(symtab *SymTab) {
 func (gt *GcTypes) AssignId(typ *Type) int {
 	gt.types = append(gt.types, typ)
 	return len(gt.types) - 1
-}
\ No newline at end of file
+}
+func (gt *GcTypes) IdOf(typ *Type) int {
+	for id, t := range gt.types {
+		if t == typ {
+			return id
+		}
+	}
+	return 0 // Unknown
+}
+
+// Pointers within values of a type (or enum constructor), as word offsets
+type typeRoots struct {
+	name    string // Unique within program
+	offsets []int  // Empty when values hold no pointers
+}
+
+// Roots of each type in id order. Enum types appear once for each of their constructors, in tag order.
+func (gt *GcTypes) roots() []typeRoots {
+	var roots []typeRoots
+	tag := 0
+	var et *Type
+	for _, t := range gt.types {
+		switch t.Kind {
+		case String, Array, Bytes, Function:
+			roots = append(roots, typeRoots{})
+
+		case Struct:
+			var off []int
+			for _, f := range t.AsStruct().Fields {
+				if f.Type.IsPointer() {
+					off = append(off, f.Addr/ptrSize)
+				}
+			}
+			roots = append(roots, typeRoots{"struct_" + t.AsmName(), off})
+
+		case Enum:
+			if t != et {
+				tag = 0
+			}
+			et = t
+			cons := t.AsEnum().Members[tag]
+			if cons.AsEnumCons().Tag != tag {
+				panic("out of order!")
+			}
+			var off []int
+			for i, tp := range cons.Params {
+				if tp.IsPointer() {
+					off = append(off, i+1) // Skip tag!
+				}
+			}
+			roots = append(roots, typeRoots{fmt.Sprintf("enum_%v_tag_%v", t.AsmName(), tag), off})
+			tag += 1
+
+		default:
+			panic(fmt.Sprintf("Unexpected type for GC: %v (%v)\n", t.AsmName(), typeKindNames[t.Kind]))
+		}
+	}
+	return roots
+}
@@ -0,0 +1,194 @@
+package main
+
+// Inlining. Calls to small functions are replaced with a copy of the callee's body. This runs before SSA construction
+// so every copied temp can simply be renamed, parameters become copies of the arguments and each return becomes a copy
+// into the call's result followed by a jump to the code after the call.
+//
+// Cost model: a callee is inlined when its size (in instructions) is within budget. With a profile, call sites which
+// never executed are not inlined & hot ones are allowed a larger budget. Functions declared #[Inline] are always inlined
+// (where possible) & those declared #[NoInline] never are, regardless of size or profile.
+
+const inlineBudget = 16
+const hotInlineBudget = 64
+
+// Call sites executing at least this fraction of the hottest block's count are hot
+const hotCallRatio = 10
+
+func inlineCalls(fns []*irFunc, gt *GcTypes) {
+
+	byName := make(map[string]*irFunc)
+	hottest := 0
+	for _, f := range fns {
+		byName[f.name] = f
+		for _, b := range f.blocks {
+			if b.count > hottest {
+				hottest = b.count
+			}
+		}
+	}
+
+	// Callees are visited before callers so calls within them are already inlined
+	for _, f := range callGraphPostorder(fns, byName) {
+		// Only original call sites are considered so inlined code is never itself expanded
+		work := append([]*irBlock(nil), f.blocks...)
+		for len(work) > 0 {
+			b := work[0]
+			work = work[1:]
+			for k, i := range b.instrs {
+				if i.op != irCall || i.sym == nil {
+					continue
+				}
+				callee := byName[i.fn.AsmName(i.sym.Name)]
+				if callee == nil || !f.shouldInline(b, i, callee, hottest) {
+					continue
+				}
+				work = append([]*irBlock{f.inline(b, k, callee)}, work...)
+				break
+			}
+		}
+		f.cfg()
+	}
+}
+
+func callGraphPostorder(fns []*irFunc, byName map[string]*irFunc) []*irFunc {
+	var order []*irFunc
+	visited := make(map[*irFunc]bool)
+	var visit func(f *irFunc)
+	visit = func(f *irFunc) {
+		visited[f] = true
+		for _, b := range f.blocks {
+			for _, i := range b.instrs {
+				if i.op != irCall || i.sym == nil {
+					continue
+				}
+				if callee := byName[i.fn.AsmName(i.sym.Name)]; callee != nil && !visited[callee] {
+					visit(callee)
+				}
+			}
+		}
+		order = append(order, f)
+	}
+	for _, f := range fns {
+		if !visited[f] {
+			visit(f)
+		}
+	}
+	return order
+}
+
+func (f *irFunc) shouldInline(site *irBlock, call *irInstr, callee *irFunc, hottest int) bool {
+	if callee == f || f.attrs.isExternalReturn() || len(call.args) != len(callee.params) || !callee.isInlinable() {
+		return false // NOTE: Frames of functions called externally are not scanned by the GC
+	}
+	switch {
+	case callee.attrs.isNoInline():
+		return false // NOTE: Takes precedence when both are declared
+	case callee.attrs.isInline():
+		return true
+	}
+	budget := inlineBudget
+	if f.profiled {
+		switch {
+		case site.count == 0:
+			return false // Never executed
+		case site.count*hotCallRatio >= hottest:
+			budget = hotInlineBudget
+		}
+	}
+	return callee.size() <= budget
+}
+
+// Functions whose semantics are tied to their own stack frame or calling convention must always be called
+func (f *irFunc) isInlinable() bool {
+	if !f.typ.Is(Normal) || f.attrs.isExternalReturn() || f.attrs.requiresRawValues() {
+		return false // NOTE: Constructors must remain calls for escape analysis
+	}
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.op == irCall && i.sym != nil && (i.sym.Name == "getFramePointer" || i.fn.AsmName(i.sym.Name) == f.name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *irFunc) size() int {
+	n := 0
+	for _, b := range f.blocks {
+		n += len(b.instrs)
+	}
+	return n
+}
+
+// Replaces the call at b.instrs[k] with a copy of the callee, returning the block holding the code after the call
+func (f *irFunc) inline(b *irBlock, k int, callee *irFunc) *irBlock {
+
+	call := b.instrs[k]
+	after := f.newBlock()
+	after.instrs = append([]*irInstr(nil), b.instrs[k+1:]...)
+	after.count = b.count
+	b.instrs = b.instrs[:k]
+
+	temps := make(map[*irTemp]*irTemp)
+	rename := func(t *irTemp) *irTemp {
+		if temps[t] == nil {
+			temps[t] = f.newTemp(t.typ, t.sym)
+		}
+		return temps[t]
+	}
+	blocks := make(map[*irBlock]*irBlock)
+	for _, cb := range callee.blocks {
+		blocks[cb] = f.newBlock()
+		blocks[cb].count = b.count
+		if entry := callee.blocks[0].count; callee.profiled && entry > 0 {
+			blocks[cb].count = cb.count * b.count / entry // Scale to this call site
+		}
+	}
+
+	// Bind parameters
+	for j, p := range callee.params {
+		b.instrs = append(b.instrs, &irInstr{op: irCopy, dst: rename(p), args: []*irTemp{call.args[j]}})
+	}
+	b.instrs = append(b.instrs, &irInstr{op: irJmp, succs: []*irBlock{blocks[callee.blocks[0]]}})
+
+	// Copy body
+	var copied []*irBlock
+	for _, cb := range callee.blocks {
+		nb := blocks[cb]
+		for _, i := range cb.instrs {
+			if i.op == irRet {
+				if call.dst != nil && len(i.args) > 0 {
+					nb.instrs = append(nb.instrs, &irInstr{op: irCopy, dst: call.dst, args: []*irTemp{rename(i.args[0])}})
+				}
+				nb.instrs = append(nb.instrs, &irInstr{op: irJmp, succs: []*irBlock{after}})
+				continue
+			}
+			cp := *i
+			cp.args = nil
+			for _, arg := range i.args {
+				cp.args = append(cp.args, rename(arg))
+			}
+			if i.dst != nil {
+				cp.dst = rename(i.dst)
+			}
+			cp.succs = nil
+			for _, succ := range i.succs {
+				cp.succs = append(cp.succs, blocks[succ])
+			}
+			nb.instrs = append(nb.instrs, &cp)
+		}
+		copied = append(copied, nb)
+	}
+
+	// Place callee blocks & the remainder immediately after the call
+	var order []*irBlock
+	for _, x := range f.blocks {
+		order = append(order, x)
+		if x == b {
+			order = append(append(order, copied...), after)
+		}
+	}
+	f.blocks = order
+	return after
+}
@@ -38,7 +38,9 @@ int main(int argc, char** argv, char** envp)
         }
     }
 
+    // Output profile (if instrumented) however the program exits
+    atexit(writeProfile);
+
     // Program entry point
-    clara_asm_entrypoint(argc, argv, envp);
-    return 0;
+    return clara_asm_entrypoint(argc, argv, envp);
 }
\ No newline at end of file
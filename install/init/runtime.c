@@ -3,7 +3,18 @@
 #include <stdio.h>
 #include <stdarg.h>
 #include <string.h>
+#include <time.h>
 #include <errno.h>
+#include <fcntl.h>
+#include <netdb.h>
+#include <pthread.h>
+#include <signal.h>
+#include <spawn.h>
+#include <unistd.h>
+#include <sys/socket.h>
+#include <sys/wait.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
 #include "shared.h"
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -14,6 +25,98 @@ intptr_t blocks;
 intptr_t getBlocks() { return blocks; }
 void setBlocks(intptr_t b) { blocks = b; }
 
+// Collections are paced by allocation. One is due once the bytes allocated since the last exceed both those which
+// survived it & a minimum, so the heap grows to around twice its live size. Setting CLARA_GC_STRESS collects on every
+// allocation instead, which finds missing roots quickly.
+#define GC_MIN_HEAP (4 << 20)
+
+intptr_t heapLive;      // Bytes surviving the last collection
+intptr_t heapAllocated; // Bytes allocated since the last collection
+int gcStress = -1;      // Read from the environment on first allocation
+
+// Totals of every allocation, whichever the memory strategy, excluding block headers (See: allocCount())
+intptr_t allocs, allocBytes;
+
+int gcDue(intptr_t size)
+{
+    if (gcStress == -1) {
+        gcStress = getenv("CLARA_GC_STRESS") != NULL;
+    }
+    heapAllocated += size;
+    allocs++;
+    allocBytes += size;
+    return gcStress || (heapAllocated > heapLive && heapAllocated > GC_MIN_HEAP);
+}
+
+void gcCollected(intptr_t live)
+{
+    heapLive = live;
+    heapAllocated = 0;
+}
+
+// Reference counted blocks are freed as they become unreachable so the heap is never collected (-alloc=rc)
+void rcAllocated(intptr_t size)
+{
+    heapAllocated += size;
+    allocs++;
+    allocBytes += size;
+}
+void rcFreed(intptr_t size) { heapAllocated -= size; }
+
+intptr_t heapSize() { return heapLive + heapAllocated; }
+intptr_t allocCount() { return allocs; }
+intptr_t allocatedBytes() { return allocBytes; }
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Arena Support (-alloc=arena)
+
+// Memory is bump allocated from zeroed chunks. Resetting to a mark releases every chunk allocated since & clears the
+// remainder of the chunk the mark is within.
+#define ARENA_CHUNK (1 << 20)
+
+typedef struct chunk {
+    struct chunk *prev;
+    intptr_t next, end; // Next free byte & end of chunk
+} chunk;
+
+chunk *arena;
+
+intptr_t arenaAlloc(intptr_t size)
+{
+    allocs++;
+    allocBytes += size - 16; // Less the block header (See: arenalloc())
+    size = (size + 7) & ~7;
+    if (arena == NULL || arena->end - arena->next < size) {
+        intptr_t capacity = size > ARENA_CHUNK ? size : ARENA_CHUNK;
+        chunk *c = calloc(1, sizeof(chunk) + capacity);
+        if (c == NULL) {
+            return 0;
+        }
+        c->prev = arena;
+        c->next = (intptr_t) (c + 1);
+        c->end = c->next + capacity;
+        arena = c;
+    }
+    intptr_t p = arena->next;
+    arena->next += size;
+    return p;
+}
+
+intptr_t arenaMark() { return arena == NULL ? 0 : arena->next; }
+
+void arenaReset(intptr_t mark)
+{
+    while (arena != NULL && !(mark >= (intptr_t) (arena + 1) && mark <= arena->end)) {
+        chunk *prev = arena->prev;
+        free(arena);
+        arena = prev;
+    }
+    if (arena != NULL) {
+        memset((void *) mark, 0, arena->next - mark);
+        arena->next = mark;
+    }
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 // Stack frame support
 
@@ -30,6 +133,233 @@ int isStackBase(intptr_t frame)
     return frame == stackBase;
 }
 
+// GC roots of the frame a frame returns to. Calls are followed by the address of the caller's GC map relative to the
+// return address. See: genFnCall() in codegen.go
+intptr_t frameRoots(intptr_t frame)
+{
+    intptr_t ret = ((intptr_t *) frame)[1];
+    return ret + *((intptr_t *) ret);
+}
+
+// Site of the call a frame returns to, which precedes its GC map. See: callSite in runtime.clara
+intptr_t frameSite(intptr_t frame)
+{
+    return ((intptr_t *) frameRoots(frame))[-1];
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Thread support
+
+// Threads share the heap so only the holder of the runtime lock runs Clara code. The main thread takes it when the
+// first thread is started & a thread releases it while blocked (See: park()), recording its innermost frame so the GC
+// may scan its stack from another thread.
+typedef struct thread {
+    pthread_t id;
+    intptr_t function;          // Run by the thread & a GC root until it finishes
+    intptr_t stackBase;         // Saved while blocked
+    intptr_t parked;            // Innermost frame while blocked, otherwise 0
+    int started;
+    struct thread *prev, *next; // Unfinished threads
+} thread;
+
+static pthread_mutex_t runtimeLock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_cond_t threadStarted = PTHREAD_COND_INITIALIZER;
+static thread mainThread;
+static thread *threads;
+static __thread thread *self; // NULL until a thread is started
+
+// Implemented in assembly by codegen.go. Calls threadEntry().
+void clara_asm_threadEntry(intptr_t function);
+
+static void addThread(thread *t)
+{
+    t->next = threads;
+    if (threads != NULL) {
+        threads->prev = t;
+    }
+    threads = t;
+}
+
+static void removeThread(thread *t)
+{
+    if (t->prev != NULL) {
+        t->prev->next = t->next;
+    } else {
+        threads = t->next;
+    }
+    if (t->next != NULL) {
+        t->next->prev = t->prev;
+    }
+}
+
+// Releases the runtime lock before blocking. frame is the innermost frame of the calling thread, which must hold no
+// pointers.
+static void park(intptr_t frame)
+{
+    if (self != NULL) {
+        self->parked = frame;
+        self->stackBase = stackBase;
+        pthread_mutex_unlock(&runtimeLock);
+    }
+}
+
+static void unpark()
+{
+    if (self != NULL) {
+        pthread_mutex_lock(&runtimeLock);
+        self->parked = 0;
+        stackBase = self->stackBase;
+    }
+}
+
+static void *runThread(void *arg)
+{
+    thread *t = arg;
+    self = t;
+    pthread_mutex_lock(&runtimeLock);
+    t->started = 1;
+    pthread_cond_broadcast(&threadStarted);
+    clara_asm_threadEntry(t->function);
+    removeThread(t);
+    pthread_mutex_unlock(&runtimeLock);
+    return NULL;
+}
+
+// Starts a thread running a Clara function, returning once it has taken the runtime lock. Returns its handle or -1 &
+// sets errno.
+intptr_t startThread(intptr_t function, intptr_t frame)
+{
+    if (self == NULL) {
+        mainThread.id = pthread_self();
+        mainThread.started = 1;
+        addThread(&mainThread);
+        self = &mainThread;
+        pthread_mutex_lock(&runtimeLock);
+    }
+    thread *t = calloc(1, sizeof(thread));
+    if (t == NULL) {
+        return -1;
+    }
+    t->function = function;
+    int err = pthread_create(&t->id, NULL, runThread, t);
+    if (err != 0) {
+        free(t);
+        errno = err;
+        return -1;
+    }
+    addThread(t);
+    self->parked = frame;
+    self->stackBase = stackBase;
+    while (!t->started) {
+        pthread_cond_wait(&threadStarted, &runtimeLock);
+    }
+    self->parked = 0;
+    stackBase = self->stackBase;
+    return (intptr_t) t;
+}
+
+// Waits for a thread to finish & releases it. Returns 0 or an error number.
+intptr_t joinThread(intptr_t t, intptr_t frame)
+{
+    if ((thread *) t == self) {
+        return EDEADLK;
+    }
+    park(frame);
+    int err = pthread_join(((thread *) t)->id, NULL);
+    unpark();
+    if (err == 0) {
+        free((thread *) t);
+    }
+    return err;
+}
+
+intptr_t currentThread() { return (intptr_t) pthread_self(); }
+
+// Unfinished threads, for the GC
+intptr_t firstThread() { return (intptr_t) threads; }
+intptr_t nextThread(intptr_t t) { return (intptr_t) ((thread *) t)->next; }
+intptr_t threadFunction(intptr_t t) { return ((thread *) t)->function; }
+intptr_t parkedFrame(intptr_t t) { return ((thread *) t)->parked; }
+intptr_t threadStackBase(intptr_t t) { return ((thread *) t)->stackBase; }
+
+// Mutexes & condition variables are stored in bytes allocated by Clara code (See: thread.clara)
+intptr_t mutexSize() { return sizeof(pthread_mutex_t); }
+intptr_t condvarSize() { return sizeof(pthread_cond_t); }
+void initMutex(pthread_mutex_t *m) { pthread_mutex_init(m, NULL); }
+void initCondvar(pthread_cond_t *c) { pthread_cond_init(c, NULL); }
+
+// Blocks only if another thread holds the mutex
+void lockMutex(pthread_mutex_t *m, intptr_t frame)
+{
+    if (pthread_mutex_trylock(m) != 0) {
+        park(frame);
+        pthread_mutex_lock(m);
+        unpark();
+    }
+}
+
+void unlockMutex(pthread_mutex_t *m) { pthread_mutex_unlock(m); }
+
+void waitCondvar(pthread_cond_t *c, pthread_mutex_t *m, intptr_t frame)
+{
+    park(frame);
+    pthread_cond_wait(c, m);
+    unpark();
+}
+
+void signalCondvar(pthread_cond_t *c) { pthread_cond_signal(c); }
+void broadcastCondvar(pthread_cond_t *c) { pthread_cond_broadcast(c); }
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Signal support
+//
+// Handlers cannot run Clara code as the signal may arrive at any point, so the number of each signal received is written
+// to a pipe & Clara handlers run on a thread of their own which reads it (See: signal.clara).
+// ---------------------------------------------------------------------------------------------------------------------
+
+static int signalPipe[2] = { -1, -1 };
+
+static void signalHandler(int sig)
+{
+    int saved = errno;
+    unsigned char b = sig;
+    write(signalPipe[1], &b, 1);
+    errno = saved;
+}
+
+// Sends each future signal to waitSignal(). Returns -1 & sets errno on failure.
+intptr_t handleSignal(intptr_t sig)
+{
+    if (signalPipe[0] == -1) {
+        if (pipe(signalPipe) == -1) {
+            return -1;
+        }
+        fcntl(signalPipe[0], F_SETFD, FD_CLOEXEC);
+        fcntl(signalPipe[1], F_SETFD, FD_CLOEXEC);
+    }
+    struct sigaction sa = { 0 };
+    sa.sa_handler = signalHandler;
+    sa.sa_flags = SA_RESTART;
+    sigemptyset(&sa.sa_mask);
+    return sigaction(sig, &sa, NULL);
+}
+
+// Waits for the next signal sent by handleSignal(). Returns its number or -1 & sets errno.
+intptr_t waitSignal(intptr_t frame)
+{
+    unsigned char b;
+    ssize_t n;
+    park(frame);
+    while ((n = read(signalPipe[0], &b, 1)) == -1 && errno == EINTR) {
+    }
+    int saved = errno;
+    unpark();
+    errno = saved;
+    return n == 1 ? b : -1;
+}
+
+intptr_t raiseSignal(intptr_t sig) { return raise(sig); }
+
 // ---------------------------------------------------------------------------------------------------------------------
 // Runtime support
 
@@ -37,6 +367,10 @@ intptr_t runtime;         // Set on program start
 void setRuntime(intptr_t r) { runtime = r; }
 intptr_t getRuntime() { return runtime; }
 
+// Environment of shared libraries, which have no envp
+extern char **environ;
+intptr_t getEnviron() { return (intptr_t) environ; }
+
 // ---------------------------------------------------------------------------------------------------------------------
 // Debug support
 
@@ -56,7 +390,246 @@ void debug(char *logType, char *format, ...)
     va_end(args);
 }
 
+// ---------------------------------------------------------------------------------------------------------------------
+// Profile support (See: profile.go)
+
+struct counter {
+    char *fn;
+    intptr_t block;
+    intptr_t count;
+};
+
+struct profile {
+    intptr_t size;
+    char *path;
+    struct counter *counters;
+};
+
+extern struct profile clara_profile; // Output by codegen.go
+
+void writeProfile()
+{
+    if (clara_profile.size == 0) {
+        return; // Not instrumented
+    }
+    FILE *f = fopen(clara_profile.path, "w");
+    if (f == NULL) {
+        fprintf(stderr, "Failed to write profile: %s: %s\n", clara_profile.path, strerror(errno));
+        return;
+    }
+    for (intptr_t i = 0; i < clara_profile.size; i++) {
+        struct counter *c = &clara_profile.counters[i];
+        fprintf(f, "%s %ld %ld\n", c->fn, (long) c->block, (long) c->count);
+    }
+    fclose(f);
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 // Error support
 
 int errnum() { return errno; }
+
+// ---------------------------------------------------------------------------------------------------------------------
+// IO support
+
+// Writes any output buffered by printf() so prompts are seen before reading input
+void flushOutput() { fflush(stdout); }
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Process support
+
+// Starts a program found on the PATH. Its name & arguments are NUL separated within args. Standard output is
+// redirected to out unless it is -1. Returns the process ID or -1 & sets errno.
+intptr_t spawn(char *args, intptr_t argc, intptr_t out)
+{
+    char **argv = calloc(argc + 1, sizeof(char *));
+    if (argv == NULL) {
+        return -1;
+    }
+    for (intptr_t i = 0; i < argc; i++) {
+        argv[i] = args;
+        args += strlen(args) + 1;
+    }
+    posix_spawn_file_actions_t actions;
+    posix_spawn_file_actions_init(&actions);
+    if (out != -1) {
+        posix_spawn_file_actions_adddup2(&actions, out, STDOUT_FILENO);
+    }
+    fflush(stdout); // Output in order
+    pid_t pid;
+    int err = posix_spawnp(&pid, argv[0], &actions, NULL, argv, environ);
+    posix_spawn_file_actions_destroy(&actions);
+    free(argv);
+    if (err != 0) {
+        errno = err;
+        return -1;
+    }
+    return pid;
+}
+
+// Waits for a process to exit. Returns its exit status, 128 + the number of the signal which killed it or -1 & sets
+// errno.
+intptr_t waitProcess(intptr_t pid)
+{
+    int status;
+    while (waitpid(pid, &status, 0) == -1) {
+        if (errno != EINTR) {
+            return -1;
+        }
+    }
+    return WIFSIGNALED(status) ? 128 + WTERMSIG(status) : WEXITSTATUS(status);
+}
+
+// Opens a pipe which is not inherited by child processes. Returns (read << 32) | write or -1 & sets errno.
+intptr_t openPipe()
+{
+    int fds[2];
+    if (pipe(fds) == -1) {
+        return -1;
+    }
+    fcntl(fds[0], F_SETFD, FD_CLOEXEC);
+    fcntl(fds[1], F_SETFD, FD_CLOEXEC);
+    return ((intptr_t) fds[0] << 32) | fds[1];
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Network support
+
+// Resolves host & port then listens on (or connects to) each address in turn until one succeeds. An empty host listens
+// on every local address. Writes to a closed connection fail with EPIPE rather than raising SIGPIPE. Returns a socket
+// which is not inherited by child processes or -1 & sets errno.
+static intptr_t tcpSocket(char *host, intptr_t port, int server)
+{
+    signal(SIGPIPE, SIG_IGN);
+    struct addrinfo hints = {0};
+    hints.ai_family = AF_UNSPEC;
+    hints.ai_socktype = SOCK_STREAM;
+    hints.ai_flags = server ? AI_PASSIVE : 0;
+    char service[24];
+    snprintf(service, sizeof(service), "%ld", (long) port);
+    struct addrinfo *addrs;
+    int err = getaddrinfo(*host == '\0' ? NULL : host, service, &hints, &addrs);
+    if (err != 0) {
+        errno = err == EAI_SYSTEM ? errno : ENXIO;
+        return -1;
+    }
+    int fd = -1;
+    for (struct addrinfo *a = addrs; a != NULL; a = a->ai_next) {
+        fd = socket(a->ai_family, a->ai_socktype, a->ai_protocol);
+        if (fd == -1) {
+            continue;
+        }
+        fcntl(fd, F_SETFD, FD_CLOEXEC);
+        if (server) {
+            int on = 1;
+            setsockopt(fd, SOL_SOCKET, SO_REUSEADDR, &on, sizeof(on));
+            if (bind(fd, a->ai_addr, a->ai_addrlen) == 0 && listen(fd, SOMAXCONN) == 0) {
+                break;
+            }
+        } else if (connect(fd, a->ai_addr, a->ai_addrlen) == 0) {
+            break;
+        }
+        int saved = errno;
+        close(fd);
+        errno = saved;
+        fd = -1;
+    }
+    freeaddrinfo(addrs);
+    return fd;
+}
+
+intptr_t tcpListen(char *host, intptr_t port) { return tcpSocket(host, port, 1); }
+intptr_t tcpConnect(char *host, intptr_t port) { return tcpSocket(host, port, 0); }
+
+// Waits for a connection to a listening socket. Returns its socket or -1 & sets errno.
+intptr_t tcpAccept(intptr_t fd, intptr_t frame)
+{
+    fflush(stdout); // Output is seen while waiting
+    int conn;
+    park(frame);
+    while ((conn = accept(fd, NULL, NULL)) == -1 && errno == EINTR) {
+    }
+    int saved = errno;
+    unpark();
+    if (conn == -1) {
+        errno = saved;
+        return -1;
+    }
+    fcntl(conn, F_SETFD, FD_CLOEXEC);
+    return conn;
+}
+
+// Local port of a socket or -1 & sets errno
+intptr_t socketPort(intptr_t fd)
+{
+    struct sockaddr_storage addr;
+    socklen_t len = sizeof(addr);
+    if (getsockname(fd, (struct sockaddr *) &addr, &len) == -1) {
+        return -1;
+    }
+    switch (addr.ss_family) {
+    case AF_INET:
+        return ntohs(((struct sockaddr_in *) &addr)->sin_port);
+    case AF_INET6:
+        return ntohs(((struct sockaddr_in6 *) &addr)->sin6_port);
+    default:
+        errno = EAFNOSUPPORT;
+        return -1;
+    }
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Random support
+
+// SplitMix64 (See: https://prng.di.unimi.it/splitmix64.c). Seeded from the time & process ID on first use unless seeded
+// explicitly.
+uint64_t randomState;
+int randomSeeded;
+
+void seedRandom(intptr_t seed)
+{
+    randomState = seed;
+    randomSeeded = 1;
+}
+
+static uint64_t nextRandom()
+{
+    if (!randomSeeded) {
+        seedRandom((intptr_t) time(NULL) ^ ((intptr_t) getpid() << 32));
+    }
+    uint64_t z = (randomState += 0x9e3779b97f4a7c15);
+    z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9;
+    z = (z ^ (z >> 27)) * 0x94d049bb133111eb;
+    return z ^ (z >> 31);
+}
+
+// Uniformly distributed in [0, n), rejecting values which would bias the result to lower numbers. n must be positive.
+intptr_t randomBelow(intptr_t n)
+{
+    uint64_t limit = UINT64_MAX - UINT64_MAX % (uint64_t) n;
+    uint64_t x;
+    do {
+        x = nextRandom();
+    } while (x >= limit);
+    return (intptr_t) (x % (uint64_t) n);
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Time support
+
+intptr_t monotonicNanos()
+{
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (intptr_t) ts.tv_sec * 1000000000 + ts.tv_nsec;
+}
+
+// Sleeps for the remaining time if interrupted by a signal. Other threads run meanwhile.
+void sleepMillis(intptr_t ms, intptr_t frame)
+{
+    struct timespec ts = { ms / 1000, (ms % 1000) * 1000000 };
+    park(frame);
+    while (nanosleep(&ts, &ts) == -1 && errno == EINTR) {
+    }
+    unpark();
+}
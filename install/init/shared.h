@@ -1,2 +1,5 @@
 // Set in main.c to enable verbose GC logging
-extern int debugGc;
\ No newline at end of file
+extern int debugGc;
+
+// Defined in runtime.c to output block counts of instrumented programs
+void writeProfile();
\ No newline at end of file
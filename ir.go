@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/g-dx/clarac/lex"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Typed three-address intermediate representation. Each function is a list of basic blocks holding instructions
+// over an unbounded set of typed temporaries. Values are "semantic" (i.e. ints are not tagged) - it is the job of
+// instruction selection to choose a machine representation.
+
+type irOp int
+
+const (
+	irConst      = irOp(iota + 1) // dst = val
+	irString                      // dst = str
+	irFnAddr                      // dst = &sym
+	irCopy                        // dst = args[0]
+	irAdd                         // dst = args[0] + args[1]
+	irSub                         // dst = args[0] - args[1]
+	irMul                         // dst = args[0] * args[1]
+	irDiv                         // dst = args[0] / args[1] (truncated)
+	irMod                         // dst = args[0] % args[1] (sign of args[0])
+	irAnd                         // dst = args[0] & args[1]
+	irOr                          // dst = args[0] | args[1]
+	irXor                         // dst = args[0] ^ args[1]
+	irShl                         // dst = args[0] << args[1]
+	irShr                         // dst = args[0] >> args[1] (arithmetic)
+	irNeg                         // dst = -args[0]
+	irBNot                        // dst = ^args[0]
+	irNot                         // dst = !args[0]
+	irEq                          // dst = args[0] == args[1]
+	irLt                          // dst = args[0] < args[1]
+	irLte                         // dst = args[0] <= args[1]
+	irGt                          // dst = args[0] > args[1]
+	irGte                         // dst = args[0] >= args[1]
+	irLoad                        // dst = args[0].[val]
+	irStore                       // args[0].[val] = args[1]
+	irIndex                       // dst = args[0][args[1]] (bounds checked)
+	irSetIndex                    // args[0][args[1]] = args[2] (bounds checked)
+	irCall                        // dst = sym(args...) or args[0](args[1:]...) if sym is nil
+	irRet                         // return args[0] (if any)
+	irJmp                         // goto succs[0]
+	irBr                          // if args[0] goto succs[0] else goto succs[1]
+	irPhi                         // dst = args[i] when entered from block preds[i]
+	irStackAlloc                  // dst = &struct in stack frame with GC type id val
+	irCount                       // counters[val]++ (See: profile.go)
+)
+
+var irOpNames = map[irOp]string{
+	irConst:      "const",
+	irString:     "str",
+	irFnAddr:     "fnaddr",
+	irCopy:       "copy",
+	irAdd:        "add",
+	irSub:        "sub",
+	irMul:        "mul",
+	irDiv:        "div",
+	irMod:        "mod",
+	irAnd:        "and",
+	irOr:         "or",
+	irXor:        "xor",
+	irShl:        "shl",
+	irShr:        "shr",
+	irNeg:        "neg",
+	irBNot:       "bnot",
+	irNot:        "not",
+	irEq:         "eq",
+	irLt:         "lt",
+	irLte:        "lte",
+	irGt:         "gt",
+	irGte:        "gte",
+	irLoad:       "load",
+	irStore:      "store",
+	irIndex:      "index",
+	irSetIndex:   "setindex",
+	irCall:       "call",
+	irRet:        "ret",
+	irJmp:        "jmp",
+	irBr:         "br",
+	irPhi:        "phi",
+	irStackAlloc: "stackalloc",
+	irCount:      "count",
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type irTemp struct {
+	id  int
+	typ *Type
+	sym *Symbol // Source variable (if any)
+}
+
+func (t *irTemp) String() string {
+	if t.sym != nil {
+		return fmt.Sprintf("%v.%d", t.sym.Name, t.id)
+	}
+	return "t" + strconv.Itoa(t.id)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type irInstr struct {
+	op    irOp
+	dst   *irTemp
+	args  []*irTemp
+	val   int           // Constant value or field offset
+	str   string        // String literal (quoted)
+	sym   *Symbol       // Callee or function
+	fn    *FunctionType // Callee type
+	succs []*irBlock    // Branch targets
+
+	unchecked bool       // Index proven to be within bounds or field access of a struct proven non-null
+	pos       *lex.Token // Statement lowered from (if any)
+}
+
+// Field accesses check for a null struct, which zeroed memory (e.g. an uninitialised array element) may hold
+func (i *irInstr) isNullChecked() bool {
+	return (i.op == irLoad || i.op == irStore) && !i.unchecked && i.args[0].typ.Is(Struct)
+}
+
+func (i *irInstr) isTerminator() bool {
+	return i.op == irRet || i.op == irJmp || i.op == irBr
+}
+
+func (i *irInstr) String() string {
+	var buf bytes.Buffer
+	if i.dst != nil {
+		fmt.Fprintf(&buf, "%v:%v = ", i.dst, i.dst.typ)
+	}
+	buf.WriteString(irOpNames[i.op])
+
+	var ops []string
+	switch i.op {
+	case irConst, irStackAlloc, irCount:
+		ops = append(ops, strconv.Itoa(i.val))
+	case irString:
+		ops = append(ops, i.str)
+	case irFnAddr:
+		ops = append(ops, i.sym.Name)
+	case irLoad, irStore:
+		ops = append(ops, fmt.Sprintf("%v.[%d]", i.args[0], i.val))
+		for _, arg := range i.args[1:] {
+			ops = append(ops, arg.String())
+		}
+	case irPhi:
+		// NOTE: Only printable when arguments are ordered by predecessor
+		for _, arg := range i.args {
+			ops = append(ops, arg.String())
+		}
+	case irCall:
+		args := i.args
+		callee := ""
+		if i.sym != nil {
+			callee = i.sym.Name
+		} else {
+			callee = "*" + args[0].String()
+			args = args[1:]
+		}
+		var vals []string
+		for _, arg := range args {
+			vals = append(vals, arg.String())
+		}
+		ops = append(ops, fmt.Sprintf("%v(%v)", callee, strings.Join(vals, ", ")))
+	default:
+		for _, arg := range i.args {
+			ops = append(ops, arg.String())
+		}
+	}
+	for _, succ := range i.succs {
+		ops = append(ops, succ.String())
+	}
+	if i.unchecked {
+		ops = append(ops, "unchecked")
+	}
+	if len(ops) > 0 {
+		buf.WriteString(" ")
+		buf.WriteString(strings.Join(ops, ", "))
+	}
+	return buf.String()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type irBlock struct {
+	id     int
+	instrs []*irInstr
+	preds  []*irBlock
+	idom   *irBlock   // Immediate dominator (entry block is its own)
+	doms   []*irBlock // Blocks immediately dominated by this block
+	count  int        // Execution count from profile (if any)
+}
+
+func (b *irBlock) String() string {
+	return "b" + strconv.Itoa(b.id)
+}
+
+func (b *irBlock) last() *irInstr {
+	if len(b.instrs) == 0 {
+		return nil
+	}
+	return b.instrs[len(b.instrs)-1]
+}
+
+func (b *irBlock) isTerminated() bool {
+	last := b.last()
+	return last != nil && last.isTerminator()
+}
+
+// Phis always appear at the start of a block
+func (b *irBlock) phis() []*irInstr {
+	n := 0
+	for n < len(b.instrs) && b.instrs[n].op == irPhi {
+		n++
+	}
+	return b.instrs[:n]
+}
+
+func (b *irBlock) succs() []*irBlock {
+	if last := b.last(); last != nil {
+		return last.succs
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type irFunc struct {
+	name   string // Assembly name
+	attrs  attributes
+	typ    *FunctionType
+	params []*irTemp
+	temps  []*irTemp
+	blocks []*irBlock // blocks[0] is the entry block
+
+	profiled bool // Blocks are weighted by execution count
+}
+
+func (f *irFunc) newTemp(t *Type, s *Symbol) *irTemp {
+	tmp := &irTemp{id: len(f.temps), typ: t, sym: s}
+	f.temps = append(f.temps, tmp)
+	return tmp
+}
+
+// Blocks are laid out in the order they are placed, not created
+func (f *irFunc) newBlock() *irBlock {
+	return &irBlock{id: -1}
+}
+
+func (f *irFunc) place(b *irBlock) {
+	b.id = len(f.blocks)
+	f.blocks = append(f.blocks, b)
+}
+
+// Blocks reachable from entry
+func (f *irFunc) reachableBlocks() map[*irBlock]bool {
+	reachable := make(map[*irBlock]bool)
+	work := []*irBlock{f.blocks[0]}
+	reachable[f.blocks[0]] = true
+	for len(work) > 0 {
+		b := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, succ := range b.succs() {
+			if !reachable[succ] {
+				reachable[succ] = true
+				work = append(work, succ)
+			}
+		}
+	}
+	return reachable
+}
+
+// Remove blocks unreachable from entry, renumber the remainder & recompute predecessors
+func (f *irFunc) cfg() {
+	reachable := f.reachableBlocks()
+	var blocks []*irBlock
+	for _, b := range f.blocks {
+		if reachable[b] {
+			b.id = len(blocks)
+			b.preds = nil
+			blocks = append(blocks, b)
+		}
+	}
+	for _, b := range blocks {
+		for _, succ := range b.succs() {
+			succ.preds = append(succ.preds, b)
+		}
+	}
+	f.blocks = blocks
+}
+
+// Live temps on entry to & exit from each block, indexed by block id
+func (f *irFunc) liveness() (in []irSet, out []irSet) {
+	in = make([]irSet, len(f.blocks))
+	out = make([]irSet, len(f.blocks))
+	use := make([]irSet, len(f.blocks))
+	def := make([]irSet, len(f.blocks))
+	for _, b := range f.blocks {
+		in[b.id] = newIrSet(len(f.temps))
+		out[b.id] = newIrSet(len(f.temps))
+		use[b.id] = newIrSet(len(f.temps))
+		def[b.id] = newIrSet(len(f.temps))
+		for _, i := range b.instrs {
+			if i.op != irPhi {
+				for _, arg := range i.args {
+					if !def[b.id].has(arg) {
+						use[b.id].add(arg)
+					}
+				}
+			}
+			if i.dst != nil {
+				def[b.id].add(i.dst)
+			}
+		}
+	}
+
+	// Phi arguments are used on exit from the corresponding predecessor
+	for _, b := range f.blocks {
+		for _, i := range b.phis() {
+			for j, arg := range i.args {
+				out[b.preds[j].id].add(arg)
+			}
+		}
+	}
+
+	// Iterate to a fixed point, visiting blocks in reverse as liveness flows backwards
+	for changed := true; changed; {
+		changed = false
+		for j := len(f.blocks) - 1; j >= 0; j-- {
+			b := f.blocks[j]
+			for _, succ := range b.succs() {
+				changed = out[b.id].union(in[succ.id]) || changed
+			}
+			live := out[b.id].copy()
+			live.subtract(def[b.id])
+			live.union(use[b.id])
+			changed = in[b.id].union(live) || changed
+		}
+	}
+	return in, out
+}
+
+func (f *irFunc) print(out io.Writer) {
+	var params []string
+	for _, p := range f.params {
+		params = append(params, fmt.Sprintf("%v:%v", p, p.typ))
+	}
+	fmt.Fprintf(out, "fn %v(%v) %v\n", f.name, strings.Join(params, ", "), f.typ.ret)
+	for _, b := range f.blocks {
+		var preds []string
+		for _, pred := range b.preds {
+			preds = append(preds, pred.String())
+		}
+		var notes []string
+		if len(preds) > 0 {
+			notes = append(notes, "preds = "+strings.Join(preds, ", "))
+		}
+		if f.profiled {
+			notes = append(notes, "count = "+strconv.Itoa(b.count))
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(out, "%v: ; %v\n", b, strings.Join(notes, ", "))
+		} else {
+			fmt.Fprintf(out, "%v:\n", b)
+		}
+		for _, i := range b.instrs {
+			fmt.Fprintf(out, "    %v\n", i)
+		}
+	}
+	fmt.Fprintln(out)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Bitset of temps
+type irSet []uint64
+
+func newIrSet(n int) irSet {
+	return make(irSet, (n+63)/64)
+}
+
+func (s irSet) add(t *irTemp)      { s[t.id/64] |= 1 << uint(t.id%64) }
+func (s irSet) remove(t *irTemp)   { s[t.id/64] &^= 1 << uint(t.id%64) }
+func (s irSet) has(t *irTemp) bool { return s[t.id/64]&(1<<uint(t.id%64)) != 0 }
+
+func (s irSet) copy() irSet {
+	return append(irSet(nil), s...)
+}
+
+func (s irSet) union(o irSet) (changed bool) {
+	for i := range s {
+		v := s[i] | o[i]
+		changed = changed || v != s[i]
+		s[i] = v
+	}
+	return changed
+}
+
+func (s irSet) subtract(o irSet) {
+	for i := range s {
+		s[i] &^= o[i]
+	}
+}
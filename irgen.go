@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"github.com/g-dx/clarac/lex"
+	"strconv"
+)
+
+// Lowers a type checked (and fully rewritten) function declaration to IR
+type irBuilder struct {
+	f       *irFunc
+	cur     *irBlock
+	vars    map[*Symbol]*irTemp
+	stmt    *lex.Token // Statement being lowered
+	asserts *assertions
+}
+
+// Calls of assert() are expanded inline (See: runtime.clara)
+type assertions struct {
+	assert, failed *Symbol
+	elide          bool // Remove calls, including evaluation of their arguments
+}
+
+func lowerToIR(n *Node, gt *GcTypes, alloc *Symbol, asserts *assertions) *irFunc {
+
+	fnType := n.sym.Type.AsFunction()
+	b := &irBuilder{
+		f:       &irFunc{name: fnType.AsmName(n.sym.Name), attrs: n.attrs, typ: fnType},
+		vars:    make(map[*Symbol]*irTemp),
+		asserts: asserts,
+	}
+	b.setBlock(b.f.newBlock())
+
+	// Parameters occupy the first temps
+	for _, param := range n.params {
+		b.f.params = append(b.f.params, b.variable(param.sym))
+	}
+
+	switch fnType.Kind {
+	case StructCons, EnumCons:
+		b.constructor(n, gt.AssignId(fnType.ret), alloc)
+	case Normal, Closure:
+		switch n.op {
+		case opBlockFnDcl:
+			b.stmts(n.stmts)
+			if !b.cur.isTerminated() {
+				b.emit(&irInstr{op: irRet})
+			}
+		case opExprFnDcl:
+			b.stmt = n.stmts[0].token
+			b.ret(n.stmts[0])
+		}
+	default:
+		panic(fmt.Sprintf("Cannot lower function of kind: %v", fnType.Kind))
+	}
+
+	b.f.cfg()
+	return b.f
+}
+
+func (b *irBuilder) emit(i *irInstr) *irInstr {
+	// Code following a terminator is unreachable but must still be placed in a block
+	if b.cur.isTerminated() {
+		b.setBlock(b.f.newBlock())
+	}
+	if i.pos == nil {
+		i.pos = b.stmt
+	}
+	b.cur.instrs = append(b.cur.instrs, i)
+	return i
+}
+
+func (b *irBuilder) setBlock(blk *irBlock) {
+	b.f.place(blk)
+	b.cur = blk
+}
+
+func (b *irBuilder) jmp(to *irBlock) {
+	b.emit(&irInstr{op: irJmp, succs: []*irBlock{to}})
+}
+
+func (b *irBuilder) br(cond *irTemp, then *irBlock, els *irBlock) {
+	b.emit(&irInstr{op: irBr, args: []*irTemp{cond}, succs: []*irBlock{then, els}})
+}
+
+func (b *irBuilder) value(op irOp, t *Type, args ...*irTemp) *irTemp {
+	return b.emit(&irInstr{op: op, dst: b.f.newTemp(t, nil), args: args}).dst
+}
+
+func (b *irBuilder) constant(t *Type, v int) *irTemp {
+	return b.emit(&irInstr{op: irConst, dst: b.f.newTemp(t, nil), val: v}).dst
+}
+
+func (b *irBuilder) variable(s *Symbol) *irTemp {
+	if v, ok := b.vars[s]; ok {
+		return v
+	}
+	v := b.f.newTemp(s.Type, s)
+	b.vars[s] = v
+	return v
+}
+
+func (b *irBuilder) constructor(n *Node, id int, alloc *Symbol) {
+
+	fnType := n.sym.Type.AsFunction()
+	size := ptrSize * len(n.params)
+	if fnType.Is(EnumCons) {
+		size += ptrSize // space for tag
+	}
+
+	// Allocate memory of appropriate size
+	desc := b.emit(&irInstr{op: irString, dst: b.f.newTemp(stringType, nil), str: fmt.Sprintf("\"%v\"", fnType.Describe(n.token.Val))}).dst
+	args := []*irTemp{b.constant(intType, size), desc, b.constant(intType, id)}
+	allocFn := alloc.Type.AsFunction()
+	p := b.emit(&irInstr{op: irCall, dst: b.f.newTemp(fnType.ret, nil), args: args, sym: alloc, fn: allocFn}).dst // Implemented in lib/mem.clara
+
+	off := 0
+
+	// Set tag (if required)
+	if fnType.Is(EnumCons) {
+		b.emit(&irInstr{op: irStore, args: []*irTemp{p, b.constant(intType, fnType.AsEnumCons().Tag)}, val: off, unchecked: true})
+		off += ptrSize
+	}
+
+	// Copy parameters into fields
+	for _, param := range b.f.params {
+		b.emit(&irInstr{op: irStore, args: []*irTemp{p, param}, val: off, unchecked: true})
+		off += ptrSize
+	}
+	b.emit(&irInstr{op: irRet, args: []*irTemp{p}})
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Statements
+
+func (b *irBuilder) stmts(stmts []*Node) {
+	for _, stmt := range stmts {
+		b.stmt = stmt.token
+		switch stmt.op {
+		case opReturn:
+			b.ret(stmt.left)
+
+		case opIf:
+			b.ifElseIfElse(stmt)
+
+		case opDas, opAs:
+			b.assign(stmt)
+
+		case opWhile:
+			b.while(stmt)
+
+		case opBlock:
+			b.stmts(stmt.stmts)
+
+		default:
+			b.expr(stmt)
+		}
+	}
+}
+
+func (b *irBuilder) ret(expr *Node) {
+	var args []*irTemp
+	if expr != nil {
+		if v := b.expr(expr); v != nil {
+			args = append(args, v)
+		}
+	}
+	b.emit(&irInstr{op: irRet, args: args})
+}
+
+func (b *irBuilder) ifElseIfElse(n *Node) {
+	exit := b.f.newBlock()
+	for cur := n; cur != nil; cur = cur.right {
+		if cur.left != nil {
+			then, next := b.f.newBlock(), b.f.newBlock()
+			b.br(b.expr(cur.left), then, next)
+			b.setBlock(then)
+			b.stmts(cur.stmts)
+			b.jmp(exit)
+			b.setBlock(next)
+		} else {
+			b.stmts(cur.stmts) // Else block
+		}
+	}
+	b.jmp(exit)
+	b.setBlock(exit)
+}
+
+func (b *irBuilder) while(n *Node) {
+	head, body, exit := b.f.newBlock(), b.f.newBlock(), b.f.newBlock()
+	b.jmp(head)
+	b.setBlock(head)
+	b.br(b.expr(n.left), body, exit)
+	b.setBlock(body)
+	b.stmts(n.stmts)
+	b.jmp(head)
+	b.setBlock(exit)
+}
+
+func (b *irBuilder) assign(n *Node) {
+
+	// Evaluate expression before location to store
+	v := b.expr(n.right)
+
+	slot := n.left
+	switch slot.op {
+	case opIdentifier:
+		b.emit(&irInstr{op: irCopy, dst: b.variable(slot.sym), args: []*irTemp{v}})
+
+	case opDot:
+		p := b.expr(slot.left)
+		b.emit(&irInstr{op: irStore, args: []*irTemp{p, v}, val: slot.right.sym.Addr})
+
+	case opArray:
+		arr := b.expr(slot.left)
+		idx := b.expr(slot.right)
+		b.emit(&irInstr{op: irSetIndex, args: []*irTemp{arr, idx, v}})
+
+	default:
+		panic(fmt.Sprintf("Can't assign to op: %v", nodeTypes[slot.op]))
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Expressions
+
+var irBinaryOps = map[int]irOp{
+	opAdd:    irAdd,
+	opSub:    irSub,
+	opMul:    irMul,
+	opDiv:    irDiv,
+	opMod:    irMod,
+	opOr:     irOr,
+	opBOr:    irOr,
+	opAnd:    irAnd,
+	opBAnd:   irAnd,
+	opBXor:   irXor,
+	opBLeft:  irShl,
+	opBRight: irShr,
+	opEq:     irEq,
+	opGt:     irGt,
+	opGte:    irGte,
+	opLt:     irLt,
+	opLte:    irLte,
+}
+
+func (b *irBuilder) expr(expr *Node) *irTemp {
+
+	switch expr.op {
+
+	case opLit:
+		switch expr.sym.Type.Kind {
+		case String:
+			return b.emit(&irInstr{op: irString, dst: b.f.newTemp(expr.typ, nil), str: expr.sym.Name}).dst
+
+		case Integer:
+			i, err := strconv.ParseInt(expr.sym.Name, 0, 64)
+			if err != nil {
+				panic(err) // NOTE: Should never happen as has been checked on front end
+			}
+			return b.constant(expr.typ, int(i))
+
+		case Boolean:
+			v := 0
+			if expr.sym.Name == "true" {
+				v = 1
+			}
+			return b.constant(expr.typ, v)
+
+		default:
+			panic(fmt.Sprintf("Unknown type for literal: %v", expr.sym.Type.Kind))
+		}
+
+	// NOTE: 'and' & 'or' evaluate both operands
+	case opOr, opAnd, opAdd, opSub, opMul, opDiv, opMod, opBOr, opBAnd, opBXor, opBLeft, opBRight,
+		opGt, opGte, opLt, opLte, opEq:
+		left := b.expr(expr.left)
+		right := b.expr(expr.right)
+		return b.value(irBinaryOps[expr.op], expr.typ, left, right)
+
+	case opNot:
+		return b.value(irNot, expr.typ, b.expr(expr.left))
+
+	case opBNot:
+		return b.value(irBNot, expr.left.typ, b.expr(expr.left))
+
+	case opNeg:
+		return b.value(irNeg, expr.left.typ, b.expr(expr.left))
+
+	case opIdentifier:
+		v := expr.sym
+		switch {
+		case v.IsStack || b.vars[v] != nil:
+			return b.variable(v)
+
+		case v.Type.Is(Function) && v.IsGlobal: // Named function operand
+			return b.emit(&irInstr{op: irFnAddr, dst: b.f.newTemp(v.Type, nil), sym: v}).dst
+
+		case v.IsType:
+			return b.constant(v.Type, 0) // Types have no runtime representation - yet!
+
+		default:
+			panic(fmt.Sprintf("Can't lower identifier: %v in %v", v.Name, b.f.name))
+		}
+
+	case opTernary:
+		then, els, exit := b.f.newBlock(), b.f.newBlock(), b.f.newBlock()
+		v := b.f.newTemp(expr.typ, nil)
+		b.br(b.expr(expr.left), then, els)
+		b.setBlock(then)
+		b.emit(&irInstr{op: irCopy, dst: v, args: []*irTemp{b.expr(expr.stmts[0])}})
+		b.jmp(exit)
+		b.setBlock(els)
+		b.emit(&irInstr{op: irCopy, dst: v, args: []*irTemp{b.expr(expr.stmts[1])}})
+		b.jmp(exit)
+		b.setBlock(exit)
+		return v
+
+	case opArrayLit:
+		// Left has builder logic to create array & populate with elements
+		return b.expr(expr.left)
+
+	case opFuncCall:
+		return b.call(expr)
+
+	case opDot:
+		p := b.expr(expr.left)
+		t := expr.typ
+		if t == nil {
+			t = expr.right.sym.Type
+		}
+		return b.emit(&irInstr{op: irLoad, dst: b.f.newTemp(t, nil), args: []*irTemp{p}, val: expr.right.sym.Addr}).dst
+
+	case opArray:
+		arr := b.expr(expr.left)
+		idx := b.expr(expr.right)
+		return b.value(irIndex, expr.typ, arr, idx)
+
+	case opNamedType, opFuncType, opArrayType:
+		// Types have no runtime representation - yet!
+		t := expr.typ
+		if t == nil {
+			t = nothingType
+		}
+		return b.constant(t, 0)
+
+	default:
+		panic(fmt.Sprintf("Can't lower expr for op: %v", nodeTypes[expr.op]))
+	}
+}
+
+func (b *irBuilder) call(n *Node) *irTemp {
+
+	if n.left.Is(opIdentifier) && n.left.sym != nil && n.left.sym == b.asserts.assert {
+		b.assert(n)
+		return nil
+	}
+
+	// Determine how function is referenced
+	i := &irInstr{op: irCall}
+	if s := n.left.sym; n.left.Is(opIdentifier) && s != nil && !s.IsStack && b.vars[s] == nil {
+		i.sym = s
+		i.fn = s.Type.AsFunction()
+	} else {
+		i.args = append(i.args, b.expr(n.left))
+		i.fn = n.left.typ.AsFunction()
+	}
+
+	for _, arg := range n.stmts {
+		i.args = append(i.args, b.expr(arg))
+	}
+	t := n.typ
+	if t == nil {
+		t = i.fn.ret
+	}
+	if !t.Is(Nothing) {
+		i.dst = b.f.newTemp(t, nil)
+	}
+	return b.emit(i).dst
+}
+
+// Tests the condition of an assert() & calls assertionFailed() with its message & source if false. The failed call's
+// site provides the location.
+func (b *irBuilder) assert(n *Node) {
+	if b.asserts.elide {
+		return
+	}
+	fail, cont := b.f.newBlock(), b.f.newBlock()
+	b.br(b.expr(n.stmts[0]), cont, fail)
+	b.setBlock(fail)
+	args := []*irTemp{b.expr(n.stmts[1]), b.expr(n.stmts[2])}
+	b.emit(&irInstr{op: irCall, args: args, sym: b.asserts.failed, fn: b.asserts.failed.Type.AsFunction()})
+	b.jmp(cont)
+	b.setBlock(cont)
+}
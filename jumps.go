@@ -0,0 +1,136 @@
+package main
+
+// Simplifies control flow: branches on constant conditions (or to a single target) become jumps, jumps to blocks
+// which only jump are threaded to the final target & blocks with a single predecessor which jumps to them are merged.
+func (f *irFunc) simplifyBranches() {
+	subst := make(map[*irTemp]*irTemp)
+	for changed := true; changed; {
+		changed = f.foldBranches()
+		changed = f.threadJumps() || changed
+		changed = f.mergeBlocks(subst) || changed
+		f.removeUnreachable()
+	}
+	f.substitute(subst)
+	f.compact()
+}
+
+func (f *irFunc) foldBranches() (changed bool) {
+	consts := make(map[*irTemp]int)
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.op == irConst && i.dst.typ.Is(Boolean) {
+				consts[i.dst] = i.val
+			}
+		}
+	}
+	for _, b := range f.blocks {
+		br := b.last()
+		if br.op != irBr {
+			continue
+		}
+		taken, dropped := br.succs[0], br.succs[1]
+		if v, ok := consts[br.args[0]]; ok && v == 0 {
+			taken, dropped = dropped, taken
+		} else if !ok && taken != dropped {
+			continue
+		}
+		f.removeEdge(b, dropped)
+		br.op, br.args, br.succs = irJmp, nil, []*irBlock{taken}
+		changed = true
+	}
+	return changed
+}
+
+// Redirects predecessors of blocks which only jump elsewhere to the jump target
+func (f *irFunc) threadJumps() (changed bool) {
+	for _, b := range f.blocks[1:] {
+		if len(b.instrs) != 1 || b.last().op != irJmp {
+			continue
+		}
+		target := b.succs()[0]
+		if target == b {
+			continue // Infinite loop
+		}
+		j := predIndex(target, b)
+		for _, pred := range append([]*irBlock(nil), b.preds...) {
+			// Predecessors of both would require phis to select between different values along the same edge
+			if containsBlock(target.preds, pred) || countBlock(pred.succs(), b) > 1 {
+				continue
+			}
+			succs := pred.succs()
+			for k := range succs {
+				if succs[k] == b {
+					succs[k] = target
+				}
+			}
+			f.removeEdge(pred, b)
+			target.preds = append(target.preds, pred)
+			for _, phi := range target.phis() {
+				phi.args = append(phi.args, phi.args[j])
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Appends blocks to their only predecessor when it unconditionally jumps to them
+func (f *irFunc) mergeBlocks(subst map[*irTemp]*irTemp) (changed bool) {
+	for _, b := range f.blocks {
+		for len(b.instrs) > 0 {
+			last := b.last()
+			if last.op != irJmp {
+				break
+			}
+			succ := last.succs[0]
+			if succ == b || succ == f.blocks[0] || len(succ.preds) != 1 {
+				break
+			}
+
+			// Phis have a single argument
+			phis := succ.phis()
+			for _, phi := range phis {
+				subst[phi.dst] = phi.args[0]
+			}
+			b.instrs = append(b.instrs[:len(b.instrs)-1], succ.instrs[len(phis):]...)
+			for _, next := range b.succs() {
+				for k, pred := range next.preds {
+					if pred == succ {
+						next.preds[k] = b
+					}
+				}
+			}
+			succ.instrs, succ.preds = nil, nil
+			changed = true
+		}
+	}
+
+	// Drop merged blocks
+	blocks := f.blocks[:0]
+	for _, b := range f.blocks {
+		if len(b.instrs) > 0 {
+			blocks = append(blocks, b)
+		}
+	}
+	f.blocks = blocks
+	return changed
+}
+
+func predIndex(b *irBlock, pred *irBlock) int {
+	for j, p := range b.preds {
+		if p == pred {
+			return j
+		}
+	}
+	return -1
+}
+
+func countBlock(blocks []*irBlock, b *irBlock) int {
+	n := 0
+	for _, x := range blocks {
+		if x == b {
+			n++
+		}
+	}
+	return n
+}
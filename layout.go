@@ -0,0 +1,152 @@
+package main
+
+// Orders blocks so the common path falls through. Chains of blocks are formed by following the most likely successor:
+// loop bodies are kept contiguous with their loop header placed at the bottom (so each iteration takes a single
+// branch) and blocks which panic are moved out of line to the end of the function. When profiled, the most frequently
+// executed successor is followed and blocks which never executed are treated as cold.
+func (f *irFunc) layoutBlocks() {
+
+	f.dominators()
+	loops := f.naturalLoops()
+	cold := make(map[*irBlock]bool)
+	for _, b := range f.blocks {
+		cold[b] = b.isCold() || (f.profiled && b.count == 0)
+	}
+
+	// Whether b is within the loop headed by h
+	within := func(b *irBlock, h *irBlock) bool { return loops[h][b] }
+	depth := func(b *irBlock) int {
+		n := 0
+		for _, body := range loops {
+			if body[b] {
+				n++
+			}
+		}
+		return n
+	}
+
+	placed := make(map[*irBlock]bool)
+	var order []*irBlock
+	next := func(b *irBlock) *irBlock {
+		var best *irBlock
+		bestScore := 0
+		for _, succ := range b.succs() {
+			if placed[succ] {
+				continue
+			}
+
+			// Rotate loops entered by a jump so the header follows the body
+			if loops[succ] != nil && !within(b, succ) && b.last().op == irJmp {
+				if body := succ.last(); body.op == irBr {
+					for _, s := range body.succs {
+						if s != succ && within(s, succ) && !placed[s] && len(s.preds) == 1 {
+							return s
+						}
+					}
+				}
+			}
+
+			score := 1
+			if !cold[succ] {
+				score += 4
+			}
+			if depth(succ) >= depth(b) {
+				score += 2 // Stay in loop
+			}
+			if allPlaced(succ.preds, placed) {
+				score += 1
+			}
+			if f.profiled && best != nil && succ.count != best.count {
+				if succ.count > best.count {
+					best, bestScore = succ, score
+				}
+				continue
+			}
+			if score > bestScore {
+				best, bestScore = succ, score
+			}
+		}
+		return best
+	}
+
+	// Entry must remain first. Later chains start from the first unplaced block, preferring those which aren't cold.
+	for len(order) < len(f.blocks) {
+		start := f.blocks[0]
+		if len(order) > 0 {
+			start = nil
+			for _, b := range f.blocks {
+				if !placed[b] && (start == nil || (cold[start] && !cold[b])) {
+					start = b
+				}
+			}
+		}
+		for b := start; b != nil; b = next(b) {
+			placed[b] = true
+			order = append(order, b)
+		}
+	}
+	for id, b := range order {
+		b.id = id
+	}
+	f.blocks = order
+}
+
+// Blocks which are unlikely to execute
+func (b *irBlock) isCold() bool {
+	for _, i := range b.instrs {
+		if i.op == irCall && i.sym != nil && i.sym.Name == "panic" {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocks in each loop, keyed by header. Loops sharing a header are merged.
+func (f *irFunc) naturalLoops() map[*irBlock]map[*irBlock]bool {
+	loops := make(map[*irBlock]map[*irBlock]bool)
+	for _, b := range f.blocks {
+		for _, h := range b.succs() {
+			if !dominates(h, b) {
+				continue
+			}
+			// Back edge: walk predecessors from the latch until reaching the header
+			body := loops[h]
+			if body == nil {
+				body = map[*irBlock]bool{h: true}
+				loops[h] = body
+			}
+			work := []*irBlock{b}
+			for len(work) > 0 {
+				x := work[len(work)-1]
+				work = work[:len(work)-1]
+				if body[x] {
+					continue
+				}
+				body[x] = true
+				work = append(work, x.preds...)
+			}
+		}
+	}
+	return loops
+}
+
+func dominates(a *irBlock, b *irBlock) bool {
+	for {
+		if b == a {
+			return true
+		}
+		if b.idom == b || b.idom == nil {
+			return false
+		}
+		b = b.idom
+	}
+}
+
+func allPlaced(blocks []*irBlock, placed map[*irBlock]bool) bool {
+	for _, b := range blocks {
+		if !placed[b] {
+			return false
+		}
+	}
+	return true
+}
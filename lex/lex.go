@@ -40,6 +40,7 @@ const (
 	Plus
 	Mul
 	Div
+	Mod
 	Min
 
 	// -----------------------------------------------------------------------------------------------------------------
@@ -95,8 +96,13 @@ const (
 	Match
 	Case
 	Type
+	Const
 )
 
+func (k Kind) IsKeyword() bool {
+	return k > keyword
+}
+
 func (k Kind) IsExprStart() bool {
 	switch k {
 	case Integer, String, Identifier, True, False, Not, LParen, Fn, Min, LBrack:
@@ -116,7 +122,7 @@ func (k Kind) Precedence() int {
 		return 12
 	case Not, Neg, BNot:
 		return 11
-	case Mul, Div:
+	case Mul, Div, Mod:
 		return 10
 	case Plus, Min:
 		return 9
@@ -150,7 +156,7 @@ const (
 
 func (k Kind) Associativity() Associative {
 	switch k {
-	case LParen, Plus, And, Or, Mul, Div, Min, Eq, Dot, Neg, BAnd, BOr, BXor, BLeft, BRight:
+	case LParen, Plus, And, Or, Mul, Div, Mod, Min, Eq, Dot, Neg, BAnd, BOr, BXor, BLeft, BRight:
 		return Left
 	case Not, BNot:
 		return Right
@@ -180,6 +186,7 @@ var key = map[string]Kind{
 	"match":  Match,
 	"case":   Case,
 	"type":   Type,
+	"const":  Const,
 }
 
 var KindValues = map[Kind]string{
@@ -212,6 +219,7 @@ var KindValues = map[Kind]string{
 	Mul:        "*",
 	Plus:       "+",
 	Div:        "/",
+	Mod:        "%",
 	Min:        "- (binary)",
 	Neg:        "- (unary)",
 	True:       "true",
@@ -237,6 +245,7 @@ var KindValues = map[Kind]string{
 	Match:      "match",
 	Case:       "case",
 	Type:       "type",
+	Const:      "const",
 	Err:        "<error>",
 }
 
@@ -258,7 +267,10 @@ func Val(val string) *Token {
 
 var NoToken = &Token{Min, "(-)", 0, 0, "<none>"}
 
-func (t Token) String() string {
+func (t Token) String() string { return t.Styled(console.NewPrinter(nil)) }
+
+// Styled describes the token, coloured if the printer supports it
+func (t Token) Styled(p *console.Printer) string {
 	val := ""
 	switch {
 	case t.Kind == EOF:
@@ -272,8 +284,8 @@ func (t Token) String() string {
 	default:
 		val = fmt.Sprintf("%q", t.Val)
 	}
-	return fmt.Sprintf("%s:%v%v:%v:%v, %v%v%v %v", t.File, console.Yellow, t.Line, t.Pos,
-		console.Disable, console.NodeTypeColour, val, console.Disable, KindValues[t.Kind])
+	return fmt.Sprintf("%s:%v, %v %v", t.File, p.Sprint(console.Yellow, fmt.Sprintf("%v:%v", t.Line, t.Pos)),
+		p.Sprint(console.NodeTypeColour, val), KindValues[t.Kind])
 }
 
 // This is almost entirely inspired by the template lexer in Go. Src here:
@@ -402,6 +414,8 @@ func lexText(l *Lexer) stateFn {
 				return lexComment
 			}
 			l.emit(Div)
+		case r == '%':
+			l.emit(Mod)
 		case r == '0':
 			return lexHexOrDecInteger
 		case '1' <= r  && r <= '9':
@@ -514,7 +528,7 @@ func (l *Lexer) atTerminator() bool {
 	r := l.peek()
 	// TODO: Extract some helpers to ask isOperator(), isNewline(), etc...
 	return r == '(' || r == ' ' || r == ':' || r == ',' || r == ')' || r == '\r' || r == '\n' ||
-		r == '.' || r == '+' || r == '-' || r == '*' || r == '/' || r == '>' || r == '<' ||
+		r == '.' || r == '+' || r == '-' || r == '*' || r == '/' || r == '%' || r == '>' || r == '<' ||
 		r == '[' || r == ']' || r == eof || r == '«' || r == '»'
 }
 
@@ -545,12 +559,10 @@ func (l *Lexer) errorf(format string, args ...interface{}) stateFn {
 	return nil
 }
 
+// Column of the given offset, starting at 1
 func (l *Lexer) linePos(start int) int {
-	lineIndex := strings.LastIndex(l.input[:start], "\n")
-	if lineIndex == -1 {
-		lineIndex = 0
-	}
-	return utf8.RuneCountInString(l.input[lineIndex:start])
+	lineIndex := strings.LastIndex(l.input[:start], "\n") + 1 // Skip newline (if any)
+	return 1 + utf8.RuneCountInString(l.input[lineIndex:start])
 }
 
 func (l *Lexer) lineNumber() int {
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+)
+
+// Writes the address & size of every symbol in a linked binary, in address order. Clara functions are not sized by
+// the assembly so are assumed to extend to the next symbol in their section.
+func writeLinkMap(binary string, path string) error {
+	f, err := elf.Open(binary)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Map failure: %v", err))
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Map failure: %v", err))
+	}
+
+	// Only symbols placed in an allocated section have an address
+	var placed []elf.Symbol
+	for _, s := range syms {
+		if s.Name == "" || s.Section >= elf.SHN_LORESERVE || int(s.Section) >= len(f.Sections) || s.Section == elf.SHN_UNDEF {
+			continue
+		}
+		if t := elf.ST_TYPE(s.Info); t == elf.STT_SECTION || t == elf.STT_FILE {
+			continue
+		}
+		if elf.ST_BIND(s.Info) == elf.STB_LOCAL && elf.ST_TYPE(s.Info) == elf.STT_NOTYPE {
+			continue // Labels within functions & data
+		}
+		if f.Sections[s.Section].Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		placed = append(placed, s)
+	}
+	sort.SliceStable(placed, func(i, j int) bool { return placed[i].Value < placed[j].Value })
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "%-18v %-10v %-18v %v\n", "Address", "Size", "Section", "Symbol")
+	for j, s := range placed {
+		sec := f.Sections[s.Section]
+		size := s.Size
+		if size == 0 {
+			end := sec.Addr + sec.Size
+			for _, next := range placed[j+1:] {
+				if next.Section == s.Section && next.Value > s.Value {
+					end = next.Value
+					break
+				}
+			}
+			size = end - s.Value
+		}
+		fmt.Fprintf(w, "0x%016x %-10v %-18v %v\n", s.Value, size, sec.Name, demangle(s.Name))
+	}
+	return w.Flush()
+}
+
+func strip(binary string) error {
+	output, err := exec.Command("strip", binary).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Strip failure: %v\n%v\n", err, string(output)))
+	}
+	return nil
+}
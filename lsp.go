@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/g-dx/clarac/lex"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Language server (clarac lsp). Speaks the Language Server Protocol over stdin & stdout, checking each open document
+// with the standard lib on every change (See: check()). Diagnostics are published for the document, definitions are
+// found from the symbols the type checker resolved, hovers show their types & document symbols list its top level
+// declarations. Documents which no longer parse keep their last checked AST so navigation continues to work. Semantic
+// tokens classify keywords & the names resolved in the document (See: semanticTokens()).
+
+func runLsp(args []string, defaultInstall string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	flags := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	installPath := flags.String("install", defaultInstall, "Path to install directory.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	s := &lspServer{installPath: *installPath, out: out, docs: make(map[string]*lspDoc)}
+	r := bufio.NewReader(in)
+	for {
+		msg, err := readLspMessage(r)
+		if err == io.EOF {
+			return 1 // Exited without shutdown
+		}
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return 1
+		}
+		if status, exit := s.handle(msg); exit {
+			return status
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+// JSON-RPC
+// ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	lspParseError     = -32700
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+)
+
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+type lspErrorResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Error   lspError         `json:"error"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// Reads a message framed by a Content-Length header
+func readLspMessage(r *bufio.Reader) (*lspMessage, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length: '%v'", header.Get("Content-Length"))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	msg := &lspMessage{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return &lspMessage{Method: "$/invalid", Params: body}, nil // Reported by handle()
+	}
+	return msg, nil
+}
+
+func (s *lspServer) write(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err) // Only happens with unsupported types
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(b), b)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Protocol
+// ---------------------------------------------------------------------------------------------------------------------
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocument struct {
+	URI     string `json:"uri"`
+	Text    string `json:"text"`
+	Version int    `json:"version"`
+}
+
+type lspPositionParams struct {
+	TextDocument lspTextDocument `json:"textDocument"`
+	Position     lspPosition     `json:"position"`
+}
+
+type lspChangeParams struct {
+	TextDocument   lspTextDocument `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspHover struct {
+	Contents struct {
+		Kind  string `json:"kind"`
+		Value string `json:"value"`
+	} `json:"contents"`
+	Range lspRange `json:"range"`
+}
+
+type lspSymbol struct {
+	Name           string       `json:"name"`
+	Detail         string       `json:"detail,omitempty"`
+	Kind           int          `json:"kind"`
+	Range          lspRange     `json:"range"`
+	SelectionRange lspRange     `json:"selectionRange"`
+	Children       []*lspSymbol `json:"children,omitempty"`
+}
+
+// Symbol kinds
+const (
+	lspField      = 8
+	lspEnum       = 10
+	lspFunction   = 12
+	lspConstant   = 14
+	lspEnumMember = 22
+	lspStruct     = 23
+)
+
+const (
+	lspSeverityError = 1
+	lspSyncFull      = 1
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Server
+// ---------------------------------------------------------------------------------------------------------------------
+
+type lspServer struct {
+	installPath string
+	out         io.Writer
+	docs        map[string]*lspDoc // By path
+	shutdown    bool
+}
+
+// Open document
+type lspDoc struct {
+	uri     string
+	path    string
+	text    string
+	version int
+	root    *Node                  // Last checked AST (if any)
+	checked string                 // Text root was checked from
+	decls   map[*Symbol]*lex.Token // Declaration of each symbol in root
+}
+
+// Handles a message returning the exit status once the client asks the server to exit
+func (s *lspServer) handle(msg *lspMessage) (int, bool) {
+	var result interface{}
+	var err *lspError
+	switch msg.Method {
+	case "$/invalid":
+		err = &lspError{lspParseError, "invalid JSON message"}
+	case "initialize":
+		result = map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       map[string]interface{}{"openClose": true, "change": lspSyncFull},
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"semanticTokensProvider": map[string]interface{}{
+					"legend": map[string]interface{}{"tokenTypes": semClasses, "tokenModifiers": []string{}},
+					"full":   true,
+				},
+			},
+			"serverInfo": map[string]string{"name": "clarac"},
+		}
+	case "shutdown":
+		s.shutdown = true
+	case "exit":
+		if s.shutdown {
+			return 0, true
+		}
+		return 1, true
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			if path, ok := uriToPath(p.TextDocument.URI); ok {
+				doc := &lspDoc{uri: p.TextDocument.URI, path: path, text: p.TextDocument.Text, version: p.TextDocument.Version}
+				s.docs[path] = doc
+				s.check(doc)
+			}
+		}
+	case "textDocument/didChange":
+		var p lspChangeParams
+		if json.Unmarshal(msg.Params, &p) == nil && len(p.ContentChanges) > 0 {
+			if doc := s.doc(p.TextDocument.URI); doc != nil {
+				doc.text = p.ContentChanges[len(p.ContentChanges)-1].Text // Full sync
+				doc.version = p.TextDocument.Version
+				s.check(doc)
+			}
+		}
+	case "textDocument/didClose":
+		var p struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			if doc := s.doc(p.TextDocument.URI); doc != nil {
+				delete(s.docs, doc.path)
+				s.publish(doc, []*lspDiagnostic{})
+			}
+		}
+	case "textDocument/definition", "textDocument/hover":
+		var p lspPositionParams
+		if e := json.Unmarshal(msg.Params, &p); e != nil {
+			err = &lspError{lspInvalidParams, e.Error()}
+			break
+		}
+		if doc := s.doc(p.TextDocument.URI); doc != nil {
+			if msg.Method == "textDocument/hover" {
+				result = s.hover(doc, p.Position)
+			} else {
+				result = s.definition(doc, p.Position)
+			}
+		}
+	case "textDocument/documentSymbol":
+		var p struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		if e := json.Unmarshal(msg.Params, &p); e != nil {
+			err = &lspError{lspInvalidParams, e.Error()}
+			break
+		}
+		if doc := s.doc(p.TextDocument.URI); doc != nil {
+			result = s.symbols(doc)
+		}
+	case "textDocument/semanticTokens/full":
+		var p struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		if e := json.Unmarshal(msg.Params, &p); e != nil {
+			err = &lspError{lspInvalidParams, e.Error()}
+			break
+		}
+		if doc := s.doc(p.TextDocument.URI); doc != nil {
+			result = s.semanticTokens(doc)
+		}
+	default:
+		err = &lspError{lspMethodNotFound, fmt.Sprintf("method '%v' not supported", msg.Method)}
+	}
+
+	// Notifications have no response
+	if msg.ID == nil {
+		return 0, false
+	}
+	if err != nil {
+		s.write(&lspErrorResponse{JSONRPC: "2.0", ID: msg.ID, Error: *err})
+	} else {
+		s.write(&lspResponse{JSONRPC: "2.0", ID: msg.ID, Result: result})
+	}
+	return 0, false
+}
+
+func (s *lspServer) doc(uri string) *lspDoc {
+	path, ok := uriToPath(uri)
+	if !ok {
+		return nil
+	}
+	return s.docs[path]
+}
+
+// Checks the document with the standard lib & publishes any errors found within it
+func (s *lspServer) check(doc *lspDoc) {
+	var lib []string
+	for _, path := range glob(fmt.Sprintf("%v/lib/*.clara", s.installPath)) {
+		if abs, err := filepath.Abs(path); err == nil && abs != doc.path {
+			lib = append(lib, abs)
+		}
+	}
+	deps, err := moduleLibs(doc.path, s.installPath)
+	root, errs := s.checkSafely(append(lib, deps...), doc.path)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if root != nil {
+		doc.root = root
+		doc.checked = doc.text
+		doc.decls = findDecls(root)
+	}
+
+	diags := []*lspDiagnostic{}
+	for _, err := range sortDiagnostics(errs) {
+		d, ok := err.(*diagnostic)
+		if !ok || d.token == nil || d.token.Line < 1 {
+			if !ok {
+				diags = append(diags, &lspDiagnostic{Severity: lspSeverityError, Source: "clarac", Message: err.Error()})
+			}
+			continue // Compiler generated code
+		}
+		if d.token.File != doc.path {
+			continue // Reported in its own document
+		}
+		r := s.tokenRange(d.token)
+		if d.end != nil && d.end.File == d.token.File && d.end.Line >= d.token.Line {
+			r.End = s.tokenRange(d.end).End
+		}
+		diags = append(diags, &lspDiagnostic{Range: r, Severity: lspSeverityError, Code: d.code,
+			Source: "clarac", Message: d.text()})
+	}
+	s.publish(doc, diags)
+}
+
+// Runs check(), reading open documents in place of files & reporting any compiler panic as an error
+func (s *lspServer) checkSafely(lib []string, path string) (root *Node, errs []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			root, errs = nil, []error{fmt.Errorf("internal compiler error: %v", r)}
+		}
+	}()
+	read := func(path string) ([]byte, error) {
+		if doc, ok := s.docs[path]; ok {
+			return []byte(doc.text), nil
+		}
+		return ioutil.ReadFile(path)
+	}
+	root, _, errs = check(options{}, lib, path, read, ioutil.Discard)
+	return root, errs
+}
+
+func (s *lspServer) publish(doc *lspDoc, diags []*lspDiagnostic) {
+	s.write(&lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics", Params: map[string]interface{}{
+		"uri": doc.uri, "version": doc.version, "diagnostics": diags,
+	}})
+}
+
+func (s *lspServer) definition(doc *lspDoc, pos lspPosition) interface{} {
+	n := s.nodeAt(doc, pos)
+	if n == nil {
+		return nil
+	}
+	t := doc.decls[s.symbolOf(doc, n)]
+	if t == nil {
+		return nil
+	}
+	path, err := filepath.Abs(t.File)
+	if err != nil {
+		return nil
+	}
+	return &lspLocation{URI: pathToURI(path), Range: s.tokenRange(t)}
+}
+
+func (s *lspServer) hover(doc *lspDoc, pos lspPosition) interface{} {
+	n := s.nodeAt(doc, pos)
+	if n == nil {
+		return nil
+	}
+	var desc string
+	sym := s.symbolOf(doc, n)
+	switch {
+	case sym != nil && sym.IsType && sym.Type != nil && sym.Type.IsAny(Struct, Enum):
+		desc = fmt.Sprintf("%v %v", sym.Type.Kind, sym.Type)
+	case sym != nil && sym.IsType && sym.Type != nil:
+		desc = sym.Type.String()
+	case sym != nil && sym.IsGlobal && sym.Type != nil && sym.Type.Is(Function):
+		desc = "fn " + sym.Describe()
+	case n.typ != nil && n.Is(opIdentifier):
+		desc = fmt.Sprintf("%v: %v", n.token.Val, n.typ)
+	case n.typ != nil:
+		desc = n.typ.String()
+	case sym != nil && sym.Type != nil:
+		desc = fmt.Sprintf("%v: %v", sym.Name, sym.Type)
+	default:
+		return nil
+	}
+	h := &lspHover{Range: s.tokenRange(n.token)}
+	h.Contents.Kind = "markdown"
+	h.Contents.Value = "```clara\n" + desc + "\n```"
+	return h
+}
+
+func (s *lspServer) symbols(doc *lspDoc) []*lspSymbol {
+	syms := []*lspSymbol{}
+	if doc.root == nil {
+		return syms
+	}
+	enums := make(map[string]*lspSymbol)
+	symbol := func(n *Node, kind int, detail string) *lspSymbol {
+		r := s.tokenRange(n.token)
+		return &lspSymbol{Name: n.token.Val, Detail: detail, Kind: kind, Range: r, SelectionRange: r}
+	}
+	for _, n := range doc.root.stmts {
+		if n.token == nil || n.token.File != doc.path || n.token.Line < 1 {
+			continue
+		}
+		switch n.op {
+		case opBlockFnDcl, opExprFnDcl, opExternFnDcl:
+			detail := ""
+			if n.sym != nil && n.sym.Type != nil && n.sym.Type.Is(Function) {
+				detail = n.sym.Type.String()
+			}
+			syms = append(syms, symbol(n, lspFunction, detail))
+		case opConsFnDcl:
+			// Enum cases are moved to the root once their enum is processed
+			if f := n.sym.Type.AsFunction(); f.Kind == EnumCons {
+				if e, ok := enums[f.ret.AsEnum().Name]; ok {
+					e.Children = append(e.Children, symbol(n, lspEnumMember, ""))
+				}
+			}
+		case opStructDcl:
+			st := symbol(n, lspStruct, "")
+			for _, field := range n.stmts {
+				detail := ""
+				if field.sym != nil && field.sym.Type != nil {
+					detail = field.sym.Type.String()
+				}
+				st.Children = append(st.Children, symbol(field, lspField, detail))
+			}
+			syms = append(syms, st)
+		case opEnumDcl:
+			e := symbol(n, lspEnum, "")
+			enums[n.token.Val] = e
+			syms = append(syms, e)
+		case opConstDcl:
+			detail := ""
+			if n.typ != nil {
+				detail = n.typ.String()
+			}
+			syms = append(syms, symbol(n, lspConstant, detail))
+		}
+	}
+	sort.SliceStable(syms, func(i, j int) bool { return syms[i].Range.Start.Line < syms[j].Range.Start.Line })
+	return syms
+}
+
+// Semantic tokens of the document, with each relative to the last: line, start, length, class & modifiers
+func (s *lspServer) semanticTokens(doc *lspDoc) map[string][]int {
+	root := doc.root
+	if doc.checked != doc.text {
+		root = nil // Positions may have moved since
+	}
+	data := []int{}
+	prevLine, prevStart := 0, 0
+	for _, t := range semanticTokens(doc.text, doc.path, root) {
+		text := s.line(doc.path, t.line)
+		line, start := t.line-1, utf16Offset(text, t.pos-1)
+		if line != prevLine {
+			prevStart = 0
+		}
+		data = append(data, line-prevLine, start-prevStart, utf16Offset(text, t.pos-1+t.width)-start, int(t.class), 0)
+		prevLine, prevStart = line, start
+	}
+	return map[string][]int{"data": data}
+}
+
+// Innermost node of the document whose token contains the position
+func (s *lspServer) nodeAt(doc *lspDoc, pos lspPosition) *Node {
+	if doc.root == nil {
+		return nil
+	}
+	line := pos.Line + 1
+	col := runeColumn(s.line(doc.path, line), pos.Character)
+	var found *Node
+	WalkPreOrder(doc.root, func(n *Node) bool {
+		if n == nil {
+			return true
+		}
+		t := n.token
+		if t != nil && t.File == doc.path && t.Line == line && t.Pos <= col && col < t.Pos+utf8.RuneCountInString(t.Val) {
+			if n.sym != nil || n.typ != nil || found == nil {
+				found = n
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// Symbol the node refers to. Types are not linked to their symbol so are found by name.
+func (s *lspServer) symbolOf(doc *lspDoc, n *Node) *Symbol {
+	if n.Is(opNamedType) {
+		if sym, ok := doc.root.symtab.ResolveAll(n.token.Val, isType); ok {
+			return sym
+		}
+	}
+	return n.sym
+}
+
+// Tokens declaring each symbol of the AST
+func findDecls(root *Node) map[*Symbol]*lex.Token {
+	decls := make(map[*Symbol]*lex.Token)
+	declare := func(n *Node) {
+		if n != nil && n.sym != nil && n.token != nil && n.token.Line > 0 {
+			if _, ok := decls[n.sym]; !ok {
+				decls[n.sym] = n.token
+			}
+		}
+	}
+	var structs []*Node
+	WalkPreOrder(root, func(n *Node) bool {
+		if n == nil {
+			return true
+		}
+		switch n.op {
+		case opBlockFnDcl, opExprFnDcl, opExternFnDcl, opConsFnDcl:
+			declare(n)
+			for _, param := range n.params {
+				declare(param)
+			}
+			if n.right != nil {
+				for _, typeParam := range n.right.params {
+					declare(typeParam)
+				}
+			}
+		case opStructDcl, opEnumDcl:
+			declare(n)
+			for _, param := range n.params {
+				declare(param)
+			}
+			if n.op == opStructDcl {
+				structs = append(structs, n)
+				for _, field := range n.stmts {
+					declare(field)
+				}
+			}
+		case opConstDcl:
+			declare(n)
+		case opDas, opFor:
+			declare(n.left)
+		case opCase:
+			for _, param := range n.params {
+				declare(param)
+			}
+		}
+		return true
+	})
+
+	// Generated struct constructors are declared by their struct
+	for _, n := range root.stmts {
+		if n.op == opConsFnDcl && n.sym != nil && decls[n.sym] == nil && n.sym.Type.AsFunction().Kind == StructCons {
+			for _, st := range structs {
+				if st.sym != nil && st.sym.Type == n.sym.Type.AsFunction().ret {
+					decls[n.sym] = st.token
+				}
+			}
+		}
+	}
+	return decls
+}
+
+// Range of the token, converting its columns to UTF-16 offsets
+func (s *lspServer) tokenRange(t *lex.Token) lspRange {
+	line := s.line(t.File, t.Line)
+	width := tokenWidth(t)
+	return lspRange{
+		Start: lspPosition{Line: t.Line - 1, Character: utf16Offset(line, t.Pos-1)},
+		End:   lspPosition{Line: t.Line - 1, Character: utf16Offset(line, t.Pos-1+width)},
+	}
+}
+
+// Line of an open document or file, starting at 1
+func (s *lspServer) line(path string, n int) string {
+	var text string
+	if doc, ok := s.docs[path]; ok {
+		text = doc.text
+	} else if b, err := ioutil.ReadFile(path); err == nil {
+		text = string(b)
+	}
+	lines := strings.Split(text, "\n")
+	if n < 1 || n > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[n-1], "\r")
+}
+
+// Column (starting at 1) of the character at the UTF-16 offset
+func runeColumn(line string, offset int) int {
+	col, units := 1, 0
+	for _, r := range line {
+		units += len(utf16.Encode([]rune{r}))
+		if units > offset {
+			break
+		}
+		col++
+	}
+	return col
+}
+
+// UTF-16 offset of the first n runes
+func utf16Offset(line string, n int) int {
+	units, i := 0, 0
+	for _, r := range line {
+		if i == n {
+			return units
+		}
+		units += len(utf16.Encode([]rune{r}))
+		i++
+	}
+	return units + (n - i) // Past the end of the line
+}
+
+func uriToPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.Clean(u.Path), true
+}
+
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
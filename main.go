@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/g-dx/clarac/console"
 	"github.com/g-dx/clarac/lex"
 	"io"
 	"io/ioutil"
@@ -12,7 +13,6 @@ import (
 	"os/user"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strings"
 )
 
@@ -25,9 +25,59 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Explain error code & exit
+	if len(os.Args) >= 2 && os.Args[1] == "explain" {
+		os.Exit(runExplain(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	// Run bytecode & exit with its status
+	if len(os.Args) >= 3 && os.Args[1] == "exec" {
+		status, err := runBytecode(os.Args[2], os.Args[2:], os.Environ(), os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(status)
+	}
+
+	// Format source & exit
+	if len(os.Args) >= 2 && os.Args[1] == "fmt" {
+		os.Exit(runFmt(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	// Generate documentation & exit
+	if len(os.Args) >= 2 && os.Args[1] == "doc" {
+		os.Exit(runDoc(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	// Default install dir
 	defaultInstall := fmt.Sprintf("%v/.clara", usr.HomeDir)
 
+	// Manage dependencies & exit
+	if len(os.Args) >= 2 && os.Args[1] == "mod" {
+		os.Exit(runMod(os.Args[2:], ".", defaultInstall, os.Stdout, os.Stderr))
+	}
+
+	// Run tests & exit
+	if len(os.Args) >= 2 && os.Args[1] == "test" {
+		os.Exit(runTests(os.Args[2:], defaultInstall, os.Stdout, os.Stderr))
+	}
+
+	// Lint & exit
+	if len(os.Args) >= 2 && os.Args[1] == "vet" {
+		os.Exit(runVet(os.Args[2:], defaultInstall, os.Stdout, os.Stderr))
+	}
+
+	// Compile & run examples, comparing their output & exit
+	if len(os.Args) >= 2 && os.Args[1] == "selftest" {
+		os.Exit(runSelftest(os.Args[2:], defaultInstall, os.Stdout, os.Stderr))
+	}
+
+	// Serve language server & exit
+	if len(os.Args) >= 2 && os.Args[1] == "lsp" {
+		os.Exit(runLsp(os.Args[2:], defaultInstall, os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	// Load program path. Default to "examples"
 	installPath := flag.String("install", defaultInstall, "Path to install directory.")
 	progPath := flag.String("prog", "/examples/hello.clara", "File with Clara program to compile.")
@@ -35,21 +85,102 @@ func main() {
 	showLex := flag.Bool("lex", false, "Print the lexical output.")
 	showAst := flag.String("ast", "", "Print AST nodes matching the supplied regular expression.")
 	showTypes := flag.Bool("types", false, "Print type information as it assigned during semantic analysis.")
-	showAsm := flag.Bool("asm", false, "Print the generated assembly (intel syntax).")
+	showAsm := flag.Bool("asm", false, "Print the generated assembly.")
+	asmSyntax := flag.String("syntax", defaultSyntax, "Syntax of the generated assembly (att or intel).")
+	target := flag.String("backend", defaultBackend, "Code generator (x64, c or vm).")
+	showIr := flag.Bool("ir", false, "Print the intermediate representation passed to code generation.")
 	outPath := flag.String("out", ".", "Path to write program to.")
+	alloc := flag.String("alloc", gcAlloc, "Memory strategy: garbage collected (gc), reference counted (rc) or bump allocated & released by region() (arena).")
+	stripSyms := flag.Bool("strip", false, "Omit symbol tables from the output binary.")
+	mapPath := flag.String("map", "", "Write the address & size of each symbol in the output binary to the given file.")
+	buildMode := flag.String("buildmode", exeBuildMode, "Output an executable (exe) or a shared library & C header of its #[Export] functions (shared).")
+	optLevel := flag.Int("O", defaultOptLevel, fmt.Sprintf("Optimisation level (0-%v).", maxOptLevel))
+	profileGen := flag.String("profile-generate", "", "Instrument the program to write block execution counts to the given file on exit.")
+	profileUse := flag.String("profile-use", "", "Optimise using block execution counts from the given file.")
+	debugInfo := flag.Bool("g", false, "Emit DWARF line information so debuggers can step through Clara source lines (x64 only).")
+	noAsserts := flag.Bool("no-asserts", false, "Compile out assert() calls, including evaluation of their arguments. Requires -O2.")
+	omitFp := flag.Bool("fomit-frame-pointer", false, "Address locals relative to rsp in functions which make no calls, freeing rbp for general use.")
+	colour := flag.String("color", "auto", colourUsage)
+	diagFormat := flag.String("diag", textDiag, "Format of errors: text or sarif (SARIF 2.1.0 log, written even if there are none).")
+	dumpAfter := flag.String("dump-after", "", fmt.Sprintf("Print the IR after the named pass (%v, %v, %v) or 'all'.", lowerPass, passNames(), rcPass))
+	disable := make(map[string]*bool)
+	for _, pass := range passes {
+		if !pass.required {
+			disable[pass.name] = flag.Bool("fno-"+pass.name, false, fmt.Sprintf("Disable the '%v' pass.", pass.name))
+		}
+	}
 	flag.Parse()
+	if err := setColour(*colour); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if err := checkDiagFormat(*diagFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	// Build IR pass pipeline
+	var disabled []string
+	for _, pass := range passes {
+		if off, ok := disable[pass.name]; ok && *off {
+			disabled = append(disabled, pass.name)
+		}
+	}
+	pl, err := newPipeline(*optLevel, disabled, *dumpAfter, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *noAsserts {
+		if err := pl.elideAssertions(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	pl.profileOut = *profileGen
+	if *profileUse != "" {
+		pl.profile, err = readProfile(*profileUse)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	syntax, err := findSyntax(*asmSyntax)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	// Gather standard lib & C files
 	claraLib := glob(fmt.Sprintf("%v/lib/*.clara", *installPath)) // NOTE: Does NOT traverse all directories!
 	cLib := glob(fmt.Sprintf("%v/init/*.c", *installPath)) // NOTE: Does NOT traverse all directories!
 
-	options := options{ showLex: *showLex, astMatcher: buildAstMatcher(*showAst), showTypes: *showTypes, showAsm: *showAsm, showProg: *showProg }
+	// Add dependencies of the program's project (See: mod.go)
+	deps, err := moduleLibs(*progPath, *installPath)
+	if err != nil {
+		reportErrors([]error{err}, *diagFormat)
+	}
+	claraLib = append(claraLib, deps...)
+
+	options := options{ showLex: *showLex, astMatcher: buildAstMatcher(*showAst), showTypes: *showTypes, showAsm: *showAsm, showProg: *showProg, showIr: *showIr, omitFramePointer: *omitFp, debugInfo: *debugInfo, syntax: syntax, backend: *target, buildMode: *buildMode, alloc: *alloc, strip: *stripSyms, mapPath: *mapPath, pipeline: pl }
 	_, errs := Compile(options, claraLib, *progPath, cLib, *outPath, os.Stdout)
-	if len(errs) > 0 {
-		fmt.Println("\nErrors")
-		for _, err := range errs {
-			fmt.Printf(" - %v\n", err)
+	reportErrors(errs, *diagFormat)
+}
+
+// Prints any errors in the given format & exits if there were any
+func reportErrors(errs []error, format string) {
+	if format == sarifDiag {
+		s := newSarifWriter()
+		s.addErrors(errs)
+		if err := s.write(os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
+	} else if len(errs) > 0 {
+		printErrors(errs, os.Stdout)
+	}
+	if len(errs) > 0 {
 		os.Exit(1)
 	}
 }
@@ -60,63 +191,40 @@ type options struct {
 	showTypes  bool
 	showAsm    bool
 	showProg   bool
+	showIr     bool
+	pipeline   *pipeline // Defaults when nil
+
+	omitFramePointer bool   // Leaf functions do not maintain rbp
+	debugInfo        bool   // Source line information for debuggers
+	syntax           syntax // AT&T when nil
+	backend          string // x64 when empty
+	buildMode        string // exe when empty
+	alloc            string // gc when empty
+	strip            bool   // Remove symbol tables from the binary
+	mapPath          string // File to write symbol layout to (if any)
+	harness          string // Source of runMain() calling tests in place of main() (See: test.go)
 }
 
+func (o options) shared() bool { return o.buildMode == sharedBuildMode }
+
 func (o options) showAst() bool { return o.astMatcher != nil }
 
 func Compile(options options, claraLibPaths []string, progPath string, cLibPaths []string, outPath string, out io.Writer) (string, []error) {
-
-	// Define root AST node
-	rootSymtab := NewSymtab()
-	rootNode := &Node{op: opRoot, symtab: rootSymtab}
-
-	// Add any global symbols
-	for _, s := range stdSyms() {
-		rootSymtab.Define(s)
-	}
-
-	// Lex + parse all Clara files
-	var errs []error
-	claraLibPaths = append(claraLibPaths, progPath)
-	for _, f := range claraLibPaths {
-		bytes, err := ioutil.ReadFile(f)
-		if err != nil {
-			return "", []error{err}
-		}
-		errs = append(errs, lexAndParse(string(bytes), f, rootNode, options.showLex, out)...)
-	}
-	if len(errs) > 0 {
-		return "", errs
-	}
-
-	// Handle top level types first
-	errs = append(errs, processTopLevelTypes(rootNode, rootSymtab)...)
-	if len(errs) > 0 {
-		return "", errs
+	if err := checkBuildMode(options.buildMode); err != nil {
+		return "", []error{err}
 	}
-
-	// Pre-typecheck AST rewrite
-	WalkPostOrder(rootNode, func(n *Node) { generateStructConstructors(&errs, rootNode, n) })
-	WalkPreOrder(rootNode, func(n *Node) bool {
-		if n == nil {
-			return true
-		}
-		foldConstants(&errs, n)
-		return true
-	})
-
-	if len(errs) > 0 {
-		return "", errs
+	if err := checkAllocStrategy(options.alloc); err != nil {
+		return "", []error{err}
 	}
-
-	// Type check
-	errs = append(errs, typeCheck(rootNode, rootSymtab, nil, options.showTypes)...)
+	rootNode, exports, errs := check(options, claraLibPaths, progPath, ioutil.ReadFile, out)
 	if len(errs) > 0 {
 		return "", errs
 	}
+	rootSymtab := rootNode.symtab
 
 	// Post-typecheck AST rewrite
 	WalkPostOrder(rootNode, func(n *Node) { rewriteArrayLiteralExpr(n, rootSymtab) })
+	WalkPreOrder(rootNode, func(n *Node) bool { return lowerStringConcat(rootSymtab, n) })
 	for _, n := range rootNode.stmts {
 		if !isFn(n, "invokeDynamic") {
 			WalkPostOrder(n, func(n *Node) { rewriteAnonFnAndClosures(rootNode, n) })
@@ -133,42 +241,179 @@ func Compile(options options, claraLibPaths []string, progPath string, cLibPaths
 		printTree(rootNode, options.astMatcher, out)
 	}
 
-	// Create assembly file
+	// Create file for the backend to write
 	basename := filepath.Base(progPath)
 	progName := strings.TrimSuffix(basename, filepath.Ext(basename))
-	asmPath := fmt.Sprintf("%v/%v.S", os.TempDir(), progName)
+	be, err := newBackend(options)
+	if err != nil {
+		return "", []error{err}
+	}
+	asmPath := fmt.Sprintf("%v/%v%v", os.TempDir(), progName, be.ext())
+	if !be.native() {
+		asmPath = filepath.Join(outPath, progName+be.ext()) // Run as is
+	}
 	os.Remove(asmPath) // Ignore error
 	f, err := os.Create(asmPath)
 	if err != nil {
 		return "", []error{err}
 	}
 
-	// Generate assembly
-	asm := NewGasWriter(f, options.showAsm)
-	err = codegen(rootSymtab, rootNode.stmts, NewOptimiser(asm))
+	// Generate code
+	pl := options.pipeline
+	if pl == nil {
+		pl = defaultPipeline()
+	}
+	pl.showIr = options.showIr
+	pl.countRefs = options.alloc == rcAlloc
+	if pl.out == nil {
+		pl.out = out
+	}
+	prog, err := lowerProgram(rootSymtab, rootNode.stmts, exports, pl)
+	if err != nil {
+		return "", []error{err}
+	}
+	err = be.lower(prog, f)
 	if err != nil {
 		return "", []error{errors.New(fmt.Sprintf("\nCode Gen Errors:\n %v\n", err))}
 	}
 	f.Close()
+	if !be.native() {
+		return asmPath, nil
+	}
 
 	// Invoke gcc to link files
+	runtime, err := buildRuntime(cLibPaths)
+	if err != nil {
+		return "", []error{err}
+	}
 	outputPath := filepath.Join(outPath, progName)
-	args := []string { "-fno-pie" }
-	if runtime.GOOS == "linux" {
-		args = append(args, "-no-pie")
+	args := []string{"-pthread"} // See: startThread() in runtime.c
+	if options.shared() {
+		outputPath = filepath.Join(outPath, sharedLibName(progName))
+		args = append(args, sharedLibFlags()...)
+		if err := writeExportHeader(filepath.Join(outPath, progName+".h"), progName, exports); err != nil {
+			return "", []error{err}
+		}
 	}
 	args = append(args, "-o")
 	args = append(args, outputPath)
 	args = append(args, asmPath)
-	args = append(args, cLibPaths...)
+	if runtime != "" {
+		args = append(args, runtime)
+	}
 	cmd := exec.Command("gcc", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return "", []error{errors.New(fmt.Sprintf("Link failure: %v\n%v\n", err, string(output)))}
+		return "", []error{errors.New(fmt.Sprintf("Link failure: %v\n%v\n", err, demangleAll(string(output))))}
+	}
+
+	// Symbols are mapped before any are stripped
+	if options.mapPath != "" {
+		if err := writeLinkMap(outputPath, options.mapPath); err != nil {
+			return "", []error{err}
+		}
+	}
+	if options.strip {
+		if err := strip(outputPath); err != nil {
+			return "", []error{err}
+		}
 	}
 	return outputPath, nil
 }
 
+// Lexes, parses & type checks the standard lib & program, returning the AST before it is lowered for code generation.
+// Sources are loaded with read so unsaved files may be checked (See: lsp.go).
+func check(options options, claraLibPaths []string, progPath string, read func(string) ([]byte, error), out io.Writer) (*Node, []*export, []error) {
+	// Define root AST node
+	rootSymtab := NewSymtab()
+	rootNode := &Node{op: opRoot, symtab: rootSymtab}
+
+	// Add any global symbols
+	for _, s := range stdSyms() {
+		rootSymtab.Define(s)
+	}
+
+	// Lex + parse all Clara files
+	var errs []error
+	claraLibPaths = append(claraLibPaths, progPath)
+	for _, f := range claraLibPaths {
+		bytes, err := read(f)
+		if err != nil {
+			return nil, nil, []error{err}
+		}
+		errs = append(errs, lexAndParse(string(bytes), f, rootNode, options.showLex, out)...)
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	// Constants describing how the program was compiled
+	errs = lexAndParse(allocConstants(options.alloc), "<options>", rootNode, options.showLex, out)
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	// Generate wrappers of functions callable from C
+	exports, errs := findExports(rootNode)
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	if !options.shared() {
+		exports = nil
+	} else {
+		errs = lexAndParse(exportWrappers(rootNode, exports), "<exports>", rootNode, options.showLex, out)
+		if len(errs) > 0 {
+			return nil, nil, errs
+		}
+	}
+
+	// Generate caller of main() (or the tests) returning the exit status
+	wrapper := options.harness
+	if wrapper == "" {
+		wrapper, errs = mainWrapper(rootNode)
+		if len(errs) > 0 {
+			return nil, nil, errs
+		}
+	}
+	errs = lexAndParse(wrapper, "<main>", rootNode, options.showLex, out)
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	// Handle top level types first
+	errs = append(errs, processTopLevelTypes(rootNode, rootSymtab)...)
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	// Pre-typecheck AST rewrite
+	WalkPostOrder(rootNode, func(n *Node) { generateStructConstructors(&errs, rootNode, n) })
+	WalkPreOrder(rootNode, func(n *Node) bool {
+		if n == nil {
+			return true
+		}
+		foldConstants(&errs, n)
+		return true
+	})
+
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	// Type check. The AST is returned with any errors as everything else was still checked.
+	errs = append(errs, typeCheck(rootNode, rootSymtab, nil, options.showTypes)...)
+	if len(errs) > 0 {
+		return rootNode, nil, errs
+	}
+
+	// Mark pure functions & check assertions
+	errs = append(errs, analysePurity(rootNode)...)
+	if len(errs) > 0 {
+		return rootNode, nil, errs
+	}
+	return rootNode, exports, nil
+}
+
 func lexAndParse(code string, path string, root *Node, showLex bool, out io.Writer) (errs []error) {
 
 	// Lex
@@ -182,7 +427,7 @@ func lexAndParse(code string, path string, root *Node, showLex bool, out io.Writ
 		case lex.EOL, lex.Space, lex.Comment:
 			continue
 		case lex.Err:
-			return []error { errors.New(token.String()) }
+			return []error { &diagnostic{msg: token.String(), token: token} }
 		default:
 			tokens = append(tokens, token)
 		}
@@ -200,10 +445,25 @@ func lexAndParse(code string, path string, root *Node, showLex bool, out io.Writ
 	return NewParser().Parse(tokens, root)
 }
 
+// Clara source of runMain(), which calls main() & returns its result if it returns an int or 0 if it returns nothing
+func mainWrapper(root *Node) (string, []error) {
+	for _, n := range root.stmts {
+		if !n.isFuncDcl() || n.token.Val != "main" || len(n.params) > 0 || n.left == nil {
+			continue
+		}
+		if n.left.op != opNamedType || n.left.left != nil || n.left.token.Val != "int" {
+			return "", []error{semanticError(errMainReturnMsg, n.token)}
+		}
+		return "fn runMain() int = main()\n", nil
+	}
+	return "fn runMain() int {\n    main()\n    return 0\n}\n", nil
+}
+
 func stdSyms() []*Symbol {
 	return []*Symbol{
 		{ Name: "string", Type: stringType, IsType: true },
 		{ Name: "int", Type: intType, IsType: true },
+		{ Name: "byte", Type: byteType, IsType: true },
 		{ Name: "bool", Type: boolType, IsType: true },
 		{ Name: "pointer", Type: pointerType, IsType: true },
 		{ Name: "nothing", Type: nothingType, IsType: true },
@@ -224,10 +484,22 @@ func isFn(n *Node, name string) bool {
 	return n.Is(opBlockFnDcl) && n.token.Val == name
 }
 
+const colourUsage = "Colour output: auto (terminals only, unless NO_COLOR is set), always or never."
+
+func setColour(s string) error {
+	m, err := console.ParseMode(s)
+	if err != nil {
+		return err
+	}
+	console.SetMode(m)
+	return nil
+}
+
 func printLex(tokens []*lex.Token, out io.Writer) {
+	p := console.NewPrinter(out)
 	fmt.Fprintln(out, "\nLexical Tokens")
 	for _, token := range tokens {
-		fmt.Fprintln(out, token)
+		fmt.Fprintln(out, token.Styled(p))
 	}
 }
 
@@ -1,19 +1,37 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/json"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/textproto"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 )
 
 var regex = regexp.MustCompile("^.*?//\\sEXPECT:\\s(.*)$")
+var exitRegex = regexp.MustCompile("^.*?//\\sEXIT:\\s(\\d+)$")
+var allocRegex = regexp.MustCompile("^//\\sALLOC:\\s(\\w+)$")
+var argsRegex = regexp.MustCompile("^//\\sARGS:\\s(.+)$")
+var optRegex = regexp.MustCompile("^//\\sOPT:\\s([\\d\\s]+)$")
+
+// Backends every program is compiled with, each checked against the same expectations
+var e2eBackends = []string{"x64", "c", "vm"}
 
 type expectation struct {
 	val string
@@ -29,15 +47,14 @@ func TestPanic(t *testing.T) {
 
 	// Process each test case
 	for _, f := range files {
-		t.Run(filepath.Base(f), func(t *testing.T) {
-			f := f
-			t.Parallel()
+		f := f
+		RunBackends(t, f, func(t *testing.T, backend string, level int) {
 			expects := ParseExpectations(f, t)
 			if len(expects) != 1 {
 				t.Fatalf("Only one expectation allowed for panic tests - found %d\n", len(expects))
 			}
 			expect := expects[0]
-			out := CompileAndRun(f, t, true)
+			out := CompileAndRun(f, backend, level, t, true)
 			if !strings.Contains(out, expect.val) {
 				t.Errorf("\n- ./%v:\n - contains: '%v'\n - got     : '%v'\n", f, expect.val, out)
 			}
@@ -45,63 +62,1275 @@ func TestPanic(t *testing.T) {
 	}
 }
 
-func TestE2E(t *testing.T) {
-	files, err := filepath.Glob("./tests/*.clara")
+func TestRunner(t *testing.T) {
+	files, err := filepath.Glob("./tests/unit/*.clara")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Process each test case
+	// Run the tests of each file, matching expectations against lines of the report in order
+	for _, f := range files {
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			f := f
+			t.Parallel()
+			args := append([]string{"-install", "./install"}, ParseArgs(f, t)...)
+			var out bytes.Buffer
+			runTests(append(args, f), "", &out, &out)
+			lines := strings.Split(out.String(), "\n")
+			pos := 0
+			for _, expect := range ParseExpectations(f, t) {
+				for pos < len(lines) && !strings.Contains(lines[pos], expect.val) {
+					pos++
+				}
+				if pos == len(lines) {
+					t.Fatalf("\n- ./%v:%d:, expected: '%v', got:\n%v", f, expect.line, expect.val, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	files, err := filepath.Glob("./*.go")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Every message format a diagnostic is created from must be explained
+	fset := token.NewFileSet()
+	formats := make(map[string]string)
+	var uses []*ast.Ident
+	for _, f := range files {
+		file, err := parser.ParseFile(fset, f, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ValueSpec:
+				for i, name := range n.Names {
+					if i < len(n.Values) {
+						if lit, ok := n.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+							formats[name.Name], _ = strconv.Unquote(lit.Value)
+						}
+					}
+				}
+			case *ast.CallExpr:
+				fn, ok := n.Fun.(*ast.Ident)
+				arg := 0
+				switch {
+				case !ok:
+					return true
+				case fn.Name == "newDiagnostic":
+					arg = 1
+				case fn.Name != "semanticError" && fn.Name != "semanticError2" && fn.Name != "nodeError":
+					return true
+				}
+				msg, ok := n.Args[arg].(*ast.Ident)
+				switch {
+				case !ok:
+					t.Errorf("\n- %v:, expected: message format constant, got: %v", fset.Position(n.Pos()), n.Args[arg])
+				case msg.Obj == nil || msg.Obj.Kind == ast.Con: // Declared in another file or this one
+					uses = append(uses, msg)
+				}
+			}
+			return true
+		})
+	}
+	for _, msg := range uses {
+		if format, ok := formats[msg.Name]; !ok || errorCode(format) == "" {
+			t.Errorf("\n- %v:, expected: explanation of '%v', got: <nothing>", fset.Position(msg.Pos()), msg.Name)
+		}
+	}
+
+	// Each mistake is reported with its code & corrected by its fix
+	for _, e := range explanations {
+		t.Run(e.code, func(t *testing.T) {
+			e := e
+			t.Parallel()
+			if errorCodes[e.code] != e || errorCodes[e.msg] != e {
+				t.Fatalf("\n- %v:, expected: unique code & message format", e.code)
+			}
+			for _, example := range []struct {
+				src  string
+				want string
+			}{{e.mistake, e.code}, {e.fix, ""}} {
+				read := func(path string) ([]byte, error) {
+					if path == "example.clara" {
+						return []byte(example.src), nil
+					}
+					return ioutil.ReadFile(path)
+				}
+				_, _, errs := check(options{}, glob("./install/lib/*.clara"), "example.clara", read, ioutil.Discard)
+				var codes []string
+				for _, err := range errs {
+					if d, ok := err.(*diagnostic); ok && d.token != nil && d.token.File == "example.clara" {
+						codes = append(codes, d.code)
+					} else if !ok {
+						codes = append(codes, err.Error())
+					}
+				}
+				if got := strings.Join(codes, ", "); (example.want == "" && got != "") ||
+					(example.want != "" && !strings.Contains(got, example.want)) {
+					t.Errorf("\n- %v:, expected: '%v', got: '%v'\n%v", e.code, example.want, got, example.src)
+				}
+			}
+		})
+	}
+
+	// Unknown codes list those which are known instead
+	var out, errOut bytes.Buffer
+	if status := runExplain([]string{"E9999"}, &out, &errOut); status != 1 ||
+		!strings.HasPrefix(out.String(), "Unknown error code 'E9999'. Known codes: E0001, E0002,") {
+		t.Errorf("\n- explain E9999:, expected: exit status 1 & known codes, got: %d\n%v", status, out.String())
+	}
+	out.Reset()
+	if status := runExplain([]string{"e0001"}, &out, &errOut); status != 0 || !strings.HasPrefix(out.String(), "E0001: ") {
+		t.Errorf("\n- explain e0001:, expected: exit status 0 & explanation, got: %d\n%v", status, out.String())
+	}
+}
+
+func TestOverflowSpan(t *testing.T) {
+	// Folded arithmetic which overflows is reported across the whole expression, not only its first operand
+	src := "fn main() {\n    println(2 * (1 << 61))\n}\n"
+	read := func(path string) ([]byte, error) {
+		if path == "overflow.clara" {
+			return []byte(src), nil
+		}
+		return ioutil.ReadFile(path)
+	}
+	_, _, errs := check(options{}, glob("./install/lib/*.clara"), "overflow.clara", read, ioutil.Discard)
+	if len(errs) != 1 {
+		t.Fatalf("\n- overflow.clara:, expected: 1 error, got: %v", errs)
+	}
+	d, ok := errs[0].(*diagnostic)
+	if !ok || d.code != "E0022" || d.token.Val != "2" || d.token.Pos != 13 || d.end == nil || d.end.Val != "61" ||
+		!strings.Contains(d.Error(), "'4611686018427387904'") {
+		t.Fatalf("\n- overflow.clara:2:, expected: E0022 from '2' to '61', got: %#v %#v", d.token, d.end)
+	}
+}
+
+func TestFormatVerb(t *testing.T) {
+
+	// Unknown verbs are quoted, so those which can't be printed don't break the message
+	for _, test := range []struct {
+		src  string
+		want string
+	}{
+		{`printf("%q\n", 5)`, `unknown format verb "%q"`},
+		{`printf("%\n", 5)`, `unknown format verb "%\n"`},
+	} {
+		read := func(path string) ([]byte, error) {
+			if path == "format.clara" {
+				return []byte("fn main() {\n    " + test.src + "\n}\n"), nil
+			}
+			return ioutil.ReadFile(path)
+		}
+		_, _, errs := check(options{}, glob("./install/lib/*.clara"), "format.clara", read, ioutil.Discard)
+		if len(errs) != 1 {
+			t.Fatalf("\n- %v:, expected: 1 error, got: %v", test.src, errs)
+		}
+		if d, ok := errs[0].(*diagnostic); !ok || d.code != "E0036" || !strings.HasSuffix(d.msg, test.want) {
+			t.Errorf("\n- %v:, expected: '%v', got: %v", test.src, test.want, errs[0])
+		}
+	}
+}
+
+func TestVet(t *testing.T) {
+	files, err := filepath.Glob("./tests/vet/*.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
+	projects, err := filepath.Glob("./tests/vet/*/*.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Each line reported must match the expectation on that line, in order
+	for _, f := range append(files, projects...) {
+		t.Run(f, func(t *testing.T) {
+			f := f
+			t.Parallel()
+			args := append([]string{"-install", "./install"}, ParseArgs(f, t)...)
+			var out bytes.Buffer
+			runVet(append(args, f), "", &out, &out)
+			reports := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if out.Len() == 0 {
+				reports = nil
+			}
+			expects := ParseExpectations(f, t)
+			for i, expect := range expects {
+				if i >= len(reports) {
+					t.Fatalf("\n- ./%v:%d:, expected: '%v', got: <nothing>", f, expect.line, expect.val)
+				}
+				at := fmt.Sprintf("%v:%d:", f, expect.line)
+				if !strings.HasPrefix(reports[i], at) || !strings.HasSuffix(reports[i], expect.val) {
+					t.Fatalf("\n- ./%v:%d:, expected: '%v', got: '%v'", f, expect.line, expect.val, reports[i])
+				}
+			}
+			if len(reports) > len(expects) {
+				t.Fatalf("\n- ./%v:, expected: <nothing>, got: ['%v']", f, strings.Join(reports[len(expects):], "', '"))
+			}
+		})
+	}
+}
+
+func TestSarif(t *testing.T) {
+	files, err := filepath.Glob("./tests/sarif/*.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Each expectation names the rule of the result reported on its line, in order
 	for _, f := range files {
 		t.Run(filepath.Base(f), func(t *testing.T) {
 			f := f
 			t.Parallel()
+			_, errs := Compile(options{}, glob("./install/lib/*.clara"), f, glob("./install/init/*.c"), os.TempDir(),
+				ioutil.Discard)
+			s := newSarifWriter()
+			s.addErrors(errs)
+			var out bytes.Buffer
+			if err := s.write(&out); err != nil {
+				t.Fatal(err)
+			}
+			var sarif sarifLog
+			if err := json.Unmarshal(out.Bytes(), &sarif); err != nil {
+				t.Fatalf("invalid SARIF: %v\n%v", err, out.String())
+			}
+			results := sarif.Runs[0].Results
 			expects := ParseExpectations(f, t)
+			if len(results) != len(expects) {
+				t.Fatalf("\n- ./%v:, expected %d results, got:\n%v", f, len(expects), out.String())
+			}
+			for i, expect := range expects {
+				r := results[i]
+				rules := sarif.Runs[0].Tool.Driver.Rules
+				if r.RuleID != expect.val || r.RuleIndex == nil || rules[*r.RuleIndex].ID != r.RuleID || len(r.Locations) != 1 ||
+					r.Locations[0].PhysicalLocation.Region.StartLine != expect.line ||
+					r.Locations[0].PhysicalLocation.ArtifactLocation.URI != filepath.ToSlash(f) {
+					t.Fatalf("\n- ./%v:%d:, expected: '%v', got:\n%v", f, expect.line, expect.val, out.String())
+				}
+			}
+		})
+	}
+}
 
-			// Compile test, execute test & parse output
-			output := CompileAndRun(f, t, false)
-			lines := strings.Split(output, "\n")
-			lines = lines[:len(lines)-1] // Trim empty final line
+func TestFmt(t *testing.T) {
+	files, err := filepath.Glob("./tests/fmt/*.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			// Match output against expectations
-			pos := 0
-			var builder strings.Builder
-			for _, expect := range expects {
-				if pos < len(lines) {
-					if expect.val != lines[pos] {
-						builder.WriteString(fmt.Sprintf("- ./%v:%d:, expected: '%v', got: '%v'\n", f, expect.line, expect.val, lines[pos]))
+	// Each file formats as its .golden file, which is already formatted
+	for _, f := range files {
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			f := f
+			t.Parallel()
+			golden := strings.TrimSuffix(f, ".clara") + ".golden"
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out, errOut bytes.Buffer
+			if status := runFmt([]string{f}, &out, &errOut); status != 0 {
+				t.Fatalf("\n- ./%v:, expected: exit status 0, got: %d\n%v", f, status, errOut.String())
+			}
+			formatted := out.String()
+			if diff := diffExpected(string(expected), formatted); diff != "" {
+				t.Fatalf("\n- ./%v: %v", golden, diff)
+			}
+
+			// Formatting again changes nothing
+			if again, errs := formatSource(formatted, f); len(errs) > 0 || again != formatted {
+				t.Fatalf("\n- ./%v:, expected: no change when formatted twice, got: %v\n%v", f, errs, again)
+			}
+
+			// Differences are only printed for files which aren't formatted
+			out.Reset()
+			if status := runFmt([]string{"-d", golden}, &out, &errOut); status != 0 || out.Len() > 0 {
+				t.Fatalf("\n- ./%v:, expected: no difference, got: exit status %d\n%v%v", golden, status, out.String(),
+					errOut.String())
+			}
+			out.Reset()
+			if status := runFmt([]string{"-d", f}, &out, &errOut); status != 0 || !strings.Contains(out.String(), "+++ "+f) {
+				t.Fatalf("\n- ./%v:, expected: difference, got: exit status %d\n%v%v", f, status, out.String(),
+					errOut.String())
+			}
+		})
+	}
+}
+
+func TestDoc(t *testing.T) {
+	files, err := filepath.Glob("./tests/doc/*.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Each file is documented as its .md file & with -html as its .html file
+	for _, f := range files {
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			f := f
+			t.Parallel()
+			for _, format := range []struct {
+				args []string
+				ext  string
+			}{{nil, ".md"}, {[]string{"-html"}, ".html"}} {
+				golden := strings.TrimSuffix(f, ".clara") + format.ext
+				expected, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var out, errOut bytes.Buffer
+				if status := runDoc(append(format.args, f), &out, &errOut); status != 0 {
+					t.Fatalf("\n- ./%v:, expected: exit status 0, got: %d\n%v", f, status, errOut.String())
+				}
+				if diff := diffExpected(string(expected), out.String()); diff != "" {
+					t.Fatalf("\n- ./%v: %v", golden, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	var out bytes.Buffer
+	if status := runSelftest([]string{"-install", "./install"}, "", &out, &out); status != 0 {
+		t.Fatalf("\n- ./install/examples:, expected: exit status 0, got: %d\n%v", status, out.String())
+	}
+
+	// Each program of tests/selftest is reported with its expectation
+	files, err := filepath.Glob("./tests/selftest/*.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range files {
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			f := f
+			t.Parallel()
+			var out bytes.Buffer
+			runSelftest([]string{"-install", "./install", f}, "", &out, &out)
+			for _, expect := range ParseExpectations(f, t) {
+				if !strings.Contains(out.String(), expect.val) {
+					t.Fatalf("\n- ./%v:%d:, expected: '%v', got:\n%v", f, expect.line, expect.val, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestLsp(t *testing.T) {
+	path, err := filepath.Abs("./tests/lsp/shapes.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uri := pathToURI(path)
+	doc := map[string]interface{}{"uri": uri}
+	at := func(line int, char int) interface{} {
+		return map[string]interface{}{"textDocument": doc, "position": map[string]int{"line": line, "character": char}}
+	}
+
+	// Messages are sent in order as one session. Requests are answered & notifications may be replied to by one of the
+	// server's own, with the results (or params) expected given as JSON with {uri} for the document's URI.
+	tests := []struct {
+		name    string
+		method  string
+		request bool
+		params  interface{}
+		reply   string // Method of notification sent in reply, if not a response
+		want    string
+	}{
+		{"initialize", "initialize", true, map[string]interface{}{}, "", `{
+			"capabilities": {
+				"textDocumentSync": {"openClose": true, "change": 1},
+				"definitionProvider": true,
+				"hoverProvider": true,
+				"documentSymbolProvider": true,
+				"semanticTokensProvider": {
+					"legend": {"tokenTypes": ["keyword", "function", "parameter", "type", "field"], "tokenModifiers": []},
+					"full": true
+				}
+			},
+			"serverInfo": {"name": "clarac"}
+		}`},
+		{"initialized", "initialized", false, map[string]interface{}{}, "", ""},
+		{"didOpen", "textDocument/didOpen", false,
+			map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri, "version": 1, "text": string(text)}},
+			"textDocument/publishDiagnostics", `{
+			"uri": "{uri}",
+			"version": 1,
+			"diagnostics": [{
+				"range": {"start": {"line": 8, "character": 9}, "end": {"line": 8, "character": 18}},
+				"severity": 1,
+				"code": "E0012",
+				"source": "clarac",
+				"message": "mismatched types, got 'int', wanted 'string'"
+			}]
+		}`},
+		{"hover", "textDocument/hover", true, at(7, 13), "", `{
+			"contents": {"kind": "markdown", "value": "` + "```clara\\nfn norm(point) int\\n```" + `"},
+			"range": {"start": {"line": 7, "character": 12}, "end": {"line": 7, "character": 16}}
+		}`},
+		{"definition", "textDocument/definition", true, at(7, 13), "", `{
+			"uri": "{uri}",
+			"range": {"start": {"line": 11, "character": 3}, "end": {"line": 11, "character": 7}}
+		}`},
+		{"documentSymbol", "textDocument/documentSymbol", true, map[string]interface{}{"textDocument": doc}, "", `[
+			{
+				"name": "point", "kind": 23,
+				"range": {"start": {"line": 0, "character": 7}, "end": {"line": 0, "character": 12}},
+				"selectionRange": {"start": {"line": 0, "character": 7}, "end": {"line": 0, "character": 12}},
+				"children": [
+					{
+						"name": "x", "detail": "int", "kind": 8,
+						"range": {"start": {"line": 1, "character": 4}, "end": {"line": 1, "character": 5}},
+						"selectionRange": {"start": {"line": 1, "character": 4}, "end": {"line": 1, "character": 5}}
+					},
+					{
+						"name": "y", "detail": "int", "kind": 8,
+						"range": {"start": {"line": 2, "character": 4}, "end": {"line": 2, "character": 5}},
+						"selectionRange": {"start": {"line": 2, "character": 4}, "end": {"line": 2, "character": 5}}
 					}
-				} else {
-					builder.WriteString(fmt.Sprintf("- ./%v:%d:, expected: '%v', got: <nothing>\n", f, expect.line, expect.val))
+				]
+			},
+			{
+				"name": "main", "detail": "fn() nothing", "kind": 12,
+				"range": {"start": {"line": 5, "character": 3}, "end": {"line": 5, "character": 7}},
+				"selectionRange": {"start": {"line": 5, "character": 3}, "end": {"line": 5, "character": 7}}
+			},
+			{
+				"name": "norm", "detail": "fn(point) int", "kind": 12,
+				"range": {"start": {"line": 11, "character": 3}, "end": {"line": 11, "character": 7}},
+				"selectionRange": {"start": {"line": 11, "character": 3}, "end": {"line": 11, "character": 7}}
+			}
+		]`},
+		{"unknown", "textDocument/unknown", true, map[string]interface{}{}, "",
+			`{"code": -32601, "message": "method 'textDocument/unknown' not supported"}`},
+		{"shutdown", "shutdown", true, nil, "", `null`},
+		{"exit", "exit", false, nil, "", ""},
+	}
+
+	var in bytes.Buffer
+	for i, test := range tests {
+		msg := map[string]interface{}{"jsonrpc": "2.0", "method": test.method, "params": test.params}
+		if test.request {
+			msg["id"] = i
+		}
+		b, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(b), b)
+	}
+	var out, errOut bytes.Buffer
+	if status := runLsp([]string{"-install", "./install"}, "", &in, &out, &errOut); status != 0 {
+		t.Fatalf("\n- lsp:, expected: exit status 0, got: %d\n%v", status, errOut.String())
+	}
+
+	r := bufio.NewReader(&out)
+	for i, test := range tests {
+		if test.want == "" {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			header, err := textproto.NewReader(r).ReadMIMEHeader()
+			if err != nil {
+				t.Fatalf("\n- %v:, expected: reply, got: %v", test.method, err)
+			}
+			length, err := strconv.Atoi(header.Get("Content-Length"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := make([]byte, length)
+			if _, err := io.ReadFull(r, body); err != nil {
+				t.Fatal(err)
+			}
+			var reply struct {
+				ID     *int            `json:"id"`
+				Method string          `json:"method"`
+				Params json.RawMessage `json:"params"`
+				Result json.RawMessage `json:"result"`
+				Error  json.RawMessage `json:"error"`
+			}
+			if err := json.Unmarshal(body, &reply); err != nil {
+				t.Fatalf("\n- %v:, invalid reply: %v\n%s", test.method, err, body)
+			}
+			got := reply.Result
+			switch {
+			case test.reply != "":
+				if reply.Method != test.reply {
+					t.Fatalf("\n- %v:, expected: '%v', got:\n%s", test.method, test.reply, body)
+				}
+				got = reply.Params
+			case reply.ID == nil || *reply.ID != i:
+				t.Fatalf("\n- %v:, expected: response with id %d, got:\n%s", test.method, i, body)
+			case reply.Error != nil:
+				got = reply.Error
+			}
+			if want := strings.ReplaceAll(test.want, "{uri}", uri); CanonicalJSON(t, got) != CanonicalJSON(t, []byte(want)) {
+				t.Fatalf("\n- %v:, expected: %v\ngot: %v", test.method, CanonicalJSON(t, []byte(want)), CanonicalJSON(t, got))
+			}
+		})
+	}
+}
+
+func TestSemanticTokens(t *testing.T) {
+	path, err := filepath.Abs("./tests/lsp/tokens.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &lspServer{installPath: "./install", out: ioutil.Discard, docs: make(map[string]*lspDoc)}
+	doc := &lspDoc{uri: pathToURI(path), path: path, text: string(text), version: 1}
+	s.docs[path] = doc
+	s.check(doc)
+
+	// Each token is relative to the last: line, start, length, type & modifiers
+	data := s.semanticTokens(doc)["data"]
+	if len(data)%5 != 0 {
+		t.Fatalf("\n- ./tests/lsp/tokens.clara:, expected: groups of 5 integers, got: %v", data)
+	}
+	lines := strings.Split(string(text), "\n")
+	var got []string
+	line, start := 0, 0
+	for i := 0; i < len(data); i += 5 {
+		if data[i] > 0 {
+			start = 0
+		}
+		line, start = line+data[i], start+data[i+1]
+		got = append(got, fmt.Sprintf("%d:%d %v %v", line+1, start+1, lines[line][start:start+data[i+2]],
+			semClasses[data[i+3]]))
+	}
+	want := []string{
+		"1:1 struct keyword",
+		"1:8 duo type",
+		"2:5 a field",
+		"2:8 int type",
+		"6:1 fn keyword",
+		"6:4 first function",
+		"6:10 p parameter",
+		"6:13 duo type",
+		"6:18 int type",
+		"7:10 p parameter",
+		"7:12 a field",
+		"8:5 return keyword",
+		"11:1 fn keyword",
+		"11:4 main function",
+		"12:5 println function",
+		"12:13 first function",
+		"12:19 Duo function",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("\n- ./tests/lsp/tokens.clara:, expected:\n%v\ngot:\n%v", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// JSON with its objects' keys sorted & no whitespace
+func CanonicalJSON(t *testing.T, b []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, b)
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(canonical)
+}
+
+// Each directory of tests/mod other than app is committed to its own repository & tagged v1.0.0, with $MOD in any
+// clara.mod replaced by their parent. The app is then built against them.
+func TestSharedLibrary(t *testing.T) {
+	f := "tests/fns.clara"
+	driver := "tests/shared/driver.c"
+
+	// Exports are called from a C program linked against the library, with the header generated for it
+	dir, err := ioutil.TempDir("", "clara-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := CompileTest(f, options{buildMode: sharedBuildMode}, dir, t)
+	if filepath.Base(lib) != sharedLibName("fns") {
+		t.Fatalf("\n- ./%v:, expected: '%v', got: '%v'", f, sharedLibName("fns"), lib)
+	}
+	binary := filepath.Join(dir, "driver")
+	out, err := exec.Command("gcc", "-o", binary, driver, "-I", dir, "-L", dir, "-lfns", "-Wl,-rpath,"+dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("\n- ./%v:, expected: link against %v, got: %v\n%v", driver, lib, err, string(out))
+	}
+	MatchExpectations(driver, RunTest(driver, "", binary, e2eEnv, t, false), t)
+}
+
+func TestUnusedFunctions(t *testing.T) {
+	f := "tests/unused.clara"
+	roots := []string{"entrypoint", "threadEntry", "indexOutOfBounds", "divideByZero", "nullDereference", "used"}
+	symbol := map[string]string{"x64": "(?m)^%v[.:]", "c": "(?m)^static V f\\d+_%v[_(]"}
+
+	// Functions which can't be reached from the roots of the program are not output, whatever the backend or build
+	for _, test := range []struct {
+		name  string
+		opts  options
+		ext   string
+		roots []string
+	}{
+		{"x64", options{backend: "x64"}, ".S", roots},
+		{"c", options{backend: "c"}, ".c", roots},
+		{"shared", options{backend: "x64", buildMode: sharedBuildMode}, ".S", append(roots, "export_exported", "exported")},
+		{"rc", options{backend: "x64", alloc: rcAlloc}, ".S", append(roots, "rcRetain", "rcRelease")},
+	} {
+		dir, err := ioutil.TempDir("", "clara-unused")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		CompileTest(f, test.opts, dir, t)
+		src, err := ioutil.ReadFile(filepath.Join(os.TempDir(), "unused"+test.ext)) // See: Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range test.roots {
+			re := regexp.MustCompile(fmt.Sprintf(symbol[test.opts.backend], regexp.QuoteMeta(fnPrefix+name)))
+			if !re.Match(src) {
+				t.Errorf("\n- ./%v: %v:, expected: '%v' to be output, got: <nothing>", f, test.name, name)
+			}
+		}
+		if bytes.Contains(src, []byte("deadCall")) {
+			t.Errorf("\n- ./%v: %v:, expected: no 'deadCaller' or 'deadCallee', got:\n%v", f, test.name, string(src))
+		}
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	f := "tests/hello.clara"
+	abs, err := filepath.Abs(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "clara-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Assembly names each source file & the line of each instruction, which the binary's line table maps back to
+	binary := CompileTest(f, options{backend: "x64", debugInfo: true}, dir, t)
+	asm, err := ioutil.ReadFile(filepath.Join(os.TempDir(), "hello.S")) // See: Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := regexp.MustCompile(fmt.Sprintf(`(?m)^\s*\.file\s+(\d+)\s+%v$`, regexp.QuoteMeta(strconv.Quote(abs)))).FindSubmatch(asm)
+	if file == nil || !regexp.MustCompile(fmt.Sprintf(`(?m)^\s*\.loc\s+%s\s+2\s`, file[1])).Match(asm) {
+		t.Fatalf("\n- ./%v:, expected: .file & .loc of line 2, got:\n%v", f, string(asm))
+	}
+	if !FindLine(binary, abs, 2, t) {
+		t.Fatalf("\n- ./%v:, expected: line 2 in the line table of %v", f, binary)
+	}
+	MatchExpectations(f, RunTest(f, "x64", binary, e2eEnv, t, false), t)
+
+	// None are output otherwise
+	CompileTest(f, options{backend: "x64"}, dir, t)
+	asm, err = ioutil.ReadFile(filepath.Join(os.TempDir(), "hello.S"))
+	if err != nil || regexp.MustCompile(`(?m)^\s*\.(loc|file)\s`).Match(asm) {
+		t.Fatalf("\n- ./%v:, expected: no .loc directives, got: %v\n%v", f, err, string(asm))
+	}
+}
+
+// Whether the DWARF line table of the binary has an entry for the line of the file
+func FindLine(binary string, file string, line int, t *testing.T) bool {
+	exe, err := elf.Open(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exe.Close()
+	data, err := exe.DWARF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	units := data.Reader()
+	for {
+		unit, err := units.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit == nil {
+			return false
+		}
+		if unit.Tag != dwarf.TagCompileUnit {
+			units.SkipChildren()
+			continue
+		}
+		lines, err := data.LineReader(unit)
+		if err != nil || lines == nil {
+			continue
+		}
+		var entry dwarf.LineEntry
+		for lines.Next(&entry) == nil {
+			if entry.File != nil && entry.File.Name == file && entry.Line == line {
+				return true
+			}
+		}
+	}
+}
+
+func TestStripAndMap(t *testing.T) {
+	f := "tests/hello.clara"
+	dir, err := ioutil.TempDir("", "clara-strip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Symbols are mapped before they're stripped from the binary, which still runs
+	mapPath := filepath.Join(dir, "hello.map")
+	binary := CompileTest(f, options{backend: "x64", strip: true, mapPath: mapPath}, dir, t)
+	exe, err := elf.Open(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exe.Close()
+	if syms, err := exe.Symbols(); err != elf.ErrNoSymbols {
+		t.Fatalf("\n- ./%v:, expected: no symbols, got: %d symbols, %v", f, len(syms), err)
+	}
+	MatchExpectations(f, RunTest(f, "x64", binary, e2eEnv, t, false), t)
+
+	// Every function output is mapped, by its name in Clara
+	asm, err := ioutil.ReadFile(filepath.Join(os.TempDir(), "hello.S")) // See: Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ioutil.ReadFile(mapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := make(map[string]bool)
+	for _, match := range regexp.MustCompile(`(?m)^0x[0-9a-f]{16} +\d+ +\S+ +(.+)$`).FindAllSubmatch(m, -1) {
+		mapped[string(match[1])] = true
+	}
+	fns := regexp.MustCompile(`(?m)^\s*\.type\s+(\S+),\s*@function`).FindAllSubmatch(asm, -1)
+	for _, fn := range fns {
+		if name := demangle(string(fn[1])); !mapped[name] {
+			t.Errorf("\n- %v:, expected: '%v' to be mapped, got:\n%v", mapPath, name, string(m))
+		}
+	}
+	if len(fns) == 0 || !mapped["main"] {
+		t.Fatalf("\n- %v:, expected: main() to be mapped, got:\n%v", mapPath, string(m))
+	}
+}
+
+func TestModules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	dirs, err := filepath.Glob("./tests/mod/*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, src := range dirs {
+		dst := filepath.Join(dir, filepath.Base(src))
+		CopyModule(src, dst, dir, t)
+		if filepath.Base(src) == "app" {
+			continue
+		}
+		for _, args := range [][]string{{"init", "-q"}, {"add", "."}, {"commit", "-q", "-m", "v1.0.0"}, {"tag", "v1.0.0"}} {
+			cmd := exec.Command("git", append([]string{"-c", "user.name=clara", "-c", "user.email=clara@localhost"}, args...)...)
+			cmd.Dir = dst
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("git %v: %v\n%s", args, err, out)
+			}
+		}
+	}
+
+	// Lock & fetch dependencies then build with them
+	app := filepath.Join(dir, "app")
+	install := filepath.Join(dir, "install")
+	var out bytes.Buffer
+	if status := runMod([]string{"-install", install, "download"}, app, "", &out, &out); status != 0 {
+		t.Fatalf("clarac mod download: exit status %d\n%v", status, out.String())
+	}
+	prog := filepath.Join(app, "app.clara")
+	deps, err := moduleLibs(prog, install)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, errs := Compile(options{}, append(glob("./install/lib/*.clara"), deps...), prog, glob("./install/init/*.c"),
+		install, ioutil.Discard)
+	if len(errs) > 0 {
+		t.Fatalf("Compilation failure(s): %v", errs)
+	}
+	output, err := exec.Command(binary).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Execution failure: %v\n%s", err, output)
+	}
+	lines := strings.Split(string(output), "\n")
+	for i, expect := range ParseExpectations(prog, t) {
+		if i >= len(lines) || lines[i] != expect.val {
+			t.Fatalf("\n- ./tests/mod/app/app.clara:%d:, expected: '%v', got:\n%s", expect.line, expect.val, output)
+		}
+	}
+}
+
+func CopyModule(src string, dst string, modDir string, t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(src, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(f) == manifestName {
+			b = []byte(strings.ReplaceAll(string(b), "$MOD", modDir))
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, filepath.Base(f)), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestE2E(t *testing.T) {
+	files, err := filepath.Glob("./tests/*.clara")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Process each test case
+	for _, f := range files {
+		f := f
+		RunBackends(t, f, func(t *testing.T, backend string, level int) {
+			MatchExpectations(f, CompileAndRun(f, backend, level, t, false), t)
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	f := "tests/cse.clara"
+	dumped := regexp.MustCompile("\nIR after '(\\w+)'\n")
+	names := func(ir string) string {
+		var names []string
+		for _, match := range dumped.FindAllStringSubmatch(ir, -1) {
+			names = append(names, match[1])
+		}
+		return strings.Join(names, ", ")
+	}
+
+	// IR is printed after the named pass alone, or after every pass in order
+	if ir := DumpIr(f, nil, "cse", t); names(ir) != "cse" || !strings.Contains(ir, "fn clara_main()") {
+		t.Fatalf("\n- ./%v:, expected: IR after 'cse', got:\n%v", f, ir)
+	}
+	all := "lower, inline, ssa, constprop, jumps, cse, strength, bce, escape, nce, layout, fromssa"
+	if ir := DumpIr(f, nil, "all", t); names(ir) != all {
+		t.Fatalf("\n- ./%v:, expected: IR after '%v', got: '%v'", f, all, names(ir))
+	}
+
+	// Unknown passes can't be named & required passes can't be disabled
+	for _, test := range []struct {
+		disabled  []string
+		dumpAfter string
+		want      string
+	}{
+		{[]string{"nope"}, "", "Unknown pass: 'nope'. Available passes: inline, ssa,"},
+		{nil, "nope", "Unknown pass: 'nope'. Available passes: inline, ssa,"},
+		{[]string{"ssa"}, "", "Pass 'ssa' is required and cannot be disabled"},
+	} {
+		if _, err := newPipeline(2, test.disabled, test.dumpAfter, ioutil.Discard); err == nil ||
+			!strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("\n- %v -dump-after=%v:, expected: '%v', got: %v", test.disabled, test.dumpAfter, test.want, err)
+		}
+	}
+
+	// Disabled passes don't run, yet the program's output is unchanged
+	for _, pass := range passes {
+		if pass.required {
+			continue
+		}
+		var ir bytes.Buffer
+		pl, err := newPipeline(2, []string{pass.name}, "all", &ir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		MatchExpectations(f, CompileAndRunWith(f, options{backend: "x64", pipeline: pl}, e2eEnv, t, false), t)
+		if want := strings.Replace(all, ", "+pass.name+",", ",", 1); names(ir.String()) != want {
+			t.Errorf("\n- ./%v: -fno-%v:, expected: IR after '%v', got: '%v'", f, pass.name, want, names(ir.String()))
+		}
+	}
+}
+
+func TestShowIr(t *testing.T) {
+	f := "tests/cse.clara"
+
+	// The IR passed to code generation is that after the last pass
+	dir, err := ioutil.TempDir("", "clara-ir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var out bytes.Buffer
+	if _, errs := Compile(options{backend: "x64", showIr: true}, glob("./install/lib/*.clara"), f,
+		glob("./install/init/*.c"), dir, &out); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	ir := strings.TrimPrefix(out.String(), "\nIR\n")
+	last := strings.TrimPrefix(DumpIr(f, nil, "fromssa", t), "\nIR after 'fromssa'\n")
+	if ir == out.String() || !strings.Contains(ir, "fn clara_main()") {
+		t.Fatalf("\n- ./%v:, expected: IR after 'fromssa', got:\n%v", f, out.String())
+	}
+
+	// Closures are numbered by each compile & capture variables in no particular order, so functions which create them
+	// are only counted
+	numbers := regexp.MustCompile("[0-9]+")
+	funcs := func(ir string) (n int, fixed string) {
+		var fns []string
+		for _, fn := range strings.Split(ir, "\nfn ")[1:] {
+			n++
+			if !strings.Contains(fn, "fnaddr") && !strings.Contains(fn, "Env.") {
+				fns = append(fns, "fn "+numbers.ReplaceAllString(fn, "0"))
+			}
+		}
+		sort.Strings(fns)
+		return n, strings.Join(fns, "\n")
+	}
+	n, fixed := funcs(ir)
+	lastN, lastFixed := funcs(last)
+	if n != lastN {
+		t.Fatalf("\n- ./%v:, expected: %d functions, got: %d", f, lastN, n)
+	}
+	if diff := diffExpected(lastFixed, fixed); diff != "" {
+		t.Fatalf("\n- ./%v:, expected: IR after 'fromssa', got: %v", f, diff)
+	}
+}
+
+// Compiles the program for x64 at -O2 with the passes disabled & returns the IR printed after the pass named
+func DumpIr(progPath string, disabled []string, dumpAfter string, t *testing.T) string {
+	var ir bytes.Buffer
+	pl, err := newPipeline(2, disabled, dumpAfter, &ir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "clara-ir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	CompileTest(progPath, options{backend: "x64", pipeline: pl}, dir, t)
+	return ir.String()
+}
+
+// Returns the IR of the named function from the IR printed by the compiler
+func IrFunc(ir string, name string, t *testing.T) string {
+	for _, fn := range strings.Split(ir, "\nfn ")[1:] {
+		if strings.HasPrefix(fn, "clara_"+name+".") || strings.HasPrefix(fn, "clara_"+name+"(") {
+			return "fn " + strings.TrimSpace(fn)
+		}
+	}
+	t.Fatalf("\n- IR:, expected: function '%v', got:\n%v", name, ir)
+	return ""
+}
+
+func TestCse(t *testing.T) {
+	f := "tests/cse.clara"
+
+	// Repeated loads & arithmetic are computed once...
+	before := DumpIr(f, nil, "jumps", t)
+	after := DumpIr(f, nil, "cse", t)
+	sum := IrFunc(after, "sum", t)
+	if n, was := strings.Count(sum, "= load "), strings.Count(IrFunc(before, "sum", t), "= load "); n != 2 || was != 4 {
+		t.Errorf("\n- ./%v:, expected: 4 loads reduced to 2, got: %d reduced to %d:\n%v", f, was, n, sum)
+	}
+	if n := strings.Count(sum, "= mul "); n != 1 {
+		t.Errorf("\n- ./%v:, expected: 1 mul, got: %d:\n%v", f, n, sum)
+	}
+
+	// ...but are read again after writes which may alias them
+	write := regexp.MustCompile(`(?m)^\s*(store|setindex) `)
+	for fn, read := range map[string]string{"aliased": "= load ", "branched": "= load ", "indexed": "= index "} {
+		ir := IrFunc(after, fn, t)
+		writes := write.FindAllStringIndex(ir, -1)
+		if len(writes) == 0 || !strings.Contains(ir[writes[len(writes)-1][1]:], read) {
+			t.Errorf("\n- ./%v:, expected: '%v' after the last write in %v(), got:\n%v", f, read, fn, ir)
+		}
+	}
+}
+
+func TestBce(t *testing.T) {
+	f := "tests/bounds.clara"
+
+	// Indexes bounded by the loop condition are unchecked...
+	access := regexp.MustCompile(`(?m)^\s*(\S+ = index|setindex) .*$`)
+	before := IrFunc(DumpIr(f, nil, "strength", t), "sumTwice", t)
+	after := DumpIr(f, nil, "bce", t)
+	sumTwice := IrFunc(after, "sumTwice", t)
+	if strings.Contains(before, "unchecked") {
+		t.Errorf("\n- ./%v:, expected: checked indexes before 'bce', got:\n%v", f, before)
+	}
+	indexes := access.FindAllString(sumTwice, -1)
+	for _, index := range indexes {
+		if !strings.HasSuffix(index, ", unchecked") {
+			t.Errorf("\n- ./%v:, expected: unchecked index, got: '%v':\n%v", f, strings.TrimSpace(index), sumTwice)
+		}
+	}
+	if len(indexes) == 0 {
+		t.Errorf("\n- ./%v:, expected: indexes in sumTwice(), got:\n%v", f, sumTwice)
+	}
+
+	// ...but not those which may be out of bounds
+	if beyond := IrFunc(after, "beyond", t); !access.MatchString(beyond) || strings.Contains(beyond, "unchecked") {
+		t.Errorf("\n- ./%v:, expected: checked index in beyond(), got:\n%v", f, beyond)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	f := "tests/layout.clara"
+	before := DumpIr(f, nil, "nce", t)
+	after := DumpIr(f, nil, "layout", t)
+
+	// Blocks which panic are moved to the end of the function
+	last := func(fn string) string {
+		blocks := regexp.MustCompile(`(?m)^b\d+:`).FindAllStringIndex(fn, -1)
+		return fn[blocks[len(blocks)-1][0]:]
+	}
+	if fn := IrFunc(before, "checkedSum", t); strings.Contains(last(fn), "call panic") {
+		t.Errorf("\n- ./%v:, expected: panic before the last block before 'layout', got:\n%v", f, fn)
+	}
+	if fn := IrFunc(after, "checkedSum", t); !strings.Contains(last(fn), "call panic") {
+		t.Errorf("\n- ./%v:, expected: panic in the last block, got:\n%v", f, fn)
+	}
+
+	// Loop headers are placed after their bodies, so the outer header follows the inner loop
+	outerAfterInner := func(fn string) bool {
+		inner := strings.Index(fn, ", cols.1\n")
+		return inner >= 0 && strings.Index(fn, ", rows.0\n") > inner
+	}
+	if fn := IrFunc(before, "grid", t); outerAfterInner(fn) {
+		t.Errorf("\n- ./%v:, expected: outer loop header first before 'layout', got:\n%v", f, fn)
+	}
+	if fn := IrFunc(after, "grid", t); !outerAfterInner(fn) {
+		t.Errorf("\n- ./%v:, expected: outer loop header after the inner loop, got:\n%v", f, fn)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	f := "tests/escape.clara"
+	before := IrFunc(DumpIr(f, nil, "bce", t), "main", t)
+	after := IrFunc(DumpIr(f, nil, "escape", t), "main", t)
+
+	// Structs which don't escape are allocated on the stack, except the one stored in a holder & the one allocated in
+	// a loop which outlives its iteration
+	allocs := regexp.MustCompile(`= call (Duo|Holder)\(`)
+	if n, stack := len(allocs.FindAllString(before, -1)), strings.Count(before, "= stackalloc "); n != 6 || stack != 0 {
+		t.Errorf("\n- ./%v:, expected: 6 heap allocations before 'escape', got: %d (& %d stack):\n%v", f, n, stack, before)
+	}
+	if n, stack := len(allocs.FindAllString(after, -1)), strings.Count(after, "= stackalloc "); n != 2 || stack != 4 {
+		t.Errorf("\n- ./%v:, expected: 2 heap & 4 stack allocations, got: %d & %d:\n%v", f, n, stack, after)
+	}
+}
+
+func TestGcPacing(t *testing.T) {
+	f := "tests/pacing.clara"
+
+	// Without stress testing collections are only due once the heap grows past its minimum, yet still reclaim it
+	RunBackends(t, f, func(t *testing.T, backend string, level int) {
+		pl, err := newPipeline(level, nil, "", ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		MatchExpectations(f, CompileAndRunWith(f, options{backend: backend, pipeline: pl}, nil, t, false), t)
+	})
+}
+
+func TestProfile(t *testing.T) {
+	f := "tests/profile.clara"
+
+	// Each backend writes a profile counting every block, which weights the blocks when compiled again
+	for _, backend := range e2eBackends {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			t.Parallel()
+			dir, err := ioutil.TempDir("", "clara-profile")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "profile.txt")
+			pl, err := newPipeline(2, nil, "", ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pl.profileOut = path
+			binary := CompileTest(f, options{backend: backend, pipeline: pl}, dir, t)
+			MatchExpectations(f, RunTest(f, backend, binary, e2eEnv, t, false), t)
+
+			p, err := readProfile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var classify string
+			for fn := range p {
+				if strings.Contains(fn, "classify") {
+					classify = fn
 				}
-				pos += 1
 			}
-			if pos < len(lines) {
-				builder.WriteString(fmt.Sprintf(" - ./%v:, expected: <nothing>, got: ['%v']\n", f, strings.Join(lines[pos:], "', '")))
+			if entry, ok := p[classify][0]; !ok || entry != 1000 || p["clara_main"] == nil {
+				t.Fatalf("\n- ./%v:, expected: 1000 calls of classify(), got:\n%v", f, p)
+			}
+
+			var ir bytes.Buffer
+			pl, err = newPipeline(2, nil, lowerPass, &ir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pl.profile = p
+			binary = CompileTest(f, options{backend: backend, pipeline: pl}, dir, t)
+			MatchExpectations(f, RunTest(f, backend, binary, e2eEnv, t, false), t)
+			if !strings.Contains(ir.String(), "count = 1000") || !strings.Contains(ir.String(), "count = 10\n") {
+				t.Fatalf("\n- ./%v:, expected: blocks weighted by the profile, got:\n%v", f, ir.String())
+			}
+
+			// Profiles of another program are rejected
+			p[classify][len(p[classify])] = 1
+			pl, err = newPipeline(2, nil, "", ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
 			}
-			if builder.Len() > 0 {
-				t.Errorf("\n%v\n", builder.String())
+			pl.profile = p
+			_, errs := Compile(options{backend: backend, pipeline: pl}, glob("./install/lib/*.clara"), f,
+				glob("./install/init/*.c"), dir, ioutil.Discard)
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Profile does not match the program") {
+				t.Fatalf("\n- ./%v:, expected: profile mismatch, got: %v", f, errs)
 			}
 		})
 	}
 }
 
-func CompileAndRun(progPath string, t *testing.T, allowExecErr bool) string {
+func TestIntelSyntax(t *testing.T) {
+	files := []string{"arith", "arrays", "atomics", "bits", "bounds", "closures", "enums", "fns", "generics", "maps",
+		"printf", "regalloc", "strings", "structs", "threads", "unsafe", "vector"}
+
+	// Programs assemble & run the same whichever syntax instructions are printed in
+	intel, err := findSyntax("intel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	RunX64(t, files, func(o *options) { o.syntax = intel }, func(t *testing.T, asm string) {
+		first := strings.SplitN(asm, "\n", 2)[0]
+		if strings.TrimSpace(first) != intel.directive() || strings.Contains(asm, "%rsp") {
+			t.Fatalf("\n- expected: Intel syntax, got:\n%v", asm)
+		}
+	})
+}
+
+func TestOmitFramePointer(t *testing.T) {
+	files := []string{"arena", "arrays", "closures", "fns", "generics", "maps", "pacing", "rc", "regalloc", "strings",
+		"structs", "threads", "vector"}
+
+	// Leaf functions address their frame from rsp, which collections (on every allocation) must not disturb
+	RunX64(t, files, func(o *options) { o.omitFramePointer = true }, func(t *testing.T, asm string) {
+		for _, fn := range strings.Split(asm, "@function\n")[1:] {
+			if strings.HasPrefix(fn, fnPrefix) && !strings.Contains(fn, "pushq   %rbp") {
+				return
+			}
+		}
+		t.Fatalf("\n- expected: a leaf function without a frame, got:\n%v", asm)
+	})
+}
+
+// Runs the test of the program with each backend, at each optimisation level it names (or the default), in parallel
+func RunBackends(t *testing.T, progPath string, test func(t *testing.T, backend string, level int)) {
+	levels := ParseOptLevels(progPath, t)
+	t.Run(filepath.Base(progPath), func(t *testing.T) {
+		t.Parallel()
+		for _, backend := range e2eBackends {
+			for _, level := range levels {
+				backend, level := backend, level
+				name := backend
+				if len(levels) > 1 {
+					name = fmt.Sprintf("%v-O%d", backend, level)
+				}
+				t.Run(name, func(t *testing.T) {
+					t.Parallel()
+					test(t, backend, level)
+				})
+			}
+		}
+	})
+}
+
+// Runs each program from ./tests (named without extension) with x64 alone, compiled with the options configured, at
+// each optimisation level it names. The generated assembly is checked before the output is matched.
+func RunX64(t *testing.T, files []string, configure func(o *options), check func(t *testing.T, asm string)) {
+	for _, name := range files {
+		name, f := name, filepath.Join("tests", name+".clara")
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			t.Parallel()
+			for _, level := range ParseOptLevels(f, t) { // In turn as each writes the same assembly file
+				pl, err := newPipeline(level, nil, "", ioutil.Discard)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts := options{alloc: ParseAlloc(f, t), backend: "x64", pipeline: pl}
+				configure(&opts)
+				dir, err := ioutil.TempDir("", "clara-x64")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				binary := CompileTest(f, opts, dir, t)
+				asm, err := ioutil.ReadFile(filepath.Join(os.TempDir(), name+".S")) // See: Compile()
+				if err != nil {
+					t.Fatal(err)
+				}
+				check(t, string(asm))
+				MatchExpectations(f, RunTest(f, "x64", binary, e2eEnv, t, false), t)
+			}
+		})
+	}
+}
+
+// Environment of every test program. Collecting on every allocation finds missing GC roots.
+var e2eEnv = []string{"CLARA_ENV_KEY=CLARA_ENV_VAL", "CLARA_GC_STRESS=1"}
+
+func CompileAndRun(progPath string, backend string, level int, t *testing.T, allowExecErr bool) string {
+	pl, err := newPipeline(level, nil, "", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CompileAndRunWith(progPath, options{alloc: ParseAlloc(progPath, t), backend: backend, pipeline: pl}, e2eEnv,
+		t, allowExecErr)
+}
+
+// Compiles the program with the given options (otherwise defaults) & runs it in the given environment
+func CompileAndRunWith(progPath string, opts options, env []string, t *testing.T, allowExecErr bool) string {
+
+	// Compile program, into a directory of its own as programs are compiled by each backend at once
+	dir, err := ioutil.TempDir("", "clara-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := CompileTest(progPath, opts, dir, t)
+	return RunTest(progPath, opts.backend, binary, env, t, allowExecErr)
+}
+
+// Compiles the program into the directory, returning the binary
+func CompileTest(progPath string, opts options, dir string, t *testing.T) string {
 	defer func() {
 		if r := recover(); r != nil {
 			t.Fatalf("\nCompiler Crash: %s\n", progPath)
 		}
 	}()
-
-	// Compile program
-	binary, errs := Compile(
-		options{}, // Defaults
-		glob("./install/lib/*.clara"),
-		progPath,
-		glob("./install/init/*.c"),
-		os.TempDir(),
-		ioutil.Discard)
-
+	binary, errs := Compile(opts, glob("./install/lib/*.clara"), progPath, glob("./install/init/*.c"), dir, ioutil.Discard)
 	if len(errs) > 0 {
 		buf := bytes.NewBufferString("\n\nCompilation failure(s):\n")
 		for _, err := range errs {
@@ -110,18 +1339,51 @@ func CompileAndRun(progPath string, t *testing.T, allowExecErr bool) string {
 		buf.WriteString("\n────────────────────────────────────────────────────────────────────────────────────────")
 		t.Fatalf(buf.String())
 	}
-	defer os.Remove(binary)
+	return binary
+}
 
-	// Always set var
-	err := os.Setenv("CLARA_ENV_KEY", "CLARA_ENV_VAL")
-	if err != nil {
-		t.Fatalf("Execution failure: %v\n", err)
+// Runs the program's binary (or bytecode) in the environment, returning its output
+func RunTest(progPath string, backend string, binary string, env []string, t *testing.T, allowExecErr bool) string {
+	env = append(os.Environ(), env...)
+
+	// Bytecode is run in process, so can't be given input
+	stdin := strings.TrimSuffix(progPath, ".clara") + ".stdin"
+	if backend == "vm" {
+		if _, err := os.Stat(stdin); err == nil {
+			t.Skip("input can't be piped to the VM")
+		}
+		var out bytes.Buffer
+		code, err := runBytecode(binary, []string{binary}, env, &out)
+		if status := ParseExitStatus(progPath, t); status != 0 && !allowExecErr {
+			if code != status {
+				t.Log(out.String())
+				t.Fatalf("Execution failure: exit status %v, expected %v\n", code, status)
+			}
+			return out.String()
+		}
+		if (err != nil || code != 0) && !allowExecErr {
+			t.Log(out.String())
+			t.Fatalf("Execution failure: exit status %v, %v\n", code, err)
+		}
+		return out.String()
 	}
 
-	// Execute binary
+	// Execute binary, piping in any input alongside the test
 	cmd := exec.Command(binary)
+	cmd.Env = env
+	if in, err := os.Open(stdin); err == nil {
+		defer in.Close()
+		cmd.Stdin = in
+	}
 	outBytes, err := cmd.CombinedOutput()
 	out := string(outBytes)
+	if status := ParseExitStatus(progPath, t); status != 0 && !allowExecErr {
+		if code := cmd.ProcessState.ExitCode(); code != status {
+			t.Log(out)
+			t.Fatalf("Execution failure: exit status %v, expected %v\n", code, status)
+		}
+		return out
+	}
 	if err != nil && !allowExecErr {
 		t.Log(out)
 		t.Fatalf("Execution failure: %v\n", err)
@@ -129,6 +1391,94 @@ func CompileAndRun(progPath string, t *testing.T, allowExecErr bool) string {
 	return out
 }
 
+// Matches each line of output against the expectation of the program, in order
+func MatchExpectations(progPath string, output string, t *testing.T) {
+	expects := ParseExpectations(progPath, t)
+	lines := strings.Split(output, "\n")
+	lines = lines[:len(lines)-1] // Trim empty final line
+
+	pos := 0
+	var builder strings.Builder
+	for _, expect := range expects {
+		if pos < len(lines) {
+			if expect.val != lines[pos] {
+				builder.WriteString(fmt.Sprintf("- ./%v:%d:, expected: '%v', got: '%v'\n", progPath, expect.line, expect.val, lines[pos]))
+			}
+		} else {
+			builder.WriteString(fmt.Sprintf("- ./%v:%d:, expected: '%v', got: <nothing>\n", progPath, expect.line, expect.val))
+		}
+		pos += 1
+	}
+	if pos < len(lines) {
+		builder.WriteString(fmt.Sprintf(" - ./%v:, expected: <nothing>, got: ['%v']\n", progPath, strings.Join(lines[pos:], "', '")))
+	}
+	if builder.Len() > 0 {
+		t.Errorf("\n%v\n", builder.String())
+	}
+}
+
+// Arguments passed to clarac test (if any)
+func ParseArgs(filename string, t *testing.T) []string {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if match := argsRegex.FindStringSubmatch(line); match != nil {
+			return strings.Fields(match[1])
+		}
+	}
+	return nil
+}
+
+// Exit status expected of the program (if any)
+func ParseExitStatus(filename string, t *testing.T) int {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if match := exitRegex.FindStringSubmatch(line); match != nil && !strings.HasPrefix(line, "//") {
+			status, _ := strconv.Atoi(match[1])
+			return status
+		}
+	}
+	return 0
+}
+
+// Memory management strategy of the program (if not the default)
+func ParseAlloc(filename string, t *testing.T) string {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if match := allocRegex.FindStringSubmatch(line); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// Optimisation levels the program is compiled at, if not only the default
+func ParseOptLevels(filename string, t *testing.T) []int {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if match := optRegex.FindStringSubmatch(line); match != nil {
+			var levels []int
+			for _, f := range strings.Fields(match[1]) {
+				level, _ := strconv.Atoi(f)
+				levels = append(levels, level)
+			}
+			return levels
+		}
+	}
+	return []int{defaultOptLevel}
+}
+
 func ParseExpectations(filename string, t *testing.T) []*expectation {
 	// Read file
 	content, err := ioutil.ReadFile(filename)
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Symbol names. Functions are overloaded by parameter type so each symbol encodes the function name followed by the
+// type of every parameter:
+//
+//   symbol := "clara_" name ("." type)*
+//   name   := ident ("." digits)*
+//   type   := name ["$" type ("." type)* "$"]
+//
+// Arrays are encoded as "array$T$" & function types as "fn$P1.P2$". Compiler generated names (closures, environments &
+// anonymous functions) are suffixed with a decimal id which can never be mistaken for a type as identifiers never start
+// with a digit. External functions keep their name & main is always "clara_main".
+//
+// Clara has no modules so every symbol is in a single namespace.
+
+const fnPrefix = "clara_"
+
+// Used during codegen to avoid clashes with shared library functions
+func (ft *FunctionType) AsmName(name string) string {
+	if ft.Is(External) {
+		return name
+	}
+	if name == "main" {
+		return fnPrefix + "main"
+	}
+
+	// Build name safe for usage in ASM
+	buf := bytes.NewBufferString(fnPrefix)
+	buf.WriteString(name)
+	for _, param := range ft.Params {
+		buf.WriteString(".")
+		buf.WriteString(param.AsmName())
+	}
+	return buf.String()
+}
+
+func (t *Type) AsmName() string {
+	switch t.Kind {
+	case Array:
+		return fmt.Sprintf("array$%v$", t.AsArray().Elem.AsmName())
+	case Struct:
+		st := t.AsStruct()
+		if len(st.Types) == 0 {
+			return st.Name
+		}
+		var tps []string
+		for _, tp := range st.Types {
+			tps = append(tps, tp.AsmName())
+		}
+		return fmt.Sprintf("%v$%v$", st.Name, strings.Join(tps, "."))
+	case Enum:
+		e := t.AsEnum()
+		if len(e.Types) == 0 {
+			return e.Name
+		}
+		var tps []string
+		for _, tp := range e.Types {
+			tps = append(tps, tp.AsmName())
+		}
+		return fmt.Sprintf("%v$%v$", e.Name, strings.Join(tps, "."))
+	case Function:
+		fn := t.AsFunction()
+		buf := bytes.NewBufferString("fn")
+		if len(fn.Params) > 0 {
+			buf.WriteString(fmt.Sprintf("$%v", fn.Params[0].AsmName()))
+			for i := 1; i < len(fn.Params); i += 1 {
+				buf.WriteString(fmt.Sprintf(".%v", fn.Params[i].AsmName()))
+			}
+			buf.WriteString("$")
+		}
+		return buf.String()
+	default:
+		return t.Kind.String()
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+var mangledSymbol = regexp.MustCompile(fnPrefix + `[A-Za-z0-9_.$]+`)
+
+// Replaces every mangled symbol within s with its demangled form
+func demangleAll(s string) string {
+	return mangledSymbol.ReplaceAllStringFunc(s, demangle)
+}
+
+// Converts a symbol back to the form used in source, e.g. "clara_append.array$int$.int" becomes "append([]int, int)".
+// Symbols which aren't mangled (or can't be parsed) are returned unchanged.
+func demangle(sym string) string {
+	if !strings.HasPrefix(sym, fnPrefix) {
+		return sym
+	}
+	d := demangler{s: sym[len(fnPrefix):]}
+	name := d.name()
+	var params []string
+	for d.accept('.') {
+		params = append(params, d.typ())
+	}
+	if d.failed || d.pos != len(d.s) || name == "" {
+		return sym
+	}
+	return fmt.Sprintf("%v(%v)", name, strings.Join(params, ", "))
+}
+
+type demangler struct {
+	s      string
+	pos    int
+	failed bool
+}
+
+func (d *demangler) accept(b byte) bool {
+	if d.pos < len(d.s) && d.s[d.pos] == b {
+		d.pos += 1
+		return true
+	}
+	return false
+}
+
+// A '$' opens a list of type arguments when followed by a name & closes one otherwise
+func (d *demangler) opens() bool {
+	return d.pos+1 < len(d.s) && d.s[d.pos+1] != '.' && d.s[d.pos+1] != '$'
+}
+
+func (d *demangler) name() string {
+	start := d.pos
+	d.ident()
+	for d.pos+1 < len(d.s) && d.s[d.pos] == '.' && isDigit(d.s[d.pos+1]) {
+		d.pos += 1
+		d.ident()
+	}
+	return d.s[start:d.pos]
+}
+
+func (d *demangler) ident() {
+	for d.pos < len(d.s) && d.s[d.pos] != '.' && d.s[d.pos] != '$' {
+		d.pos += 1
+	}
+}
+
+func (d *demangler) typ() string {
+	name := d.name()
+	if name == "" {
+		d.failed = true
+		return ""
+	}
+	var args []string
+	if d.opens() && d.accept('$') {
+		args = append(args, d.typ())
+		for d.accept('.') {
+			args = append(args, d.typ())
+		}
+		if !d.accept('$') {
+			d.failed = true
+		}
+	}
+	switch {
+	case name == "array" && len(args) == 1:
+		return Array.String() + args[0]
+	case name == "fn":
+		return fmt.Sprintf("fn(%v)", strings.Join(args, ","))
+	case len(args) > 0:
+		return fmt.Sprintf("%v«%v»", name, strings.Join(args, ","))
+	default:
+		return name
+	}
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
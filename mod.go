@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dependency management (clarac mod). A project's clara.mod names it & lists the git repositories it requires with the
+// tag, branch or commit of each:
+//
+//   module shapes
+//   require https://github.com/someone/geometry.git v1.2.0
+//
+// Rules of clarac vet may also be turned on or off for the project, e.g. 'vet naming off'. Requirements of dependencies
+// are followed & where several versions of one are required the highest is used. The commit each version resolved to
+// is recorded in clara.lock so builds are repeatable. Checkouts are cached in the install directory under pkg/ & the
+// .clara files at the top of each are compiled alongside the standard lib, sharing its namespace.
+
+const (
+	manifestName = "clara.mod"
+	lockName     = "clara.lock"
+)
+
+func runMod(args []string, dir string, defaultInstall string, out io.Writer, errOut io.Writer) int {
+	flags := flag.NewFlagSet("mod", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	installPath := flags.String("install", defaultInstall, "Path to install directory, where dependencies are cached.")
+	flags.Usage = func() {
+		fmt.Fprintln(errOut, "usage: clarac mod [-install dir] init [name]")
+		fmt.Fprintln(errOut, "       clarac mod [-install dir] get <url>[@version]...")
+		fmt.Fprintln(errOut, "       clarac mod [-install dir] download")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	var err error
+	switch cmd, args := flags.Arg(0), flags.Args()[1:]; {
+	case cmd == "init" && len(args) <= 1:
+		err = modInit(dir, args)
+	case cmd == "get" && len(args) > 0:
+		err = modGet(dir, *installPath, args, out)
+	case cmd == "download" && len(args) == 0:
+		err = modDownload(dir, *installPath, out)
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return 1
+	}
+	return 0
+}
+
+func modInit(dir string, args []string) error {
+	path := filepath.Join(dir, manifestName)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%v already exists", path)
+	}
+	name := filepath.Base(dir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		name = filepath.Base(abs)
+	}
+	if len(args) == 1 {
+		name = args[0]
+	}
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("module %v\n", name)), 0644)
+}
+
+// Adds or updates requirements of the project, following the default branch for any without a version
+func modGet(dir string, installPath string, args []string, out io.Writer) error {
+	m, err := projectManifest(dir)
+	if err != nil {
+		return err
+	}
+	r, err := newResolver(m, installPath, true)
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		url, version := splitVersion(arg)
+		if err := checkRequirement(url, version); err != nil {
+			return err
+		}
+		if version == "" {
+			c, err := r.checkout(&requirement{url: url})
+			if err != nil {
+				return err
+			}
+			version = c.commit
+		}
+		m.require(url, version)
+	}
+	if _, err := r.resolve(); err != nil {
+		return err
+	}
+	if err := m.write(); err != nil {
+		return err
+	}
+	return r.writeLock(out)
+}
+
+// Resolves all requirements of the project, downloading any missing & recording them in the lock
+func modDownload(dir string, installPath string, out io.Writer) error {
+	m, err := projectManifest(dir)
+	if err != nil {
+		return err
+	}
+	r, err := newResolver(m, installPath, true)
+	if err != nil {
+		return err
+	}
+	if _, err := r.resolve(); err != nil {
+		return err
+	}
+	return r.writeLock(out)
+}
+
+func projectManifest(dir string) (*manifest, error) {
+	path := findManifest(dir)
+	if path == "" {
+		return nil, fmt.Errorf("no %v found in %v or any parent directory (See: clarac mod init)", manifestName, dir)
+	}
+	return readManifest(path)
+}
+
+// Source files of the dependencies of the project containing the program, if any, as locked
+func moduleLibs(progPath string, installPath string) ([]string, error) {
+	path := findManifest(filepath.Dir(progPath))
+	if path == "" {
+		return nil, nil
+	}
+	m, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newResolver(m, installPath, false)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := r.resolve()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, c := range deps {
+		files = append(files, glob(filepath.Join(c.dir, "*.clara"))...)
+	}
+	return files, nil
+}
+
+// Path of the manifest in the directory or its closest parent with one
+func findManifest(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, manifestName)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type manifest struct {
+	path     string
+	name     string
+	requires []*requirement
+	vet      []*vetSetting
+	lines    []string // Source, kept so comment lines survive updates
+}
+
+// Rule turned on or off for clarac vet (See: vet.go)
+type vetSetting struct {
+	rule string
+	on   bool
+	line int
+}
+
+type requirement struct {
+	url     string
+	version string
+	line    int // Within the manifest, 1-based
+}
+
+func readManifest(path string) (*manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{path: path, lines: strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")}
+	for i, line := range m.lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		switch {
+		case fields[0] == "module" && len(fields) == 2 && m.name == "":
+			m.name = fields[1]
+		case fields[0] == "module":
+			return nil, fmt.Errorf("%v:%d: expected a single 'module <name>'", path, i+1)
+		case fields[0] == "require" && len(fields) == 3:
+			if err := checkRequirement(fields[1], fields[2]); err != nil {
+				return nil, fmt.Errorf("%v:%d: %v", path, i+1, err)
+			}
+			if m.find(fields[1]) != nil {
+				return nil, fmt.Errorf("%v:%d: %v is already required", path, i+1, fields[1])
+			}
+			m.requires = append(m.requires, &requirement{url: fields[1], version: fields[2], line: i + 1})
+		case fields[0] == "require":
+			return nil, fmt.Errorf("%v:%d: expected 'require <url> <version>'", path, i+1)
+		case fields[0] == "vet" && len(fields) == 3 && (fields[2] == "on" || fields[2] == "off"):
+			m.vet = append(m.vet, &vetSetting{rule: fields[1], on: fields[2] == "on", line: i + 1})
+		case fields[0] == "vet":
+			return nil, fmt.Errorf("%v:%d: expected 'vet <rule> on|off'", path, i+1)
+		default:
+			return nil, fmt.Errorf("%v:%d: unknown directive '%v'", path, i+1, fields[0])
+		}
+	}
+	if m.name == "" {
+		return nil, fmt.Errorf("%v: missing 'module <name>'", path)
+	}
+	return m, nil
+}
+
+func (m *manifest) find(url string) *requirement {
+	for _, r := range m.requires {
+		if r.url == url {
+			return r
+		}
+	}
+	return nil
+}
+
+// Sets the required version of the dependency, rewriting its line if already required
+func (m *manifest) require(url string, version string) {
+	line := fmt.Sprintf("require %v %v", url, version)
+	if r := m.find(url); r != nil {
+		r.version = version
+		m.lines[r.line-1] = line
+		return
+	}
+	m.lines = append(m.lines, line)
+	m.requires = append(m.requires, &requirement{url: url, version: version, line: len(m.lines)})
+}
+
+func (m *manifest) write() error {
+	return ioutil.WriteFile(m.path, []byte(strings.Join(m.lines, "\n")+"\n"), 0644)
+}
+
+// Splits url@version, where the version follows the path so user@host URLs are left intact
+func splitVersion(arg string) (string, string) {
+	i := strings.LastIndex(arg, "@")
+	if i < 0 || i < strings.LastIndexAny(arg, "/:") {
+		return arg, ""
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// Rejects values git would read as options
+func checkRequirement(url string, version string) error {
+	if url == "" || strings.HasPrefix(url, "-") {
+		return fmt.Errorf("invalid url '%v'", url)
+	}
+	if strings.HasPrefix(version, "-") {
+		return fmt.Errorf("invalid version '%v'", version)
+	}
+	return nil
+}
+
+// Orders semantic versions (vMAJOR[.MINOR[.PATCH]]). Anything else only compares equal to itself.
+func compareVersions(url string, a string, b string) (int, error) {
+	if a == b {
+		return 0, nil
+	}
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0, fmt.Errorf("%v is required at both %v & %v, which cannot be ordered", url, a, b)
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func parseVersion(s string) ([3]int, bool) {
+	var v [3]int
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if !strings.HasPrefix(s, "v") || len(parts) > len(v) {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Locked commit of a required version
+type lockEntry struct {
+	url     string
+	version string
+	commit  string
+}
+
+type checkout struct {
+	lockEntry
+	dir      string
+	requires []*requirement
+}
+
+type resolver struct {
+	root   *manifest
+	cache  string
+	update bool                  // Resolve versions missing from the lock rather than report them
+	lock   map[string]*lockEntry // By url@version
+	locked map[string]*lockEntry // By url
+	seen   map[string]*checkout  // By url@version
+	used   []*checkout           // Selected by the last resolve()
+}
+
+func newResolver(m *manifest, installPath string, update bool) (*resolver, error) {
+	r := &resolver{root: m, cache: filepath.Join(installPath, "pkg"), update: update, lock: make(map[string]*lockEntry),
+		locked: make(map[string]*lockEntry), seen: make(map[string]*checkout)}
+	b, err := ioutil.ReadFile(r.lockPath())
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%v:%d: expected '<url> <version> <commit>'", r.lockPath(), i+1)
+		}
+		e := &lockEntry{url: fields[0], version: fields[1], commit: fields[2]}
+		r.lock[e.url+"@"+e.version] = e
+		r.locked[e.url] = e
+	}
+	return r, nil
+}
+
+func (r *resolver) lockPath() string { return filepath.Join(filepath.Dir(r.root.path), lockName) }
+
+// Selects the highest required version of each dependency reachable from the project, ordered by url
+func (r *resolver) resolve() ([]*checkout, error) {
+	selected := make(map[string]*requirement)
+	queue := append([]*requirement(nil), r.root.requires...)
+	for len(queue) > 0 {
+		req := queue[0]
+		queue = queue[1:]
+		if e, ok := r.locked[req.url]; ok && !r.update && e.version != req.version {
+			// Lock only holds selected versions, which may be higher than this requirement
+			if c, err := compareVersions(req.url, e.version, req.version); err == nil && c > 0 {
+				req = &requirement{url: req.url, version: e.version, line: req.line}
+			}
+		}
+		if cur, ok := selected[req.url]; ok {
+			c, err := compareVersions(req.url, cur.version, req.version)
+			if err != nil {
+				return nil, err
+			}
+			if c >= 0 {
+				continue
+			}
+		}
+		selected[req.url] = req
+		c, err := r.checkout(req)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, c.requires...)
+	}
+
+	// Drop dependencies only required by versions which were not selected
+	r.used = nil
+	reached := make(map[string]bool)
+	var walk func(reqs []*requirement)
+	walk = func(reqs []*requirement) {
+		for _, req := range reqs {
+			if !reached[req.url] {
+				reached[req.url] = true
+				c := r.seen[req.url+"@"+selected[req.url].version]
+				r.used = append(r.used, c)
+				walk(c.requires)
+			}
+		}
+	}
+	walk(r.root.requires)
+	sort.Slice(r.used, func(i, j int) bool { return r.used[i].url < r.used[j].url })
+	return r.used, nil
+}
+
+// Checkout of the required version, fetching it if not cached. An empty version is the default branch.
+func (r *resolver) checkout(req *requirement) (*checkout, error) {
+	key := req.url + "@" + req.version
+	if c, ok := r.seen[key]; ok {
+		return c, nil
+	}
+	rev := req.version
+	if e, ok := r.lock[key]; ok {
+		rev = e.commit
+	} else if !r.update {
+		return nil, fmt.Errorf("%v:%d: %v %v is missing from %v (See: clarac mod download)", r.root.path, req.line,
+			req.url, req.version, lockName)
+	}
+
+	c := &checkout{lockEntry: lockEntry{url: req.url, version: req.version, commit: rev}}
+	if _, err := os.Stat(r.dir(c)); rev == "" || os.IsNotExist(err) {
+		if err := r.fetch(c); err != nil {
+			return nil, err
+		}
+	}
+	c.dir = r.dir(c)
+	if path := filepath.Join(c.dir, manifestName); fileExists(path) {
+		m, err := readManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		c.requires = m.requires
+	}
+	if req.version != "" {
+		r.seen[key] = c
+	}
+	return c, nil
+}
+
+func (r *resolver) dir(c *checkout) string {
+	return filepath.Join(r.cache, modulePath(c.url)+"@"+c.commit)
+}
+
+// Clones the repository & checks out the commit (or version, when unlocked) in the cache
+func (r *resolver) fetch(c *checkout) error {
+	if err := os.MkdirAll(r.cache, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(r.cache, "fetch")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := git("", "clone", "--quiet", "--", c.url, tmp); err != nil {
+		return fmt.Errorf("fetching %v: %v", c.url, err)
+	}
+	if c.commit != "" {
+		if err := git(tmp, "checkout", "--quiet", c.commit, "--"); err != nil {
+			return fmt.Errorf("fetching %v %v: %v", c.url, c.commit, err)
+		}
+	}
+	commit, err := exec.Command("git", "-C", tmp, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return fmt.Errorf("fetching %v: %v", c.url, err)
+	}
+	c.commit = strings.TrimSpace(string(commit))
+	dir := r.dir(c)
+	if fileExists(dir) {
+		return nil // Already cached under its commit
+	}
+	if err := os.RemoveAll(filepath.Join(tmp, ".git")); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+func git(dir string, args ...string) error {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// Writes the commits of the selected versions, reporting any newly locked
+func (r *resolver) writeLock(out io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("// Generated by clarac mod. Do not edit.\n")
+	for _, c := range r.used {
+		fmt.Fprintf(&buf, "%v %v %v\n", c.url, c.version, c.commit)
+		if _, ok := r.lock[c.url+"@"+c.version]; !ok {
+			fmt.Fprintf(out, "locked %v %v (%v)\n", c.url, c.version, c.commit)
+		}
+	}
+	return ioutil.WriteFile(r.lockPath(), buf.Bytes(), 0644)
+}
+
+// Cache path of the repository, e.g. github.com/someone/geometry for https://github.com/someone/geometry.git or
+// git@github.com:someone/geometry.git
+func modulePath(url string) string {
+	s := url
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	} else if i := strings.Index(s, ":"); i > 0 && !strings.Contains(s[:i], "/") {
+		s = s[:i] + "/" + s[i+1:]
+	}
+	if i := strings.Index(s, "@"); i >= 0 && i < strings.Index(s, "/") {
+		s = s[i+1:]
+	}
+	var parts []string
+	for _, p := range strings.Split(strings.TrimSuffix(s, ".git"), "/") {
+		switch p {
+		case "", ".", "..":
+		default:
+			parts = append(parts, p)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
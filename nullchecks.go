@@ -0,0 +1,42 @@
+package main
+
+// Removes null checks which are provably redundant: the struct was allocated by the function or already checked by an
+// access in a dominating block.
+func (f *irFunc) eliminateNullChecks() {
+
+	f.dominators()
+	allocated := make(map[*irTemp]bool)
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.op == irStackAlloc || (i.op == irCall && i.fn.Is(StructCons)) {
+				allocated[i.dst] = true
+			}
+		}
+	}
+
+	checked := make(map[*irTemp]bool)
+	var visit func(b *irBlock)
+	visit = func(b *irBlock) {
+		var added []*irTemp
+		for _, i := range b.instrs {
+			if !i.isNullChecked() {
+				continue
+			}
+			p := i.args[0]
+			if checked[p] || allocated[p] {
+				i.unchecked = true
+			}
+			if !checked[p] {
+				checked[p] = true
+				added = append(added, p)
+			}
+		}
+		for _, child := range b.doms {
+			visit(child)
+		}
+		for _, p := range added {
+			delete(checked, p)
+		}
+	}
+	visit(f.blocks[0])
+}
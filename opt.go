@@ -0,0 +1,102 @@
+package main
+
+// Helpers shared by IR optimisation passes. All passes operate on (and preserve) SSA form.
+
+// Instructions without side effects which may be removed if their result is unused
+func (i *irInstr) isRemovable() bool {
+	switch i.op {
+	case irCall, irStore, irSetIndex, irIndex, irRet, irJmp, irBr, irCount:
+		return false
+	case irDiv, irMod:
+		return false // May trap
+	default:
+		return true
+	}
+}
+
+// Replaces every use of a temp with its substitute, following chains of substitutions
+func (f *irFunc) substitute(subst map[*irTemp]*irTemp) {
+	if len(subst) == 0 {
+		return
+	}
+	resolve := func(t *irTemp) *irTemp {
+		for {
+			s, ok := subst[t]
+			if !ok {
+				return t
+			}
+			t = s
+		}
+	}
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			for j, arg := range i.args {
+				i.args[j] = resolve(arg)
+			}
+		}
+	}
+}
+
+// Removes instructions whose results are never used & have no side effects
+func (f *irFunc) eliminateDeadCode() {
+	uses := make(map[*irTemp]int)
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			for _, arg := range i.args {
+				uses[arg]++
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, b := range f.blocks {
+			instrs := b.instrs[:0]
+			for _, i := range b.instrs {
+				if i.dst != nil && uses[i.dst] == 0 && i.isRemovable() {
+					for _, arg := range i.args {
+						uses[arg]--
+					}
+					changed = true
+					continue
+				}
+				instrs = append(instrs, i)
+			}
+			b.instrs = instrs
+		}
+	}
+	f.compact()
+}
+
+// Removes the edge between two blocks, updating phis in the successor
+func (f *irFunc) removeEdge(from *irBlock, to *irBlock) {
+	for j, pred := range to.preds {
+		if pred != from {
+			continue
+		}
+		to.preds = append(to.preds[:j:j], to.preds[j+1:]...)
+		for _, phi := range to.phis() {
+			phi.args = append(phi.args[:j:j], phi.args[j+1:]...)
+		}
+		return
+	}
+}
+
+// Removes blocks which can no longer be reached from entry & renumbers the remainder
+func (f *irFunc) removeUnreachable() {
+	reachable := f.reachableBlocks()
+	var blocks []*irBlock
+	for _, b := range f.blocks {
+		if reachable[b] {
+			b.id = len(blocks)
+			blocks = append(blocks, b)
+			continue
+		}
+		for _, succ := range b.succs() {
+			if reachable[succ] {
+				f.removeEdge(b, succ)
+			}
+		}
+	}
+	f.blocks = blocks
+}
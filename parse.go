@@ -2,9 +2,10 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"github.com/g-dx/clarac/lex"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const errSyntaxMsg = "%v:%d:%d: syntax error, Unexpected '%v', expected: '%v'"
@@ -25,6 +26,11 @@ func NewParser() *Parser {
 const (
 	extRet = 1 << iota
 	rawValues
+	pure
+	inline
+	noInline
+	exported
+	noRc
 )
 
 type attributes int
@@ -34,6 +40,21 @@ func (attr attributes) isExternalReturn() bool {
 func (attr attributes) requiresRawValues() bool {
 	return (attr & rawValues) == rawValues
 }
+func (attr attributes) isPure() bool {
+	return (attr & pure) == pure
+}
+func (attr attributes) isInline() bool {
+	return (attr & inline) == inline
+}
+func (attr attributes) isNoInline() bool {
+	return (attr & noInline) == noInline
+}
+func (attr attributes) isExported() bool {
+	return (attr & exported) == exported
+}
+func (attr attributes) isNoRc() bool {
+	return (attr & noRc) == noRc
+}
 
 func (attr attributes) Add(name string) attributes {
 	switch name {
@@ -41,6 +62,16 @@ func (attr attributes) Add(name string) attributes {
 		return attr | extRet
 	case "RawValues":
 		return attr | rawValues
+	case "Pure":
+		return attr | pure
+	case "Inline":
+		return attr | inline
+	case "NoInline":
+		return attr | noInline
+	case "Export":
+		return attr | exported
+	case "NoRc":
+		return attr | noRc
 	default:
 		return attr // TODO: Report unknown attributes
 	}
@@ -70,8 +101,11 @@ func (p *Parser) Parse(tokens []*lex.Token, root *Node) (errs []error) {
 		case lex.Enum:
 			root.Add(p.parseEnum(attr))
 
+		case lex.Const:
+			root.Add(p.parseConst())
+
 		default:
-			kinds := []string{lex.KindValues[lex.Fn], lex.KindValues[lex.Struct], lex.KindValues[lex.Enum]}
+			kinds := []string{lex.KindValues[lex.Fn], lex.KindValues[lex.Struct], lex.KindValues[lex.Enum], lex.KindValues[lex.Const]}
 			p.syntaxError(strings.Join(kinds, " or "))
 			p.next()
 			// TODO: p.sync(lex.Fn, lex.Struct, lex.Enum)
@@ -96,6 +130,13 @@ func (p *Parser) parseAttributes() (attr attributes) {
 	return
 }
 
+func (p *Parser) parseConst() *Node {
+	p.need(lex.Const)
+	id := p.need(lex.Identifier)
+	p.need(lex.As)
+	return &Node{op: opConstDcl, token: id, left: p.parseExpr(0)}
+}
+
 func (p *Parser) parseEnum(attrs attributes) *Node {
 	p.need(lex.Enum)
 	id := p.need(lex.Identifier)
@@ -303,15 +344,42 @@ func parseFunction(p *Parser, token *lex.Token) *Node {
 
 func parseCall(p *Parser, left *Node, token *lex.Token) *Node {
 	var args []*Node
+	var first []*lex.Token // Tokens of the first argument
 	if p.isNot(lex.RParen) {
 		for ok := true; ok; ok = p.match(lex.Comma) {
+			start := p.pos
 			args = append(args, p.parseExpr(0))
+			if len(args) == 1 {
+				first = p.tokens[start:p.pos]
+			}
 		}
 	}
 	p.need(lex.RParen)
+
+	// assert(condition, msg) is compiler-known & also passed the source of its condition. See: irBuilder.assert()
+	if left.Is(opIdentifier) && left.token.Val == "assert" && len(args) == 2 {
+		src := lex.WithVal(first[0], strconv.Quote(sourceText(first)))
+		src.Kind = lex.String
+		args = append(args, &Node{op: opLit, token: src})
+	}
 	return &Node {op: opFuncCall, token: token, left: left, stmts: args}
 }
 
+// Source text of tokens, with a single space wherever they were separated
+func sourceText(tokens []*lex.Token) string {
+	var buf strings.Builder
+	for j, t := range tokens {
+		if j > 0 {
+			prev := tokens[j-1]
+			if t.Line != prev.Line || t.File != prev.File || t.Pos > prev.Pos+utf8.RuneCountInString(prev.Val) {
+				buf.WriteByte(' ')
+			}
+		}
+		buf.WriteString(t.Val)
+	}
+	return buf.String()
+}
+
 func parseTypedCall(p *Parser, left *Node, token *lex.Token) *Node {
 	var types []*Node
 	if p.isNot(lex.RGmet) {
@@ -373,6 +441,7 @@ var infixKindToOp = map[lex.Kind]int{
 	lex.Min: opSub,
 	lex.Mul: opMul,
 	lex.Div: opDiv,
+	lex.Mod: opMod,
 	lex.BLeft: opBLeft,
 	lex.BRight: opBRight,
 	lex.BAnd: opBAnd,
@@ -408,7 +477,7 @@ func init() {
 	infixParsers[lex.LBrack] = parseArray
 	infixParsers[lex.Question] = parseTernaryOperator
 
-	binaryOperators(lex.Dot, lex.Plus, lex.Min, lex.Mul, lex.Div,
+	binaryOperators(lex.Dot, lex.Plus, lex.Min, lex.Mul, lex.Div, lex.Mod,
 		lex.BLeft, lex.BRight, lex.BRight, lex.BAnd, lex.BOr,
 		lex.BXor, lex.Gt, lex.Gte, lex.Lt, lex.Lte, lex.Eq,
 		lex.Or, lex.And)
@@ -588,12 +657,12 @@ func (p *Parser) syntaxError(expected string) {
 		// Store error
 		token := p.tokens[p.pos]
 		p.errs = append(p.errs,
-			errors.New(fmt.Sprintf(errSyntaxMsg,
+			newDiagnostic(token, errSyntaxMsg,
 				token.File,
 				token.Line,
 				token.Pos,
 				p.tokens[p.pos].Val,
-				expected)))
+				expected))
 	}
 }
 
@@ -14,13 +14,13 @@ func NewOptimiser(w asmWriter) asmWriter {
 func (p *peep) ins(i inst, ops ...operand) {
 
 	// Remove unnecessary "intermediate" register for mov, ensuring we don't attempt mem -> mem
-	if p.i == movq && i == movq && regMatches(p.ops[1], ops[0]) && !(mem(p.ops[0]) && mem(ops[1])) {
+	if p.i == movq && i == movq && regMatches(p.ops[1], ops[0]) && isScratch(ops[0]) && !(mem(p.ops[0]) && mem(ops[1])) {
 		p.ops = []operand { p.ops[0], ops[1] }
 		return
 	}
 
 	// Remove unnecessary "intermediate" register for push
-	if p.i == movq && i == pushq && regMatches(p.ops[1], ops[0]) {
+	if p.i == movq && i == pushq && regMatches(p.ops[1], ops[0]) && isScratch(ops[0]) {
 		p.i = i
 		p.ops = []operand { p.ops[0] }
 		return
@@ -46,6 +46,12 @@ func regMatches(o1, o2 operand) bool {
 	return ok1 && ok2 && r1 == r2
 }
 
+// Scratch registers never hold values beyond a single IR instruction. See: allocateRegisters
+func isScratch(o operand) bool {
+	r, ok := o.(reg)
+	return ok && (r == rax || r == rbx || r == rcx)
+}
+
 func mem(o operand) bool {
 	_, ok := o.(memOp)
 	return ok
@@ -57,7 +63,10 @@ func (p *peep) stringLit(s string) operand               { p.write(); return p.w
 func (p *peep) label(s string)                           { p.write(); p.w.label(s) }
 func (p *peep) newLabel(s string) string                 { p.write(); return p.w.newLabel(s) }
 func (p *peep) raw(s string)                             { p.write(); p.w.raw(s) }
+func (p *peep) comment(s string)                         { p.write(); p.w.comment(s) }
+func (p *peep) loc(file string, line, col int)           { p.write(); p.w.loc(file, line, col) }
 func (p *peep) addr(sym operand)                         { p.write(); p.w.addr(sym) }
+func (p *peep) relAddr(sym operand)                      { p.write(); p.w.relAddr(sym) }
 func (p *peep) fnStart(name string)                      { p.write(); p.w.fnStart(name) }
 func (p *peep) fnEnd()                                   { p.write() }
 func (p *peep) roSymbol(name string, f func(w asmWriter)) operand { p.write(); return p.w.roSymbol(name, f) }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Ordered IR passes. Each pass runs when the optimisation level is at least its level & it has not been disabled.
+type pass struct {
+	name     string
+	level    int  // Lowest optimisation level pass runs at
+	required bool // Pass cannot be disabled
+	run      func(fns []*irFunc, gt *GcTypes)
+}
+
+var passes = []pass{
+	{name: "inline", level: 2, run: inlineCalls},
+	{name: "ssa", required: true, run: eachFunc((*irFunc).toSSA)},
+	{name: "constprop", level: 1, run: eachFunc((*irFunc).propagateConstants)},
+	{name: "jumps", level: 1, run: eachFunc((*irFunc).simplifyBranches)},
+	{name: "cse", level: 1, run: eachFunc((*irFunc).eliminateCommonSubexpressions)},
+	{name: "strength", level: 1, run: eachFunc((*irFunc).reduceStrength)},
+	{name: "bce", level: 2, run: eachFunc((*irFunc).eliminateBoundsChecks)},
+	{name: "escape", level: 2, run: allocateOnStack},
+	{name: "nce", level: 2, run: eachFunc((*irFunc).eliminateNullChecks)},
+	{name: "layout", level: 1, run: eachFunc((*irFunc).layoutBlocks)},
+	{name: "fromssa", required: true, run: eachFunc((*irFunc).fromSSA)},
+}
+
+// Default level when none is specified
+const defaultOptLevel = 2
+const maxOptLevel = 2
+
+// Pseudo passes naming the IR immediately after lowering & after inserting reference counting
+const (
+	lowerPass = "lower"
+	rcPass    = "rc"
+)
+
+func eachFunc(fn func(f *irFunc)) func(fns []*irFunc, gt *GcTypes) {
+	return func(fns []*irFunc, gt *GcTypes) {
+		for _, f := range fns {
+			fn(f)
+		}
+	}
+}
+
+func allocateOnStack(fns []*irFunc, gt *GcTypes) {
+	esc := analyseEscapes(fns)
+	for _, f := range fns {
+		f.allocateOnStack(fns, esc, gt)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type pipeline struct {
+	level     int
+	disabled  map[string]bool
+	dumpAfter string // Pass name, "all" or empty
+	showIr    bool   // Print final IR
+	out       io.Writer
+
+	elideAsserts bool // Remove assert() calls. Requires -O2.
+
+	countRefs bool         // Insert reference counting once all passes have run (-alloc=rc)
+	rc        *refCounting // Runtime functions which count references, set on lowering
+
+	profile    profile        // Block counts from a previous run (if any)
+	profileOut string         // Path instrumented programs write block counts to (if any)
+	counters   []blockCounter // Counters of instrumented blocks
+}
+
+func defaultPipeline() *pipeline {
+	return &pipeline{level: defaultOptLevel}
+}
+
+func newPipeline(level int, disabled []string, dumpAfter string, out io.Writer) (*pipeline, error) {
+	if level < 0 || level > maxOptLevel {
+		return nil, fmt.Errorf("Unknown optimisation level: -O%v", level)
+	}
+	p := &pipeline{level: level, disabled: make(map[string]bool), dumpAfter: dumpAfter, out: out}
+	for _, name := range disabled {
+		pass, ok := findPass(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown pass: '%v'. Available passes: %v", name, passNames())
+		}
+		if pass.required {
+			return nil, fmt.Errorf("Pass '%v' is required and cannot be disabled", name)
+		}
+		p.disabled[name] = true
+	}
+	if _, ok := findPass(dumpAfter); !ok && dumpAfter != "" && dumpAfter != "all" && dumpAfter != lowerPass && dumpAfter != rcPass {
+		return nil, fmt.Errorf("Unknown pass: '%v'. Available passes: %v", dumpAfter, passNames())
+	}
+	return p, nil
+}
+
+// Removes assert() calls, which is only permitted when fully optimising
+func (p *pipeline) elideAssertions() error {
+	if p.level < 2 {
+		return fmt.Errorf("-no-asserts requires -O2")
+	}
+	p.elideAsserts = true
+	return nil
+}
+
+// Stack allocated structs are never freed so hold references forever when counted
+func (p *pipeline) enabled(pass pass) bool {
+	if p.countRefs && pass.name == "escape" {
+		return false
+	}
+	return pass.required || (p.level >= pass.level && !p.disabled[pass.name])
+}
+
+func (p *pipeline) run(fns []*irFunc, gt *GcTypes) error {
+	for _, f := range fns {
+		if p.profile != nil {
+			if err := f.applyProfile(p.profile); err != nil {
+				return err
+			}
+		}
+		if p.profileOut != "" {
+			p.counters = f.instrument(p.counters)
+		}
+	}
+	p.dump(lowerPass, fns)
+	for _, pass := range passes {
+		if p.enabled(pass) {
+			pass.run(fns, gt)
+			p.dump(pass.name, fns)
+		}
+	}
+	if p.rc != nil {
+		p.rc.insert(fns)
+		p.dump(rcPass, fns)
+	}
+	if p.showIr {
+		fmt.Fprintln(p.out, "\nIR")
+		p.print(fns)
+	}
+	return nil
+}
+
+func (p *pipeline) dump(name string, fns []*irFunc) {
+	if p.dumpAfter != name && p.dumpAfter != "all" {
+		return
+	}
+	fmt.Fprintf(p.out, "\nIR after '%v'\n", name)
+	p.print(fns)
+}
+
+func (p *pipeline) print(fns []*irFunc) {
+	fmt.Fprintln(p.out)
+	for _, f := range fns {
+		f.print(p.out)
+	}
+}
+
+func findPass(name string) (pass, bool) {
+	for _, pass := range passes {
+		if pass.name == name {
+			return pass, true
+		}
+	}
+	return pass{}, false
+}
+
+func passNames() string {
+	var names []string
+	for _, pass := range passes {
+		names = append(names, pass.name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Profile guided optimisation. Instrumented programs count executions of every block (as numbered immediately after
+// lowering) & write the totals on exit. Feeding the file back into a later compile weights each block by its count.
+//
+// Profile format is one counter per line: "<function asm name> <block id> <count>"
+
+// Execution counts keyed by function then block id
+type profile map[string]map[int]int
+
+// Identifies the block each counter belongs to
+type blockCounter struct {
+	fn    string
+	block int
+}
+
+func readProfile(path string) (profile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	p := make(profile)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Invalid profile: %v:%v: expected '<function> <block> <count>'", path, line)
+		}
+		block, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid profile: %v:%v: bad block id '%v'", path, line, fields[1])
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("Invalid profile: %v:%v: bad count '%v'", path, line, fields[2])
+		}
+		if p[fields[0]] == nil {
+			p[fields[0]] = make(map[int]int)
+		}
+		p[fields[0]][block] += count // Counters for inlined copies may be repeated
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Weights blocks by their profiled count. Functions absent from the profile are left unweighted, however those present
+// must have a count for every block & no others, or the profile was generated from a different program.
+func (f *irFunc) applyProfile(p profile) error {
+	counts, ok := p[f.name]
+	if !ok {
+		return nil
+	}
+	ids := make(map[int]bool)
+	for _, b := range f.blocks {
+		if _, ok := counts[b.id]; !ok {
+			return fmt.Errorf("Profile does not match the program: function '%v' has no count for block %v", f.name, b.id)
+		}
+		ids[b.id] = true
+	}
+	for id := range counts {
+		if !ids[id] {
+			return fmt.Errorf("Profile does not match the program: function '%v' has no block %v", f.name, id)
+		}
+	}
+	f.profiled = true
+	for _, b := range f.blocks {
+		b.count = counts[b.id]
+	}
+	return nil
+}
+
+// Counts executions of every block, returning the counters with those for this function appended
+func (f *irFunc) instrument(counters []blockCounter) []blockCounter {
+	for _, b := range f.blocks {
+		n := len(b.phis())
+		count := &irInstr{op: irCount, val: len(counters)}
+		b.instrs = append(b.instrs[:n], append([]*irInstr{count}, b.instrs[n:]...)...)
+		counters = append(counters, blockCounter{f.name, b.id})
+	}
+	return counters
+}
+
+// Outputs the counters read by writeProfile() (See: runtime.c) on exit. An empty table is output when the program is
+// not instrumented.
+func genProfileTable(asm asmWriter, counters []blockCounter, path string) {
+
+	asm.raw(".data")
+	asm.tab(".align", "8")
+	name := fnOp(fnPrefix + "profile").Print()
+	asm.tab(".globl", name)
+	asm.label(name)
+	asm.tab(".8byte", strconv.Itoa(len(counters)))
+	asm.addr(labelOp(".PP"))
+	asm.addr(labelOp(".PC"))
+
+	// Counters: function name, block & count
+	asm.label(".PC")
+	names := make(map[string]string)
+	for _, c := range counters {
+		if _, ok := names[c.fn]; !ok {
+			names[c.fn] = fmt.Sprintf(".PN%v", len(names))
+		}
+		asm.addr(labelOp(names[c.fn]))
+		asm.tab(".8byte", strconv.Itoa(c.block))
+		asm.tab(".8byte", "0")
+	}
+	for _, c := range counters {
+		if label, ok := names[c.fn]; ok {
+			asm.label(label)
+			asm.tab(".asciz", strconv.Quote(c.fn))
+			delete(names, c.fn)
+		}
+	}
+	asm.label(".PP")
+	asm.tab(".asciz", strconv.Quote(path))
+}
+
+// Address of a counter's count
+func counterOp(i int) operand {
+	return ripOp(fmt.Sprintf(".PC+%v", i*3*ptrSize+2*ptrSize))
+}
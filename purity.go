@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Purity analysis marks every function which performs no IO and mutates no memory as pure. A function is impure if it:
+//
+// - calls an external function not declared #[Pure]
+// - calls a function value (closure, parameter, struct field, etc) which cannot be resolved statically
+// - assigns to a struct field or array element
+// - calls another impure function
+//
+func analysePurity(root *Node) (errs []error) {
+
+	// Gather all function declarations, including anonymous functions. External functions are only pure if declared so.
+	var fns []*Node
+	WalkPreOrder(root, func(n *Node) bool {
+		if n != nil && n.isFuncDcl() && n.sym != nil {
+			if n.op == opExternFnDcl {
+				n.sym.Type.AsFunction().IsPure = n.attrs.isPure()
+			} else {
+				fns = append(fns, n)
+			}
+		}
+		return true
+	})
+
+	// Record local causes of impurity & calls between functions
+	reasons := make(map[*Symbol]string)
+	callers := make(map[*Symbol][]*Symbol)
+	for _, fn := range fns {
+		impure := func(reason string) {
+			if _, ok := reasons[fn.sym]; !ok {
+				reasons[fn.sym] = reason
+			}
+		}
+		for _, stmt := range fn.stmts {
+			WalkPreOrder(stmt, func(n *Node) bool {
+				if n == nil {
+					return true
+				}
+				switch n.op {
+				case opBlockFnDcl, opExprFnDcl:
+					return false // Analysed separately
+
+				case opAs:
+					if n.left.Is(opDot, opArray) {
+						impure("assigns to field or array element")
+					}
+
+				case opFuncCall:
+					callee := n.left.sym
+					if !n.left.Is(opIdentifier) || callee == nil || !callee.IsGlobal || !callee.Type.Is(Function) {
+						impure("calls function value")
+					} else if f := callee.Type.AsFunction(); f.Is(External) && !f.IsPure {
+						impure(fmt.Sprintf("calls impure function '%v'", callee.Name))
+					} else {
+						callers[callee] = append(callers[callee], fn.sym)
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	// Propagate impurity from callees to callers
+	var work []*Symbol
+	for _, fn := range fns {
+		if _, ok := reasons[fn.sym]; ok {
+			work = append(work, fn.sym)
+		}
+	}
+	for len(work) > 0 {
+		callee := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, caller := range callers[callee] {
+			if _, ok := reasons[caller]; !ok {
+				reasons[caller] = fmt.Sprintf("calls impure function '%v'", callee.Name)
+				work = append(work, caller)
+			}
+		}
+	}
+
+	// Record purity & check assertions
+	for _, fn := range fns {
+		reason, impure := reasons[fn.sym]
+		fn.sym.Type.AsFunction().IsPure = !impure
+		if impure && fn.attrs.isPure() {
+			errs = append(errs, semanticError(errImpureFnMsg, fn.token, reason))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,220 @@
+package main
+
+import "github.com/g-dx/clarac/lex"
+
+// Reference counting (-alloc=rc). Once all other passes have run every counted temp owns a reference to its value for
+// as long as it is live. References are taken when a value is copied into a temp (except from calls of Clara
+// functions, which return an owned reference) & when stored into memory, & dropped when a temp dies or a value in
+// memory is overwritten. Blocks are freed as soon as their count reaches zero (See: install/lib/rc.clara).
+//
+// Cycles are never freed.
+type refCounting struct {
+	retain  *Symbol // rcRetain()
+	release *Symbol // rcRelease()
+	alloc   *Symbol // claralloc(), returns an uncounted block
+}
+
+// Stack frames, heap blocks & call sites are never counted
+func isCounted(t *Type) bool {
+	if !t.IsPointer() {
+		return false
+	}
+	if t.Is(Struct) {
+		switch t.AsStruct().Name {
+		case "frame", "block", "callSite":
+			return false
+		}
+	}
+	return true
+}
+
+func (rc *refCounting) insert(fns []*irFunc) {
+	for _, f := range fns {
+		if !f.attrs.isNoRc() {
+			rc.count(f)
+		}
+	}
+}
+
+func (rc *refCounting) call(s *Symbol, t *irTemp, pos *lex.Token) *irInstr {
+	return &irInstr{op: irCall, sym: s, fn: s.Type.AsFunction(), args: []*irTemp{t}, pos: pos}
+}
+
+// Calls of Clara functions return a reference owned by the caller
+func (rc *refCounting) owned(i *irInstr) bool {
+	return i.op == irCall && (i.sym == nil || !i.fn.Is(External)) && i.sym != rc.alloc
+}
+
+func (rc *refCounting) count(f *irFunc) {
+
+	// References are dropped on the edge a temp dies along, so each must have a block of its own
+	for _, b := range f.blocks {
+		if len(b.succs()) < 2 {
+			continue
+		}
+		last := b.last()
+		for j, succ := range last.succs {
+			if len(succ.preds) > 1 {
+				edge := f.newBlock()
+				edge.instrs = []*irInstr{{op: irJmp, succs: []*irBlock{succ}, pos: last.pos}}
+				f.place(edge)
+				last.succs[j] = edge
+			}
+		}
+	}
+	if len(f.blocks[0].preds) > 0 {
+		entry := f.newBlock()
+		entry.instrs = []*irInstr{{op: irJmp, succs: []*irBlock{f.blocks[0]}}}
+		f.blocks = append([]*irBlock{entry}, f.blocks...)
+	}
+	f.cfg()
+
+	// Values converted to uncounted pointers (e.g. by unsafe()) must outlive the conversion, so each instruction also
+	// uses the counted temps from which its arguments were derived
+	sources := f.countedSources()
+	derived := make(map[*irInstr][]*irTemp)
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			for _, arg := range i.args {
+				for _, src := range sources[arg] {
+					if !containsTemp(i.args, src) && !containsTemp(derived[i], src) {
+						derived[i] = append(derived[i], src)
+					}
+				}
+			}
+			i.args = append(i.args, derived[i]...)
+		}
+	}
+	in, out := f.liveness()
+	after := make([][]irSet, len(f.blocks)) // Live after each instruction
+	for _, b := range f.blocks {
+		after[b.id] = make([]irSet, len(b.instrs))
+		live := out[b.id].copy()
+		for j := len(b.instrs) - 1; j >= 0; j-- {
+			i := b.instrs[j]
+			after[b.id][j] = live.copy()
+			if i.dst != nil {
+				live.remove(i.dst)
+			}
+			for _, arg := range i.args {
+				live.add(arg)
+			}
+		}
+		for _, i := range b.instrs {
+			i.args = i.args[:len(i.args)-len(derived[i])]
+		}
+	}
+
+	temps := f.temps // Excluding those added below
+	for _, b := range f.blocks {
+		var instrs []*irInstr
+		switch {
+		case b.id == 0:
+			for _, p := range f.params {
+				if isCounted(p.typ) && in[b.id].has(p) {
+					instrs = append(instrs, rc.call(rc.retain, p, nil))
+				}
+			}
+		case len(b.preds) == 1:
+			dead := out[b.preds[0].id].copy()
+			dead.subtract(in[b.id])
+			for _, t := range temps {
+				if isCounted(t.typ) && dead.has(t) {
+					instrs = append(instrs, rc.call(rc.release, t, nil))
+				}
+			}
+		}
+
+		for j, i := range b.instrs {
+			var post []*irInstr
+			live := after[b.id][j]
+
+			// Stores replace the reference held by memory
+			if v := storedValue(i); v != nil && isCounted(v.typ) {
+				old := f.newTemp(v.typ, nil)
+				if i.op == irStore {
+					instrs = append(instrs, &irInstr{op: irLoad, dst: old, args: []*irTemp{i.args[0]}, val: i.val, unchecked: i.unchecked, pos: i.pos})
+				} else {
+					instrs = append(instrs, &irInstr{op: irIndex, dst: old, args: i.args[:2], unchecked: i.unchecked, pos: i.pos})
+				}
+				instrs = append(instrs, rc.call(rc.retain, v, i.pos))
+				post = append(post, rc.call(rc.release, old, i.pos))
+			}
+
+			// Redefined temps drop the reference to their previous value once it has been used
+			if i.dst != nil && isCounted(i.dst.typ) && containsTemp(i.args, i.dst) {
+				prev := f.newTemp(i.dst.typ, i.dst.sym)
+				instrs = append(instrs, &irInstr{op: irCopy, dst: prev, args: []*irTemp{i.dst}, pos: i.pos})
+				post = append(post, rc.call(rc.release, prev, i.pos))
+			}
+
+			if i.dst != nil && isCounted(i.dst.typ) {
+				switch {
+				case !live.has(i.dst):
+					if rc.owned(i) {
+						post = append(post, rc.call(rc.release, i.dst, i.pos))
+					}
+				case !rc.owned(i) && i.op != irConst && i.op != irString && i.op != irFnAddr:
+					post = append(post, rc.call(rc.retain, i.dst, i.pos))
+				}
+			}
+
+			// Returned values pass their reference to the caller but those they were derived from are dropped
+			uses := derived[i]
+			if i.op != irRet {
+				uses = append(append([]*irTemp(nil), i.args...), derived[i]...)
+			}
+			for k, arg := range uses {
+				if isCounted(arg.typ) && arg != i.dst && !live.has(arg) && !containsTemp(uses[:k], arg) {
+					post = append(post, rc.call(rc.release, arg, i.pos))
+				}
+			}
+
+			if i.isTerminator() {
+				instrs = append(append(instrs, post...), i)
+			} else {
+				instrs = append(append(instrs, i), post...)
+			}
+		}
+		b.instrs = instrs
+	}
+	f.compact()
+}
+
+// Counted temps from which each uncounted pointer (or frame, block, etc) may have been derived
+func (f *irFunc) countedSources() map[*irTemp][]*irTemp {
+	sources := make(map[*irTemp][]*irTemp)
+	for changed := true; changed; {
+		changed = false
+		for _, b := range f.blocks {
+			for _, i := range b.instrs {
+				if i.dst == nil || isCounted(i.dst.typ) || !(i.dst.typ.IsPointer() || i.dst.typ.Is(Pointer)) {
+					continue
+				}
+				for _, arg := range i.args {
+					srcs := sources[arg]
+					if isCounted(arg.typ) {
+						srcs = []*irTemp{arg}
+					}
+					for _, src := range srcs {
+						if !containsTemp(sources[i.dst], src) {
+							sources[i.dst] = append(sources[i.dst], src)
+							changed = true
+						}
+					}
+				}
+			}
+		}
+	}
+	return sources
+}
+
+func storedValue(i *irInstr) *irTemp {
+	switch i.op {
+	case irStore:
+		return i.args[1]
+	case irSetIndex:
+		return i.args[2]
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import "sort"
+
+// Linear scan register allocation. See: "Linear Scan Register Allocation" (Poletto & Sarkar).
+//
+// Each temp is given a single location for its entire lifetime: either a register or a stack slot. Registers used
+// as scratch by instruction selection (rax, rbx, rcx, rdx & r11) are never allocated. Temps live across a call must
+// survive it so may only use callee saved registers, and pointers live across a call are always spilled as the GC
+// only scans stack slots. Functions without a frame pointer may also be allocated rbp as a callee saved register.
+
+var callerSaved = []reg{rsi, rdi, r8, r9, r10}
+var calleeSaved = []reg{r12, r13, r14, r15}
+
+type interval struct {
+	t          *irTemp
+	start, end int
+	acrossCall bool
+}
+
+type allocation struct {
+	regs    map[*irTemp]reg
+	slots   map[*irTemp]int  // Stack slot index of spilled temps
+	objects map[*irInstr]int // Stack slot index of the first field of each stack allocated struct
+	saved   []reg            // Callee saved registers in use
+	size    int              // Total stack slots required
+}
+
+func allocateRegisters(f *irFunc, in []irSet, out []irSet, preserved []reg) *allocation {
+
+	intervals := liveIntervals(f, in, out)
+	sort.SliceStable(intervals, func(i, j int) bool { return intervals[i].start < intervals[j].start })
+
+	a := &allocation{regs: make(map[*irTemp]reg), slots: make(map[*irTemp]int)}
+	spilled := make(map[*irTemp]bool)
+	spill := func(t *irTemp) {
+		delete(a.regs, t)
+		spilled[t] = true
+	}
+
+	free := make(map[reg]bool)
+	for _, r := range append(append([]reg(nil), callerSaved...), preserved...) {
+		free[r] = true
+	}
+	used := make(map[reg]bool)
+	var active []*interval // Ordered by increasing end
+	for _, cur := range intervals {
+
+		// Expire intervals which have ended
+		n := 0
+		for _, it := range active {
+			if it.end >= cur.start {
+				active[n] = it
+				n++
+			} else {
+				free[a.regs[it.t]] = true
+			}
+		}
+		active = active[:n]
+
+		var candidates []reg
+		switch {
+		case cur.acrossCall && cur.t.typ.IsPointer():
+			spill(cur.t)
+			continue
+		case cur.acrossCall:
+			candidates = preserved
+		default:
+			candidates = append(append([]reg(nil), callerSaved...), preserved...)
+		}
+
+		r, ok := reg(0), false
+		for _, c := range candidates {
+			if free[c] {
+				r, ok = c, true
+				break
+			}
+		}
+
+		if !ok {
+			// Spill whichever interval ends last
+			var victim *interval
+			for _, it := range active {
+				if containsReg(candidates, a.regs[it.t]) && (victim == nil || it.end > victim.end) {
+					victim = it
+				}
+			}
+			if victim == nil || victim.end <= cur.end {
+				spill(cur.t)
+				continue
+			}
+			r = a.regs[victim.t]
+			spill(victim.t)
+			active = removeInterval(active, victim)
+		}
+
+		free[r] = false
+		used[r] = true
+		a.regs[cur.t] = r
+		j := sort.Search(len(active), func(j int) bool { return active[j].end > cur.end })
+		active = append(active[:j], append([]*interval{cur}, active[j:]...)...)
+	}
+
+	for _, r := range preserved {
+		if used[r] {
+			a.saved = append(a.saved, r)
+		}
+	}
+	a.layoutFrame(f, intervals, spilled)
+	return a
+}
+
+// Computes a single conservative range for each temp over instructions numbered in block order. Operands are read
+// at an instruction's position & the result written at the next so a result may reuse the register of an operand.
+func liveIntervals(f *irFunc, in []irSet, out []irSet) []*interval {
+
+	intervals := make([]*interval, len(f.temps))
+	extend := func(t *irTemp, pos int) {
+		it := intervals[t.id]
+		if it == nil {
+			intervals[t.id] = &interval{t: t, start: pos, end: pos}
+			return
+		}
+		if pos < it.start {
+			it.start = pos
+		}
+		if pos > it.end {
+			it.end = pos
+		}
+	}
+
+	// Parameters are defined together before the first instruction
+	for _, p := range f.params {
+		extend(p, -1)
+		extend(p, 0)
+	}
+
+	var calls []int
+	pos := 0
+	for _, b := range f.blocks {
+		start := pos
+		for _, i := range b.instrs {
+			for _, arg := range i.args {
+				extend(arg, pos)
+			}
+			if i.dst != nil {
+				extend(i.dst, pos+1)
+			}
+			if i.op == irCall {
+				calls = append(calls, pos)
+			}
+			pos += 2
+		}
+		for _, t := range f.temps {
+			if in[b.id].has(t) {
+				extend(t, start)
+			}
+			if out[b.id].has(t) {
+				extend(t, pos-1)
+			}
+		}
+	}
+
+	var res []*interval
+	for _, it := range intervals {
+		if it == nil {
+			continue
+		}
+		for _, c := range calls {
+			if it.start <= c && it.end > c+1 {
+				it.acrossCall = true
+				break
+			}
+		}
+		res = append(res, it)
+	}
+	return res
+}
+
+func containsReg(regs []reg, r reg) bool {
+	for _, x := range regs {
+		if x == r {
+			return true
+		}
+	}
+	return false
+}
+
+func removeInterval(intervals []*interval, it *interval) []*interval {
+	for j, x := range intervals {
+		if x == it {
+			return append(intervals[:j], intervals[j+1:]...)
+		}
+	}
+	return intervals
+}
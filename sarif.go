@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/g-dx/clarac/lex"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// SARIF 2.1.0 (https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html) output of diagnostics, selected by
+// -diag=sarif, so findings can be annotated on source by code scanning & CI systems. Paths relative to the working
+// directory are reported against %SRCROOT% & columns count code points, as token positions do.
+
+const (
+	textDiag  = "text"
+	sarifDiag = "sarif"
+)
+
+func checkDiagFormat(format string) error {
+	if format != textDiag && format != sarifDiag {
+		return fmt.Errorf("invalid diagnostic format '%v', expected: %v or %v", format, textDiag, sarifDiag)
+	}
+	return nil
+}
+
+type sarifLog struct {
+	Schema  string      `json:"$schema"`
+	Version string      `json:"version"`
+	Runs    []*sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool      `json:"tool"`
+	ColumnKind string         `json:"columnKind"`
+	Results    []*sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string       `json:"name"`
+	InformationURI string       `json:"informationUri"`
+	Rules          []*sarifRule `json:"rules,omitempty"`
+}
+
+type sarifRule struct {
+	ID               string        `json:"id"`
+	ShortDescription *sarifMessage `json:"shortDescription,omitempty"`
+	Help             *sarifMessage `json:"help,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string           `json:"ruleId,omitempty"`
+	RuleIndex *int             `json:"ruleIndex,omitempty"`
+	Level     string           `json:"level"`
+	Message   sarifMessage     `json:"message"`
+	Locations []*sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine,omitempty"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// Results of a single run of the compiler, with each rule described once
+type sarifWriter struct {
+	run   *sarifRun
+	rules map[string]int // Index in the driver by id
+}
+
+func newSarifWriter() *sarifWriter {
+	return &sarifWriter{
+		run: &sarifRun{
+			Tool:       sarifTool{Driver: sarifDriver{Name: "clarac", InformationURI: "https://github.com/g-dx/clara"}},
+			ColumnKind: "unicodeCodePoints",
+			Results:    []*sarifResult{},
+		},
+		rules: make(map[string]int),
+	}
+}
+
+// Adds compiler errors, as written by printErrors()
+func (s *sarifWriter) addErrors(errs []error) {
+	for _, err := range sortDiagnostics(errs) {
+		d, ok := err.(*diagnostic)
+		switch {
+		case !ok:
+			s.add("", "", "", "error", err.Error(), nil, nil)
+		case d.code != "":
+			e := errorCodes[d.code]
+			s.add(d.code, e.summary, fmt.Sprintf("For examples run: clarac explain %v", d.code), "error", d.text(),
+				d.token, d.end)
+		default:
+			s.add("", "", "", "error", d.text(), d.token, d.end)
+		}
+	}
+}
+
+// Adds a result spanning from t to end (if any), describing its rule (if any) the first time it is seen. Tokens created
+// by the compiler have no location.
+func (s *sarifWriter) add(rule string, summary string, help string, level string, msg string, t *lex.Token,
+	end *lex.Token) {
+	r := &sarifResult{RuleID: rule, Level: level, Message: sarifMessage{Text: msg}}
+	if rule != "" {
+		i, ok := s.rules[rule]
+		if !ok {
+			i = len(s.run.Tool.Driver.Rules)
+			s.rules[rule] = i
+			desc := &sarifRule{ID: rule}
+			if summary != "" {
+				desc.ShortDescription = &sarifMessage{Text: summary}
+			}
+			if help != "" {
+				desc.Help = &sarifMessage{Text: help}
+			}
+			s.run.Tool.Driver.Rules = append(s.run.Tool.Driver.Rules, desc)
+		}
+		r.RuleIndex = &i
+	}
+	if t != nil && t.Line > 0 && t.File != "" && !strings.HasPrefix(t.File, "<") {
+		region := sarifRegion{StartLine: t.Line, StartColumn: t.Pos, EndColumn: t.Pos + tokenWidth(t)}
+		if end != nil && end.File == t.File && (end.Line > t.Line || (end.Line == t.Line && end.Pos > t.Pos)) {
+			region.EndLine, region.EndColumn = end.Line, end.Pos+tokenWidth(end)
+		}
+		r.Locations = []*sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifact(t.File),
+			Region:           region,
+		}}}
+	}
+	s.run.Results = append(s.run.Results, r)
+}
+
+func sarifArtifact(path string) sarifArtifactLocation {
+	if !filepath.IsAbs(path) {
+		return sarifArtifactLocation{URI: filepath.ToSlash(filepath.Clean(path)), URIBaseID: "%SRCROOT%"}
+	}
+	return sarifArtifactLocation{URI: pathToURI(path)}
+}
+
+func (s *sarifWriter) write(out io.Writer) error {
+	b, err := json.MarshalIndent(&sarifLog{Schema: "https://json.schemastore.org/sarif-2.1.0.json", Version: "2.1.0",
+		Runs: []*sarifRun{s.run}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", b)
+	return err
+}
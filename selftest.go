@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// End to end test of the compiler (clarac selftest). Every program in the examples directory is compiled with the
+// standard lib, run without arguments or input & its exit status & output compared with the adjacent .expected file,
+// which holds the line 'exit status N' followed by the output. Programs without one (e.g. servers) are only compiled.
+// -update writes the .expected files of programs instead of comparing them, creating them for any program named alone.
+
+func runSelftest(args []string, defaultInstall string, out io.Writer, errOut io.Writer) int {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	installPath := flags.String("install", defaultInstall, "Path to install directory.")
+	colour := flags.String("color", "auto", colourUsage)
+	target := flags.String("backend", defaultBackend, "Code generator (x64, c or vm).")
+	update := flags.Bool("update", false, "Write the exit status & output of each program to its .expected file.")
+	timeout := flags.Duration("timeout", 10*time.Second, "Maximum time each program may run for (native backends only).")
+	flags.Usage = func() {
+		fmt.Fprintln(errOut, "usage: clarac selftest [-install dir] [-color mode] [-backend name] [-update] [-timeout d] [file or directory]...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := setColour(*colour); err != nil {
+		fmt.Fprintln(errOut, err)
+		return 2
+	}
+	be, err := newBackend(options{backend: *target})
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return 2
+	}
+	dir, err := ioutil.TempDir("", "clara-selftest")
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{filepath.Join(*installPath, "examples")}
+	}
+	named := make(map[string]bool)
+	for _, path := range paths {
+		named[path] = true
+	}
+	r := &selftest{installPath: *installPath, backend: *target, interpret: !be.native(), timeout: *timeout, dir: dir,
+		out: out}
+	for _, path := range fmtPaths(paths) {
+		r.runProgram(path, *update, named[path])
+	}
+	fmt.Fprintf(out, "\n%d passed, %d failed\n", r.passed, r.failed)
+	if r.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type selftest struct {
+	installPath string
+	backend     string
+	interpret   bool // Bytecode is run by the VM in process
+	timeout     time.Duration
+	dir         string // Where binaries are written
+	out         io.Writer
+
+	passed, failed int
+}
+
+// Compiles the program & runs it, if it has or is to be given an .expected file
+func (r *selftest) runProgram(path string, update bool, create bool) {
+	expectedPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".expected"
+	expected, err := ioutil.ReadFile(expectedPath)
+	run := err == nil || (update && create)
+	if err != nil && !os.IsNotExist(err) {
+		r.fail(path, 0, err.Error())
+		return
+	}
+
+	start := time.Now()
+	deps, err := moduleLibs(path, r.installPath)
+	if err != nil {
+		r.fail(path, 0, err.Error())
+		return
+	}
+	out, err := ioutil.TempDir(r.dir, "")
+	if err != nil {
+		r.fail(path, 0, err.Error())
+		return
+	}
+	binary, errs := Compile(options{backend: r.backend},
+		append(glob(fmt.Sprintf("%v/lib/*.clara", r.installPath)), deps...),
+		path,
+		glob(fmt.Sprintf("%v/init/*.c", r.installPath)),
+		out,
+		ioutil.Discard)
+	if len(errs) > 0 {
+		fmt.Fprintf(r.out, "FAIL %v [build failed]\n", path)
+		printErrors(errs, r.out)
+		r.failed++
+		return
+	}
+	if !run {
+		fmt.Fprintf(r.out, "ok   %v (%.2fs, not run)\n", path, time.Since(start).Seconds())
+		r.passed++
+		return
+	}
+
+	output, stderr, status, err := r.exec(binary)
+	elapsed := time.Since(start).Seconds()
+	if err != nil {
+		r.fail(path, elapsed, err.Error(), stderr)
+		return
+	}
+	actual := fmt.Sprintf("exit status %d\n%v", status, output)
+	if update {
+		if err := ioutil.WriteFile(expectedPath, []byte(actual), 0644); err != nil {
+			r.fail(path, elapsed, err.Error())
+			return
+		}
+		fmt.Fprintf(r.out, "ok   %v (%.2fs, updated)\n", path, elapsed)
+		r.passed++
+		return
+	}
+	if diff := diffExpected(string(expected), actual); diff != "" {
+		r.fail(path, elapsed, fmt.Sprintf("%v: %v", expectedPath, diff), stderr)
+		return
+	}
+	fmt.Fprintf(r.out, "ok   %v (%.2fs)\n", path, elapsed)
+	r.passed++
+}
+
+// Runs the binary, or interpreter for bytecode, returning its output, errors & exit status
+func (r *selftest) exec(binary string) (string, string, int, error) {
+	var out, errOut bytes.Buffer
+	if r.interpret {
+		status, err := runBytecode(binary, []string{binary}, os.Environ(), &out)
+		return out.String(), "", status, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary)
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out.String(), errOut.String(), 0, fmt.Errorf("timed out after %v", r.timeout)
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		return out.String(), errOut.String(), exit.ExitCode(), nil
+	}
+	return out.String(), errOut.String(), 0, err
+}
+
+func (r *selftest) fail(path string, elapsed float64, details ...string) {
+	fmt.Fprintf(r.out, "FAIL %v (%.2fs)\n", path, elapsed)
+	for _, d := range details {
+		printIndented(d, r.out)
+	}
+	r.failed++
+}
+
+// First line (starting at 1) differing between the expected & actual results, or nothing if they match
+func diffExpected(expected string, actual string) string {
+	if expected == actual {
+		return ""
+	}
+	want, got := strings.SplitAfter(expected, "\n"), strings.SplitAfter(actual, "\n")
+	for i := 0; ; i++ {
+		switch {
+		case i >= len(want):
+			return fmt.Sprintf("line %d: unexpected %q", i+1, got[i])
+		case i >= len(got):
+			return fmt.Sprintf("line %d: expected %q, got nothing", i+1, want[i])
+		case want[i] != got[i]:
+			return fmt.Sprintf("line %d: expected %q, got %q", i+1, want[i], got[i])
+		}
+	}
+}
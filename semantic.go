@@ -1,9 +1,9 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"github.com/g-dx/clarac/lex"
+	"math/big"
 	"strconv"
 	"strings"
 )
@@ -41,11 +41,20 @@ const (
 	errTypeParameterNotKnownMsg = "%v:%d:%d: error, type parameter(s) '%v' of return type '%v' not known, explicit function call type parameters required"
 	errEmptyArrayLiteralMsg     = "%v:%d:%d: error, empty array literal not allowed ... yet!"
 	errNoTypeParametersMsg      = "%v:%d:%d: error, type '%v' does not declare type parameters"
+	errImpureFnMsg              = "%v:%d:%d: error, function '%v' declared #[Pure] but %v"
+	errDivideByZeroMsg          = "%v:%d:%d: error, integer division by zero"
+	errNotConstantMsg           = "%v:%d:%d: error, value of constant '%v' is not a constant expression"
+	errConstantCycleMsg         = "%v:%d:%d: error, constant '%v' depends on its own value"
+	errNotExportableMsg         = "%v:%d:%d: error, function '%v' cannot be exported as %v"
+	errMainReturnMsg            = "%v:%d:%d: error, function '%v' must return int or nothing"
+	errFormatVerbMsg            = "%v:%d:%d: error, unknown format verb %q"
+	errFormatTypeMsg            = "%v:%d:%d: error, format verb '%v' does not accept type '%v'"
+	errFormatArgsMsg            = "%v:%d:%d: error, format has %v verb(s) but %v argument(s)"
 	maxCaseArgCount             = 5
-	maxFnArgCount               = 6
+	maxFnValueArgCount          = 5 // Forwarded by invokeDynamic(). See: closures.go
 
 	// Debug messages
-	debugTypeInfoFormat = "⚫ %s%-60s%s %s%-30s%s ⇨ %s%s%s\n"
+	debugTypeInfoFormat = "⚫ %s %s ⇨ %s\n"
 )
 
 //---------------------------------------------------------------------------------------------------------------
@@ -53,21 +62,35 @@ const (
 type OperatorTypes map[int][]TypeKind
 
 var operatorTypes = OperatorTypes{
-	opAdd:    {Integer},
-	opSub:    {Integer},
-	opMul:    {Integer},
-	opDiv:    {Integer},
+	opAdd:    {Integer, Byte},
+	opSub:    {Integer, Byte},
+	opMul:    {Integer, Byte},
+	opDiv:    {Integer, Byte},
+	opMod:    {Integer, Byte},
 	opRange:  {Integer},
 	opOr:     {Boolean},
 	opAnd:    {Boolean},
-	opBAnd:   {Integer},
-	opBOr:    {Integer},
-	opBXor:   {Integer},
-	opBLeft:  {Integer},
-	opBRight: {Integer},
+	opBAnd:   {Integer, Byte},
+	opBOr:    {Integer, Byte},
+	opBXor:   {Integer, Byte},
+	opBLeft:  {Integer, Byte},
+	opBRight: {Integer, Byte},
 	// TODO: What about unary operators? Operators which return a different type?
 }
 
+// Implicit conversions applied to operands of arithmetic & comparison operators. Only byte ➞ int widening is
+// permitted, all other conversions require an explicit call (toInt, toByte, etc).
+func widen(left *Type, right *Type) (*Type, bool) {
+	switch {
+	case left.Matches(right):
+		return left, true
+	case left.IsAny(Integer, Byte) && right.IsAny(Integer, Byte):
+		return intType, true
+	default:
+		return nil, false
+	}
+}
+
 func (ot OperatorTypes) isValid(op int, tk TypeKind) bool {
 	tks := ot[op]
 	if tks == nil {
@@ -117,6 +140,15 @@ func processTopLevelTypes(rootNode *Node, symtab *SymTab) (errs []error) {
 			}
 			topType = &Type{Kind: Struct, Data: &StructType{Name: n.token.Val, Types: types}}
 
+		case opConstDcl:
+			// Value is evaluated during type checking
+			n.symtab = symtab
+			n.sym = &Symbol{Name: n.token.Val, IsGlobal: true, Const: n}
+			if _, found := symtab.Define(n.sym); found {
+				errs = append(errs, semanticError(errRedeclaredMsg, n.token))
+			}
+			continue
+
 		case opBlockFnDcl, opExprFnDcl, opExternFnDcl:
 			// NOTE: This type is unimportant as function symbols created here
 			// are intended only to check for redeclares. The real function symbols
@@ -247,9 +279,9 @@ func instantiateType(symtab *SymTab, n *Node, errs *[]error) *Type {
 
 	switch n.op {
 	case opNamedType:
-		s, ok := symtab.ResolveAll(n.token.Val, func(s *Symbol) bool { return s.IsType })
+		s, ok := symtab.ResolveAll(n.token.Val, isType)
 		if !ok {
-			*errs = append(*errs, semanticError(errUnknownTypeMsg, n.token))
+			*errs = append(*errs, suggest(semanticError(errUnknownTypeMsg, n.token), n.token.Val, symtab.Names(isType)))
 			return nil
 		}
 
@@ -299,7 +331,7 @@ func instantiateType(symtab *SymTab, n *Node, errs *[]error) *Type {
 				bound[et.Types[i]] = t
 			}
 			return substituteType(s.Type, bound)
-		case Integer, String, Boolean, Bytes, Pointer, Parameter, Nothing:
+		case Integer, Byte, String, Boolean, Bytes, Pointer, Parameter, Nothing:
 			*errs = append(*errs, semanticError2(errNoTypeParametersMsg, n.token, s.Name))
 			return nil
 		default:
@@ -401,9 +433,9 @@ func processFnType(n *Node, symName string, symtab *SymTab, child *SymTab, types
 func createType(symtab *SymTab, n *Node) (*Type, error) {
 	switch n.op {
 	case opNamedType:
-		s, ok := symtab.ResolveAll(n.token.Val, func(s *Symbol) bool { return s.IsType })
+		s, ok := symtab.ResolveAll(n.token.Val, isType)
 		if !ok {
-			return nil, semanticError(errUnknownTypeMsg, n.token)
+			return nil, suggest(semanticError(errUnknownTypeMsg, n.token), n.token.Val, symtab.Names(isType))
 		}
 		// Validate all parameterised types exist
 		if n.left != nil {
@@ -458,13 +490,122 @@ func foldConstants(errs *[]error, n *Node) {
 
 	// Check for overflow
 	if n.op == opLit && n.token.Kind == lex.Integer {
-		_, err := strconv.ParseInt(n.token.Val, 0, 64)
-		if err != nil {
+		i, err := strconv.ParseInt(n.token.Val, 0, 64)
+		if err != nil || i > maxInt || i < minInt {
 			*errs = append(*errs, semanticError(errIntegerOverflowMsg, n.token))
 		}
 	}
 }
 
+// Range of (tagged) integer values
+const (
+	maxInt = 1<<62 - 1
+	minInt = -1 << 62
+)
+
+// Evaluates an operator applied to integer or boolean literals at compile time and rewrites the node to a literal
+// of the result. Integer arithmetic which overflows is reported, as are literals too large to be represented.
+func foldConstantExpr(n *Node) error {
+	if !n.left.Is(opLit) || (n.right != nil && !n.right.Is(opLit)) {
+		return nil
+	}
+	if !n.left.typ.IsAny(Integer, Boolean) || (n.right != nil && !n.right.typ.Matches(n.left.typ)) {
+		return nil
+	}
+	if n.left.typ.Is(Boolean) && n.Is(opGt, opGte, opLt, opLte) {
+		return nil
+	}
+
+	var l, r int64
+	l, _ = strconv.ParseInt(n.left.token.Val, 0, 64)
+	if n.right != nil {
+		r, _ = strconv.ParseInt(n.right.token.Val, 0, 64)
+	}
+	lb := n.left.token.Kind == lex.True
+	rb := n.right != nil && n.right.token.Kind == lex.True
+
+	var v int64
+	var exact *big.Int // Result of arithmetic before wrapping
+	var b bool
+	isBool := false
+	switch n.op {
+	case opAdd:
+		v, exact = l+r, new(big.Int).Add(big.NewInt(l), big.NewInt(r))
+	case opSub:
+		v, exact = l-r, new(big.Int).Sub(big.NewInt(l), big.NewInt(r))
+	case opMul:
+		v, exact = l*r, new(big.Int).Mul(big.NewInt(l), big.NewInt(r))
+	case opDiv:
+		if r == 0 {
+			return semanticError2(errDivideByZeroMsg, n.right.token)
+		}
+		v, exact = l/r, new(big.Int).Quo(big.NewInt(l), big.NewInt(r)) // Truncated, as idiv
+	case opMod:
+		if r == 0 {
+			return semanticError2(errDivideByZeroMsg, n.right.token)
+		}
+		v, exact = l%r, new(big.Int).Rem(big.NewInt(l), big.NewInt(r)) // Sign of dividend, as idiv
+	case opNeg:
+		v, exact = -l, new(big.Int).Neg(big.NewInt(l))
+	case opBAnd:
+		v = l & r
+	case opBOr:
+		v = l | r
+	case opBXor:
+		v = l ^ r
+	case opBNot:
+		v = ^l
+	case opBLeft:
+		v, exact = l<<uint(r&63), new(big.Int).Lsh(big.NewInt(l), uint(r&63))
+	case opBRight:
+		v = l >> uint(r&63)
+	case opEq:
+		isBool, b = true, l == r && lb == rb
+	case opGt:
+		isBool, b = true, l > r
+	case opGte:
+		isBool, b = true, l >= r
+	case opLt:
+		isBool, b = true, l < r
+	case opLte:
+		isBool, b = true, l <= r
+	case opAnd:
+		isBool, b = true, lb && rb
+	case opOr:
+		isBool, b = true, lb || rb
+	case opNot:
+		isBool, b = true, !lb
+	default:
+		return nil
+	}
+
+	// Rewrite node to literal
+	t := &lex.Token{Kind: lex.Integer, Pos: n.left.token.Pos, Line: n.left.token.Line, File: n.left.token.File}
+	switch {
+	case isBool && b:
+		t.Kind, t.Val = lex.True, "true"
+	case isBool:
+		t.Kind, t.Val = lex.False, "false"
+	case exact != nil && (exact.Cmp(big.NewInt(maxInt)) > 0 || exact.Cmp(big.NewInt(minInt)) < 0):
+		return nodeError(errIntegerOverflowMsg, n, exact.String())
+	default:
+		t.Val = strconv.FormatInt((v<<1)>>1, 10) // Discard bits which do not fit alongside the tag
+	}
+	_, end := nodeRange(n)
+	n.op = opLit
+	n.token = t
+	n.end = end
+	n.left = nil
+	n.right = nil
+	n.sym = nil
+	return nil
+}
+
+// Growable arrays from the standard library (See: vector.clara)
+func isVector(t *Type) bool {
+	return t.Is(Struct) && t.AsStruct().Name == "vector"
+}
+
 func lowerForStatement(n *Node) {
 	// Maybe: for x in b where x > 2 {}      // Iterator with predicate
 	if n.op == opFor {
@@ -487,6 +628,17 @@ func lowerForStatement(n *Node) {
 			while.stmts = append(while.stmts, n.stmts...)
 			while.stmts = append(while.stmts, inc(val.copy(), 1))
 			n.stmts = append(stmts, das(val, intLit(0)), while)
+		} else if isVector(arrayOrRange.typ) {
+			// Elements up to the size of the vector, which is read on each iteration as the body may append
+			vec := newVar("$vector$", arrayOrRange.typ)
+			strct := arrayOrRange.typ.AsStruct()
+			data, size := strct.GetField("data"), strct.GetField("size")
+			val := newVar("$idx$", intType)
+			while := while(lt(val.copy(), dot(vec.copy(), ident(lex.NoToken, size), intType)))
+			while.stmts = append(while.stmts, as(n.left, access(dot(vec.copy(), ident(lex.NoToken, data), data.Type), val.copy())))
+			while.stmts = append(while.stmts, n.stmts...)
+			while.stmts = append(while.stmts, inc(val.copy(), 1))
+			n.stmts = []*Node{das(vec, arrayOrRange), das(val, intLit(0)), while}
 		} else {
 			val = n.left
 			initVal := arrayOrRange.left
@@ -525,6 +677,124 @@ func rewriteArrayLiteralExpr(n *Node, symtab *SymTab) {
 	}
 }
 
+// Checks the arguments of a call to printf() or debug() match the verbs of its format, when it is a literal. Integer
+// verbs are rewritten to take the 64-bit values Clara passes, so "%d" prints any int.
+func checkFormat(n *Node, pos int, symtab *SymTab) (errs []error) {
+	if len(n.stmts) <= pos || !n.stmts[pos].Is(opLit) || !n.stmts[pos].typ.Is(String) {
+		return nil
+	}
+	lit := n.stmts[pos]
+	format, err := strconv.Unquote(lit.token.Val)
+	if err != nil {
+		return nil
+	}
+	args := n.stmts[pos+1:]
+	var buf strings.Builder
+	verbs := 0
+	for j := 0; j < len(format); j++ {
+		buf.WriteByte(format[j])
+		if format[j] != '%' {
+			continue
+		}
+		start := j
+		for j++; j < len(format) && strings.IndexByte("-+ #0123456789.*", format[j]) >= 0; j++ {
+			buf.WriteByte(format[j])
+			if format[j] == '*' { // Width or precision is taken from an argument
+				if verbs < len(args) && !args[verbs].typ.IsAny(Integer, Byte) {
+					errs = append(errs, semanticError2(errFormatTypeMsg, args[verbs].token, "*", args[verbs].typ))
+				}
+				verbs++
+			}
+		}
+		for ; j < len(format) && strings.IndexByte("hljzt", format[j]) >= 0; j++ {
+			// Length is implied by the type of the argument
+		}
+		if j == len(format) {
+			return append(errs, semanticError2(errFormatVerbMsg, lit.token, format[start:]))
+		}
+		verb := format[j]
+		if verb == '%' && j == start+1 {
+			buf.WriteByte(verb)
+			continue
+		}
+		// References are passed as addresses so may be printed as integers
+		var accepts func(t *Type) bool
+		switch verb {
+		case 'd', 'i', 'u', 'x', 'X', 'o':
+			buf.WriteString("ll")
+			accepts = func(t *Type) bool { return !t.Is(String) }
+		case 'c':
+			accepts = func(t *Type) bool { return t.IsAny(Integer, Byte) }
+		case 's':
+			accepts = func(t *Type) bool { return t.Is(String) }
+		case 'p':
+			accepts = func(t *Type) bool { return !t.IsAny(Integer, Byte, Boolean) }
+		default:
+			return append(errs, semanticError2(errFormatVerbMsg, lit.token, format[start:j+1]))
+		}
+		buf.WriteByte(verb)
+		if verbs < len(args) && !accepts(args[verbs].typ) {
+			errs = append(errs, semanticError2(errFormatTypeMsg, args[verbs].token, format[start:j+1], args[verbs].typ))
+		}
+		verbs++
+	}
+	if verbs != len(args) {
+		return append(errs, semanticError2(errFormatArgsMsg, lit.token, verbs, len(args)))
+	}
+	if len(errs) == 0 && buf.String() != format {
+		lit.token = lex.WithVal(lit.token, strconv.Quote(buf.String()))
+		typeCheckLiteral(lit, symtab)
+	}
+	return errs
+}
+
+// Lowers a chain of string concatenations to appends to a single builder, so each operand is copied once
+//
+// a + b + c -> toString(append(append(append(NewStringBuilder(16), a), b), c))
+func lowerStringConcat(symtab *SymTab, n *Node) bool {
+	if n == nil || !n.Is(opAdd) || !n.typ.Is(String) {
+		return true
+	}
+	var operands []*Node
+	var flatten func(*Node)
+	flatten = func(x *Node) {
+		if x.Is(opAdd) && x.typ.Is(String) {
+			flatten(x.left)
+			flatten(x.right)
+		} else {
+			operands = append(operands, x)
+		}
+	}
+	flatten(n)
+
+	sb := symtab.MustResolve("stringBuilder").Type
+	appendFn := mustResolveFn(symtab, "append", sb, stringType)
+	x := fnCallBySym(lex.NoToken, symtab.MustResolve("NewStringBuilder"), intLit(16))
+	for _, operand := range operands {
+		x = fnCallBySym(lex.NoToken, appendFn, x, operand)
+	}
+	*n = *fnCallBySym(lex.NoToken, mustResolveFn(symtab, "toString", sb), x)
+	return true
+}
+
+// Overload of a function with the given parameter types
+func mustResolveFn(symtab *SymTab, name string, params ...*Type) *Symbol {
+	for s := symtab.MustResolve(name); s != nil; s = s.Next {
+		f := s.Type.AsFunction()
+		if len(f.Params) != len(params) {
+			continue
+		}
+		matches := true
+		for i, p := range params {
+			matches = matches && f.Params[i].Matches(p)
+		}
+		if matches {
+			return s
+		}
+	}
+	panic(fmt.Sprintf("Required overload of '%v' not found!", name))
+}
+
 func lowerMatchStatement(symtab *SymTab, n *Node) {
 	if n.op == opMatch {
 
@@ -662,14 +932,16 @@ func generateStructConstructor(root *Node, n *Node) (*Symbol, error) {
 	return fs, nil
 }
 
+func isType(s *Symbol) bool { return s.IsType }
+
 func semanticError(msg string, t *lex.Token, vals ...interface{}) error {
 	args := append([]interface{}(nil), t.File, t.Line, t.Pos, t.Val)
 	args = append(args, vals...)
-	return errors.New(fmt.Sprintf(msg, args...))
+	return newDiagnostic(t, msg, args...)
 }
 
 func semanticError2(msg string, t *lex.Token, vals ...interface{}) error {
 	args := append([]interface{}(nil), t.File, t.Line, t.Pos)
 	args = append(args, vals...)
-	return errors.New(fmt.Sprintf(msg, args...))
+	return newDiagnostic(t, msg, args...)
 }
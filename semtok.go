@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/g-dx/clarac/lex"
+	"sort"
+	"unicode/utf8"
+)
+
+// Semantic tokens. Keywords are found by lexing the source while names are classified by the symbols the type checker
+// resolved for them, so a call to a function & a read of a parameter of the same spelling are told apart. Names which
+// resolve to nothing of interest (e.g. local variables) are left to the editor's own highlighting.
+
+type semClass int
+
+const (
+	semKeyword semClass = iota
+	semFunction
+	semParameter
+	semType
+	semField
+)
+
+// Names of each class, in order, as sent in the server's legend
+var semClasses = []string{"keyword", "function", "parameter", "type", "field"}
+
+type semToken struct {
+	line  int // Starting at 1
+	pos   int // Column, starting at 1
+	width int // In runes
+	class semClass
+}
+
+// Classifies the tokens of the file in order of position. Names are only classified if root was checked from src.
+func semanticTokens(src string, path string, root *Node) []*semToken {
+	byPos := make(map[[2]int]*semToken)
+	classify := func(t *lex.Token, class semClass) {
+		if t == nil || t.File != path || t.Line < 1 {
+			return // Another file or compiler generated
+		}
+		key := [2]int{t.Line, t.Pos}
+		if _, ok := byPos[key]; !ok {
+			byPos[key] = &semToken{line: t.Line, pos: t.Pos, width: utf8.RuneCountInString(t.Val), class: class}
+		}
+	}
+	for _, line := range fmtLex(src, path) {
+		for _, t := range line.tokens {
+			if t.Kind.IsKeyword() {
+				classify(t, semKeyword)
+			}
+		}
+	}
+	if root != nil {
+		semanticNames(root, func(n *Node, class semClass) {
+			if n.token != nil && n.token.Kind == lex.Identifier {
+				classify(n.token, class)
+			}
+		})
+	}
+	var toks []*semToken
+	for _, t := range byPos {
+		toks = append(toks, t)
+	}
+	sort.Slice(toks, func(i, j int) bool {
+		return toks[i].line < toks[j].line || (toks[i].line == toks[j].line && toks[i].pos < toks[j].pos)
+	})
+	return toks
+}
+
+// Calls f with each name in the AST which declares or refers to a function, parameter, type or field
+func semanticNames(root *Node, f func(n *Node, class semClass)) {
+	params := make(map[*Symbol]bool)
+	fields := make(map[*Node]bool)
+	WalkPreOrder(root, func(n *Node) bool {
+		if n == nil {
+			return true
+		}
+		switch n.op {
+		case opBlockFnDcl, opExprFnDcl, opExternFnDcl:
+			for _, p := range n.params {
+				if p.sym != nil {
+					params[p.sym] = true
+				}
+			}
+		case opStructDcl:
+			for _, field := range n.stmts {
+				fields[field] = true
+			}
+		case opDot:
+			fields[n.right] = true
+		}
+		return true
+	})
+	WalkPreOrder(root, func(n *Node) bool {
+		if n == nil {
+			return true
+		}
+		switch n.op {
+		case opBlockFnDcl, opExprFnDcl, opExternFnDcl, opConsFnDcl:
+			f(n, semFunction)
+		case opStructDcl, opEnumDcl:
+			f(n, semType)
+			for _, p := range n.params { // Type parameters aren't walked
+				f(p, semType)
+			}
+		case opNamedType:
+			f(n, semType)
+		case opIdentifier:
+			switch {
+			case fields[n]:
+				f(n, semField)
+			case n.sym == nil:
+			case params[n.sym]:
+				f(n, semParameter)
+			case n.sym.IsType:
+				f(n, semType)
+			case n.sym.IsGlobal && n.sym.Type != nil && n.sym.Type.Is(Function):
+				f(n, semFunction)
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Shared libraries (-buildmode=shared). Functions declared #[Export] are callable from C under their own name. Each is
+// wrapped by a generated #[ExtRet] Clara function which makes its frame the stack base & initialises the runtime on
+// first use. Backends then output a trampoline for each export which converts C values to Clara values & calls the
+// wrapper, as clara_asm_entrypoint does for main.
+//
+// Only ints & bools may be passed & returned & calls from C must not be nested within a call to Clara code.
+
+const (
+	exeBuildMode    = "exe"
+	sharedBuildMode = "shared"
+)
+
+func checkBuildMode(mode string) error {
+	switch mode {
+	case "", exeBuildMode, sharedBuildMode:
+		return nil
+	default:
+		return fmt.Errorf("Unknown build mode: '%v'. Available build modes: %v, %v", mode, exeBuildMode, sharedBuildMode)
+	}
+}
+
+const maxExportParams = 6 // Passed in registers
+
+var cIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type export struct {
+	name    string // C name
+	params  []*Node
+	ret     *Node // nil if function returns nothing
+	wrapper string
+	asmName string // Of wrapper, set after type checking
+}
+
+// Gathers & checks functions declared #[Export]
+func findExports(root *Node) (exports []*export, errs []error) {
+	names := make(map[string]bool)
+	for _, n := range root.stmts {
+		if !n.isFuncDcl() || !n.attrs.isExported() {
+			continue
+		}
+		name := n.token.Val
+		switch {
+		case n.op == opExternFnDcl:
+			errs = append(errs, semanticError(errNotExportableMsg, n.token, "it is external"))
+		case n.right != nil:
+			errs = append(errs, semanticError(errNotExportableMsg, n.token, "it is generic"))
+		case !cIdentifier.MatchString(name):
+			errs = append(errs, semanticError(errNotExportableMsg, n.token, "its name is not a C identifier"))
+		case names[name]:
+			errs = append(errs, semanticError(errNotExportableMsg, n.token, "another function of the same name is exported"))
+		case len(n.params) > maxExportParams:
+			errs = append(errs, semanticError(errNotExportableMsg, n.token, fmt.Sprintf("it has more than %v parameters", maxExportParams)))
+		default:
+			e := &export{name: name, params: n.params, ret: n.left, wrapper: "export_" + name}
+			for _, p := range n.params {
+				if !isExportableType(p.left) {
+					errs = append(errs, semanticError(errNotExportableMsg, n.token, fmt.Sprintf("parameter '%v' is not an int or bool", p.token.Val)))
+					e = nil
+					break
+				}
+			}
+			if e != nil && n.left != nil && !isExportableType(n.left) {
+				errs = append(errs, semanticError(errNotExportableMsg, n.token, "it does not return an int, bool or nothing"))
+				e = nil
+			}
+			if e != nil {
+				exports = append(exports, e)
+			}
+		}
+		names[name] = true
+	}
+	return exports, errs
+}
+
+func isExportableType(n *Node) bool {
+	return n.op == opNamedType && n.left == nil && (n.token.Val == "int" || n.token.Val == "bool")
+}
+
+// Clara source of the wrapper of each export. Libraries need not declare main() so one is provided if required.
+func exportWrappers(root *Node, exports []*export) string {
+	var buf bytes.Buffer
+	hasMain := false
+	for _, n := range root.stmts {
+		hasMain = hasMain || (n.isFuncDcl() && n.token.Val == "main")
+	}
+	if !hasMain {
+		buf.WriteString("fn main() {}\n")
+	}
+	for _, e := range exports {
+		var params, args []string
+		for j, p := range e.params {
+			params = append(params, fmt.Sprintf("p%v: %v", j, p.left.token.Val))
+			args = append(args, fmt.Sprintf("p%v", j))
+		}
+		ret, call := "", fmt.Sprintf("%v(%v)", e.name, strings.Join(args, ", "))
+		if e.ret != nil {
+			ret, call = " "+e.ret.token.Val, "return "+call
+		}
+		fmt.Fprintf(&buf, "#[ExtRet]\nfn %v(%v)%v {\n    enterLibrary(getFramePointer())\n    %v\n}\n", e.wrapper,
+			strings.Join(params, ", "), ret, call)
+	}
+	return buf.String()
+}
+
+func sharedLibName(name string) string {
+	if runtime.GOOS == "darwin" {
+		return "lib" + name + ".dylib"
+	}
+	return "lib" + name + ".so"
+}
+
+// Generated code is position independent but references its own symbols PC relative, so they must bind locally
+func sharedLibFlags() []string {
+	if runtime.GOOS == "darwin" {
+		return []string{"-dynamiclib"}
+	}
+	return []string{"-shared", "-Wl,-Bsymbolic"}
+}
+
+// Writes a C header declaring each export
+func writeExportHeader(path string, guard string, exports []*export) error {
+	var buf bytes.Buffer
+	guard = strings.ToUpper(cIdent(guard)) + "_H"
+	fmt.Fprintf(&buf, "// Generated by clarac. Functions exported from Clara code.\n#ifndef %v\n#define %v\n\n", guard, guard)
+	buf.WriteString("#include <stdbool.h>\n#include <stdint.h>\n\n")
+	for _, e := range exports {
+		var params []string
+		for _, p := range e.params {
+			params = append(params, fmt.Sprintf("%v %v", cExportType(p.left), p.token.Val))
+		}
+		if len(params) == 0 {
+			params = append(params, "void")
+		}
+		fmt.Fprintf(&buf, "%v %v(%v);\n", cExportType(e.ret), e.name, strings.Join(params, ", "))
+	}
+	fmt.Fprintf(&buf, "\n#endif // %v\n", guard)
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func isIntExport(n *Node) bool { return n.token.Val == "int" }
+
+func cExportType(n *Node) string {
+	switch {
+	case n == nil:
+		return "void"
+	case isIntExport(n):
+		return "int64_t"
+	default:
+		return "bool"
+	}
+}
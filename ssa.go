@@ -0,0 +1,252 @@
+package main
+
+// SSA construction & destruction. See: "A Simple, Fast Dominance Algorithm" (Cooper, Harvey & Kennedy) and
+// "Efficiently Computing Static Single Assignment Form and the Control Dependence Graph" (Cytron et al).
+
+// Computes the immediate dominator of every block & the dominator tree
+func (f *irFunc) dominators() {
+
+	// Number blocks in postorder
+	order := make(map[*irBlock]int)
+	var postorder []*irBlock
+	var visit func(b *irBlock)
+	visit = func(b *irBlock) {
+		order[b] = -1 // Visiting
+		for _, succ := range b.succs() {
+			if _, ok := order[succ]; !ok {
+				visit(succ)
+			}
+		}
+		order[b] = len(postorder)
+		postorder = append(postorder, b)
+	}
+	visit(f.blocks[0])
+
+	intersect := func(b1, b2 *irBlock) *irBlock {
+		for b1 != b2 {
+			for order[b1] < order[b2] {
+				b1 = b1.idom
+			}
+			for order[b2] < order[b1] {
+				b2 = b2.idom
+			}
+		}
+		return b1
+	}
+
+	for _, b := range f.blocks {
+		b.idom = nil
+		b.doms = nil
+	}
+	entry := f.blocks[0]
+	entry.idom = entry
+
+	// Iterate in reverse postorder to a fixed point
+	for changed := true; changed; {
+		changed = false
+		for j := len(postorder) - 2; j >= 0; j-- {
+			b := postorder[j]
+			var idom *irBlock
+			for _, pred := range b.preds {
+				if pred.idom == nil {
+					continue // Not yet processed
+				}
+				if idom == nil {
+					idom = pred
+				} else {
+					idom = intersect(pred, idom)
+				}
+			}
+			if b.idom != idom {
+				b.idom = idom
+				changed = true
+			}
+		}
+	}
+
+	for _, b := range f.blocks[1:] {
+		b.idom.doms = append(b.idom.doms, b)
+	}
+}
+
+// Set of blocks where dominance of each block ends, indexed by block id
+func (f *irFunc) dominanceFrontiers() [][]*irBlock {
+	df := make([][]*irBlock, len(f.blocks))
+	for _, b := range f.blocks {
+		if len(b.preds) < 2 {
+			continue
+		}
+		for _, pred := range b.preds {
+			for runner := pred; runner != b.idom; runner = runner.idom {
+				if !containsBlock(df[runner.id], b) {
+					df[runner.id] = append(df[runner.id], b)
+				}
+			}
+		}
+	}
+	return df
+}
+
+func containsBlock(blocks []*irBlock, b *irBlock) bool {
+	for _, x := range blocks {
+		if x == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrites the function so every temp is assigned exactly once. Phis are only inserted where a temp is live.
+func (f *irFunc) toSSA() {
+
+	f.dominators()
+	df := f.dominanceFrontiers()
+	in, _ := f.liveness()
+
+	// Record blocks which define each temp. Parameters are defined on entry.
+	defs := make(map[*irTemp][]*irBlock)
+	for _, p := range f.params {
+		defs[p] = append(defs[p], f.blocks[0])
+	}
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.dst != nil && !containsBlock(defs[i.dst], b) {
+				defs[i.dst] = append(defs[i.dst], b)
+			}
+		}
+	}
+
+	// Insert phis at the iterated dominance frontier of each definition
+	phis := make(map[*irInstr]*irTemp)
+	temps := append([]*irTemp(nil), f.temps...)
+	for _, t := range temps {
+		hasPhi := make(map[*irBlock]bool)
+		work := append([]*irBlock(nil), defs[t]...)
+		for len(work) > 0 {
+			x := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, y := range df[x.id] {
+				if hasPhi[y] || !in[y.id].has(t) {
+					continue
+				}
+				phi := &irInstr{op: irPhi, dst: t, args: make([]*irTemp, len(y.preds))}
+				n := len(y.phis())
+				y.instrs = append(y.instrs[:n], append([]*irInstr{phi}, y.instrs[n:]...)...)
+				phis[phi] = t
+				hasPhi[y] = true
+				if !containsBlock(defs[t], y) {
+					work = append(work, y)
+				}
+			}
+		}
+	}
+
+	// Rename every definition & use by walking the dominator tree
+	stacks := make(map[*irTemp][]*irTemp)
+	for _, p := range f.params {
+		stacks[p] = []*irTemp{p}
+	}
+	undefined := make(map[*irTemp]*irTemp)
+	current := func(t *irTemp) *irTemp {
+		if s := stacks[t]; len(s) > 0 {
+			return s[len(s)-1]
+		}
+		// Use without a reaching definition. Follow the old behaviour of reading a zero value.
+		if u, ok := undefined[t]; ok {
+			return u
+		}
+		u := f.newTemp(t.typ, t.sym)
+		entry := f.blocks[0]
+		entry.instrs = append([]*irInstr{{op: irConst, dst: u}}, entry.instrs...)
+		undefined[t] = u
+		return u
+	}
+
+	var rename func(b *irBlock)
+	rename = func(b *irBlock) {
+		var pushed []*irTemp
+		for _, i := range b.instrs {
+			if i.op != irPhi {
+				for j, arg := range i.args {
+					i.args[j] = current(arg)
+				}
+			}
+			if i.dst != nil {
+				t := i.dst
+				i.dst = f.newTemp(t.typ, t.sym)
+				stacks[t] = append(stacks[t], i.dst)
+				pushed = append(pushed, t)
+			}
+		}
+		for _, succ := range b.succs() {
+			for j, pred := range succ.preds {
+				if pred != b {
+					continue
+				}
+				for _, phi := range succ.phis() {
+					phi.args[j] = current(phis[phi])
+				}
+			}
+		}
+		for _, child := range b.doms {
+			rename(child)
+		}
+		for _, t := range pushed {
+			stacks[t] = stacks[t][:len(stacks[t])-1]
+		}
+	}
+	rename(f.blocks[0])
+	f.compact()
+}
+
+// Replaces phis with copies. Each phi is given its own temp which every predecessor assigns before branching so
+// phis which read each other (i.e. swap values) remain correct.
+func (f *irFunc) fromSSA() {
+	for _, b := range f.blocks {
+		for _, phi := range b.phis() {
+			t := f.newTemp(phi.dst.typ, phi.dst.sym)
+			for j, pred := range b.preds {
+				end := len(pred.instrs) - 1
+				cp := &irInstr{op: irCopy, dst: t, args: []*irTemp{phi.args[j]}}
+				pred.instrs = append(pred.instrs[:end], cp, pred.instrs[end])
+			}
+			phi.op = irCopy
+			phi.args = []*irTemp{t}
+		}
+	}
+	f.compact()
+}
+
+// Drops unused temps & renumbers the remainder, keeping parameters first
+func (f *irFunc) compact() {
+	used := make(map[*irTemp]bool)
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			for _, arg := range i.args {
+				used[arg] = true
+			}
+			if i.dst != nil {
+				used[i.dst] = true
+			}
+		}
+	}
+	temps := append([]*irTemp(nil), f.params...)
+	for _, t := range f.temps {
+		if used[t] && !containsTemp(f.params, t) {
+			temps = append(temps, t)
+		}
+	}
+	for id, t := range temps {
+		t.id = id
+	}
+	f.temps = temps
+}
+
+func containsTemp(temps []*irTemp, t *irTemp) bool {
+	for _, x := range temps {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
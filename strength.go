@@ -0,0 +1,122 @@
+package main
+
+// Replaces multiplication & division by constants with cheaper shifts & adds. Multiplies by 3, 5 & 9 are left to
+// instruction selection which can use a single LEA.
+func (f *irFunc) reduceStrength() {
+
+	consts := make(map[*irTemp]int)
+	for _, b := range f.blocks {
+		for _, i := range b.instrs {
+			if i.op == irConst && i.dst.typ.IsAny(Integer, Byte) {
+				consts[i.dst] = i.val
+			}
+		}
+	}
+
+	subst := make(map[*irTemp]*irTemp)
+	for _, b := range f.blocks {
+		var instrs []*irInstr
+		value := func(op irOp, t *Type, args ...*irTemp) *irTemp {
+			i := &irInstr{op: op, dst: f.newTemp(t, nil), args: args}
+			instrs = append(instrs, i)
+			return i.dst
+		}
+		constant := func(v int) *irTemp {
+			i := &irInstr{op: irConst, dst: f.newTemp(intType, nil), val: v}
+			instrs = append(instrs, i)
+			return i.dst
+		}
+
+		for _, i := range b.instrs {
+			if i.dst == nil || !i.dst.typ.Is(Integer) {
+				instrs = append(instrs, i)
+				continue
+			}
+			switch i.op {
+			case irMul:
+				x, c, ok := constOperand(i, consts)
+				if !ok || c < 0 || c == 3 || c == 5 || c == 9 {
+					break
+				}
+				switch {
+				case c == 0:
+					i.op, i.args, i.val = irConst, nil, 0
+
+				case c == 1:
+					subst[i.dst] = x
+					continue
+
+				case isPowerOfTwo(c):
+					i.op, i.args = irShl, []*irTemp{x, constant(log2(c))}
+
+				case bitCount(c) == 2:
+					// x * (2^a + 2^b) = (x << a) + (x << b)
+					lo := c & -c
+					hi := c - lo
+					t := x
+					if lo > 1 {
+						t = value(irShl, i.dst.typ, x, constant(log2(lo)))
+					}
+					i.op, i.args = irAdd, []*irTemp{value(irShl, i.dst.typ, x, constant(log2(hi))), t}
+
+				case isPowerOfTwo(c + 1):
+					// x * (2^a - 1) = (x << a) - x
+					i.op, i.args = irSub, []*irTemp{value(irShl, i.dst.typ, x, constant(log2(c+1))), x}
+				}
+
+			case irDiv:
+				c, ok := consts[i.args[1]]
+				if !ok || c <= 0 || !isPowerOfTwo(c) {
+					break
+				}
+				x := i.args[0]
+				if c == 1 {
+					subst[i.dst] = x
+					continue
+				}
+
+				// Arithmetic shifts round towards negative infinity but division truncates so negative values are
+				// biased by 2^k - 1 first
+				sign := value(irShr, i.dst.typ, x, constant(63))
+				bias := value(irAnd, i.dst.typ, sign, constant(c-1))
+				i.op, i.args = irShr, []*irTemp{value(irAdd, i.dst.typ, x, bias), constant(log2(c))}
+			}
+			instrs = append(instrs, i)
+		}
+		b.instrs = instrs
+	}
+	f.substitute(subst)
+	f.eliminateDeadCode()
+}
+
+// Returns the non-constant operand & constant value of a commutative operation
+func constOperand(i *irInstr, consts map[*irTemp]int) (*irTemp, int, bool) {
+	if c, ok := consts[i.args[1]]; ok {
+		return i.args[0], c, true
+	}
+	if c, ok := consts[i.args[0]]; ok {
+		return i.args[1], c, true
+	}
+	return nil, 0, false
+}
+
+func isPowerOfTwo(v int) bool {
+	return v > 0 && v&(v-1) == 0
+}
+
+func log2(v int) int {
+	n := 0
+	for v > 1 {
+		v >>= 1
+		n++
+	}
+	return n
+}
+
+func bitCount(v int) int {
+	n := 0
+	for ; v != 0; v &= v - 1 {
+		n++
+	}
+	return n
+}
@@ -8,10 +8,10 @@ import (
 //----------------------------------------------------------------------------------------------------------------------
 
 const ptrSize = 8 // 64-bit pointer size in bytes
-const fnPrefix = "clara_"
 //----------------------------------------------------------------------------------------------------------------------
 
 var intType = &Type{ Kind: Integer, Data: &IntType{} }
+var byteType = &Type{ Kind: Byte, Data: &ByteType{} }
 var boolType = &Type{ Kind: Boolean, Data: &BoolType{} }
 var stringType = &Type{ Kind: String, Data: &StringType{} }
 var nothingType = &Type{ Kind: Nothing, Data: &NothingType{} }
@@ -37,6 +37,7 @@ const (
 	Parameter
 	Nothing
 	Pointer
+	Byte
 )
 
 var typeKindNames = map[TypeKind]string {
@@ -51,6 +52,7 @@ var typeKindNames = map[TypeKind]string {
 	Nothing:   "nothing",
 	Parameter: "T",
 	Pointer:   "pointer",
+	Byte:      "byte",
 }
 
 func (tk TypeKind) String() string {
@@ -124,7 +126,7 @@ func (t *Type) MatchesImpl(x *Type, allowBinding bool, bound map[*Type]*Type) bo
 			}
 		}
 		return true
-	case Boolean, String, Nothing, Pointer, Integer, Bytes:
+	case Boolean, String, Nothing, Pointer, Integer, Bytes, Byte:
 		return t.Kind == x.Kind
 	case Array:
 		if x.Kind != Array {
@@ -238,46 +240,6 @@ func (t *Type) String() string {
 	}
 }
 
-func (t *Type) AsmName() string {
-	switch t.Kind {
-	case Array:
-		return fmt.Sprintf("array$%v$", t.AsArray().Elem.AsmName())
-	case Struct:
-		st := t.AsStruct()
-		if len(st.Types) == 0 {
-			return st.Name
-		}
-		var tps []string
-		for _, tp := range st.Types {
-			tps = append(tps, tp.AsmName())
-		}
-		return fmt.Sprintf("%v$%v$", st.Name, strings.Join(tps, "."))
-	case Enum:
-		e := t.AsEnum()
-		if len(e.Types) == 0 {
-			return e.Name
-		}
-		var tps []string
-		for _, tp := range e.Types {
-			tps = append(tps, tp.AsmName())
-		}
-		return fmt.Sprintf("%v$%v$", e.Name, strings.Join(tps, "."))
-	case Function:
-		fn := t.AsFunction()
-		buf := bytes.NewBufferString("fn")
-		if len(fn.Params) > 0 {
-			buf.WriteString(fmt.Sprintf("$%v", fn.Params[0].AsmName()))
-			for i := 1; i < len(fn.Params); i += 1 {
-				buf.WriteString(fmt.Sprintf(".%v", fn.Params[i].AsmName()))
-			}
-			buf.WriteString("$")
-		}
-		return buf.String()
-	default:
-		return t.Kind.String()
-	}
-}
-
 //----------------------------------------------------------------------------------------------------------------------
 
 type StructType struct {
@@ -335,25 +297,7 @@ type FunctionType struct {
 	ret        *Type
 	isVariadic bool
 	RawValues  bool
-}
-
-// Used during codegen to avoid clashes with shared library functions
-func (ft *FunctionType) AsmName(name string) string {
-	if ft.Is(External) {
-		return name
-	}
-	if name == "main" {
-		return fnPrefix + "main"
-	}
-
-	// Build name safe for usage in ASM
-	buf := bytes.NewBufferString(fnPrefix)
-	buf.WriteString(name)
-	for _, param := range ft.Params {
-		buf.WriteString(".")
-		buf.WriteString(param.AsmName())
-	}
-	return buf.String()
+	IsPure     bool // No IO or memory mutation. Set during purity analysis
 }
 
 func (ft *FunctionType) Describe(name string) string {
@@ -431,6 +375,11 @@ type IntType struct {
 
 //----------------------------------------------------------------------------------------------------------------------
 
+type ByteType struct {
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
 type StringType struct {
 }
 
@@ -462,6 +411,7 @@ type Symbol struct {
 	IsType    bool
 	Type      *Type
 	Next 	  *Symbol // Only valid for function symbols!
+	Const     *Node   // Only valid for constant symbols!
 }
 
 func NewStackSym(name string, t *Type) *Symbol {
@@ -527,6 +477,18 @@ func (st *SymTab) ResolveAll(name string, pred func(*Symbol)bool) (*Symbol, bool
 	return nil, false
 }
 
+// Names of all symbols visible from this scope which satisfy the predicate
+func (st *SymTab) Names(pred func(*Symbol)bool) (names []string) {
+	for curr := st; curr != nil; curr = curr.parent {
+		for name, s := range curr.symbols {
+			if !s.IsLiteral && pred(s) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
 func (st *SymTab) MustResolve(name string) *Symbol {
 	s, ok := st.Resolve(name)
 	if !ok {
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Prints instructions in the syntax of a particular assembler dialect. Directives & labels are common to both as GAS
+// accepts either syntax once selected.
+type syntax interface {
+	directive() string // Selects the syntax at the start of the file (if required)
+	print(i inst, ops []operand) string
+}
+
+var syntaxes = map[string]syntax{
+	"att":   attSyntax{},
+	"intel": intelSyntax{},
+}
+
+const defaultSyntax = "att"
+
+func findSyntax(name string) (syntax, error) {
+	s, ok := syntaxes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown assembly syntax: '%v'. Available syntaxes: att, intel", name)
+	}
+	return s, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// AT&T syntax (https://en.wikibooks.org/wiki/X86_Assembly/GAS_Syntax). Operands print themselves in this syntax.
+type attSyntax struct{}
+
+func (attSyntax) directive() string { return "" }
+
+func (attSyntax) print(i inst, ops []operand) string {
+	s := make([]string, len(ops))
+	for j, op := range ops {
+		s[j] = op.Print()
+	}
+	return fmt.Sprintf("%-7s %-50s", instNames[i], strings.Join(s, ", "))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Intel syntax without register prefixes. Destination operands come first, size suffixes are dropped & memory
+// operands are sized explicitly.
+type intelSyntax struct{}
+
+var intelNames = map[inst]string{
+	movq:   "mov",
+	movb:   "mov",
+	movsbq: "movsx",
+	movzbq: "movzx",
+	popq:   "pop",
+	pushq:  "push",
+	leaq:   "lea",
+	notq:   "not",
+	negq:   "neg",
+	orq:    "or",
+	xorq:   "xor",
+	sarq:   "sar",
+	shlq:   "shl",
+	andq:   "and",
+	cmpq:   "cmp",
+	addq:   "add",
+	incq:   "inc",
+	subq:   "sub",
+	imulq:  "imul",
+	idivq:  "idiv",
+	xchgq:  "xchg",
+
+	lockXaddq:    "lock xadd",
+	lockCmpxchgq: "lock cmpxchg",
+}
+
+func (intelSyntax) directive() string { return ".intel_syntax noprefix" }
+
+func (intelSyntax) print(i inst, ops []operand) string {
+	name, ok := intelNames[i]
+	if !ok {
+		name = instNames[i]
+	}
+	size := "qword"
+	if i == movb || i == movsbq || i == movzbq {
+		size = "byte"
+	}
+	s := make([]string, len(ops))
+	for j, op := range ops {
+		k := len(ops) - 1 - j
+		if i == enter {
+			k = j // NOTE: Operand order is the same in both syntaxes
+		}
+		s[k] = intelOperand(op, i, size)
+	}
+	return fmt.Sprintf("%-7s %-50s", name, strings.Join(s, ", "))
+}
+
+func intelOperand(op operand, i inst, size string) string {
+	switch op := op.(type) {
+	case reg:
+		return op.Print()[1:] // Trim '%'
+	case litOp:
+		return string(op)
+	case symOp:
+		return "offset " + op.Print()[1:] // Trim '$'
+	case ripOp:
+		return intelMem(i, size, "rip + "+string(op))
+	case memOp:
+		if op.indir && !op.deref {
+			return op.base.Print()[1:] // Register indirect jump or call
+		}
+		addr := op.base.Print()[1:]
+		if op.idx != 0 {
+			scl := op.scl
+			if scl < 1 {
+				scl = 1
+			}
+			addr += fmt.Sprintf(" + %v*%v", op.idx.Print()[1:], scl)
+		}
+		if op.disp != 0 {
+			addr += fmt.Sprintf(" %v %v", sign(int(op.disp)), strconv.Itoa(abs(int(op.disp))))
+		}
+		return intelMem(i, size, addr)
+	default:
+		return op.Print() // Labels & functions
+	}
+}
+
+func intelMem(i inst, size string, addr string) string {
+	if i == leaq {
+		return "[" + addr + "]" // Address only
+	}
+	return fmt.Sprintf("%v ptr [%v]", size, addr)
+}
+
+func sign(i int) string {
+	if i < 0 {
+		return "-"
+	}
+	return "+"
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Test runner (clarac test). Functions named testXxx which take no arguments & return nothing are tests. Each file is
+// compiled once with a runMain() which calls the test named by its first argument (See: testWrapper()) & each test runs
+// in its own process, so a failed assert() or panic fails only that test. Output of failed tests is shown beneath them.
+//
+// Functions named benchXxx which take an int & return nothing are benchmarks, run when selected by -bench. Each is
+// called by benchmark() (See: bench.clara) with increasing iteration counts until a call takes at least -benchtime &
+// the time & allocations per iteration of that call are reported.
+
+func runTests(args []string, defaultInstall string, out io.Writer, errOut io.Writer) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	installPath := flags.String("install", defaultInstall, "Path to install directory.")
+	colour := flags.String("color", "auto", colourUsage)
+	run := flags.String("run", "", "Run only tests whose name matches the supplied regular expression.")
+	target := flags.String("backend", defaultBackend, "Code generator (x64, c or vm).")
+	bench := flags.String("bench", "", "Run benchmarks whose name matches the supplied regular expression.")
+	benchTime := flags.Duration("benchtime", time.Second, "Minimum time taken by the reported run of each benchmark.")
+	verbose := flags.Bool("v", false, "Print the output of passing tests too.")
+	flags.Usage = func() {
+		fmt.Fprintln(errOut, "usage: clarac test [-install dir] [-color mode] [-run regexp] [-bench regexp] [-benchtime d] [-backend name] [-v] <file or directory>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := setColour(*colour); err != nil {
+		fmt.Fprintln(errOut, err)
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		fmt.Fprintf(errOut, "invalid -run expression: %v\n", err)
+		return 2
+	}
+	var benchFilter *regexp.Regexp
+	if *bench != "" {
+		if benchFilter, err = regexp.Compile(*bench); err != nil {
+			fmt.Fprintf(errOut, "invalid -bench expression: %v\n", err)
+			return 2
+		}
+	}
+	be, err := newBackend(options{backend: *target})
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return 2
+	}
+	dir, err := ioutil.TempDir("", "clara-test")
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	r := &testRunner{installPath: *installPath, backend: *target, interpret: !be.native(), benchTime: *benchTime, dir: dir,
+		verbose: *verbose, out: out}
+	for _, path := range fmtPaths(flags.Args()) {
+		r.runFile(path, filter, benchFilter)
+	}
+	if r.passed+r.failed == 0 {
+		fmt.Fprintln(out, "no tests to run")
+	} else {
+		fmt.Fprintf(out, "\n%d passed, %d failed\n", r.passed, r.failed)
+	}
+	if r.failed > 0 || r.broken {
+		return 1
+	}
+	return 0
+}
+
+type testRunner struct {
+	installPath string
+	backend     string
+	interpret   bool // Bytecode is run by the VM in process
+	benchTime   time.Duration
+	dir         string // Where test binaries are written
+	verbose     bool
+	out         io.Writer
+
+	passed, failed int
+	broken         bool // A file failed to compile
+}
+
+// Compiles the file & runs each of its tests, followed by its benchmarks if any are selected
+func (r *testRunner) runFile(path string, filter *regexp.Regexp, benchFilter *regexp.Regexp) {
+	tests, benchmarks, errs := findTests(path)
+	if len(errs) > 0 {
+		r.fail(path, errs)
+		return
+	}
+	tests = selectTests(tests, filter)
+	benchmarks = selectTests(benchmarks, benchFilter)
+	if len(tests)+len(benchmarks) == 0 {
+		return
+	}
+
+	deps, err := moduleLibs(path, r.installPath)
+	if err != nil {
+		r.fail(path, []error{err})
+		return
+	}
+
+	start := time.Now()
+	binary, errs := Compile(options{backend: r.backend, harness: testWrapper(tests, benchmarks, r.benchTime)},
+		append(glob(fmt.Sprintf("%v/lib/*.clara", r.installPath)), deps...),
+		path,
+		glob(fmt.Sprintf("%v/init/*.c", r.installPath)),
+		r.dir,
+		ioutil.Discard)
+	if len(errs) > 0 {
+		r.fail(path, errs)
+		return
+	}
+	failed := r.failed
+	for _, t := range tests {
+		output, elapsed, ok := r.run(binary, t)
+		if ok {
+			fmt.Fprintf(r.out, "--- PASS: %v (%.2fs)\n", t.token.Val, elapsed)
+			if r.verbose {
+				printIndented(output, r.out)
+			}
+			r.passed++
+		}
+	}
+	for _, b := range benchmarks {
+		output, _, ok := r.run(binary, b)
+		if !ok {
+			continue
+		}
+		result, found := parseBenchmark(output)
+		if !found {
+			fmt.Fprintf(r.out, "--- FAIL: %v\n    %v:%d: no result reported\n", b.token.Val, b.token.File, b.token.Line)
+			printIndented(output, r.out)
+			r.failed++
+			continue
+		}
+		fmt.Fprintf(r.out, "%-24v %v\n", b.token.Val, result)
+		r.passed++
+	}
+	result := "ok"
+	if r.failed > failed {
+		result = "FAIL"
+	}
+	fmt.Fprintf(r.out, "%-4v %v (%.2fs)\n", result, path, time.Since(start).Seconds())
+}
+
+// Runs the test or benchmark, reporting it as failed unless it exits successfully
+func (r *testRunner) run(binary string, t *Node) (string, float64, bool) {
+	began := time.Now()
+	output, status, err := r.exec(binary, t.token.Val)
+	elapsed := time.Since(began).Seconds()
+	switch {
+	case err != nil:
+		fmt.Fprintf(r.out, "--- FAIL: %v (%.2fs)\n    %v:%d: %v\n", t.token.Val, elapsed, t.token.File, t.token.Line, err)
+	case status != 0:
+		fmt.Fprintf(r.out, "--- FAIL: %v (%.2fs)\n    %v:%d: exit status %d\n", t.token.Val, elapsed, t.token.File, t.token.Line, status)
+		printIndented(output, r.out)
+	default:
+		return output, elapsed, true
+	}
+	r.failed++
+	return output, elapsed, false
+}
+
+// Runs the test in its own process, or interpreter for bytecode, returning its output & exit status
+func (r *testRunner) exec(binary string, name string) (string, int, error) {
+	var out bytes.Buffer
+	if r.interpret {
+		status, err := runBytecode(binary, []string{binary, name}, os.Environ(), &out)
+		return out.String(), status, err
+	}
+	cmd := exec.Command(binary, name)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return out.String(), exit.ExitCode(), nil
+	}
+	return out.String(), 0, err
+}
+
+func (r *testRunner) fail(path string, errs []error) {
+	fmt.Fprintf(r.out, "FAIL %v [build failed]\n", path)
+	printErrors(errs, r.out)
+	r.broken = true
+}
+
+func printIndented(s string, out io.Writer) {
+	for _, line := range strings.Split(strings.TrimRight(s, "\n"), "\n") {
+		if line != "" {
+			fmt.Fprintf(out, "    %v\n", line)
+		}
+	}
+}
+
+// Declarations of tests & benchmarks in the file in the order they appear
+func findTests(path string) (tests []*Node, benchmarks []*Node, errs []error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	root := &Node{op: opRoot, symtab: NewSymtab()}
+	if errs := lexAndParse(string(b), path, root, false, ioutil.Discard); len(errs) > 0 {
+		return nil, nil, errs
+	}
+	for _, n := range root.stmts {
+		if (n.op != opBlockFnDcl && n.op != opExprFnDcl) || n.left != nil || n.right != nil {
+			continue
+		}
+		switch {
+		case isTestName(n.token.Val, "test") && len(n.params) == 0:
+			tests = append(tests, n)
+		case isTestName(n.token.Val, "bench") && len(n.params) == 1 && n.params[0].left.Is(opNamedType) &&
+			n.params[0].left.token.Val == "int":
+			benchmarks = append(benchmarks, n)
+		}
+	}
+	return tests, benchmarks, nil
+}
+
+func selectTests(tests []*Node, filter *regexp.Regexp) (selected []*Node) {
+	for _, t := range tests {
+		if filter != nil && filter.MatchString(t.token.Val) {
+			selected = append(selected, t)
+		}
+	}
+	return selected
+}
+
+// Whether the name is the prefix alone or followed by anything other than a lowercase letter, e.g. testSort or
+// test_sort but not testing
+func isTestName(name string, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return r == utf8.RuneError || !unicode.IsLower(r)
+}
+
+// Clara source of runMain(), which calls the test or benchmark named by the first program argument returning 0 or 2 if
+// none is named
+func testWrapper(tests []*Node, benchmarks []*Node, benchTime time.Duration) string {
+	var buf bytes.Buffer
+	buf.WriteString("fn runMain() int {\n")
+	buf.WriteString("    args := getRuntime().args\n")
+	buf.WriteString("    if args.length < 2 {\n        return 2\n    }\n")
+	for _, t := range tests {
+		fmt.Fprintf(&buf, "    if args[1].Equals(\"%v\") {\n        %v()\n        return 0\n    }\n", t.token.Val, t.token.Val)
+	}
+	for _, b := range benchmarks {
+		fmt.Fprintf(&buf, "    if args[1].Equals(\"%v\") {\n        benchmark(%v, %d)\n        return 0\n    }\n", b.token.Val,
+			b.token.Val, benchTime.Nanoseconds())
+	}
+	buf.WriteString("    return 2\n}\n")
+	return buf.String()
+}
+
+// Per iteration results of the run reported by benchmark()
+func parseBenchmark(output string) (string, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		var n, nanos, allocs, bytes int64
+		if _, err := fmt.Sscanf(line, "benchmark: %d %d %d %d", &n, &nanos, &allocs, &bytes); err == nil && n > 0 {
+			return fmt.Sprintf("%10d %12d ns/op %10d B/op %8d allocs/op", n, nanos/n, bytes/n, allocs/n), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,4 @@
+module app
+
+// Requires strs through greet
+require $MOD/greet v1.0.0
@@ -0,0 +1,2 @@
+module greet
+require $MOD/strs v1.0.0
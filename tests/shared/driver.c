@@ -0,0 +1,14 @@
+// Calls the functions tests/fns.clara exports, through the header generated alongside its shared library
+#include <inttypes.h>
+#include <stdio.h>
+#include "fns.h"
+
+int main(void)
+{
+    printf("%" PRId64 "\n", clamp(12, 0, 10)); // EXPECT: 10
+    printf("%" PRId64 "\n", clamp(-3, 0, 10)); // EXPECT: 0
+    printf("%" PRId64 "\n", clamp(4, 0, 10));  // EXPECT: 4
+    printf("%d\n", isOdd(7));                  // EXPECT: 1
+    printf("%d\n", isOdd(-8));                 // EXPECT: 0
+    return 0;
+}
@@ -0,0 +1,3 @@
+module project
+
+vet naming off
@@ -6,6 +6,7 @@ import (
 	"github.com/g-dx/clarac/console"
 	"github.com/g-dx/clarac/lex"
 	"math/rand"
+	"os"
 	"strings"
 )
 
@@ -25,7 +26,7 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 		}
 
 		if !left.typ.Is(Boolean) {
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, left.token, left.typ, boolType))
+			errs = append(errs, nodeError(errMismatchedTypesMsg, left, left.typ, boolType))
 			goto end
 		}
 
@@ -49,7 +50,7 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 		}
 
 		if !left.typ.Is(Boolean) {
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, left.token, left.typ, boolType))
+			errs = append(errs, nodeError(errMismatchedTypesMsg, left, left.typ, boolType))
 			goto end
 		}
 
@@ -79,7 +80,7 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 
 		// Default to empty return
 		rType := nothingType
-		rToken := n.token
+		rNode := n
 
 		// Check expression if any
 		if left != nil {
@@ -88,16 +89,16 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 				goto end
 			}
 			rType = left.typ
-			rToken = left.token
+			rNode = left
 		}
 
 		if !fn.ret.Matches(rType) {
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, rToken, rType, fn.ret))
+			errs = append(errs, nodeError(errMismatchedTypesMsg, rNode, rType, fn.ret))
 			goto end
 		}
 		n.typ = rType
 
-	case opAnd, opOr, opAdd, opMul, opSub, opDiv, opBAnd, opBOr, opBXor, opBLeft, opBRight, opRange:
+	case opAnd, opOr, opAdd, opMul, opSub, opDiv, opMod, opBAnd, opBOr, opBXor, opBLeft, opBRight, opRange:
 		errs = append(errs, typeCheck(left, symtab, fn, debug)...)
 		errs = append(errs, typeCheck(right, symtab, fn, debug)...)
 
@@ -105,19 +106,29 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 			goto end
 		}
 
+		// String concatenation (See: lowerStringConcat)
+		if n.op == opAdd && (left.typ.Is(String) || right.typ.Is(String)) {
+			if !left.typ.Is(String) || !right.typ.Is(String) {
+				errs = append(errs, nodeError(errMismatchedTypesMsg, n, left.typ, right.typ))
+			}
+			n.typ = stringType
+			goto end
+		}
+
 		if !operatorTypes.isValid(n.op, left.typ.Kind) {
 			// Not valid for op
-			errs = append(errs, semanticError2(errInvalidOperatorTypeMsg, left.token, left.typ, n.token.Val))
+			errs = append(errs, nodeError(errInvalidOperatorTypeMsg, left, left.typ, n.token.Val))
 			goto end
 		}
 		if !operatorTypes.isValid(n.op, right.typ.Kind) {
 			// Not valid for op
-			errs = append(errs, semanticError2(errInvalidOperatorTypeMsg, right.token, right.typ, n.token.Val))
+			errs = append(errs, nodeError(errInvalidOperatorTypeMsg, right, right.typ, n.token.Val))
 			goto end
 		}
-		if !left.typ.Matches(right.typ) {
+		_, ok := widen(left.typ, right.typ)
+		if !ok {
 			// Mismatched types
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, left.token, left.typ, right.typ))
+			errs = append(errs, nodeError(errMismatchedTypesMsg, n, left.typ, right.typ))
 		}
 
 		// Promote appropriate type
@@ -127,6 +138,9 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 		default:
 			n.typ = intType // All arithmetic operations produces int
 		}
+		if ok {
+			errs = append(errs, typeCheckConstantExpr(n, symtab, fn)...)
+		}
 
 	case opNot:
 		errs = append(errs, typeCheck(left, symtab, fn, debug)...)
@@ -136,10 +150,11 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 		}
 
 		if !left.typ.Is(Boolean) {
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, left.token, left.typ, boolType))
+			errs = append(errs, nodeError(errMismatchedTypesMsg, left, left.typ, boolType))
 			goto end
 		}
 		n.typ = boolType
+		errs = append(errs, typeCheckConstantExpr(n, symtab, fn)...)
 
 	case opBNot, opNeg:
 		errs = append(errs, typeCheck(left, symtab, fn, debug)...)
@@ -148,36 +163,31 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 			goto end
 		}
 
-		if !left.typ.Is(Integer) {
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, left.token, left.typ, intType))
+		if !left.typ.IsAny(Integer, Byte) {
+			errs = append(errs, nodeError(errMismatchedTypesMsg, left, left.typ, intType))
 			goto end
 		}
 		n.typ = intType
+		errs = append(errs, typeCheckConstantExpr(n, symtab, fn)...)
 
 	case opLit:
-		s, found := symtab.Resolve(n.token.Val)
-		if !found {
-			s, _ = symtab.Define(&Symbol{Name: n.token.Val, IsLiteral: true})
-			switch n.token.Kind {
-			case lex.Integer:
-				s.Type = intType
-			case lex.String:
-				s.Type = stringType
-			case lex.True, lex.False:
-				s.Type = boolType
-			default:
-				panic(fmt.Sprintf("Unknown literal! %v", lex.KindValues[n.token.Kind]))
-			}
-		}
-		n.sym = s
-		n.typ = n.sym.Type
+		typeCheckLiteral(n, symtab)
 
 	case opIdentifier:
 		err := typeCheckIdentifier(n, symtab, false)
 		if err != nil {
 			errs = append(errs, err)
+			goto end
 		}
 
+		// Replace constants with their value
+		if n.sym.Const != nil {
+			errs = append(errs, typeCheckConstRef(n)...)
+		}
+
+	case opConstDcl:
+		errs = append(errs, typeCheckConst(n)...)
+
 	case opFuncCall:
 		errs = append(errs, typeCheckFuncCall(n, symtab, symtab, fn, debug)...)
 
@@ -188,11 +198,12 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 		if !left.hasType() || !right.hasType() {
 			goto end
 		}
-		if !left.typ.Matches(right.typ) {
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, left.token, left.typ, right.typ))
+		if _, ok := widen(left.typ, right.typ); !ok {
+			errs = append(errs, nodeError(errMismatchedTypesMsg, n, left.typ, right.typ))
 			goto end
 		}
 		n.typ = boolType
+		errs = append(errs, typeCheckConstantExpr(n, symtab, fn)...)
 
 	case opStructDcl, opEnumDcl:
 		// Nothing to do...
@@ -201,7 +212,7 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 
 		// Closures will not have been annotated yet. Do it now.
 		if n.sym == nil {
-			_, err := processFnType(n, fmt.Sprintf("%X", rand.Uint32()), symtab, symtab.Child(), nil,false)
+			_, err := processFnType(n, fmt.Sprintf("anon.%d", rand.Uint32()), symtab, symtab.Child(), nil,false)
 			if err != nil {
 				errs = append(errs, err)
 				goto end
@@ -220,7 +231,7 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 		if n.op == opExprFnDcl {
 			expr := n.stmts[0]
 			if expr.typ != nil && !fn.ret.Matches(expr.typ) {
-				errs = append(errs, semanticError2(errMismatchedTypesMsg, n.stmts[0].token, n.stmts[0].typ, fn.ret))
+				errs = append(errs, nodeError(errMismatchedTypesMsg, n.stmts[0], n.stmts[0].typ, fn.ret))
 				goto end
 			}
 		}
@@ -296,7 +307,11 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 			// Check field exists in struct
 			sym := strct.GetField(right.token.Val)
 			if sym == nil {
-				errs = append(errs, semanticError(errStructHasNoFieldMsg, right.token, strct.Name))
+				var fields []string
+				for _, f := range strct.Fields {
+					fields = append(fields, f.Name)
+				}
+				errs = append(errs, suggest(semanticError(errStructHasNoFieldMsg, right.token, strct.Name), right.token.Val, fields))
 				goto end
 			}
 
@@ -323,7 +338,13 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 		}
 
 		if !right.typ.Is(Integer) {
-			errs = append(errs, semanticError2(errNonIntegerIndexMsg, right.token, right.typ))
+			errs = append(errs, nodeError(errNonIntegerIndexMsg, right, right.typ))
+			goto end
+		}
+
+		// Strings & bytes are indexed by (readonly) byte
+		if left.typ.IsAny(String, Bytes) {
+			n.typ = byteType
 			goto end
 		}
 
@@ -382,7 +403,7 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 
 		// Check types in assignment
 		if !left.typ.Matches(right.typ) {
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, right.token, right.typ, left.typ))
+			errs = append(errs, nodeError(errMismatchedTypesMsg, right, right.typ, left.typ))
 			goto end
 		}
 
@@ -406,7 +427,7 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 
 		// Ensure enum type
 		if !left.typ.Is(Enum) {
-			errs = append(errs, semanticError2(errMismatchedTypesMsg, left.token, left.typ, "<enum>"))
+			errs = append(errs, nodeError(errMismatchedTypesMsg, left, left.typ, "<enum>"))
 			goto end
 		}
 
@@ -455,7 +476,7 @@ func typeCheck(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs []er
 
 		// TODO: Allow "remaining" keyword to be used
 		if len(n.stmts) != len(enum.Members) {
-			errs = append(errs, semanticError2(errMatchNotExhaustiveMsg, left.token, left.typ))
+			errs = append(errs, nodeError(errMatchNotExhaustiveMsg, left, left.typ))
 			goto end
 		}
 
@@ -520,7 +541,7 @@ func typeCheckTernary(n *Node, symtab *SymTab, fn *FunctionType, debug bool) []e
 		return errs
 	}
 	if !cond.typ.Is(Boolean) {
-		return []error{ semanticError2(errMismatchedTypesMsg, cond.token, cond.typ, boolType) }
+		return []error{ nodeError(errMismatchedTypesMsg, cond, cond.typ, boolType) }
 	}
 	ifExpr := n.stmts[0]
 	if errs := typeCheck(ifExpr, symtab, fn, debug); !ifExpr.hasType() {
@@ -531,7 +552,7 @@ func typeCheckTernary(n *Node, symtab *SymTab, fn *FunctionType, debug bool) []e
 		return errs
 	}
 	if !ifExpr.typ.Matches(elseExpr.typ) {
-		return []error{ semanticError2(errMismatchedTypesMsg, elseExpr.token, elseExpr.typ, ifExpr.typ) }
+		return []error{ nodeError(errMismatchedTypesMsg, elseExpr, elseExpr.typ, ifExpr.typ) }
 	}
 	n.typ = ifExpr.typ
 	return nil
@@ -547,7 +568,7 @@ func typeCheckArrayLit(n *Node, symtab *SymTab, fn *FunctionType, debug bool) []
 		}
 		// Type of first element defines type for rest of elements
 		if !expr.typ.Matches(n.stmts[0].typ) {
-			return []error{ semanticError2(errMismatchedTypesMsg, expr.token, expr.typ, intType) }
+			return []error{ nodeError(errMismatchedTypesMsg, expr, expr.typ, intType) }
 		}
 	}
 	n.typ = &Type{Kind: Array, Data: &ArrayType{Elem: n.stmts[0].typ}}
@@ -561,17 +582,20 @@ func typeCheckFor(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs [
 		return errs
 	}
 
-	// 2 case - either an range expression or an array
+	// 3 cases - either an range expression, an array or a vector
 	var varType *Type
 	switch {
 	case n.right.typ.Kind == Array:
 		varType = n.right.typ.AsArray().Elem
 
+	case isVector(n.right.typ):
+		varType = n.right.typ.AsStruct().GetField("data").Type.AsArray().Elem
+
 	case n.right.Is(opRange):
 		varType = n.right.typ
 
 	default:
-		errs = append(errs, semanticError2(errMismatchedTypesMsg, n.right.token, n.right.typ, "<array> or <range expression>"))
+		errs = append(errs, nodeError(errMismatchedTypesMsg, n.right, n.right.typ, "<array>, <vector> or <range expression>"))
 	}
 
 	// Create & assign new symbol
@@ -591,11 +615,6 @@ func typeCheckFor(n *Node, symtab *SymTab, fn *FunctionType, debug bool) (errs [
 
 func typeCheckFuncCall(n *Node, fnSymtab *SymTab, symtab *SymTab, fn *FunctionType, debug bool) (errs []error) {
 
-	if len(n.stmts) > maxFnArgCount {
-		errs = append(errs, semanticError2(errTooManyArgsMsg, n.token, n.token.Val, maxFnArgCount))
-		return errs
-	}
-
 	// Typecheck function call source
 	switch n.left.op {
 	case opBlockFnDcl, opDot, opFuncCall, opArray:
@@ -612,6 +631,13 @@ func typeCheckFuncCall(n *Node, fnSymtab *SymTab, symtab *SymTab, fn *FunctionTy
 		return errs
 	}
 
+	// Calls to function values are rewritten to invokeDynamic() calls which forward a fixed number of arguments
+	if n.isNonGlobalFnCall() && len(n.stmts) > maxFnValueArgCount {
+		if s, ok := symtab.Resolve("invokeDynamic"); !ok || s.Type.AsFunction() != fn {
+			return append(errs, semanticError2(errTooManyArgsMsg, n.token, n.token.Val, maxFnValueArgCount))
+		}
+	}
+
 	// Type check type parameters
 	for _, param := range n.params {
 		errs = append(errs, typeCheck(param, symtab, fn, debug)...)
@@ -631,6 +657,9 @@ func typeCheckFuncCall(n *Node, fnSymtab *SymTab, symtab *SymTab, fn *FunctionTy
 			if err != nil {
 				return append(errs, err)
 			}
+			if arg.sym.Const != nil {
+				errs = append(errs, typeCheckConstRef(arg)...)
+			}
 		default:
 			errs = append(errs, typeCheck(arg, symtab, fn, debug)...)
 		}
@@ -644,7 +673,7 @@ func typeCheckFuncCall(n *Node, fnSymtab *SymTab, symtab *SymTab, fn *FunctionTy
 		s, _ := fnSymtab.Resolve(n.left.token.Val)
 		n.left.sym = s
 		n.typ = nothingType
-		return errs
+		return append(errs, checkFormat(n, len(s.Type.AsFunction().Params)-1, symtab)...)
 	}
 
 	// SPECIAL CASE: Allow anything into the unsafe function
@@ -743,13 +772,13 @@ func matchFuncCallByType(t *Type, n *Node) (*Type, error) {
 				for s := arg.sym; s != nil; s = s.Next {
 					candidates.WriteString(fmt.Sprintf("	%v\n", s.Describe()))
 				}
-				return nil, semanticError2(errOverloadResolutionMsg, arg.token, param,
+				return nil, nodeError(errOverloadResolutionMsg, arg, param,
 					candidates.String())
 			}
 
 			// Match on declared type
 			if !arg.typ.Matches(param) {
-				return nil, semanticError2(errMismatchedTypesMsg, arg.token, arg.typ, param)
+				return nil, nodeError(errMismatchedTypesMsg, arg, arg.typ, param)
 			}
 		}
 		return f.ret, nil
@@ -778,13 +807,13 @@ func matchFuncCallByType(t *Type, n *Node) (*Type, error) {
 				for s := arg.sym; s != nil; s = s.Next {
 					candidates.WriteString(fmt.Sprintf("	%v\n", s.Describe()))
 				}
-				return nil, semanticError2(errOverloadResolutionMsg, arg.token, substituteType(param, bound),
+				return nil, nodeError(errOverloadResolutionMsg, arg, substituteType(param, bound),
 					candidates.String())
 			}
 
 			// Match on declared type
 			if !arg.typ.PolyMatch(param, bound) {
-				return nil, semanticError2(errMismatchedTypesMsg, arg.token, arg.typ, substituteType(param, bound))
+				return nil, nodeError(errMismatchedTypesMsg, arg, arg.typ, substituteType(param, bound))
 			}
 		}
 
@@ -886,20 +915,91 @@ func findUnboundTypeParameters(t *Type, bound map[*Type]*Type) []*Type {
 			}
 		}
 		return []*Type{t} // Unmatched
-	case t.IsAny(Nothing, Boolean, Integer, Bytes, Pointer, String):
+	case t.IsAny(Nothing, Boolean, Integer, Byte, Bytes, Pointer, String):
 		return nil
 	default:
 		panic("unreachable")
 	}
 }
 
+func typeCheckLiteral(n *Node, symtab *SymTab) {
+	s, found := symtab.Resolve(n.token.Val)
+	if !found {
+		s, _ = symtab.Define(&Symbol{Name: n.token.Val, IsLiteral: true})
+		switch n.token.Kind {
+		case lex.Integer:
+			s.Type = intType
+		case lex.String:
+			s.Type = stringType
+		case lex.True, lex.False:
+			s.Type = boolType
+		default:
+			panic(fmt.Sprintf("Unknown literal! %v", lex.KindValues[n.token.Kind]))
+		}
+	}
+	n.sym = s
+	n.typ = n.sym.Type
+}
+
+// Evaluate operators over literals at compile time
+func typeCheckConstantExpr(n *Node, symtab *SymTab, fn *FunctionType) []error {
+	if err := foldConstantExpr(n); err != nil {
+		return []error{err}
+	}
+	if n.Is(opLit) {
+		typeCheckLiteral(n, symtab)
+	}
+	return nil
+}
+
+// Constants are evaluated on first use (or declaration) & must reduce to a single literal
+func typeCheckConst(n *Node) (errs []error) {
+	if n.typ != nil {
+		return nil // Evaluated or in progress
+	}
+	n.typ = nothingType // Mark in progress to detect cycles
+	errs = typeCheck(n.left, n.symtab, nil, false)
+	if len(errs) == 0 && !n.left.Is(opLit) {
+		errs = append(errs, semanticError(errNotConstantMsg, n.token))
+	}
+	if len(errs) > 0 {
+		n.left = &Node{op: opError, token: n.left.token}
+		return errs
+	}
+	n.typ = n.left.typ
+	n.sym.Type = n.typ
+	return nil
+}
+
+func typeCheckConstRef(n *Node) []error {
+	dcl := n.sym.Const
+	errs := typeCheckConst(dcl)
+	switch {
+	case len(errs) > 0:
+		return errs
+	case dcl.left.Is(opError):
+		return nil // Already reported
+	case dcl.typ == nothingType:
+		return []error{semanticError(errConstantCycleMsg, n.token)}
+	}
+
+	// Rewrite to literal
+	lit := dcl.left
+	n.op = opLit
+	n.token = &lex.Token{Kind: lit.token.Kind, Val: lit.token.Val, Pos: n.token.Pos, Line: n.token.Line, File: n.token.File}
+	n.sym = lit.sym
+	n.typ = lit.typ
+	return nil
+}
+
 func typeCheckIdentifier(n *Node, symtab *SymTab, allowAmbiguous bool) error {
 
 	// If no symbol - try to find identifier declaration
 	if n.sym == nil {
 		sym, found := symtab.Resolve(n.token.Val)
 		if !found {
-			return semanticError(errUnknownVarMsg, n.token)
+			names := symtab.Names(func(s *Symbol) bool { return !s.IsType })
+			return suggest(semanticError(errUnknownVarMsg, n.token), n.token.Val, names)
 		}
 		if sym.Next != nil && !allowAmbiguous {
 			var types []string
@@ -933,8 +1033,9 @@ func printTypeInfo(n *Node) {
 	}
 
 	// Dump type info
-	fmt.Printf(debugTypeInfoFormat,
-		console.Yellow, location, console.Disable,
-		console.Red, fmt.Sprintf("%s(%s)", nodeTypes[n.op], symbolName), console.Disable,
-		console.Green, calculatedType, console.Disable)
+	p := console.NewPrinter(os.Stdout)
+	p.Printf(debugTypeInfoFormat,
+		p.Sprint(console.Yellow, fmt.Sprintf("%-60s", location)),
+		p.Sprint(console.Red, fmt.Sprintf("%-30s", fmt.Sprintf("%s(%s)", nodeTypes[n.op], symbolName))),
+		p.Sprint(console.Green, calculatedType))
 }
@@ -0,0 +1,45 @@
+package main
+
+// Functions reachable from the roots (by assembly name) through direct calls or references to named functions.
+// Anything else, including unused standard library functions, is never called & so need not be compiled.
+func reachableFuncs(fns []*irFunc, roots ...string) []*irFunc {
+
+	byName := make(map[string]*irFunc)
+	for _, f := range fns {
+		byName[f.name] = f
+	}
+
+	reachable := make(map[*irFunc]bool)
+	var work []*irFunc
+	mark := func(name string) {
+		if f := byName[name]; f != nil && !reachable[f] {
+			reachable[f] = true
+			work = append(work, f)
+		}
+	}
+	for _, name := range roots {
+		mark(name)
+	}
+	for len(work) > 0 {
+		f := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, b := range f.blocks {
+			for _, i := range b.instrs {
+				switch {
+				case i.op == irCall && i.sym != nil:
+					mark(i.fn.AsmName(i.sym.Name))
+				case i.op == irFnAddr:
+					mark(i.sym.Type.AsFunction().AsmName(i.sym.Name))
+				}
+			}
+		}
+	}
+
+	var live []*irFunc
+	for _, f := range fns {
+		if reachable[f] {
+			live = append(live, f)
+		}
+	}
+	return live
+}
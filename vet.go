@@ -0,0 +1,328 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/g-dx/clarac/lex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Linter (clarac vet). Each file is type checked with the standard lib & then every enabled rule is run over its
+// declarations, reporting code which compiles but is likely a mistake. Rules are enabled by default & may be turned off
+// by a flag named after the rule (-naming=false) or for a whole project with a 'vet <rule> off' line in its clara.mod.
+// Flags take precedence over the project. A single report is suppressed by '//clara:ignore <rule>' ending its line.
+
+type vetRule struct {
+	name string
+	doc  string
+	run  func(p *vetPass, decl *Node)
+}
+
+var vetRules = []vetRule{
+	{name: "unusedresult", doc: "Report unused results of pure function calls & other expressions without effects.", run: vetUnusedResult},
+	{name: "assign", doc: "Report comparisons used as statements, where '=' was likely meant, & variables assigned to themselves.", run: vetAssign},
+	{name: "naming", doc: "Report names breaking convention: enums, fields & variables begin lowercase, enum cases capitalised & constants upper case.", run: vetNaming},
+}
+
+// Caller of no tests, so files without main() can be checked
+const vetHarness = "fn runMain() int {\n    return 0\n}\n"
+
+func runVet(args []string, defaultInstall string, out io.Writer, errOut io.Writer) int {
+	flags := flag.NewFlagSet("vet", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	installPath := flags.String("install", defaultInstall, "Path to install directory.")
+	colour := flags.String("color", "auto", colourUsage)
+	diagFormat := flags.String("diag", textDiag, "Format of findings & errors: text or sarif (SARIF 2.1.0 log).")
+	enabled := make(map[string]*bool)
+	for _, rule := range vetRules {
+		enabled[rule.name] = flags.Bool(rule.name, true, rule.doc)
+	}
+	flags.Usage = func() {
+		fmt.Fprintln(errOut, "usage: clarac vet [-install dir] [-color mode] [-diag format] [-<rule>=false]... <file or directory>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := setColour(*colour); err != nil {
+		fmt.Fprintln(errOut, err)
+		return 2
+	}
+	if err := checkDiagFormat(*diagFormat); err != nil {
+		fmt.Fprintln(errOut, err)
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	status := 0
+	sarif := newSarifWriter()
+	for _, path := range fmtPaths(flags.Args()) {
+		rules, err := vetConfig(path, enabled, set)
+		if err != nil {
+			status = 1
+			if *diagFormat == sarifDiag {
+				sarif.addErrors([]error{err})
+			} else {
+				fmt.Fprintln(errOut, err)
+			}
+			continue
+		}
+		reports, errs := vetFile(path, *installPath, rules)
+		if len(errs) > 0 {
+			status = 1
+			if *diagFormat == sarifDiag {
+				sarif.addErrors(errs)
+			} else {
+				printErrors(errs, errOut)
+			}
+			continue
+		}
+		for _, r := range reports {
+			status = 1
+			if *diagFormat == sarifDiag {
+				sarif.add(r.rule, vetRuleDoc(r.rule), "", "warning", r.msg, r.token, nil)
+			} else {
+				fmt.Fprintln(out, r)
+			}
+		}
+	}
+	if *diagFormat == sarifDiag {
+		if err := sarif.write(out); err != nil {
+			fmt.Fprintln(errOut, err)
+			return 1
+		}
+	}
+	return status
+}
+
+func vetRuleDoc(name string) string {
+	for _, rule := range vetRules {
+		if rule.name == name {
+			return rule.doc
+		}
+	}
+	return ""
+}
+
+// Rules enabled for the file by its project, unless set by flag
+func vetConfig(path string, enabled map[string]*bool, set map[string]bool) ([]vetRule, error) {
+	on := make(map[string]bool)
+	for name, b := range enabled {
+		on[name] = *b
+	}
+	if mp := findManifest(filepath.Dir(path)); mp != "" {
+		m, err := readManifest(mp)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range m.vet {
+			if _, ok := enabled[v.rule]; !ok {
+				return nil, fmt.Errorf("%v:%d: unknown vet rule '%v'", mp, v.line, v.rule)
+			}
+			if !set[v.rule] {
+				on[v.rule] = v.on
+			}
+		}
+	}
+	var rules []vetRule
+	for _, rule := range vetRules {
+		if on[rule.name] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func vetFile(path string, installPath string, rules []vetRule) ([]*vetReport, []error) {
+	deps, err := moduleLibs(path, installPath)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var lib []string
+	abs, _ := filepath.Abs(path)
+	for _, f := range append(glob(fmt.Sprintf("%v/lib/*.clara", installPath)), deps...) {
+		if a, err := filepath.Abs(f); err != nil || a != abs {
+			lib = append(lib, f) // Vetting the standard lib itself
+		}
+	}
+	root, _, errs := check(options{harness: vetHarness}, lib, path, ioutil.ReadFile, ioutil.Discard)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	p := &vetPass{root: root}
+	for _, rule := range rules {
+		p.rule = rule.name
+		for _, decl := range root.stmts {
+			if decl.token != nil && decl.token.File == path {
+				rule.run(p, decl)
+			}
+		}
+	}
+
+	// Drop suppressed & duplicate reports, e.g. of a rule flagging the same node from several declarations
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+	ignored := ignoredCodes(string(src), path)
+	var reports []*vetReport
+	seen := make(map[string]bool)
+	for _, r := range p.reports {
+		if !ignored[r.token.Line][r.rule] && !seen[r.String()] {
+			seen[r.String()] = true
+			reports = append(reports, r)
+		}
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		a, b := reports[i].token, reports[j].token
+		return a.Line < b.Line || (a.Line == b.Line && a.Pos < b.Pos)
+	})
+	return reports, nil
+}
+
+type vetPass struct {
+	root    *Node
+	rule    string // Currently running
+	reports []*vetReport
+}
+
+type vetReport struct {
+	token *lex.Token
+	rule  string
+	msg   string
+}
+
+func (r *vetReport) String() string {
+	return fmt.Sprintf("%v:%d:%d: %v (%v)", r.token.File, r.token.Line, r.token.Pos, r.msg, r.rule)
+}
+
+func (p *vetPass) report(t *lex.Token, format string, args ...interface{}) {
+	p.reports = append(p.reports, &vetReport{token: t, rule: p.rule, msg: fmt.Sprintf(format, args...)})
+}
+
+// Calls f with each statement in the bodies of the declaration & any functions or blocks within it
+func (p *vetPass) statements(decl *Node, f func(stmt *Node)) {
+	WalkPreOrder(decl, func(n *Node) bool {
+		if n == nil {
+			return false
+		}
+		switch n.op {
+		case opBlockFnDcl, opIf, opElseIf, opElse, opWhile, opFor, opCase, opBlock:
+			for _, stmt := range n.stmts {
+				f(stmt)
+			}
+		}
+		return true
+	})
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func vetUnusedResult(p *vetPass, decl *Node) {
+	p.statements(decl, func(stmt *Node) {
+		switch stmt.op {
+		case opFuncCall:
+			callee := stmt.left.sym
+			if !stmt.left.Is(opIdentifier) || callee == nil || !callee.Type.Is(Function) || stmt.typ == nil ||
+				stmt.typ.Is(Nothing) {
+				return
+			}
+			if callee.Type.AsFunction().IsPure {
+				p.report(stmt.left.token, "result of pure function '%v' is unused", callee.Name)
+			}
+		case opLit, opIdentifier, opDot, opArray, opAdd, opSub, opMul, opDiv, opMod, opNeg, opNot, opAnd, opOr, opGt,
+			opGte, opLt, opLte, opBAnd, opBOr, opBXor, opBNot, opBLeft, opBRight:
+			p.report(stmt.token, "result of expression is unused")
+		}
+	})
+}
+
+func vetAssign(p *vetPass, decl *Node) {
+	p.statements(decl, func(stmt *Node) {
+		switch {
+		case stmt.op == opEq:
+			p.report(stmt.token, "result of comparison is unused, did you mean '='?")
+		case stmt.op == opAs && sameVariable(stmt.left, stmt.right):
+			p.report(stmt.token, "'%v' is assigned to itself", variableName(stmt.left))
+		}
+	})
+}
+
+// Whether both are the same variable or field of it, e.g. a.b & a.b
+func sameVariable(a *Node, b *Node) bool {
+	switch {
+	case a == nil || b == nil || a.op != b.op:
+		return false
+	case a.op == opIdentifier:
+		return a.sym != nil && a.sym == b.sym
+	case a.op == opDot:
+		return sameVariable(a.left, b.left) && a.right.Is(opIdentifier) && b.right.Is(opIdentifier) &&
+			a.right.token.Val == b.right.token.Val
+	default:
+		return false
+	}
+}
+
+func variableName(n *Node) string {
+	if n.op == opDot {
+		return variableName(n.left) + "." + n.right.token.Val
+	}
+	return n.token.Val
+}
+
+func vetNaming(p *vetPass, decl *Node) {
+	switch decl.op {
+	case opConstDcl:
+		if strings.ToUpper(decl.token.Val) != decl.token.Val {
+			p.report(decl.token, "constant names should be upper case, '%v'", decl.token.Val)
+		}
+	case opEnumDcl:
+		if !startsLower(decl.token.Val) {
+			p.report(decl.token, "enum names should start with a lowercase letter, '%v'", decl.token.Val)
+		}
+	case opConsFnDcl: // Enum cases are moved to the root when typed
+		if decl.sym != nil && decl.sym.Type.AsFunction().Is(EnumCons) && startsLower(decl.token.Val) {
+			p.report(decl.token, "enum cases should be capitalised, '%v'", decl.token.Val)
+		}
+	case opStructDcl:
+		for _, field := range decl.stmts {
+			if !startsLower(field.token.Val) {
+				p.report(field.token, "field names should start with a lowercase letter, '%v'", field.token.Val)
+			}
+		}
+	}
+	WalkPreOrder(decl, func(n *Node) bool {
+		if n == nil {
+			return false
+		}
+		var vars []*Node
+		switch {
+		case n.op == opBlockFnDcl || n.op == opExprFnDcl:
+			vars = n.params
+		case n.op == opDas:
+			vars = []*Node{n.left}
+		}
+		for _, v := range vars {
+			if v.Is(opIdentifier) && !startsLower(v.token.Val) {
+				p.report(v.token, "variable names should start with a lowercase letter, '%v'", v.token.Val)
+			}
+		}
+		return true
+	})
+}
+
+func startsLower(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return r == '_' || unicode.IsLower(r)
+}
@@ -0,0 +1,1173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+
+ Bytecode VM:
+ ------------
+ Executes programs output by the bytecode backend (See: bytecode.go). Memory is a single byte array addressed from
+ bcDataBase & laid out as:
+
+   data | stack | heap
+
+ The stack holds frames, which grow upwards. The heap is allocated by calloc() & grows as required. Temps & operands
+ are held outside of memory so only frames are visible to the GC. External functions are implemented in Go.
+
+ Threads run in goroutines & take turns holding the runtime lock, as in runtime.c. The holder executes using the state
+ held by vm, which is saved in its vmThread when it blocks.
+
+*/
+
+const (
+	vmStackSize       = 16 << 20
+	vmMaxMemory       = 4 << 30
+	vmMinHeap         = 4 << 20 // See: GC_MIN_HEAP in runtime.c
+	vmThreadStackSize = 1 << 20
+)
+
+type vm struct {
+	prog    *bcProgram
+	externs []vmExtern // Indexed as prog.externs
+	mem     []byte
+
+	// Execution state
+	calls  []vmCall
+	locals []int64
+	stack  []int64 // Operands
+
+	// Memory
+	sp, stackEnd int64             // Address of next frame & end of stack
+	heap         int64             // Address of next allocation
+	free         map[int64][]int64 // Freed allocations, keyed by size
+
+	// Runtime support (See: runtime.c)
+	top, stackBase  int64 // Innermost frame record & frame record of entrypoint
+	blocks, runtime int64
+	heapLive        int64 // Bytes surviving the last collection
+	heapAllocated   int64 // Bytes allocated since the last collection
+	gcStress        bool
+	allocs          int64 // Totals of every allocation (See: allocCount())
+	allocBytes      int64
+	arena           []int64 // Arena allocations, in order
+	environ         int64
+	errno           int64
+	files           map[int64]*os.File
+	listeners       map[int64]*net.TCPListener
+	nextFd          int64
+	procs           map[int64]*exec.Cmd // Started by spawn(), keyed by process ID
+	signals         chan os.Signal      // Received signals which have handlers (See: signal.clara)
+	random          uint64              // SplitMix64 state
+	randomSeeded    bool
+	started         time.Time // Origin of the monotonic clock
+	ended           chan vmEnd
+
+	// Threads (See: thread.clara)
+	gil        sync.Mutex          // Runtime lock
+	thread     *vmThread           // Holder of the runtime lock
+	threads    []*vmThread         // Unfinished
+	handles    map[int64]*vmThread // Unjoined
+	nextHandle int64
+	mutexes    map[int64]chan struct{} // Locked when full
+	condvars   map[int64]*vmCondvar
+	debugGc    bool
+	out        *bufio.Writer
+	stdout     io.Writer // Unbuffered output, inherited by child processes
+}
+
+// Execution state of a thread, saved while another holds the runtime lock
+type vmThread struct {
+	handle   int64
+	function int64 // Run by the thread & a GC root until it finishes
+	parked   int64 // Innermost frame while blocked, otherwise 0
+	stack    int64 // Allocation holding frames (0 for the main thread)
+	done     chan struct{}
+
+	calls                               []vmCall
+	locals, operands                    []int64
+	sp, stackEnd, top, stackBase, errno int64
+}
+
+// Threads waiting on a condition variable, woken by closing their channel
+type vmCondvar struct {
+	waiters []chan struct{}
+}
+
+type vmEnd struct {
+	status int
+	err    error
+}
+
+type vmCall struct {
+	fn     *bcFunc
+	pc     int
+	locals int   // Index of first local
+	frame  int64 // Address of frame
+	record int64 // Address of frame record (if any)
+}
+
+type vmExtern struct {
+	params int // Minimum arguments
+	fn     func(vm *vm, args []int64) int64
+}
+
+// Raised to stop execution
+type vmExit int
+type vmFault string
+
+// Runs a bytecode file with the given arguments (the first of which is the program name) & environment, returning its
+// exit status
+func runBytecode(path string, args []string, env []string, out io.Writer) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	prog, err := readBytecode(f)
+	f.Close()
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", path, err)
+	}
+	return execBytecode(prog, args, env, out)
+}
+
+func execBytecode(prog *bcProgram, args []string, env []string, out io.Writer) (status int, err error) {
+
+	vm := &vm{prog: prog, free: make(map[int64][]int64), files: make(map[int64]*os.File), nextFd: 3,
+		listeners: make(map[int64]*net.TCPListener), procs: make(map[int64]*exec.Cmd), out: bufio.NewWriter(out), stdout: out, started: time.Now(),
+		ended: make(chan vmEnd, 1), handles: make(map[int64]*vmThread), nextHandle: 1, mutexes: make(map[int64]chan struct{}),
+		condvars: make(map[int64]*vmCondvar)}
+	for _, name := range prog.externs {
+		ext, ok := vmExterns[name]
+		if !ok {
+			return 0, fmt.Errorf("Unknown external function: '%v'", name)
+		}
+		vm.externs = append(vm.externs, ext)
+	}
+	for _, f := range prog.fns {
+		for _, i := range f.code {
+			if i.op == bcCallX && i.b < vm.externs[i.a].params {
+				return 0, fmt.Errorf("Corrupt bytecode: %v: too few arguments for external function: '%v'", f.name, prog.externs[i.a])
+			}
+		}
+	}
+	for _, arg := range args {
+		if arg == "--gc.debug" || arg == "-g" { // See: bootstrap.c
+			vm.debugGc = true
+		}
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "CLARA_GC_STRESS=") { // See: runtime.c
+			vm.gcStress = true
+		}
+	}
+
+	// Lay out memory. The base frame record has no maps & calls never trap to the GC from it.
+	vm.mem = append(vm.mem, prog.data...)
+	vm.sp = align(bcDataBase+int64(len(vm.mem)), 4096)
+	vm.stackEnd = vm.sp + vmStackSize
+	vm.heap = vm.stackEnd
+	vm.mem = append(vm.mem, make([]byte, vm.stackEnd-bcDataBase-int64(len(vm.mem)))...)
+	vm.top = vm.sp
+	vm.sp += 3 * ptrSize
+
+	// The program ends when main() returns or any thread exits or faults. Output profile (if instrumented) however it
+	// ends.
+	vm.thread = vm.newThread(0, 0)
+	vm.gil.Lock()
+	go func() {
+		defer vm.stopped()
+		argv := vm.cStrings(args)
+		envp := vm.cStrings(env)
+		vm.environ = envp
+		vm.run(prog.fns[prog.entrypoint], []int64{int64(len(args))<<1 | 1, argv, envp})
+		vm.ended <- vmEnd{status: int(int32(vm.pop() >> 1))} // Exit status
+	}()
+	end := <-vm.ended
+	vm.out.Flush()
+	if end.err == nil {
+		vm.writeProfile()
+	}
+	return end.status, end.err
+}
+
+// Ends the program if the current thread exits or faults. The runtime lock is kept so no other thread runs.
+func (vm *vm) stopped() {
+	switch r := recover().(type) {
+	case nil:
+	case vmExit:
+		vm.ended <- vmEnd{status: int(r)}
+	case vmFault:
+		err := fmt.Errorf("Bytecode error: %v", r)
+		if len(vm.calls) > 0 {
+			err = fmt.Errorf("Bytecode error in %v: %v", demangle(vm.calls[len(vm.calls)-1].fn.name), r)
+		}
+		vm.ended <- vmEnd{err: err}
+	default:
+		panic(r)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (vm *vm) newThread(function, stack int64) *vmThread {
+	t := &vmThread{handle: vm.nextHandle, function: function, stack: stack, done: make(chan struct{})}
+	vm.nextHandle++
+	vm.threads = append(vm.threads, t)
+	vm.handles[t.handle] = t
+	return t
+}
+
+// Runs threadEntry() in a new thread, signalling started once it holds the runtime lock
+func (vm *vm) runThread(t *vmThread, started chan struct{}) {
+	vm.gil.Lock()
+	vm.resume(t)
+	close(started)
+	defer vm.stopped()
+	vm.run(vm.prog.fns[vm.prog.threadEntry], []int64{t.function})
+	for j, u := range vm.threads {
+		if u == t {
+			vm.threads = append(vm.threads[:j], vm.threads[j+1:]...)
+			break
+		}
+	}
+	close(t.done)
+	vm.gil.Unlock()
+}
+
+// Releases the runtime lock before blocking, saving the state of the current thread. frame is its innermost frame,
+// from which the GC scans its stack.
+func (vm *vm) park(frame int64) *vmThread {
+	t := vm.thread
+	t.parked = frame
+	t.calls, t.locals, t.operands = vm.calls, vm.locals, vm.stack
+	t.sp, t.stackEnd, t.top, t.stackBase, t.errno = vm.sp, vm.stackEnd, vm.top, vm.stackBase, vm.errno
+	vm.out.Flush() // Output is seen while blocked
+	vm.gil.Unlock()
+	return t
+}
+
+func (vm *vm) unpark(t *vmThread) {
+	vm.gil.Lock()
+	vm.resume(t)
+}
+
+func (vm *vm) resume(t *vmThread) {
+	vm.thread, t.parked = t, 0
+	vm.calls, vm.locals, vm.stack = t.calls, t.locals, t.operands
+	vm.sp, vm.stackEnd, vm.top, vm.stackBase, vm.errno = t.sp, t.stackEnd, t.top, t.stackBase, t.errno
+}
+
+// Index of the unfinished thread with a handle or -1
+func (vm *vm) threadIndex(handle int64) int {
+	for j, t := range vm.threads {
+		if t.handle == handle {
+			return j
+		}
+	}
+	return -1
+}
+
+func (vm *vm) run(f *bcFunc, args []int64) {
+	vm.call(f, args)
+	c := &vm.calls[len(vm.calls)-1]
+	code, locals := c.fn.code, vm.locals[c.locals:]
+	for {
+		i := code[c.pc]
+		c.pc++
+		switch i.op {
+		case bcConst:
+			vm.push(int64(i.a))
+		case bcLocal:
+			vm.push(locals[i.a])
+		case bcSetLocal:
+			locals[i.a] = vm.pop()
+		case bcSlot:
+			vm.push(vm.word(c.record - int64(i.a)*ptrSize))
+		case bcSetSlot:
+			vm.setWord(c.record-int64(i.a)*ptrSize, vm.pop())
+		case bcFrame:
+			vm.push(c.record)
+		case bcDup:
+			vm.push(vm.stack[len(vm.stack)-1])
+		case bcPop:
+			vm.pop()
+		case bcTag:
+			vm.push(vm.pop()<<1 | 1)
+		case bcUntag:
+			vm.push(vm.pop() >> 1)
+		case bcNeg:
+			vm.push(-vm.pop())
+		case bcNot:
+			vm.push(^vm.pop())
+		case bcAdd, bcSub, bcMul, bcDiv, bcMod, bcAnd, bcOr, bcXor, bcShl, bcShr, bcEq, bcLt, bcLte, bcGt, bcGte, bcLtu:
+			y := vm.pop()
+			vm.push(binaryOp(i.op, vm.pop(), y))
+		case bcLoad:
+			vm.push(vm.word(vm.pop() + int64(i.a)))
+		case bcStore:
+			v := vm.pop()
+			vm.setWord(vm.pop()+int64(i.a), v)
+		case bcLoadB:
+			vm.push(int64(vm.mem[vm.index(vm.pop()+int64(i.a), 1)]))
+		case bcCall, bcCallI:
+			var callee *bcFunc
+			n, gcMap := i.b, i.c
+			if i.op == bcCallI {
+				n, gcMap = i.a, i.b
+				fn := vm.word(vm.stack[len(vm.stack)-n-1])
+				if fn < 0 || fn >= int64(len(vm.prog.fns)) {
+					vm.fault("invalid function value: %v", fn)
+				}
+				callee = vm.prog.fns[fn]
+			} else {
+				callee = vm.prog.fns[i.a]
+			}
+			if c.fn.linked {
+				vm.setWord(c.record+2*ptrSize, int64(gcMap)) // Caller's GC map
+			}
+			args := vm.stack[len(vm.stack)-n:]
+			vm.call(callee, args)
+			vm.stack = vm.stack[:len(vm.stack)-n]
+			if i.op == bcCallI {
+				vm.pop()
+			}
+			c = &vm.calls[len(vm.calls)-1]
+			code, locals = c.fn.code, vm.locals[c.locals:]
+		case bcCallX:
+			args := vm.stack[len(vm.stack)-i.b:]
+			v := vm.externs[i.a].fn(vm, args)
+			vm.stack = vm.stack[:len(vm.stack)-i.b]
+			vm.push(v)
+		case bcRet:
+			vm.ret()
+			if len(vm.calls) == 0 {
+				return
+			}
+			c = &vm.calls[len(vm.calls)-1]
+			code, locals = c.fn.code, vm.locals[c.locals:]
+		case bcJmp:
+			c.pc = i.a
+		case bcJnz:
+			if vm.pop() != 0 {
+				c.pc = i.a
+			}
+		default:
+			vm.fault("unknown op: %v", i.op)
+		}
+	}
+}
+
+func binaryOp(op bcOp, x, y int64) int64 {
+	switch op {
+	case bcAdd:
+		return x + y
+	case bcSub:
+		return x - y
+	case bcMul:
+		return x * y
+	case bcDiv:
+		return x / y // NOTE: Divisors are checked & 63-bit values cannot overflow
+	case bcMod:
+		return x % y
+	case bcAnd:
+		return x & y
+	case bcOr:
+		return x | y
+	case bcXor:
+		return x ^ y
+	case bcShl:
+		return x << uint64(y&63)
+	case bcShr:
+		return x >> uint64(y&63)
+	case bcEq:
+		return boolInt(x == y)
+	case bcLt:
+		return boolInt(x < y)
+	case bcLte:
+		return boolInt(x <= y)
+	case bcGt:
+		return boolInt(x > y)
+	case bcGte:
+		return boolInt(x >= y)
+	default: // bcLtu
+		return boolInt(uint64(x) < uint64(y))
+	}
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Enters a function. Frames are cleared so pointers are never scanned before they are assigned.
+func (vm *vm) call(f *bcFunc, args []int64) {
+	c := vmCall{fn: f, locals: len(vm.locals), frame: vm.sp}
+	if f.slots > 0 || f.linked {
+		size := int64(f.slots+3) * ptrSize
+		if vm.sp+size > vm.stackEnd {
+			vm.fault("stack overflow")
+		}
+		mem := vm.mem[vm.index(vm.sp, int(size)):][:size]
+		for j := range mem {
+			mem[j] = 0
+		}
+		c.record = vm.sp + int64(f.slots)*ptrSize
+		vm.sp += size
+		if f.linked {
+			vm.setWord(c.record, vm.top)
+			vm.setWord(c.record+ptrSize, vm.word(vm.top+2*ptrSize))
+			vm.top = c.record
+		}
+	}
+	n := len(vm.locals) + f.temps
+	for len(vm.locals) < n {
+		vm.locals = append(vm.locals, 0)
+	}
+	copy(vm.locals[c.locals:c.locals+f.params], args) // NOTE: Extra arguments are dropped
+	vm.calls = append(vm.calls, c)
+}
+
+func (vm *vm) ret() {
+	c := vm.calls[len(vm.calls)-1]
+	if c.fn.linked {
+		vm.top = vm.word(c.record)
+	}
+	vm.sp = c.frame
+	vm.locals = vm.locals[:c.locals]
+	vm.calls = vm.calls[:len(vm.calls)-1]
+}
+
+func (vm *vm) push(v int64) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *vm) pop() int64 {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+func (vm *vm) fault(format string, a ...interface{}) {
+	panic(vmFault(fmt.Sprintf(format, a...)))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Index in memory of n bytes at addr
+func (vm *vm) index(addr int64, n int) int {
+	off := addr - bcDataBase
+	if off < 0 || off+int64(n) > int64(len(vm.mem)) {
+		vm.fault("invalid memory access: 0x%x", addr)
+	}
+	return int(off)
+}
+
+func (vm *vm) word(addr int64) int64 {
+	return int64(binary.LittleEndian.Uint64(vm.mem[vm.index(addr, ptrSize):]))
+}
+
+func (vm *vm) setWord(addr int64, v int64) {
+	binary.LittleEndian.PutUint64(vm.mem[vm.index(addr, ptrSize):], uint64(v))
+}
+
+// NUL terminated string at addr
+func (vm *vm) cString(addr int64) string {
+	start := vm.index(addr, 0)
+	for j := start; j < len(vm.mem); j++ {
+		if vm.mem[j] == 0 {
+			return string(vm.mem[start:j])
+		}
+	}
+	vm.fault("unterminated string: 0x%x", addr)
+	return ""
+}
+
+// Allocates a NULL terminated array of strings, as passed to C main()
+func (vm *vm) cStrings(ss []string) int64 {
+	array := vm.calloc(int64(len(ss)+1), ptrSize)
+	for j, s := range ss {
+		p := vm.calloc(int64(len(s)+1), 1)
+		copy(vm.mem[vm.index(p, len(s)):], s)
+		vm.setWord(array+int64(j)*ptrSize, p)
+	}
+	return array
+}
+
+// Allocates cleared memory, returning 0 when exhausted. Allocations are preceded by their size so they can be reused
+// once freed.
+func (vm *vm) calloc(count, size int64) int64 {
+	if count < 0 || size < 0 || (size != 0 && count > vmMaxMemory/size) {
+		return 0
+	}
+	n := align(count*size, ptrSize)
+	if free := vm.free[n]; len(free) > 0 {
+		p := free[len(free)-1]
+		vm.free[n] = free[:len(free)-1]
+		mem := vm.mem[vm.index(p, int(n)):][:n]
+		for j := range mem {
+			mem[j] = 0
+		}
+		return p
+	}
+	end := vm.heap + ptrSize + n
+	if end-bcDataBase > vmMaxMemory {
+		return 0
+	}
+	if need := end - bcDataBase; need > int64(len(vm.mem)) {
+		grow := int64(len(vm.mem))
+		if grow < need-int64(len(vm.mem)) {
+			grow = need - int64(len(vm.mem))
+		}
+		vm.mem = append(vm.mem, make([]byte, grow)...)
+	}
+	p := vm.heap + ptrSize
+	vm.setWord(vm.heap, n)
+	vm.heap = end
+	return p
+}
+
+func (vm *vm) freeMem(p int64) {
+	if p == 0 {
+		return
+	}
+	n := vm.word(p - ptrSize)
+	vm.free[n] = append(vm.free[n], p)
+}
+
+func align(n, to int64) int64 {
+	return (n + to - 1) / to * to
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Formats a string as printf() does. Only the conversions used by Clara programs are supported.
+func (vm *vm) format(format string, args []int64) string {
+	var buf strings.Builder
+	next := func() int64 {
+		if len(args) == 0 {
+			return 0
+		}
+		v := args[0]
+		args = args[1:]
+		return v
+	}
+	for j := 0; j < len(format); j++ {
+		if format[j] != '%' {
+			buf.WriteByte(format[j])
+			continue
+		}
+
+		// Flags, width & precision are as in Go except '*' which takes the value from the next argument
+		spec := "%"
+		for j++; j < len(format) && strings.IndexByte("-+ #0123456789.*", format[j]) >= 0; j++ {
+			if format[j] == '*' {
+				spec += strconv.Itoa(int(int32(next())))
+			} else {
+				spec += format[j : j+1]
+			}
+		}
+		bits := 32
+		for ; j < len(format) && strings.IndexByte("hlqjzt", format[j]) >= 0; j++ {
+			switch format[j] {
+			case 'h':
+				bits /= 2
+			default:
+				bits = 64
+			}
+		}
+		if j == len(format) {
+			buf.WriteString(spec)
+			break
+		}
+		switch c := format[j]; c {
+		case 'd', 'i':
+			v := next()
+			if bits < 64 {
+				v = v << (64 - bits) >> (64 - bits) // Sign extend
+			}
+			fmt.Fprintf(&buf, spec+"d", v)
+		case 'u', 'x', 'X', 'o':
+			v := uint64(next())
+			if bits < 64 {
+				v &= 1<<bits - 1
+			}
+			if c == 'u' {
+				c = 'd'
+			}
+			fmt.Fprintf(&buf, spec+string(c), v)
+		case 'c':
+			fmt.Fprintf(&buf, spec+"c", rune(byte(next())))
+		case 's':
+			p := next()
+			s := "(null)"
+			if p != 0 {
+				s = vm.cString(p)
+			}
+			fmt.Fprintf(&buf, spec+"s", s)
+		case 'p':
+			fmt.Fprintf(&buf, "0x%x", uint64(next()))
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteString(spec + string(c))
+		}
+	}
+	return buf.String()
+}
+
+// Outputs the counters of an instrumented program. See: writeProfile() in runtime.c
+func (vm *vm) writeProfile() {
+	profile := int64(vm.prog.profile)
+	size := vm.word(profile)
+	if size == 0 {
+		return // Not instrumented
+	}
+	path := vm.cString(vm.word(profile + ptrSize))
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write profile: %v\n", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	counters := vm.word(profile + 2*ptrSize)
+	for j := int64(0); j < size; j++ {
+		c := counters + j*3*ptrSize
+		fmt.Fprintf(w, "%s %d %d\n", vm.cString(vm.word(c)), vm.word(c+ptrSize), vm.word(c+2*ptrSize))
+	}
+	w.Flush()
+	f.Close()
+}
+
+// Records the error number of a failed call & returns -1
+func (vm *vm) fail(err error) int64 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		vm.errno = int64(errno)
+	} else {
+		vm.errno = 5 // EIO
+	}
+	return -1
+}
+
+// Resolution failures are reported as ENXIO, as runtime.c
+func (vm *vm) netFail(err error) int64 {
+	var dns *net.DNSError
+	if errors.As(err, &dns) {
+		vm.errno = 6 // ENXIO
+		return -1
+	}
+	return vm.fail(err)
+}
+
+// Connections are read & written as files, through a (blocking) copy of their descriptor
+func (vm *vm) addConn(conn *net.TCPConn) int64 {
+	f, err := conn.File()
+	conn.Close()
+	if err != nil {
+		return vm.fail(err)
+	}
+	fd := vm.nextFd
+	vm.files[fd] = f
+	vm.nextFd++
+	return fd
+}
+
+// As runtime.c
+func (vm *vm) nextRandom() uint64 {
+	if !vm.randomSeeded {
+		vm.random, vm.randomSeeded = uint64(time.Now().Unix()^int64(os.Getpid())<<32), true
+	}
+	vm.random += 0x9e3779b97f4a7c15
+	z := vm.random
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Environment variables, as set by setenv()
+func (vm *vm) environment() []string {
+	var env []string
+	for p := vm.environ; vm.word(p) != 0; p += ptrSize {
+		env = append(env, vm.cString(vm.word(p)))
+	}
+	return env
+}
+
+func (vm *vm) file(fd int64) *os.File {
+	switch fd {
+	case 0:
+		return os.Stdin
+	case 2:
+		return os.Stderr
+	}
+	return vm.files[fd]
+}
+
+// External functions. Values are passed & returned as in the C backend.
+var vmExterns = map[string]vmExtern{
+
+	// libc
+	"printf": {1, func(vm *vm, args []int64) int64 {
+		vm.out.WriteString(vm.format(vm.cString(args[0]), args[1:]))
+		return 0
+	}},
+	"exit": {1, func(vm *vm, args []int64) int64 {
+		panic(vmExit(int32(args[0])))
+	}},
+	"calloc": {2, func(vm *vm, args []int64) int64 {
+		return vm.calloc(args[0], args[1])
+	}},
+	"free": {1, func(vm *vm, args []int64) int64 {
+		vm.freeMem(args[0])
+		return 0
+	}},
+	"open": {3, func(vm *vm, args []int64) int64 {
+		flags := []int{os.O_RDONLY, os.O_WRONLY, os.O_RDWR, os.O_RDWR}[args[1]&3]
+		for bit, flag := range map[int64]int{0x40: os.O_CREATE, 0x80: os.O_EXCL, 0x200: os.O_TRUNC, 0x400: os.O_APPEND} {
+			if args[1]&bit != 0 {
+				flags |= flag // NOTE: Linux values
+			}
+		}
+		f, err := os.OpenFile(vm.cString(args[0]), flags, os.FileMode(args[2]))
+		if err != nil {
+			return vm.fail(err)
+		}
+		fd := vm.nextFd
+		vm.files[fd] = f
+		vm.nextFd++
+		return fd
+	}},
+	"read": {3, func(vm *vm, args []int64) int64 {
+		f := vm.file(args[0])
+		if f == nil {
+			vm.errno = 9 // EBADF
+			return -1
+		}
+		vm.out.Flush()
+		n, err := f.Read(vm.mem[vm.index(args[1], int(args[2])):][:args[2]])
+		if err != nil && err != io.EOF {
+			return vm.fail(err)
+		}
+		return int64(n)
+	}},
+	"write": {3, func(vm *vm, args []int64) int64 {
+		buf := vm.mem[vm.index(args[1], int(args[2])):][:args[2]]
+		if args[0] == 1 {
+			vm.out.Write(buf)
+			return args[2]
+		}
+		f := vm.file(args[0])
+		if f == nil {
+			vm.errno = 9 // EBADF
+			return -1
+		}
+		vm.out.Flush()
+		n, err := f.Write(buf)
+		if err != nil {
+			return vm.fail(err)
+		}
+		return int64(n)
+	}},
+	"close": {1, func(vm *vm, args []int64) int64 {
+		if l := vm.listeners[args[0]]; l != nil {
+			delete(vm.listeners, args[0])
+			if err := l.Close(); err != nil {
+				return vm.fail(err)
+			}
+			return 0
+		}
+		f := vm.files[args[0]]
+		if f == nil {
+			vm.errno = 9 // EBADF
+			return -1
+		}
+		delete(vm.files, args[0])
+		if err := f.Close(); err != nil {
+			return vm.fail(err)
+		}
+		return 0
+	}},
+	"lseek": {3, func(vm *vm, args []int64) int64 {
+		f := vm.file(args[0])
+		if f == nil {
+			vm.errno = 9 // EBADF
+			return -1
+		}
+		pos, err := f.Seek(args[1], int(args[2]))
+		if err != nil {
+			return vm.fail(err)
+		}
+		return pos
+	}},
+	"getenv": {1, func(vm *vm, args []int64) int64 {
+		name := vm.cString(args[0]) + "="
+		for p := vm.environ; vm.word(p) != 0; p += ptrSize {
+			if strings.HasPrefix(vm.cString(vm.word(p)), name) {
+				return vm.word(p) + int64(len(name))
+			}
+		}
+		return 0
+	}},
+	"setenv": {3, func(vm *vm, args []int64) int64 {
+		name, val := vm.cString(args[0]), vm.cString(args[1])
+		if name == "" || strings.Contains(name, "=") {
+			vm.errno = 22 // EINVAL
+			return -1
+		}
+		var env []string
+		for p := vm.environ; vm.word(p) != 0; p += ptrSize {
+			if s := vm.cString(vm.word(p)); !strings.HasPrefix(s, name+"=") {
+				env = append(env, s)
+			} else if args[2] == 0 {
+				return 0
+			}
+		}
+		vm.environ = vm.cStrings(append(env, name+"="+val))
+		return 0
+	}},
+	"gettimeofday": {1, func(vm *vm, args []int64) int64 {
+		now := time.Now()
+		vm.setWord(args[0], now.Unix())
+		vm.setWord(args[0]+ptrSize, int64(now.Nanosecond()/1000))
+		return 0
+	}},
+
+	// runtime.c
+	"debug": {2, func(vm *vm, args []int64) int64 {
+		if vm.debugGc && strings.EqualFold(vm.cString(args[0]), "gc") {
+			vm.out.WriteString(vm.format(vm.cString(args[1]), args[2:]))
+			vm.out.Flush() // Flush immediately
+		}
+		return 0
+	}},
+	"flushOutput": {0, func(vm *vm, args []int64) int64 {
+		vm.out.Flush()
+		return 0
+	}},
+	"spawn": {3, func(vm *vm, args []int64) int64 {
+		argv := make([]string, args[1])
+		for j, p := 0, args[0]; j < len(argv); j++ {
+			argv[j] = vm.cString(p)
+			p += int64(len(argv[j])) + 1
+		}
+		cmd := exec.Command(argv[0], argv[1:]...)
+		cmd.Env, cmd.Stdin, cmd.Stdout, cmd.Stderr = vm.environment(), os.Stdin, vm.stdout, os.Stderr
+		if args[2] != -1 {
+			f := vm.file(args[2])
+			if f == nil {
+				vm.errno = 9 // EBADF
+				return -1
+			}
+			cmd.Stdout = f
+		}
+		vm.out.Flush() // Output in order
+		if err := cmd.Start(); err != nil {
+			if errors.Is(err, exec.ErrNotFound) {
+				vm.errno = 2 // ENOENT
+				return -1
+			}
+			return vm.fail(err)
+		}
+		pid := int64(cmd.Process.Pid)
+		vm.procs[pid] = cmd
+		return pid
+	}},
+	"waitProcess": {1, func(vm *vm, args []int64) int64 {
+		cmd := vm.procs[args[0]]
+		if cmd == nil {
+			vm.errno = 10 // ECHILD
+			return -1
+		}
+		delete(vm.procs, args[0])
+		err := cmd.Wait()
+		var exit *exec.ExitError
+		if err != nil && !errors.As(err, &exit) {
+			return vm.fail(err)
+		}
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int64(ws.Signal())
+		}
+		return int64(cmd.ProcessState.ExitCode())
+	}},
+	"seedRandom": {1, func(vm *vm, args []int64) int64 {
+		vm.random, vm.randomSeeded = uint64(args[0]), true
+		return 0
+	}},
+	"randomBelow": {1, func(vm *vm, args []int64) int64 {
+		n := uint64(args[0])
+		limit := math.MaxUint64 - math.MaxUint64%n
+		x := vm.nextRandom()
+		for x >= limit {
+			x = vm.nextRandom()
+		}
+		return int64(x % n)
+	}},
+	"monotonicNanos": {0, func(vm *vm, args []int64) int64 {
+		return int64(time.Since(vm.started))
+	}},
+	"handleSignal": {1, vmHandleSignal},
+	"waitSignal": {1, func(vm *vm, args []int64) int64 {
+		t := vm.park(args[0])
+		sig := <-vm.signals
+		vm.unpark(t)
+		return int64(sig.(syscall.Signal))
+	}},
+	"raiseSignal": {1, vmRaiseSignal},
+	"sleepMillis": {2, func(vm *vm, args []int64) int64 {
+		t := vm.park(args[1])
+		time.Sleep(time.Duration(args[0]) * time.Millisecond)
+		vm.unpark(t)
+		return 0
+	}},
+	"startThread": {2, func(vm *vm, args []int64) int64 {
+		stack := vm.calloc(vmThreadStackSize, 1)
+		if stack == 0 {
+			vm.errno = 12 // ENOMEM
+			return -1
+		}
+		t := vm.newThread(args[0], stack)
+		t.top, t.sp, t.stackEnd = stack, stack+3*ptrSize, stack+vmThreadStackSize // Base record, as main's
+		started := make(chan struct{})
+		self := vm.park(args[1])
+		go vm.runThread(t, started)
+		<-started
+		vm.unpark(self)
+		return t.handle
+	}},
+	"joinThread": {2, func(vm *vm, args []int64) int64 {
+		t := vm.handles[args[0]]
+		switch {
+		case t == nil:
+			return 3 // ESRCH
+		case t == vm.thread:
+			return 35 // EDEADLK
+		}
+		self := vm.park(args[1])
+		<-t.done
+		vm.unpark(self)
+		delete(vm.handles, t.handle)
+		vm.freeMem(t.stack)
+		return 0
+	}},
+	"currentThread": {0, func(vm *vm, args []int64) int64 { return vm.thread.handle }},
+	"firstThread":   {0, func(vm *vm, args []int64) int64 { return vm.threads[0].handle }},
+	"nextThread": {1, func(vm *vm, args []int64) int64 {
+		if j := vm.threadIndex(args[0]) + 1; j > 0 && j < len(vm.threads) {
+			return vm.threads[j].handle
+		}
+		return 0
+	}},
+	"threadFunction":  {1, func(vm *vm, args []int64) int64 { return vm.handles[args[0]].function }},
+	"parkedFrame":     {1, func(vm *vm, args []int64) int64 { return vm.handles[args[0]].parked }},
+	"threadStackBase": {1, func(vm *vm, args []int64) int64 { return vm.handles[args[0]].stackBase }},
+
+	// Mutexes & condition variables hold the key of their implementation
+	"mutexSize":   {0, func(vm *vm, args []int64) int64 { return ptrSize }},
+	"condvarSize": {0, func(vm *vm, args []int64) int64 { return ptrSize }},
+	"initMutex": {1, func(vm *vm, args []int64) int64 {
+		vm.setWord(args[0], vm.nextHandle)
+		vm.mutexes[vm.nextHandle] = make(chan struct{}, 1)
+		vm.nextHandle++
+		return 0
+	}},
+	"initCondvar": {1, func(vm *vm, args []int64) int64 {
+		vm.setWord(args[0], vm.nextHandle)
+		vm.condvars[vm.nextHandle] = &vmCondvar{}
+		vm.nextHandle++
+		return 0
+	}},
+	"lockMutex": {2, func(vm *vm, args []int64) int64 {
+		m := vm.mutexes[vm.word(args[0])]
+		select {
+		case m <- struct{}{}:
+		default:
+			t := vm.park(args[1])
+			m <- struct{}{}
+			vm.unpark(t)
+		}
+		return 0
+	}},
+	"unlockMutex": {1, func(vm *vm, args []int64) int64 {
+		<-vm.mutexes[vm.word(args[0])]
+		return 0
+	}},
+	"waitCondvar": {3, func(vm *vm, args []int64) int64 {
+		c, m := vm.condvars[vm.word(args[0])], vm.mutexes[vm.word(args[1])]
+		w := make(chan struct{})
+		c.waiters = append(c.waiters, w)
+		<-m
+		t := vm.park(args[2])
+		<-w
+		m <- struct{}{}
+		vm.unpark(t)
+		return 0
+	}},
+	"signalCondvar": {1, func(vm *vm, args []int64) int64 {
+		c := vm.condvars[vm.word(args[0])]
+		if len(c.waiters) > 0 {
+			close(c.waiters[0])
+			c.waiters = c.waiters[1:]
+		}
+		return 0
+	}},
+	"broadcastCondvar": {1, func(vm *vm, args []int64) int64 {
+		c := vm.condvars[vm.word(args[0])]
+		for _, w := range c.waiters {
+			close(w)
+		}
+		c.waiters = nil
+		return 0
+	}},
+	"openPipe": {0, func(vm *vm, args []int64) int64 {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return vm.fail(err)
+		}
+		fd := vm.nextFd
+		vm.files[fd], vm.files[fd+1] = r, w
+		vm.nextFd += 2
+		return fd<<32 | (fd + 1)
+	}},
+	"tcpListen": {2, func(vm *vm, args []int64) int64 {
+		l, err := net.Listen("tcp", net.JoinHostPort(vm.cString(args[0]), strconv.FormatInt(args[1], 10)))
+		if err != nil {
+			return vm.netFail(err)
+		}
+		fd := vm.nextFd
+		vm.listeners[fd] = l.(*net.TCPListener)
+		vm.nextFd++
+		return fd
+	}},
+	"tcpAccept": {2, func(vm *vm, args []int64) int64 {
+		l := vm.listeners[args[0]]
+		if l == nil {
+			vm.errno = 88 // ENOTSOCK
+			return -1
+		}
+		t := vm.park(args[1])
+		conn, err := l.AcceptTCP()
+		vm.unpark(t)
+		if err != nil {
+			return vm.fail(err)
+		}
+		return vm.addConn(conn)
+	}},
+	"tcpConnect": {2, func(vm *vm, args []int64) int64 {
+		conn, err := net.Dial("tcp", net.JoinHostPort(vm.cString(args[0]), strconv.FormatInt(args[1], 10)))
+		if err != nil {
+			return vm.netFail(err)
+		}
+		return vm.addConn(conn.(*net.TCPConn))
+	}},
+	"socketPort": {1, func(vm *vm, args []int64) int64 {
+		l := vm.listeners[args[0]]
+		if l == nil {
+			vm.errno = 88 // ENOTSOCK
+			return -1
+		}
+		return int64(l.Addr().(*net.TCPAddr).Port)
+	}},
+	"errnum":    {0, func(vm *vm, args []int64) int64 { return vm.errno }},
+	"getBlocks": {0, func(vm *vm, args []int64) int64 { return vm.blocks }},
+	"setBlocks": {1, func(vm *vm, args []int64) int64 { vm.blocks = args[0]; return 0 }},
+	"gcDue": {1, func(vm *vm, args []int64) int64 {
+		vm.heapAllocated += args[0]
+		vm.allocs, vm.allocBytes = vm.allocs+1, vm.allocBytes+args[0]
+		return boolInt(vm.gcStress || (vm.heapAllocated > vm.heapLive && vm.heapAllocated > vmMinHeap))
+	}},
+	"gcCollected": {1, func(vm *vm, args []int64) int64 { vm.heapLive, vm.heapAllocated = args[0], 0; return 0 }},
+	"rcAllocated": {1, func(vm *vm, args []int64) int64 {
+		vm.heapAllocated += args[0]
+		vm.allocs, vm.allocBytes = vm.allocs+1, vm.allocBytes+args[0]
+		return 0
+	}},
+	"rcFreed":        {1, func(vm *vm, args []int64) int64 { vm.heapAllocated -= args[0]; return 0 }},
+	"heapSize":       {0, func(vm *vm, args []int64) int64 { return vm.heapLive + vm.heapAllocated }},
+	"allocCount":     {0, func(vm *vm, args []int64) int64 { return vm.allocs }},
+	"allocatedBytes": {0, func(vm *vm, args []int64) int64 { return vm.allocBytes }},
+	"arenaAlloc": {1, func(vm *vm, args []int64) int64 {
+		vm.allocs, vm.allocBytes = vm.allocs+1, vm.allocBytes+args[0]-16 // Less the block header (See: arenalloc())
+		p := vm.calloc(args[0], 1)
+		if p != 0 {
+			vm.arena = append(vm.arena, p)
+		}
+		return p
+	}},
+	"arenaMark": {0, func(vm *vm, args []int64) int64 { return int64(len(vm.arena)) }},
+	"arenaReset": {1, func(vm *vm, args []int64) int64 {
+		for _, p := range vm.arena[args[0]:] {
+			vm.freeMem(p)
+		}
+		vm.arena = vm.arena[:args[0]]
+		return 0
+	}},
+	"getRuntime":   {0, func(vm *vm, args []int64) int64 { return vm.runtime }},
+	"setRuntime":   {1, func(vm *vm, args []int64) int64 { vm.runtime = args[0]; return 0 }},
+	"getEnviron":   {0, func(vm *vm, args []int64) int64 { return vm.environ }},
+	"setStackBase": {1, func(vm *vm, args []int64) int64 { vm.stackBase = args[0]; return 0 }},
+	"isStackBase":  {1, func(vm *vm, args []int64) int64 { return boolInt(args[0] == vm.stackBase) }},
+	"frameRoots": {1, func(vm *vm, args []int64) int64 {
+		ret := vm.word(args[0] + ptrSize)
+		return ret + vm.word(ret)
+	}},
+	"frameSite": {1, func(vm *vm, args []int64) int64 {
+		ret := vm.word(args[0] + ptrSize)
+		return vm.word(ret + vm.word(ret) - ptrSize)
+	}},
+
+	// Builtins (See: cBuiltins)
+	"readByte": {2, func(vm *vm, args []int64) int64 {
+		return int64(int8(vm.mem[vm.index(args[0]+args[1]>>1, 1)]))
+	}},
+	"readInt": {2, func(vm *vm, args []int64) int64 {
+		return vm.word(args[0] + (args[1]>>1)*ptrSize)
+	}},
+	"writeByte": {3, func(vm *vm, args []int64) int64 {
+		vm.mem[vm.index(args[0]+args[1]>>1, 1)] = byte(args[2])
+		return 0
+	}},
+	"writeInt": {3, func(vm *vm, args []int64) int64 {
+		vm.setWord(args[0]+(args[1]>>1)*ptrSize, args[2])
+		return 0
+	}},
+	// Only one thread runs at once (See: vm.gil) so atomics need no further synchronisation
+	"atomicLoad": {1, func(vm *vm, args []int64) int64 { return vm.word(args[0]) }},
+	"atomicStore": {2, func(vm *vm, args []int64) int64 {
+		vm.setWord(args[0], args[1])
+		return 0
+	}},
+	"atomicAdd": {2, func(vm *vm, args []int64) int64 {
+		v := vm.word(args[0]) + args[1] - 1
+		vm.setWord(args[0], v)
+		return v
+	}},
+	"compareAndSwap": {3, func(vm *vm, args []int64) int64 {
+		if vm.word(args[0]) != args[1] {
+			return boolInt(false)
+		}
+		vm.setWord(args[0], args[2])
+		return boolInt(true)
+	}},
+	"getFramePointer": {0, func(vm *vm, args []int64) int64 { return vm.top }},
+	"unsafe":          {2, func(vm *vm, args []int64) int64 { return args[0] + args[1]>>1 }},
+	"toTaggedInt":     {1, func(vm *vm, args []int64) int64 { return args[0]<<1 | 1 }},
+	"toUntaggedInt":   {1, func(vm *vm, args []int64) int64 { return args[0] >> 1 }},
+	"typeInfoTable":   {0, func(vm *vm, args []int64) int64 { return int64(vm.prog.typeInfo) }},
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Signals of the VM (See: signal.clara), which are handled & raised as those of its own process
+
+func vmHandleSignal(vm *vm, args []int64) int64 {
+	sig := syscall.Signal(args[0])
+	if sig < 1 || sig > 64 || sig == syscall.SIGKILL || sig == syscall.SIGSTOP {
+		vm.errno = 22 // EINVAL
+		return -1
+	}
+	if vm.signals == nil {
+		vm.signals = make(chan os.Signal, 16)
+	}
+	signal.Notify(vm.signals, sig)
+	return 0
+}
+
+func vmRaiseSignal(vm *vm, args []int64) int64 {
+	if err := syscall.Kill(os.Getpid(), syscall.Signal(args[0])); err != nil {
+		return vm.fail(err)
+	}
+	return 0
+}
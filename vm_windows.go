@@ -0,0 +1,13 @@
+package main
+
+// Signals of the VM (See: signal.clara) are not supported on Windows
+
+func vmHandleSignal(vm *vm, args []int64) int64 {
+	vm.errno = 38 // ENOSYS
+	return -1
+}
+
+func vmRaiseSignal(vm *vm, args []int64) int64 {
+	vm.errno = 38 // ENOSYS
+	return -1
+}
@@ -87,7 +87,7 @@ func Walk(isPreOrder bool, n *Node, f func(*Node) bool) {
 	case opLit, opError:
 		// ...
 
-	case opIdentifier, opReturn, opNamedType:
+	case opIdentifier, opReturn, opNamedType, opConstDcl:
 		if n.left != nil {
 			Walk(isPreOrder, n.left, f)
 		}
@@ -95,7 +95,7 @@ func Walk(isPreOrder bool, n *Node, f func(*Node) bool) {
 	case opNot, opNeg, opBNot, opArrayType:
 		Walk(isPreOrder, n.left, f)
 
-	case opAs, opDas, opAdd, opSub, opMul, opDiv, opAnd, opOr, opBAnd,
+	case opAs, opDas, opAdd, opSub, opMul, opDiv, opMod, opAnd, opOr, opBAnd,
 		opBOr, opBXor, opEq, opGt, opGte, opLt, opLte, opBLeft, opBRight,
 		opDot, opArray, opRange:
 		Walk(isPreOrder, n.left, f)